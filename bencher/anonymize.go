@@ -0,0 +1,187 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Anonymizer replaces what would identify a project in its results, its
+// repository, packages, tags, email addresses, URLs and file paths, with
+// aliases, so that comparisons can be shared publicly or with vendors.
+// Benchmark names and measurements are kept.
+type Anonymizer struct {
+	// Key keys the hashes from which aliases are derived, so that they
+	// can't be reversed by hashing guessed names, and are the same
+	// across the results anonymized with the same key.
+	Key []byte
+	// Aliases maps names e.g. "go.opencensus.io/trace" to the aliases
+	// replacing them e.g. "tracing", in place of their hashes.
+	Aliases map[string]string
+}
+
+var (
+	anonEmailRe = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	anonURLRe   = regexp.MustCompile(`[A-Za-z][A-Za-z0-9+.-]*://[^\s"'<>]+`)
+	// anonPathRe matches absolute paths of at least two elements, lest it
+	// matches units e.g. "ns/op", following a space, quote or "=".
+	anonPathRe = regexp.MustCompile(`(^|[\s"'(=])((?:/[\w.+-]+){2,}|[A-Za-z]:\\[\w.+\\-]+)`)
+)
+
+// alias returns the alias of name, prefixed by its kind e.g. "pkg-1f3a9c0b2e".
+func (a *Anonymizer) alias(kind, name string) string {
+	if alias, ok := a.Aliases[name]; ok {
+		return alias
+	}
+	mac := hmac.New(sha256.New, a.Key)
+	mac.Write([]byte(name))
+	return kind + "-" + hex.EncodeToString(mac.Sum(nil))[:10]
+}
+
+// Anonymize returns a copy of res, the result of a run of repo, with
+// identifying names replaced by aliases. The links to stored objects,
+// profiles, the full report and the shadow comparison are left out.
+func (a *Anonymizer) Anonymize(repo string, res *Result) *Result {
+	// Longer names are replaced first e.g. packages before their repository.
+	names := map[string]string{repo: a.alias("repo", repo)}
+	for _, row := range res.Rows {
+		for _, label := range strings.Fields(row.Group) {
+			if strings.HasPrefix(label, "pkg:") {
+				pkg := strings.TrimPrefix(label, "pkg:")
+				names[pkg] = a.alias("pkg", pkg)
+			}
+		}
+	}
+	for _, ps := range res.Packages {
+		names[ps.Package] = a.alias("pkg", ps.Package)
+	}
+	for _, pkg := range res.FailedPackages {
+		names[pkg] = a.alias("pkg", pkg)
+	}
+	for name := range a.Aliases {
+		names[name] = a.Aliases[name]
+	}
+	delete(names, "")
+	keys := make([]string, 0, len(names))
+	for name := range names {
+		keys = append(keys, name)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	var oldnew []string
+	for _, name := range keys {
+		oldnew = append(oldnew, name, names[name])
+	}
+	replacer := strings.NewReplacer(oldnew...)
+
+	scrub := func(s string) string {
+		s = anonURLRe.ReplaceAllStringFunc(s, func(url string) string { return a.alias("url", url) })
+		s = anonEmailRe.ReplaceAllStringFunc(s, func(email string) string { return a.alias("email", email) + "@example.com" })
+		s = anonPathRe.ReplaceAllStringFunc(s, func(m string) string {
+			sm := anonPathRe.FindStringSubmatch(m)
+			return sm[1] + a.alias("path", sm[2])
+		})
+		return replacer.Replace(s)
+	}
+	scrubAll := func(ss []string) []string {
+		if ss == nil {
+			return nil
+		}
+		scrubbed := make([]string, len(ss))
+		for i, s := range ss {
+			scrubbed[i] = scrub(s)
+		}
+		return scrubbed
+	}
+	scrubRows := func(rows []*Row) []*Row {
+		if rows == nil {
+			return nil
+		}
+		scrubbed := make([]*Row, len(rows))
+		for i, row := range rows {
+			rc := *row
+			rc.Group, rc.Benchmark = scrub(rc.Group), scrub(rc.Benchmark)
+			scrubbed[i] = &rc
+		}
+		return scrubbed
+	}
+
+	anon := &Result{
+		Benchmarks:        scrub(res.Benchmarks),
+		HTMLBenchmarks:    scrub(res.HTMLBenchmarks),
+		RunAt:             res.RunAt,
+		Rows:              scrubRows(res.Rows),
+		Consecutive:       res.Consecutive,
+		Omitted:           res.Omitted,
+		Warnings:          scrubAll(res.Warnings),
+		FailedPackages:    scrubAll(res.FailedPackages),
+		SkippedBenchmarks: scrubAll(res.SkippedBenchmarks),
+		Deltas:            scrub(res.Deltas),
+		Cached:            res.Cached,
+		Tier:              res.Tier,
+	}
+	if res.Tags != nil {
+		anon.Tags = make(map[string]string, len(res.Tags))
+		for key, value := range res.Tags {
+			anon.Tags[key] = a.alias("tag", value)
+		}
+	}
+	for _, ps := range res.Packages {
+		pc := *ps
+		pc.Package = scrub(pc.Package)
+		pc.Skipped, pc.Failed = scrubAll(pc.Skipped), scrubAll(pc.Failed)
+		anon.Packages = append(anon.Packages, &pc)
+	}
+	for _, b := range res.Baselines {
+		anon.Baselines = append(anon.Baselines, &BaselineResult{
+			Label:      scrub(b.Label),
+			Name:       scrub(b.Name),
+			Rows:       scrubRows(b.Rows),
+			Benchmarks: scrub(b.Benchmarks),
+			Error:      scrub(b.Error),
+		})
+	}
+	if res.Policy != nil {
+		anon.Policy = &PolicyVerdict{Severity: res.Policy.Severity, Violations: scrubAll(res.Policy.Violations)}
+	}
+	return anon
+}
+
+// ExportRun returns the result of the stored run with runID, compared
+// against the stored run before it, anonymized by a if set, e.g. to be
+// shared outside of the organization.
+func (br *Request) ExportRun(ctx context.Context, runID string, a *Anonymizer) (*Result, error) {
+	ctx, span := br.startSpan(ctx, "export-run")
+	defer span.End()
+
+	res, err := br.rerenderRun(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return res, nil
+	}
+	return a.Anonymize(br.GitRepoURL, res), nil
+}
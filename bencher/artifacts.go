@@ -0,0 +1,108 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/orijtech/infra"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+)
+
+const (
+	// artifactChunkSize is how much of an artifact is held in memory
+	// at a time while it is uploaded to storage.
+	artifactChunkSize = 8 << 20
+
+	// artifactsDir holds the artifacts uploaded to a run, so
+	// that they can't replace the run's own objects.
+	artifactsDir = "artifacts/"
+)
+
+// ArtifactName returns the name under which an artifact uploaded to a
+// run is opened with OpenArtifact e.g. "artifacts/bench.test.tar.gz".
+func ArtifactName(name string) string {
+	return artifactsDir + name
+}
+
+// UploadArtifact uploads the artifact read from r, e.g. a profile or a
+// bundle of test binaries, alongside the results of the stored run with
+// runID. It is streamed to storage in chunks with a resumable upload
+// rather than held in memory, unless it must be encrypted client-side,
+// and storage's CRC32C of it is verified against what was read.
+func (br *Request) UploadArtifact(ctx context.Context, runID, name string, r io.Reader) (string, error) {
+	ctx, span := br.startSpan(ctx, "upload-artifact")
+	defer span.End()
+
+	if br.StorageService == nil {
+		return "", ErrNoStorageService
+	}
+	if runID == "" || name == "" || strings.Contains(runID, "..") || strings.Contains(name, "..") {
+		return "", fmt.Errorf("invalid artifact %q of run %q", name, runID)
+	}
+	if _, err := br.downloadBlob(ctx, runID+runMetaSuffix); err != nil {
+		return "", fmt.Errorf("Retrieving metadata of run %q: %v", runID, err)
+	}
+
+	// The envelope is sealed as a whole, hence held in memory.
+	if len(br.EncryptionKey) > 0 {
+		plaintext, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+		sealed, err := sealEnvelope(br.EncryptionKey, plaintext)
+		if err != nil {
+			return "", err
+		}
+		r = bytes.NewReader(sealed)
+	}
+
+	crc := crc32.New(castagnoli)
+	counted := &countingReader{r: io.TeeReader(r, crc), n: br.transfers.addStored}
+	obj := &storage.Object{
+		Name:     br.inBenchmarksDir(runID + "-" + ArtifactName(name)),
+		Metadata: withTraceID(ctx, br.objectMetadata(runID)),
+	}
+	call := br.StorageService.Objects.Insert(br.GCSBucket, obj).
+		Media(counted, googleapi.ChunkSize(artifactChunkSize)).Context(ctx)
+	if br.KMSKeyName != "" {
+		call = call.KmsKeyName(br.KMSKeyName)
+	}
+	if br.Public {
+		call = call.PredefinedAcl("publicRead")
+	}
+	obj, err := call.Do()
+	if err != nil {
+		return "", fmt.Errorf("Uploading artifact %q: %v", name, err)
+	}
+
+	want := make([]byte, 4)
+	binary.BigEndian.PutUint32(want, crc.Sum32())
+	if obj.Crc32c != base64.StdEncoding.EncodeToString(want) {
+		// A corrupt artifact is worse than none.
+		_ = br.StorageService.Objects.Delete(br.GCSBucket, obj.Name).Generation(obj.Generation).Context(ctx).Do()
+		return "", fmt.Errorf("Uploading artifact %q: stored CRC32C %s, want %s", name, obj.Crc32c, base64.StdEncoding.EncodeToString(want))
+	}
+	return infra.ObjectURL(obj), nil
+}
@@ -0,0 +1,331 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+
+	"github.com/orijtech/infra"
+)
+
+// ErrBaselineConflict is returned when the baseline was replaced by a
+// concurrent run between being read and being replaced by this one.
+var ErrBaselineConflict = errors.New("the baseline was concurrently replaced")
+
+// maxBaselineRetries is the number of times a run that
+// conflicted is compared afresh against the new baseline.
+const maxBaselineRetries = 3
+
+// anyGeneration promotes an object regardless of the destination's generation.
+const anyGeneration = int64(-1)
+
+// stageAndPromote uploads the run's own immutable copy of a blob as
+// staged, then copies it server-side to each of the "latest" paths.
+// Since a copy only ever replaces an object with a completely uploaded
+// one, a crash mid-upload can't leave a truncated baseline behind.
+// generations maps paths to the generation they must have to be replaced,
+// 0 meaning that they mustn't exist, while others are replaced regardless.
+func (br *Request) stageAndPromote(ctx context.Context, staged string, rfn func() io.Reader, paths []string, generations map[string]int64) (map[string]string, error) {
+	ctx, span := br.startSpan(ctx, "stage-and-promote")
+	defer span.End()
+
+	urls := make(map[string]string)
+	url, err := uploadBenchmarksToGCS(ctx, br.definition(staged, rfn))
+	if err != nil {
+		return urls, fmt.Errorf("Uploading %q: %v", staged, err)
+	}
+	urls[staged] = url
+
+	for _, path := range paths {
+		generation, ok := generations[path]
+		if !ok {
+			generation = anyGeneration
+		}
+		url, err := br.promote(ctx, staged, path, generation)
+		if err == ErrBaselineConflict {
+			return urls, err
+		}
+		if err != nil {
+			return urls, fmt.Errorf("Promoting %q to %q: %v", staged, path, err)
+		}
+		urls[path] = url
+	}
+	return urls, nil
+}
+
+// promote copies the object src to dst under the repository's benchmarks
+// directory, replacing dst atomically if it is at generation, unless that
+// is anyGeneration. Without a storage service it falls back to downloading
+// and re-uploading src, which is neither atomic nor guarded.
+func (br *Request) promote(ctx context.Context, src, dst string, generation int64) (string, error) {
+	return br.promoteAs(ctx, br.runID, src, dst, generation)
+}
+
+// promoteAs is promote, stamping dst with runID, that of the run whose
+// results it then holds, rather than with that of the request's run.
+func (br *Request) promoteAs(ctx context.Context, runID, src, dst string, generation int64) (string, error) {
+	ctx, span := br.startSpan(ctx, "promote")
+	defer span.End()
+
+	if br.StorageService == nil {
+		blob, err := br.downloadBlob(ctx, src)
+		if err != nil {
+			return "", err
+		}
+		return br.uploadBlob(ctx, dst, blob)
+	}
+
+	call := br.StorageService.Objects.Rewrite(br.GCSBucket, br.inBenchmarksDir(src),
+		br.GCSBucket, br.inBenchmarksDir(dst), &storage.Object{Metadata: withTraceID(ctx, br.objectMetadata(runID))}).Context(ctx)
+	if br.KMSKeyName != "" {
+		call = call.DestinationKmsKeyName(br.KMSKeyName)
+	}
+	if br.Public {
+		call = call.DestinationPredefinedAcl("publicRead")
+	}
+	if generation != anyGeneration {
+		call = call.IfGenerationMatch(generation)
+	}
+	// Large objects or ones changing encryption may take several calls.
+	for {
+		resp, err := call.Do()
+		if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusPreconditionFailed {
+			return "", ErrBaselineConflict
+		}
+		if err != nil {
+			return "", err
+		}
+		if resp.Done {
+			br.transfers.addStored(int64(resp.Resource.Size))
+			return infra.ObjectURL(resp.Resource), nil
+		}
+		call = call.RewriteToken(resp.RewriteToken)
+	}
+}
+
+// downloadGeneration retrieves the named object at the given generation,
+// so that what is read is exactly what a guarded promotion would replace.
+func (br *Request) downloadGeneration(ctx context.Context, name string, generation int64) ([]byte, error) {
+	if br.StorageService == nil {
+		return br.downloadBlob(ctx, name)
+	}
+	ctx, span := br.startSpan(ctx, "download-generation")
+	defer span.End()
+
+	blob, err := br.fetchGeneration(ctx, name, generation)
+	if err != nil {
+		return nil, err
+	}
+	return openEnvelope(br.EncryptionKey, blob)
+}
+
+// uploadWithRetries compares afterBlob against the baseline and replaces
+// it, comparing afresh against the new baseline, after a short pause,
+// should a concurrent run replace it in the meantime.
+func (br *Request) uploadWithRetries(ctx context.Context, nowUniqPrefix string, afterBlob []byte) (*Result, error) {
+	for attempt := 1; ; attempt++ {
+		res, err := br.uploadToGCS(ctx, nowUniqPrefix, afterBlob)
+		if err != ErrBaselineConflict || attempt > maxBaselineRetries {
+			return res, err
+		}
+		trace.FromContext(ctx).Annotatef(nil, "Baseline conflict, retrying (attempt %d)", attempt)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+}
+
+// baselineEditsDir holds a copy of every baseline replaced
+// by ReplaceBaseline, from which the surgery can be undone.
+const baselineEditsDir = "baseline-edits/"
+
+func validBaselineName(name string) error {
+	if name != "latest" && !strings.HasPrefix(name, "latest@") {
+		return fmt.Errorf(`invalid baseline %q, expecting "latest" or e.g. "latest@branch=master"`, name)
+	}
+	return nil
+}
+
+// editedBaseline returns name or, if blank, that of the baseline that runs
+// on this platform are compared against: the platform's own or, in buckets
+// predating those of platforms, "latest".
+func (br *Request) editedBaseline(ctx context.Context, name string) string {
+	if name != "" {
+		return name
+	}
+	if compared, obj, _ := br.baselineObject(ctx); obj != nil {
+		return compared
+	}
+	return br.baselineName()
+}
+
+// DownloadBaseline returns the stored results of the named baseline, that
+// runs on this platform are compared against if blank, e.g. to edit them
+// before ReplaceBaseline.
+func (br *Request) DownloadBaseline(ctx context.Context, name string) ([]byte, error) {
+	ctx, span := br.startSpan(ctx, "download-baseline")
+	defer span.End()
+
+	name = br.editedBaseline(ctx, name)
+	if err := validBaselineName(name); err != nil {
+		return nil, err
+	}
+	return br.downloadBlob(ctx, name)
+}
+
+// ReplaceBaseline replaces the named baseline, that runs on this platform
+// are compared against if blank, with blob, which must hold benchmark results, e.g. to recover from a corrupted
+// or skewed baseline. The replaced baseline is first copied under
+// baseline-edits/, and the name of that copy is returned. If a run replaces
+// the baseline in the meantime, ErrBaselineConflict is returned instead.
+func (br *Request) ReplaceBaseline(ctx context.Context, name string, blob []byte) (string, error) {
+	ctx, span := br.startSpan(ctx, "replace-baseline")
+	defer span.End()
+
+	name = br.editedBaseline(ctx, name)
+	if err := validBaselineName(name); err != nil {
+		return "", err
+	}
+	generation, before, err := br.readBaseline(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return br.replaceBaseline(ctx, name, generation, before, blob)
+}
+
+// readBaseline returns the current generation of the named baseline and its results.
+func (br *Request) readBaseline(ctx context.Context, name string) (int64, []byte, error) {
+	obj, err := br.statObject(ctx, name)
+	if err == nil && obj == nil {
+		err = errors.New("not found")
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("Retrieving baseline %q: %v", name, err)
+	}
+	blob, err := br.downloadGeneration(ctx, name, obj.Generation)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Retrieving baseline %q: %v", name, err)
+	}
+	return obj.Generation, blob, nil
+}
+
+// replaceBaseline backs up before, the results of the given generation of
+// the named baseline, then replaces that very generation with blob.
+func (br *Request) replaceBaseline(ctx context.Context, name string, generation int64, before, blob []byte) (string, error) {
+	if len(parseResults(blob)) == 0 {
+		return "", fmt.Errorf("expecting benchmark results to replace baseline %q with", name)
+	}
+	prefix := baselineEditsDir + br.now().UTC().Format(time.RFC3339Nano) + "-"
+	backup := prefix + name + "-before"
+	if _, err := br.uploadBlob(ctx, backup, before); err != nil {
+		return "", fmt.Errorf("Copying baseline %q: %v", name, err)
+	}
+	rfn := func() io.Reader { return bytes.NewReader(blob) }
+	if _, err := br.stageAndPromote(ctx, prefix+name, rfn, []string{name}, map[string]int64{name: generation}); err != nil {
+		return backup, err
+	}
+	return backup, nil
+}
+
+// DropFromBaseline drops the results of the benchmarks matching any of
+// patterns, in the syntax of the ignore file e.g. "Flaky*", from the named
+// baseline, that runs on this platform are compared against if blank, returning the number of result lines dropped.
+func (br *Request) DropFromBaseline(ctx context.Context, name string, patterns []string) (int, error) {
+	ctx, span := br.startSpan(ctx, "drop-from-baseline")
+	defer span.End()
+
+	for i, pattern := range patterns {
+		patterns[i] = strings.TrimPrefix(pattern, "Benchmark")
+		if _, err := path.Match(patterns[i], ""); err != nil {
+			return 0, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	name = br.editedBaseline(ctx, name)
+	if err := validBaselineName(name); err != nil {
+		return 0, err
+	}
+	generation, blob, err := br.readBaseline(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	kept := dropIgnored(blob, patterns)
+	dropped := len(parseResults(blob)) - len(parseResults(kept))
+	if dropped == 0 {
+		return 0, nil
+	}
+	if _, err := br.replaceBaseline(ctx, name, generation, blob, kept); err != nil {
+		return 0, err
+	}
+	return dropped, nil
+}
+
+// RollbackBaseline makes the run before the one whose results the baseline
+// of this platform holds, or before the most recent one if it holds those
+// of none e.g. once edited, the baseline, as PromoteRun does. Only the runs
+// on this platform that replaced the baseline and were neither deleted nor
+// compacted are rolled back to, hence calling it again rolls back further.
+func (br *Request) RollbackBaseline(ctx context.Context) (*Run, error) {
+	ctx, span := br.startSpan(ctx, "rollback-baseline")
+	defer span.End()
+
+	var current string
+	if obj, err := br.statObject(ctx, br.baselineName()); err == nil && obj != nil {
+		current = obj.Metadata[MetadataRunID]
+	}
+	var runs []*Run
+	held := -1
+	rf := &RunFilter{PageSize: math.MaxInt32}
+	_, err := br.WalkRuns(ctx, rf, func(run *Run) error {
+		if !run.replacedBaseline() || run.GOOS != runtime.GOOS || run.GOARCH != runtime.GOARCH {
+			return nil
+		}
+		if run.ID == current {
+			held = len(runs)
+		}
+		runs = append(runs, run)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if held < 0 {
+		held = len(runs) - 1
+	}
+	if held < 1 {
+		return nil, fmt.Errorf("expecting a stored run of %q on %s/%s to roll back to, before the baseline's", br.GitRepoURL, runtime.GOOS, runtime.GOARCH)
+	}
+	run := runs[held-1]
+	if err := br.PromoteRun(ctx, run.ID); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// storeTestRuns stores n runs on this platform, oldest first,
+// each with results of its own, and returns them.
+func storeTestRuns(t *testing.T, br *Request, n int) []*Run {
+	ctx := context.Background()
+	var runs []*Run
+	start := time.Date(2018, 10, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		run := &Run{StartTime: start.AddDate(0, 0, i), GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}
+		run.ID = run.StartTime.Format(time.RFC3339) + fmt.Sprintf("-r%d", i)
+		results := fmt.Sprintf("BenchmarkSum \t 1000\t %d ns/op\n", 100+i)
+		if _, err := br.uploadBlob(ctx, run.ID, []byte(results)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := br.uploadRunMeta(ctx, run); err != nil {
+			t.Fatal(err)
+		}
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// heldRun returns the ID of the run whose results the named baseline holds.
+func heldRun(t *testing.T, br *Request, name string) string {
+	obj, err := br.statObject(context.Background(), name)
+	if err != nil {
+		t.Fatalf("retrieving baseline %q: %v", name, err)
+	}
+	return obj.Metadata[MetadataRunID]
+}
+
+func TestRollbackBaselineGoesFurtherBack(t *testing.T) {
+	es, _ := openTestStore(t)
+	ctx := context.Background()
+	br := &Request{GitRepoURL: "example.com/tm", GCSBucket: "bencher", StorageService: es.Service()}
+	runs := storeTestRuns(t, br, 3)
+	if err := br.PromoteRun(ctx, runs[2].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []*Run{runs[1], runs[0]} {
+		run, err := br.RollbackBaseline(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run.ID != want.ID {
+			t.Fatalf("rolled back to run %s, want %s", run.ID, want.ID)
+		}
+		if got := heldRun(t, br, br.baselineName()); got != want.ID {
+			t.Fatalf("the baseline holds run %q, want %q", got, want.ID)
+		}
+	}
+	if _, err := br.RollbackBaseline(ctx); err == nil {
+		t.Fatal("rolled back past the oldest run")
+	}
+}
+
+func TestReplaceBaselineDefaultsToThePlatformsBaseline(t *testing.T) {
+	es, _ := openTestStore(t)
+	ctx := context.Background()
+	br := &Request{GitRepoURL: "example.com/tm", GCSBucket: "bencher", StorageService: es.Service()}
+	runs := storeTestRuns(t, br, 1)
+	if err := br.PromoteRun(ctx, runs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	edited := []byte("BenchmarkSum \t 1000\t 42 ns/op\n")
+	if _, err := br.ReplaceBaseline(ctx, "", edited); err != nil {
+		t.Fatal(err)
+	}
+	name, obj, _ := br.baselineObject(ctx)
+	if obj == nil {
+		t.Fatal("no baseline to compare against")
+	}
+	compared, err := br.downloadBlob(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(compared) != string(edited) {
+		t.Fatalf("runs are compared against %q, want the edited %q", compared, edited)
+	}
+}
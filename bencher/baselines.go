@@ -0,0 +1,117 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/tabwriter"
+)
+
+// BaselineResult is the comparison of a run against one of the additional
+// baselines of Request.Baselines.
+type BaselineResult struct {
+	Label string
+	Name  string
+	// Rows are the benchmark metrics that changed significantly against it.
+	Rows       []*Row `json:",omitempty"`
+	Benchmarks string `json:",omitempty"`
+	// Error if set, is why the run couldn't be compared against it.
+	Error string `json:",omitempty"`
+}
+
+// compareBaselines compares the run's results of res against every one of
+// br.Baselines, e.g. the last release's besides the parent commit's, and
+// tabulates the deltas against them all side by side. A baseline that
+// can't be compared against is reported as such rather than failing the run.
+func (br *Request) compareBaselines(ctx context.Context, res *Result) {
+	ctx, span := br.startSpan(ctx, "compare-baselines")
+	defer span.End()
+
+	labels := []string{"baseline"}
+	columns := [][]*Row{res.Rows}
+	for _, set := range br.Baselines {
+		bres := &BaselineResult{Label: set.Label, Name: set.Name}
+		res.Baselines = append(res.Baselines, bres)
+		if bres.Label == "" {
+			bres.Label = set.Name
+		}
+		before, err := br.downloadBlob(ctx, set.Name)
+		if err != nil {
+			bres.Error = fmt.Sprintf("Retrieving %q: %v", set.Name, err)
+			continue
+		}
+		changed, err := br.compare(ctx, before, res.after, br.splitBy())
+		if err != nil {
+			bres.Error = err.Error()
+			continue
+		}
+		buf := new(bytes.Buffer)
+		formatText(buf, changed)
+		bres.Rows, bres.Benchmarks = resultRows(changed), buf.String()
+		labels = append(labels, "vs "+bres.Label)
+		columns = append(columns, bres.Rows)
+	}
+	if len(columns) > 1 {
+		labels[0] = "vs baseline"
+		res.Deltas = formatDeltas(labels, columns)
+	}
+}
+
+// formatDeltas tabulates the deltas of the rows of every column side by
+// side, a row per changed benchmark metric, with "~" where it didn't change.
+func formatDeltas(labels []string, columns [][]*Row) string {
+	type key struct{ group, benchmark, metric string }
+	var keys []key
+	deltas := make(map[key][]string)
+	for i, rows := range columns {
+		for _, row := range rows {
+			k := key{row.Group, row.Benchmark, row.Metric}
+			if deltas[k] == nil {
+				keys = append(keys, k)
+				deltas[k] = make([]string, len(columns))
+				for j := range deltas[k] {
+					deltas[k][j] = "~"
+				}
+			}
+			deltas[k][i] = row.Delta
+		}
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "name\tmetric")
+	for _, label := range labels {
+		fmt.Fprintf(tw, "\t%s", label)
+	}
+	fmt.Fprintln(tw)
+	for _, k := range keys {
+		name := k.benchmark
+		if k.group != "" {
+			name = k.group + "/" + name
+		}
+		fmt.Fprintf(tw, "%s\t%s", name, k.metric)
+		for _, delta := range deltas[k] {
+			fmt.Fprintf(tw, "\t%s", delta)
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+	return buf.String()
+}
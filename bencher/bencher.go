@@ -21,9 +21,12 @@ import (
 	"fmt"
 	"go/build"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"text/template"
 	"time"
@@ -32,84 +35,571 @@ import (
 
 	"go.opencensus.io/trace"
 
+	"google.golang.org/api/storage/v1"
+
 	"github.com/keighl/postmark"
 	"github.com/orijtech/infra"
 )
 
 const unchanged = int(0)
 
-func runGoBenchmarks(ctx context.Context, gitRepoURL string) ([]byte, error) {
-	ctx, span := trace.StartSpan(ctx, "/run-go-benchmarks")
+// childEnvKeys are the only variables of the server's environment passed
+// on to the go commands, lest benchmarked code read the server's secrets
+// e.g. BENCHER_POSTMARK_SERVER_TOKEN or GOOGLE_APPLICATION_CREDENTIALS.
+var childEnvKeys = []string{
+	"PATH", "HOME", "USER", "LANG", "LC_ALL", "TZ",
+	"TMPDIR", "TEMP", "TMP",
+	"SYSTEMROOT", "COMSPEC", "PATHEXT", "USERPROFILE", "APPDATA", "LOCALAPPDATA",
+	"GOROOT", "GOPATH", "GOCACHE", "GOFLAGS", "GO111MODULE", "GOTOOLCHAIN",
+	"GOPROXY", "GONOPROXY", "GOPRIVATE", "GOSUMDB", "GONOSUMDB", "GOINSECURE",
+	"CGO_ENABLED", "CC", "CXX", "PKG_CONFIG_PATH",
+}
+
+// childEnv returns the allowed variables of the server's environment.
+func childEnv() []string {
+	var env []string
+	for _, key := range childEnvKeys {
+		if value, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+value)
+		}
+	}
+	return env
+}
+
+// projectDir is the target Go project's directory, that
+// of its checked out sources while it is benchmarked.
+func (br *Request) projectDir() string {
+	if br.workDir != "" {
+		return br.workDir
+	}
+	return br.gopathDir()
+}
+
+// gopathDir is the target Go project's directory in GOPATH.
+func (br *Request) gopathDir() string {
+	return filepath.Join(build.Default.GOPATH, "src", filepath.FromSlash(br.GitRepoURL))
+}
+
+// goCmd returns a command that runs the go tool with args in the target
+// Go project's directory, with only the environment that it needs.
+func (br *Request) goCmd(ctx context.Context, args ...string) *exec.Cmd {
+	return br.harnessCmd(ctx, "go", args...)
+}
+
+func (br *Request) runGoBenchmarks(ctx context.Context) (*goTestRun, error) {
+	if br.TimeBudget > 0 {
+		return br.runBudgetedBenchmarks(ctx)
+	}
+	return br.runGoTest(ctx, "", []string{"./..."})
+}
+
+// runGoTest runs the benchmarks of pkgs for benchtime each, go test's
+// default if blank.
+func (br *Request) runGoTest(ctx context.Context, benchtime string, pkgs []string) (*goTestRun, error) {
+	ctx, span := br.startSpan(ctx, "run-go-benchmarks")
 	defer span.End()
 
 	// 1. Change directories to the target Go project
-	cmd := exec.CommandContext(ctx, "go", "test", "-run=^$", "-bench=.", "-count=5", "./...")
-	cmd.Dir = filepath.Join(build.Default.GOPATH, "src", gitRepoURL)
-	output, err := cmd.Output()
+	args := []string{"test", "-json", "-run=^$", "-bench=.", "-count=5"}
+	if benchtime != "" {
+		args = append(args, "-benchtime="+benchtime)
+	}
+	// Allocations are only reported by every benchmark with -benchmem.
+	if err := br.loadZeroAllocs(); err != nil {
+		return nil, err
+	}
+	if len(br.zeroAllocs) > 0 {
+		args = append(args, "-benchmem")
+	}
+	cmd := br.goCmd(ctx, append(args, pkgs...)...)
+	// A runaway stderr would otherwise be held in memory whole.
+	stderr := &cappedBuffer{max: 64 << 10}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, err
 	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
 
-	// Filter out anything that doesn't begin with a benchmark
-	lines := strings.Split(string(output), "\n")
-	var benchmarkLines []string
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "Benchmark") {
-			benchmarkLines = append(benchmarkLines, line)
+	gtr, err := parseTestEvents(ctx, stdout, br.OnTestEvent)
+	if err != nil {
+		// go test would otherwise block writing the rest of its output.
+		_, _ = io.Copy(ioutil.Discard, stdout)
+	}
+	waitErr := cmd.Wait()
+	if err != nil && err != ErrNoBenchmarks {
+		return nil, fmt.Errorf("Parsing go test events: %v", err)
+	}
+	failed := gtr.failedPackages()
+	if err == nil && waitErr != nil && len(failed) > 0 {
+		// The other packages' results are still compared, the failed
+		// packages being accounted for in the result rather than dropped.
+		span.Annotatef(nil, "Benchmarks failed in packages: %s", strings.Join(failed, ", "))
+		return gtr, nil
+	}
+	if err != nil || waitErr != nil {
+		gtr.events.Close()
+	}
+	if waitErr != nil {
+		if len(failed) > 0 {
+			return nil, fmt.Errorf("Benchmarks failed in packages: %s", strings.Join(failed, ", "))
+		}
+		if stderr.truncated {
+			stderr.WriteString(" [truncated]")
 		}
+		return nil, fmt.Errorf("%v: %s", waitErr, bytes.TrimSpace(stderr.Bytes()))
 	}
-	if len(benchmarkLines) == 0 {
-		return nil, ErrNoBenchmarks
+	if err != nil {
+		return nil, err
 	}
-	return []byte(strings.Join(benchmarkLines, "\n")), nil
+	return gtr, nil
 }
 
 type Request struct {
-	AppEmail         string        `json:"app_email"`
-	AppSecret        string        `json:"app_secret"`
-	GCSBucket        string        `json:"gcs_bucket"`
-	GCSProject       string        `json:"gcs_project"`
-	GitRepoURL       string        `json:"git_repo_url"`
-	AlertEmails      []string      `json:"alert_emails"`
-	Secret           string        `json:"secret"`
-	Public           bool          `json:"public"`
-	EmailServerToken string        `json:"email_server_token"`
+	AppEmail          string        `json:"app_email"`
+	AppSecret         string        `json:"app_secret"`
+	GCSBucket         string        `json:"gcs_bucket"`
+	GCSProject        string        `json:"gcs_project"`
+	GitRepoURL        string        `json:"git_repo_url"`
+	AlertEmails       []string      `json:"alert_emails"`
+	Secret            string        `json:"secret"`
+	Public            bool          `json:"public"`
+	EmailServerToken  string        `json:"email_server_token"`
 	EmailAccountToken string        `json:"email_client_token"`
-	InfraClient      *infra.Client `json:"infra_client"`
+	InfraClient       *infra.Client `json:"infra_client"`
+
+	// StorageService is used to list stored
+	// objects, which InfraClient cannot do.
+	StorageService *storage.Service `json:"-"`
+
+	// KMSKeyName if set, is the resource name of the Cloud KMS key
+	// with which GCS encrypts the uploaded artifacts at rest e.g.
+	// "projects/p/locations/global/keyRings/r/cryptoKeys/k".
+	KMSKeyName string `json:"kms_key_name"`
+
+	// EncryptionKey if set, is a 32 byte key with which every artifact
+	// is AES-256-GCM envelope encrypted before it is uploaded.
+	EncryptionKey []byte `json:"-"`
+
+	// Profile if set, additionally captures CPU profiles of every
+	// package's benchmarks and uploads them as flamegraph HTML.
+	Profile bool `json:"profile"`
+
+	// Tags are free-form key-value pairs attached to the run
+	// e.g. {"experiment": "poolalloc"}. They are stored with
+	// the results and shown in reports.
+	Tags map[string]string `json:"tags"`
+
+	// GroupBy lists tag keys by which benchmarks
+	// are additionally grouped when comparing.
+	GroupBy []string `json:"group_by"`
+
+	// RepeatNotifications controls what is emailed when a run has
+	// the same changes as the previously notified one: RepeatSend,
+	// RepeatCondense or RepeatSuppress. It defaults to RepeatSend.
+	RepeatNotifications string `json:"repeat_notifications"`
+
+	// Timezone is the IANA name of the time zone e.g. "America/Toronto"
+	// used for report timestamps and quota months. Defaults to UTC.
+	// Storage prefixes are in UTC regardless.
+	Timezone string `json:"timezone"`
+
+	// Locale is the BCP 47 language tag e.g. "de-CH" by
+	// whose conventions numbers in HTML reports are formatted.
+	Locale string `json:"locale"`
+
+	// NumberFormat if set, is the NumberFormat of the means in reports,
+	// in place of the target repository's .bencherformat file, e.g.
+	// "digits=4, time/op=ns" for benchmarks of a few nanoseconds.
+	NumberFormat string `json:"number_format"`
+
+	// Suite lists the repositories that BenchmarkSuite benchmarks in
+	// turn, with the request's other settings, e.g. opencensus-go and
+	// its exporters, for a single report grouped by repository.
+	Suite []string `json:"suite"`
+
+	// Compare lists the stored result sets to compare side by side with
+	// CompareSets, e.g. the latest results of master, pr-1234 and pr-1250.
+	Compare []*ResultSet `json:"compare"`
+
+	// Baselines lists stored results that a run is also compared against,
+	// besides its baseline, e.g. the last release's as
+	// {"label": "v0.22.0", "name": "latest@version=v0.22.0"}, with a
+	// column of deltas each in the report.
+	Baselines []*ResultSet `json:"baselines"`
+
+	// BaselineRunID if set, is the ID of the stored run e.g.
+	// "2018-10-03T10:04:05Z-a1b2c3" against whose results the run is
+	// compared instead of "latest", e.g. to compare against the run
+	// before a change was merged. Such runs leave the baseline as it was.
+	BaselineRunID string `json:"baseline_run_id"`
+
+	// PullRequest if set, is the number of the pull request whose push
+	// the run benchmarks. Such runs are compared against the baseline but
+	// leave it as it was, and are grouped by PullRequestHistory.
+	PullRequest int `json:"pull_request"`
+	// ReviewComments if set, with PullRequest, posts the regressions of
+	// benchmarks declared in files that the pull request changed as inline
+	// comments of a review at their functions, through the GitHub API with
+	// the GitHubToken. Failing to is a warning of the result.
+	ReviewComments bool `json:"review_comments"`
+	// Submitted is set for runs submitted with a submission token rather
+	// than the server's credentials. Like those of pull requests, they are
+	// compared against the baseline but leave it as it was.
+	Submitted bool `json:"submitted"`
+
+	// Force if set, benchmarks the sources even if the results of the
+	// same commit with the same settings were cached by an earlier run.
+	Force bool `json:"force"`
+
+	// ServiceName if set, is the service the request's spans are of,
+	// DefaultServiceName otherwise.
+	ServiceName string `json:"-"`
+	// SpanConvention if set, names the request's spans and chooses their
+	// attributes, DefaultSpanConvention otherwise.
+	SpanConvention SpanConvention `json:"-"`
+
+	// TraceSampler if set, samples the traces begun by the request's
+	// methods when their context carries no span, instead of the
+	// global default sampler. See ParseSampler.
+	TraceSampler trace.Sampler `json:"-"`
+
+	// CacheDir if set, is the directory in which downloaded baselines
+	// are cached by generation, so that comparing against an unchanged
+	// baseline doesn't download it again.
+	CacheDir string `json:"-"`
+
+	// HTTPClient if set, is used for outbound HTTP calls
+	// such as to Postmark, e.g. to go through a proxy.
+	HTTPClient *http.Client `json:"-"`
+
+	// ErrorReporter if set, is where runs that fail are reported, e.g.
+	// StackdriverReporter, with their repository and run ID.
+	ErrorReporter ErrorReporter `json:"-"`
+
+	// Env are additional "key=value" environment variables for the go
+	// commands that fetch and run the benchmarks, which otherwise only
+	// inherit a few of the server's e.g. PATH, HOME and GOPROXY.
+	Env []string `json:"-"`
+
+	// DashboardURL if set, is the base URL of the dashboard to whose
+	// history charts the benchmarks in HTML reports link.
+	DashboardURL string `json:"-"`
+
+	// UnsubscribeKey if set, with a DashboardURL, signs the links through
+	// which every alert email unsubscribes from, or tunes, the notifications
+	// of the repository, each then emailed separately with their own.
+	UnsubscribeKey []byte `json:"-"`
+
+	// EmailSubject, EmailFrom and EmailReplyTo if set, are text/template
+	// templates of the notification's headers, executed with an
+	// EmailHeaderData e.g. "[bench][{{.Repo}}@{{.Ref}}] {{.Regressions}} regressions".
+	// The subject otherwise defaults to "Benchmarks for <repo>" and the
+	// sender to AppEmail.
+	EmailSubject string `json:"email_subject"`
+	EmailFrom    string `json:"email_from"`
+	EmailReplyTo string `json:"email_reply_to"`
+
+	// Outliers is how outlying samples are discarded before comparing:
+	// OutliersKeep, OutliersMinMax or OutliersMAD. Stored results are kept
+	// whole. Defaults to OutliersKeep.
+	Outliers string `json:"outliers"`
+
+	// GOGC and GODEBUG if set, are those of the benchmarks, and Seed is
+	// passed to them as BENCHER_SEED for seeding their random sources. They
+	// are recorded with the results, and comparing results measured with
+	// different values warns of it, as e.g. GC tuning masquerades as
+	// regressions.
+	GOGC    string `json:"gogc"`
+	GODEBUG string `json:"godebug"`
+	Seed    string `json:"seed"`
+
+	// UnitsOfWork maps benchmarks, named without the GOMAXPROCS suffix
+	// e.g. "StartSpan", or "*" for any other, to the metric they report
+	// with b.ReportMetric as their work per op e.g. "spans/op". Their
+	// per-op metrics are then also compared per unit of work e.g. as
+	// "ns/spans", which unlike ns/op don't change with the input size.
+	UnitsOfWork map[string]string `json:"units_of_work"`
+
+	// MaxEmailRows caps the changed rows in emailed reports to those that
+	// changed the most, linking to the full report instead. Defaults to 50.
+	MaxEmailRows int `json:"max_email_rows"`
+
+	// AttachResults if set, attaches the raw before and after results and
+	// their comparison to notifications, for recipients who can't access
+	// the stored objects.
+	AttachResults bool `json:"attach_results"`
+
+	// CriticalBenchmarks lists the benchmarks, named as benchstat reports
+	// them with or without the GOMAXPROCS suffix e.g. "StartSpan", whose
+	// absence from the latest run lowers the repository's health score.
+	CriticalBenchmarks []string `json:"critical_benchmarks"`
+
+	// Comparer is the name of the registered Comparer deciding which
+	// benchmarks changed significantly, "benchstat" if blank.
+	Comparer string `json:"comparer"`
+	// ShadowComparer if set, is the name of a registered Comparer run
+	// alongside Comparer, whose differing judgements are recorded in the
+	// result's Shadow and in ShadowComparisonsView but never alerted about.
+	ShadowComparer string `json:"-"`
+
+	// RunAs if set, is the name of an unprivileged user as whom the go
+	// commands run, with a private HOME, GOPATH and GOCACHE that are
+	// removed after the run, so that benchmarked code can't read the
+	// server's files. Switching users requires the server to run as root.
+	RunAs string `json:"-"`
+
+	// OnTestEvent if set is invoked with every event
+	// of "go test -json" as the benchmarks run.
+	OnTestEvent func(*TestEvent) `json:"-"`
+
+	// Pricing if set, is used to estimate the cost of every run.
+	Pricing *Pricing `json:"-"`
+
+	// Quotas are soft limits on the monthly machine time of repositories,
+	// of which the first matching GitRepoURL applies to its runs.
+	Quotas []*Quota `json:"-"`
+
+	// Features if set, toggle subsystems for the request's repository,
+	// which are otherwise all enabled.
+	Features *FeatureFlags `json:"-"`
+
+	// Faults if set, are failures injected on purpose by operators
+	// to exercise retries, dead letters and alerts.
+	Faults *Faults `json:"-"`
+
+	// Policy if set, is the gating Policy evaluated after comparing, in
+	// place of the one in the target repository's .bencherpolicy file.
+	Policy string `json:"policy"`
+
+	// VCS is the name of the registered VCS checking out the sources to
+	// benchmark, DefaultVCS if blank: VCSGOPATH benchmarks them as they
+	// are in GOPATH, VCSGit checks out Revision of the repository, and
+	// VCSModule downloads version Revision e.g. "v0.22.0" of the module
+	// through GOPROXY, without any repository checkout.
+	VCS string `json:"vcs"`
+	// Revision is the commit, branch, tag or module version to check out.
+	Revision string `json:"revision"`
+	// SourceURL if set, is the URL from which VCSGit clones the
+	// repository, when it isn't "https://" followed by GitRepoURL.
+	SourceURL string `json:"source_url"`
+
+	// Harness if set, is the name of the registered harness running the
+	// benchmarks, in place of the one in the target repository's
+	// .bencherharness file, DefaultHarness if neither is set.
+	Harness string `json:"harness"`
+
+	// Snapshot if set, archives the workspace of the run, its sources
+	// including go.sum, and records the Go toolchain's version, so that
+	// RerunSnapshot can re-execute it later.
+	Snapshot bool `json:"snapshot"`
+
+	// TimeBudget if set, is how long the benchmarks of the Go harness
+	// should take in total, divided across packages by adjusting their
+	// -benchtime to their durations in the previous run, so that the
+	// suite fits a predictable window e.g. on pull requests.
+	TimeBudget time.Duration `json:"-"`
+
+	// PublishTo if set, are where the run's report, results and summary
+	// are also published, each as "<publisher>:<target>" e.g.
+	// "github-release:census-instrumentation/opencensus-go@v0.22.0".
+	// See RegisterPublisher.
+	PublishTo []string `json:"publish_to"`
+	// PublisherTokens are the credentials of the publishers by name
+	// e.g. a GitHub token for PublisherGitHubRelease.
+	PublisherTokens map[string]string `json:"-"`
+
+	// NotifyNoBenchmarks if set, emails the alert emails when the run
+	// finds no benchmarks, which is otherwise only recorded as a run of
+	// status RunStatusNoBenchmarks and returned with ErrNoBenchmarks.
+	NotifyNoBenchmarks bool `json:"notify_no_benchmarks"`
+
+	// ZeroAllocs if set, are the patterns in the syntax of path.Match
+	// e.g. "StartSpan*" of the benchmarks that must report 0 allocs/op,
+	// in place of those in the target repository's .bencherzeroalloc file.
+	// Any allocation fails the run, whatever its significance.
+	ZeroAllocs []string `json:"zero_allocs"`
+
+	// AlertOwners if set, resolves the alert emails of a run in place of
+	// AlertEmails: AlertOwnersCodeOwners from the owners of its changed
+	// packages in the target repository's CODEOWNERS, or "@org/team" from
+	// the members of a GitHub team, through the API with the GitHubToken.
+	// AlertEmails are kept if no owner has a public email.
+	AlertOwners string `json:"alert_owners"`
+	// GitHubToken authenticates calls to the GitHub API.
+	GitHubToken string `json:"-"`
+
+	// Routes if set, are the Routes of the run's notifications by
+	// severity tier, in place of those in the target repository's
+	// .bencherroutes file. Without either, every report is emailed.
+	Routes string `json:"routes"`
+	// SlackWebhookURL and PagerDutyRoutingKey are where
+	// ChannelSlack and ChannelPagerDuty notifications go.
+	SlackWebhookURL     string `json:"-"`
+	PagerDutyRoutingKey string `json:"-"`
+
+	jail      *jail
+	transfers transfers
+	// ignore are the patterns of the benchmarks
+	// that the target repository's ignore file mutes.
+	ignore []string
+	// policy is the parsed Policy or policy file, if any.
+	policy *Policy
+	// routes are the parsed Routes or routes file, if any.
+	routes *Routes
+	// codeOwners is the target repository's CODEOWNERS, if
+	// its alert emails are resolved from it.
+	codeOwners *CodeOwners
+	// numberFormat is the parsed NumberFormat or number format file, if any.
+	numberFormat *NumberFormat
+	// zeroAllocs are the patterns of ZeroAllocs or of the zero
+	// allocation file, of the benchmarks that must not allocate.
+	zeroAllocs []string
+	// workDir if set, is the directory of the checked out sources.
+	workDir string
+	// commit is the commit or module version of the checked out
+	// sources, if they are those of an immutable revision.
+	commit string
+	// runID is the ID of the run whose objects are being uploaded.
+	runID string
+
+	// partial is set while the results being stored lack those of
+	// packages that failed, hence mustn't replace the baseline.
+	partial bool
+	// harness is the name of the harness that ran the benchmarks.
+	harness string
+	// fixtures is the docker compose project of the fixtures
+	// started for the benchmarks, if any.
+	fixtures string
+
+	// mailer, runner, customComparer, clock and idGenerator if set,
+	// are injected by a Service in place of Postmark, the harness, the
+	// comparer named by Comparer, the system's clock and timeIDs.
+	mailer         Mailer
+	runner         Harness
+	customComparer Comparer
+	clock          Clock
+	idGenerator    IDGenerator
 }
 
 func (br *Request) BenchmarkAndEmail(ctx context.Context) (interface{}, error) {
-	ctx, span := trace.StartSpan(ctx, "/benchmark-and-email")
+	ctx, span := br.startSpan(ctx, "benchmark-and-email")
 	defer span.End()
 
 	// 1. TODO: Match up those secrets and validate!
+	// Bad header templates should fail before, not after, the benchmarks run.
+	if err := br.ValidateTemplates(); err != nil {
+		return nil, err
+	}
 
 	// 2. Run those benchmarks
 	results, err := br.Benchmark(ctx)
+	if res, ok := results.(*Result); ok && err == ErrNoBenchmarks && br.NotifyNoBenchmarks {
+		if nerr := br.notifyNoBenchmarks(ctx, res); nerr != nil {
+			return results, nerr
+		}
+	}
 	if err != nil {
-		return nil, err
+		return results, err
+	}
+	// The earlier run already notified of a cached result.
+	if res, ok := results.(*Result); ok && res.Cached {
+		return results, nil
 	}
 
-	toEmails := strings.Join(br.AlertEmails, ",")
-	htmlBuf := new(bytes.Buffer)
-	if err := emailTmpl.Execute(htmlBuf, results); err != nil {
-		return nil, err
+	res, _ := results.(*Result)
+	if err := br.resolveAlertOwners(ctx, res); err != nil {
+		// The static alert emails are better than none.
+		span.Annotatef(nil, "Resolving alert owners: %v", err)
 	}
 
-	pmClient := postmark.NewClient(br.EmailServerToken, br.EmailAccountToken)
-	email := postmark.Email{
-		From:     br.AppEmail,
-		To:       toEmails,
-		Subject:  fmt.Sprintf("Benchmarks for %s", br.GitRepoURL),
-		HtmlBody: htmlBuf.String(),
+	subject := fmt.Sprintf("Benchmarks for %s", br.GitRepoURL)
+	tmpl := emailTmpl
+	headerData := newEmailHeaderData(br.GitRepoURL, res)
+	if res != nil {
+		switch br.RepeatNotifications {
+		case "", RepeatSend:
+		case RepeatCondense, RepeatSuppress:
+			res.Consecutive, err = br.checkRepeat(ctx, res)
+			if err != nil {
+				return results, err
+			}
+			if res.Consecutive <= 1 {
+				break
+			}
+			if br.RepeatNotifications == RepeatSuppress {
+				return results, nil
+			}
+			status := "still changed"
+			for _, row := range res.Rows {
+				if row.Change < 0 {
+					status = "still regressed"
+					break
+				}
+			}
+			subject = fmt.Sprintf("Benchmarks for %s: %s, %s consecutive run", br.GitRepoURL, status, ordinal(res.Consecutive))
+			headerData.Consecutive, headerData.Status = res.Consecutive, status
+			tmpl = condensedEmailTmpl
+		default:
+			return results, fmt.Errorf("unknown repeat_notifications %q", br.RepeatNotifications)
+		}
 	}
 
-	if _, err := pmClient.SendEmail(email); err != nil {
-		return results, err
+	if res != nil && br.routes != nil && br.featureEnabled(FeatureRouting) {
+		return results, br.route(ctx, subject, tmpl, res, headerData)
+	}
+	return results, br.sendEmail(ctx, subject, tmpl, results, headerData)
+}
+
+// sendEmail emails results, rendered with tmpl, to the alert emails
+// as their preferences say, adding them to the digest of those who
+// prefer one.
+func (br *Request) sendEmail(ctx context.Context, subject string, tmpl *template.Template, results interface{}, headerData *EmailHeaderData) error {
+	span := trace.FromContext(ctx)
+
+	subject, from, replyTo, err := br.emailHeaders(subject, headerData)
+	if err != nil {
+		return err
 	}
 
-	return results, nil
+	to, digested, err := br.recipients(ctx, br.resultTier(results))
+	if err != nil {
+		return err
+	}
+	if res, ok := results.(*Result); ok && res != nil && len(digested) > 0 {
+		if err := br.addToDigest(ctx, res, digested); err != nil {
+			return err
+		}
+	}
+	if len(to) == 0 {
+		span.Annotatef(nil, "No alert email wants to be emailed right away")
+		return nil
+	}
+
+	// The run succeeded, hence its results are sent as text
+	// rather than not at all if the HTML can't be rendered.
+	var htmlBody, textBody string
+	if htmlBuf, err := br.emailBody(tmpl, results); err == nil {
+		htmlBody = htmlBuf.String()
+	} else {
+		span.Annotatef(nil, "Rendering the HTML email: %v", err)
+		textBody = textEmail(results)
+	}
+
+	email := postmark.Email{
+		From:     from,
+		Subject:  subject,
+		ReplyTo:  replyTo,
+		HtmlBody: htmlBody,
+		TextBody: textBody,
+	}
+	if res, ok := results.(*Result); ok && br.AttachResults {
+		email.Attachments = res.attachments()
+	}
+
+	return br.deliverTo(ctx, email, to)
 }
 
 var (
@@ -118,205 +608,721 @@ var (
 )
 
 type Result struct {
+	// Status is that of the run e.g. RunStatusNoBenchmarks, if it ran.
+	Status string `json:",omitempty"`
+
 	URLs           map[string]string
 	Benchmarks     string
 	HTMLBenchmarks string
-}
 
-var pmClient = postmark.NewClient(os.Getenv("BENCHER_POSTMARK_SERVER_TOKEN"), os.Getenv("BENCHER_POSTMARK_CLIENT_TOKEN"))
+	// Profiles maps a package's import path to
+	// the URL of its CPU flamegraph, if profiled.
+	Profiles map[string]string `json:",omitempty"`
+
+	Tags map[string]string `json:",omitempty"`
+
+	// RunAt is the RFC3339 formatted start time of the run.
+	RunAt string `json:",omitempty"`
+
+	// Packages summarizes how each package's benchmarks ran.
+	Packages []*PackageSummary `json:",omitempty"`
+
+	// Rows are the significantly changed benchmark metrics.
+	Rows []*Row `json:",omitempty"`
+
+	// Consecutive is the number of consecutive runs,
+	// including this one, with the same changes.
+	Consecutive int `json:",omitempty"`
+
+	// ReportURL is the URL of the full HTML report.
+	ReportURL string `json:",omitempty"`
+	// Omitted is the number of changed rows left out of the
+	// emailed report, which then links to the full report.
+	Omitted int `json:",omitempty"`
 
-func (br *Request) Benchmark(ctx context.Context) (interface{}, error) {
-	ctx, span := trace.StartSpan(ctx, "/benchmark")
+	// Warnings are caveats of the comparison e.g. that
+	// the compared runs ran with different GOGC values.
+	Warnings []string `json:",omitempty"`
+	// EnvironmentDiff lists how the environments of the compared
+	// runs differ, e.g. their Go versions, if both were recorded.
+	EnvironmentDiff []*EnvironmentChange `json:",omitempty"`
+
+	// FailedPackages are the packages whose benchmarks failed to run, and
+	// SkippedBenchmarks the benchmarks that were skipped, e.g.
+	// "go.opencensus.io/trace.BenchmarkExport", which the comparison lacks.
+	FailedPackages    []string `json:",omitempty"`
+	SkippedBenchmarks []string `json:",omitempty"`
+
+	// Baselines are the comparisons against Request.Baselines, and Deltas
+	// tabulates the changes against the baseline and those side by side.
+	Baselines []*BaselineResult `json:",omitempty"`
+	Deltas    string            `json:",omitempty"`
+
+	// Shadow is how Request.ShadowComparer judged the changes, if set.
+	Shadow *ShadowComparison `json:",omitempty"`
+
+	// Cached is set if the result is that of an earlier run of the same
+	// commit with the same settings, returned instead of re-running.
+	Cached bool `json:",omitempty"`
+
+	// before and after are the raw results that were compared,
+	// and baselineRunID the run whose results before are, if known.
+	before, after []byte
+	changed       []*benchstat.Table
+	baselineRunID string
+
+	// Cost is the estimated cost of the run, if priced.
+	Cost *RunCost `json:",omitempty"`
+
+	// Policy is the verdict of the gating policy, if any, on the changes
+	// e.g. for CI to fail if its Severity is SeverityFail.
+	Policy *PolicyVerdict `json:",omitempty"`
+
+	// Tier is the severity tier by which the notification was routed,
+	// if the repository routes notifications.
+	Tier string `json:",omitempty"`
+
+	// Review is the URL of the review commenting on the pull request's
+	// regressions, if Request.ReviewComments posted one.
+	Review string `json:",omitempty"`
+
+	// Published maps each of Request.PublishTo to
+	// the URL at which the report was published.
+	Published map[string]string `json:",omitempty"`
+
+	// SuiteDuration is how long the benchmarks took,
+	// compared with the previous runs.
+	SuiteDuration *SuiteDuration `json:",omitempty"`
+}
+
+func (br *Request) Benchmark(ctx context.Context) (results interface{}, err error) {
+	ctx, span := br.startSpan(ctx, "benchmark")
 	defer span.End()
 
+	// Failures are reported with the ID of the run, once it has one.
+	var runID string
+	defer func() { br.reportError(ctx, runID, err) }()
+
+	if err := validateTags(br.Tags); err != nil {
+		return nil, err
+	}
+	if err := br.validateRuntimeSettings(); err != nil {
+		return nil, err
+	}
+	if br.Public && len(br.EncryptionKey) > 0 {
+		return nil, errors.New("public results cannot be encrypted client-side")
+	}
+	// A bad policy should fail before, not after, the benchmarks run.
+	if br.Policy != "" {
+		if _, err := ParsePolicy(br.Policy); err != nil {
+			return nil, err
+		}
+	}
+	for _, value := range br.PublishTo {
+		if _, _, _, err := parsePublishTarget(value); err != nil {
+			return nil, err
+		}
+	}
+	loc, err := br.location()
+	if err != nil {
+		return nil, err
+	}
+
 	// 1. Check out the branch if necessary
 	// 2. Run the tests
 	// 3. Get the before and after
 
-	afterBlob, err := runGoBenchmarks(ctx, br.GitRepoURL)
+	removeCheckout, err := br.checkout(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return br.uploadToGCS(ctx, afterBlob)
-}
+	defer removeCheckout()
 
-func (br *Request) uploadToGCS(ctx context.Context, afterBlob []byte) (interface{}, error) {
-	ctx, span := trace.StartSpan(ctx, "/upload-to-gcs")
-	defer span.End()
+	cacheKey := br.resultCacheKey(ctx)
+	if cacheKey != "" && !br.Force {
+		if err := br.loadZeroAllocs(); err != nil {
+			return nil, err
+		}
+		// No changes don't say whether benchmarks that mustn't allocate
+		// did, which only their results do, hence such runs are re-run.
+		if cr := br.lookUpResult(ctx, cacheKey); cr != nil && !(cr.NoChanges && len(br.zeroAllocs) > 0) {
+			if cr.NoChanges {
+				return nil, ErrNoChanges
+			}
+			cr.Result.Cached = true
+			return cr.Result, nil
+		}
+	}
 
-	inBenchmarksDir := func(suffix string) string {
-		return br.GitRepoURL + "/benchmarks/" + suffix
+	quotaUsage, err := br.checkQuota(ctx, br.now().In(loc))
+	if err != nil {
+		return nil, err
 	}
 
-	now := time.Now()
-	nowUniqPrefix := fmt.Sprintf("%d-%d-%d/%d", now.Year(), now.Month(), now.Day(), now.Unix())
+	// The workspace is archived as checked out, before the benchmarks
+	// can modify it, e.g. go test updating go.sum.
+	var snapshotPath string
+	var snapshot *Snapshot
+	if br.Snapshot && !br.featureEnabled(FeatureSnapshots) {
+		span.Annotatef(nil, "Snapshots are disabled for %s", br.GitRepoURL)
+	} else if br.Snapshot {
+		if snapshotPath, snapshot, err = br.snapshotWorkspace(ctx); err != nil {
+			return nil, err
+		}
+		defer os.Remove(snapshotPath)
+	}
 
-	infraClient := br.InfraClient
+	leaveJail, err := br.enterJail()
+	if err != nil {
+		return nil, fmt.Errorf("Creating the jail of %q: %v", br.RunAs, err)
+	}
+	defer leaveJail()
 
-	// 1. Check if the cloud listing exists
-	obj, err := infraClient.Object(br.GCSBucket, inBenchmarksDir("latest"))
-	if err != nil || obj == nil {
-		ctx, span := trace.StartSpan(ctx, "/non-existent-benchmarks")
-		defer span.End()
+	now := br.now().In(loc)
+	stopFixtures, err := br.startFixtures(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if stopFixtures != nil {
+		defer stopFixtures()
+	}
+	if err := br.runHook(ctx, hookPreRun); err != nil {
+		return nil, err
+	}
+	suiteStart := br.now()
+	gtr, err := br.runBenchmarks(ctx)
+	suiteElapsed := br.now().Sub(suiteStart)
+	// A failing post-run hook doesn't invalidate the results.
+	postRunErr := br.runHook(ctx, hookPostRun)
+	if postRunErr != nil {
+		span.Annotatef(nil, "%v", postRunErr)
+	}
+	if err == ErrNoBenchmarks {
+		return br.recordNoBenchmarks(ctx, now, quotaUsage)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer gtr.events.Close()
+	if br.ignore, err = readIgnoreFile(br.projectDir()); err != nil {
+		return nil, fmt.Errorf("Reading %s: %v", ignoreFileName, err)
+	}
+	if err := br.loadPolicy(); err != nil {
+		return nil, err
+	}
+	if err := br.loadRoutes(); err != nil {
+		return nil, err
+	}
+	if err := br.loadCodeOwners(); err != nil {
+		return nil, err
+	}
+	if err := br.loadNumberFormat(); err != nil {
+		return nil, err
+	}
+	afterBlob := gtr.benchmarks
+	if settings := br.runtimeSettings(); len(settings) > 0 {
+		afterBlob = append(tagsHeader(settings), afterBlob...)
+	}
+	if len(br.Tags) > 0 {
+		afterBlob = append(tagsHeader(br.Tags), afterBlob...)
+	}
 
-		results := map[string]string{}
-		// log.Printf("Most likely the stored benchmarks don't yet exist!")
+	nowUniqPrefix := br.ids().RunID(now)
+	br.runID, runID = nowUniqPrefix, nowUniqPrefix
+	defer func() { br.runID = "" }()
 
-		paths := []string{"latest", nowUniqPrefix}
-		for _, path := range paths {
-			url, err := uploadBenchmarksToGCS(ctx, &definition{
-				GCSProject: br.GCSProject,
-				Bucket:     br.GCSBucket,
-				Name:       inBenchmarksDir(path),
-				Public:     br.Public,
-				Reader: func() io.Reader {
-					return bytes.NewReader(afterBlob)
-				},
-				infraClient: infraClient,
-			})
-			if err != nil {
-				return results, fmt.Errorf("Uploading benchmarks first-time: %v", err)
-			}
-			results[path] = url
+	failed, skipped := gtr.failedPackages(), gtr.skippedBenchmarks()
+	br.partial = len(failed) > 0
+	defer func() { br.partial = false }()
+	// Allocating fails benchmarks that mustn't whether or not anything
+	// changed, which gate checks again against the baseline if so.
+	allocations := zeroAllocViolations(br.zeroAllocs, nil, dropIgnored(afterBlob, br.ignore))
+	res, err := br.uploadWithRetries(ctx, nowUniqPrefix, afterBlob)
+	if err == ErrNoChanges {
+		// Such runs store no metadata, but took machine time all the same.
+		elapsed := br.now().Sub(now)
+		br.recordUsage(ctx, nowUniqPrefix, now, elapsed.Minutes(), br.estimateCost(elapsed))
+	}
+	if err == ErrNoChanges && len(failed) > 0 {
+		// No changes among the benchmarks that ran isn't no changes.
+		return nil, fmt.Errorf("No changes detected, but %s", accountingWarnings(failed, nil)[0])
+	}
+	if err == ErrNoChanges && len(allocations) > 0 {
+		return nil, fmt.Errorf("No changes detected, but %s", strings.Join(allocations, "; "))
+	}
+	if err == ErrNoChanges && cacheKey != "" {
+		br.cacheResult(ctx, cacheKey, nil)
+	}
+	if err != nil {
+		if res == nil {
+			return nil, err
+		}
+		return res, err
+	}
+	res.Status = RunStatusOK
+	res.Tags = br.Tags
+	res.RunAt = now.Format(time.RFC3339)
+	res.Packages = gtr.packages
+	res.FailedPackages, res.SkippedBenchmarks = failed, skipped
+	res.Warnings = append(accountingWarnings(failed, skipped), res.Warnings...)
+	if postRunErr != nil {
+		res.Warnings = append(res.Warnings, postRunErr.Error())
+	}
+	if len(br.Baselines) > 0 {
+		br.compareBaselines(ctx, res)
+	}
+	res.SuiteDuration = br.suiteDuration(ctx, suiteElapsed, runtime.GOARCH)
+	env := br.environment(ctx)
+	res.EnvironmentDiff = diffEnvironments(br.runEnvironment(ctx, res.baselineRunID), env)
+	if err := br.gate(res); err != nil {
+		return res, fmt.Errorf("Evaluating the policy: %v", err)
+	}
+	br.shadowCompare(ctx, res)
+
+	eventsURL, err := uploadBenchmarksToGCS(ctx, br.definition(nowUniqPrefix+"-events.json", gtr.events.Reader))
+	if err != nil {
+		return res, fmt.Errorf("Uploading go test events: %v", err)
+	}
+	res.URLs[nowUniqPrefix+"-events"] = eventsURL
+
+	// Only go test can profile the benchmarks.
+	if br.Profile && !br.featureEnabled(FeatureProfiling) {
+		res.Warnings = append(res.Warnings, "Profiling is disabled for this repository")
+	} else if br.Profile && br.harness == HarnessGo {
+		// The baseline was already replaced, hence the run is
+		// recorded all the same, without some of its profiles.
+		if res.Profiles, err = br.uploadProfiles(ctx, nowUniqPrefix); err != nil {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("Profiling: %v", err))
+		}
+	}
+
+	// The cost of uploading the metadata itself is negligible.
+	res.Cost = br.estimateCost(br.now().Sub(now))
+	run := &Run{
+		ID:        nowUniqPrefix,
+		Repo:      br.GitRepoURL,
+		Tags:      br.Tags,
+		StartTime: now,
+		Status:    RunStatusOK,
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		Packages:  gtr.packages,
+		Cost:      res.Cost,
+		GOGC:      br.GOGC,
+		GODEBUG:   br.GODEBUG,
+		Seed:      br.Seed,
+		VCS:       br.VCS,
+		Revision:  br.Revision,
+		Commit:    br.commit,
+		Harness:   br.harness,
+		Snapshot:  snapshot,
+
+		Environment: env,
+
+		MachineMinutes: br.now().Sub(now).Minutes(),
+		SuiteSeconds:   suiteElapsed.Seconds(),
+		BaselineRunID:  br.BaselineRunID,
+		PullRequest:    br.PullRequest,
+		Partial:        br.partial,
+		Submitted:      br.Submitted,
+	}
+	if _, err := br.uploadRunMeta(ctx, run); err != nil {
+		return res, fmt.Errorf("Uploading run metadata: %v", err)
+	}
+	br.recordUsage(ctx, run.ID, now, run.MachineMinutes, run.Cost)
+	if br.PullRequest != 0 {
+		if err := br.recordPullRevision(ctx, run, res); err != nil {
+			return res, err
 		}
-		return &Result{URLs: results, Benchmarks: string(afterBlob)}, nil
 	}
+	if br.PullRequest != 0 && br.ReviewComments {
+		review, rerr := br.commentOnPullRequest(ctx, res)
+		if rerr != nil {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("Commenting on pull request #%d: %v", br.PullRequest, rerr))
+		}
+		res.Review = review
+	}
+	if snapshot != nil {
+		if err := br.uploadSnapshot(ctx, run.ID, snapshotPath); err != nil {
+			return res, err
+		}
+	}
+	if quotaUsage != nil {
+		br.warnOfQuota(ctx, quotaUsage, run.MachineMinutes)
+	}
+	if len(br.PublishTo) > 0 {
+		var warnings []string
+		res.Published, warnings = br.publishArtifacts(ctx, run.ID, runArtifacts(br.GitRepoURL, res))
+		res.Warnings = append(res.Warnings, warnings...)
+	}
+	// Partial results may be those of flaky failures, hence are re-run.
+	if cacheKey != "" && len(failed) == 0 {
+		br.cacheResult(ctx, cacheKey, res)
+	}
+	return res, nil
+}
+
+// recordNoBenchmarks stores a run that found no benchmarks with status
+// RunStatusNoBenchmarks, leaving the baseline as it was, and returns its
+// Result with ErrNoBenchmarks.
+func (br *Request) recordNoBenchmarks(ctx context.Context, now time.Time, quotaUsage *QuotaUsage) (*Result, error) {
+	ctx, span := br.startSpan(ctx, "record-no-benchmarks")
+	defer span.End()
 
-	ctx, dlSpan := trace.StartSpan(ctx, "/download-existent-benchmarks")
-	// 2. Otherwise, retrieve those benchmarks since they exist.
-	brc, err := infraClient.Download(br.GCSBucket, inBenchmarksDir("latest"))
-	dlSpan.End()
+	br.runID = br.ids().RunID(now)
+	defer func() { br.runID = "" }()
 
+	run := &Run{
+		ID:        br.runID,
+		Repo:      br.GitRepoURL,
+		Tags:      br.Tags,
+		StartTime: now,
+		Status:    RunStatusNoBenchmarks,
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		Cost:      br.estimateCost(br.now().Sub(now)),
+		VCS:       br.VCS,
+		Revision:  br.Revision,
+		Commit:    br.commit,
+		Harness:   br.harness,
+
+		MachineMinutes: br.now().Sub(now).Minutes(),
+	}
+	metaURL, err := br.uploadRunMeta(ctx, run)
 	if err != nil {
-		return nil, fmt.Errorf("Retrieving `before` benchmarks: %v", err)
+		return nil, fmt.Errorf("Uploading run metadata: %v", err)
+	}
+	br.recordUsage(ctx, run.ID, now, run.MachineMinutes, run.Cost)
+	if quotaUsage != nil {
+		br.warnOfQuota(ctx, quotaUsage, run.MachineMinutes)
+	}
+	res := &Result{
+		Status: RunStatusNoBenchmarks,
+		URLs:   map[string]string{run.ID + runMetaSuffix: metaURL},
+		Tags:   br.Tags,
+		RunAt:  now.Format(time.RFC3339),
+		Cost:   run.Cost,
 	}
-	beforeBuffer := new(bytes.Buffer)
-	_, err = io.Copy(beforeBuffer, brc)
-	_ = brc.Close()
+	return res, ErrNoBenchmarks
+}
+
+// notifyNoBenchmarks emails the alert emails that the run res found no
+// benchmarks e.g. because they were moved or renamed.
+func (br *Request) notifyNoBenchmarks(ctx context.Context, res *Result) error {
+	if len(br.AlertEmails) == 0 {
+		return nil
+	}
+	revision := br.Revision
+	if revision == "" {
+		revision = "the default revision"
+	}
+	email := postmark.Email{
+		From:    br.AppEmail,
+		To:      strings.Join(br.AlertEmails, ","),
+		Subject: fmt.Sprintf("No benchmarks found for %s", br.GitRepoURL),
+		TextBody: fmt.Sprintf("The run of %s at %s found no benchmarks in %s.\n\n"+
+			"The run was recorded, but the baseline is unchanged. If the benchmarks were\n"+
+			"moved or renamed, check the packages and the harness that run them.\n",
+			br.GitRepoURL, res.RunAt, revision),
+	}
+	return br.deliver(ctx, email)
+}
+
+func (br *Request) inBenchmarksDir(suffix string) string {
+	return br.GitRepoURL + "/benchmarks/" + suffix
+}
+
+// uploadBlob uploads blob under the repository's benchmarks directory.
+func (br *Request) uploadBlob(ctx context.Context, name string, blob []byte) (string, error) {
+	return uploadBenchmarksToGCS(ctx, br.definition(name, func() io.Reader {
+		return bytes.NewReader(blob)
+	}))
+}
+
+// definition describes the upload of the named object under
+// the repository's benchmarks directory with the request's
+// storage and encryption settings.
+func (br *Request) definition(name string, rfn func() io.Reader) *definition {
+	return &definition{
+		GCSProject:     br.GCSProject,
+		Bucket:         br.GCSBucket,
+		Name:           br.inBenchmarksDir(name),
+		Public:         br.Public,
+		Reader:         func() io.Reader { return &countingReader{r: rfn(), n: br.transfers.addStored} },
+		KMSKeyName:     br.KMSKeyName,
+		EncryptionKey:  br.EncryptionKey,
+		Metadata:       br.objectMetadata(br.runID),
+		infraClient:    br.InfraClient,
+		storageService: br.StorageService,
+		faults:         br.Faults,
+		generation:     anyGeneration,
+	}
+}
+
+// uploadProfiles profiles the benchmarks and uploads
+// the resulting flamegraphs under the run's prefix.
+func (br *Request) uploadProfiles(ctx context.Context, nowUniqPrefix string) (map[string]string, error) {
+	ctx, span := br.startSpan(ctx, "upload-profiles")
+	defer span.End()
+
+	flamegraphs, err := br.profileGoBenchmarks(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("Downloading `before` benchmarks: %v", err)
+		return nil, err
 	}
 
-	c := &benchstat.Collection{
-		Alpha:      0.05,
-		AddGeoMean: false,
-		DeltaTest:  benchstat.UTest,
-		SplitBy:    []string{"pkg", "goos", "goarch"},
+	urls := make(map[string]string)
+	for pkg, html := range flamegraphs {
+		name := nowUniqPrefix + "-profiles/" + strings.Replace(pkg, "/", "_", -1) + ".html"
+		url, err := br.uploadBlob(ctx, name, html)
+		if err != nil {
+			return urls, fmt.Errorf("Uploading flamegraph for %q: %v", pkg, err)
+		}
+		urls[pkg] = url
 	}
-	c.AddConfig("before", beforeBuffer.Bytes())
-	c.AddConfig("after", afterBlob)
+	return urls, nil
+}
 
-	ctx, computeTablesSpan := trace.StartSpan(ctx, "/compute-benchmark-differences")
-	// 3. Now generate those benchmarks
-	tables := c.Tables()
-	// Filter out the unchanged values
-	var changed []*benchstat.Table
-	for _, table := range tables {
-		var rows []*benchstat.Row
-		for _, row := range table.Rows {
-			if row.Change != unchanged {
-				rows = append(rows, row)
-			}
+// baselineObject returns the name and object of the baseline to compare
+// against, nil if there is none yet: that of the platform or, in buckets
+// whose baselines predate those of platforms, "latest" and its results if
+// they were measured on the same platform, or aren't labeled with one.
+func (br *Request) baselineObject(ctx context.Context) (string, *storage.Object, []byte) {
+	name := br.baselineName()
+	if obj, err := br.statObject(ctx, name); err == nil && obj != nil {
+		return name, obj, nil
+	}
+	obj, err := br.statObject(ctx, "latest")
+	if err != nil || obj == nil {
+		return "", nil, nil
+	}
+	blob, err := br.downloadGeneration(ctx, "latest", obj.Generation)
+	if err != nil {
+		return "", nil, nil
+	}
+	if goos, goarch := resultsPlatform(blob); goos != "" && (goos != runtime.GOOS || goarch != runtime.GOARCH) {
+		return "", nil, nil
+	}
+	return "latest", obj, blob
+}
+
+func (br *Request) uploadToGCS(ctx context.Context, nowUniqPrefix string, afterBlob []byte) (*Result, error) {
+	ctx, span := br.startSpan(ctx, "upload-to-gcs")
+	defer span.End()
+
+	// 1. Check if the cloud listing exists, unless comparing against a chosen run
+	baseline := br.baselineName()
+	var compared string
+	var obj *storage.Object
+	var beforeBlob []byte
+	var err error
+	if br.BaselineRunID != "" {
+		if beforeBlob, err = br.baselineRunResults(ctx); err != nil {
+			return nil, err
+		}
+	} else if compared, obj, beforeBlob = br.baselineObject(ctx); obj == nil {
+		ctx, span := br.startSpan(ctx, "non-existent-benchmarks")
+		defer span.End()
+
+		// log.Printf("Most likely the stored benchmarks don't yet exist!")
+
+		// Generation 0 guards against another run having created it meanwhile.
+		rfn := func() io.Reader { return bytes.NewReader(afterBlob) }
+		results, err := br.stageAndPromote(ctx, nowUniqPrefix, rfn, br.latestPaths(), map[string]int64{baseline: 0})
+		if err == ErrBaselineConflict {
+			return nil, err
 		}
-		if len(rows) == 0 {
-			continue
+		if err != nil {
+			return &Result{URLs: results}, fmt.Errorf("Uploading benchmarks first-time: %v", err)
 		}
+		return &Result{URLs: results, Benchmarks: string(afterBlob), after: afterBlob}, nil
+	}
 
-		table.Rows = rows
-		// Otherwise now swap out the old rows
-		// and this is a changed table result.
-		changed = append(changed, table)
+	// 2. Otherwise, retrieve those benchmarks since they exist, at the
+	// generation that will be replaced only if no other run replaced it.
+	var generations map[string]int64
+	switch {
+	case obj == nil:
+	case compared != baseline:
+		// The platform's baseline mustn't have been created meanwhile.
+		generations = map[string]int64{baseline: 0}
+	default:
+		beforeBlob, err = br.downloadGeneration(ctx, baseline, obj.Generation)
+		if err != nil {
+			return nil, fmt.Errorf("Retrieving `before` benchmarks: %v", err)
+		}
+		generations = map[string]int64{baseline: obj.Generation}
 	}
-	computeTablesSpan.End()
 
+	// 3. Now generate those benchmarks
+	changed, err := br.compare(ctx, beforeBlob, afterBlob, br.splitBy())
+	if err != nil {
+		return nil, err
+	}
 	if len(changed) == 0 {
+		// The shadow comparer may yet disagree, which is only recorded.
+		br.shadowCompare(ctx, &Result{before: beforeBlob, after: afterBlob})
 		return nil, ErrNoChanges
 	}
 
 	// 4. Now update/replace the already existent benchmarks
 	newBenchmarksReaderFunc := func() io.Reader {
 		buf := new(bytes.Buffer)
-		benchstat.FormatText(buf, changed)
+		formatText(buf, changed)
 		return buf
 	}
 
+	// Each upload is staged under the run's prefix, then promoted to "latest".
 	uploads := []struct {
-		rfn   func() io.Reader
-		paths []string
+		staged      string
+		rfn         func() io.Reader
+		paths       []string
+		generations map[string]int64
 	}{
 		{
-			paths: []string{
-				"latest",
-				nowUniqPrefix,
-			},
-			rfn: func() io.Reader { return bytes.NewReader(afterBlob) },
+			staged:      nowUniqPrefix,
+			rfn:         func() io.Reader { return bytes.NewReader(afterBlob) },
+			paths:       br.latestPaths(),
+			generations: generations,
 		},
 		{
-			paths: []string{
-				"latest-results",
-				nowUniqPrefix + "-results",
-			},
-			rfn: newBenchmarksReaderFunc,
+			staged: nowUniqPrefix + "-results",
+			rfn:    newBenchmarksReaderFunc,
+			paths:  []string{"latest-results"},
 		},
 	}
+	if !br.replacesBaseline() {
+		uploads[1].paths = nil
+	}
 
-	ctx, uploadsSpan := trace.StartSpan(ctx, "/perform-uploads")
+	ctx, uploadsSpan := br.startSpan(ctx, "perform-uploads")
 	defer uploadsSpan.End()
 
 	urls := make(map[string]string)
 	for _, upload := range uploads {
-		for _, path := range upload.paths {
-			def := &definition{
-				GCSProject:  br.GCSProject,
-				Bucket:      br.GCSBucket,
-				Name:        inBenchmarksDir(path),
-				Public:      br.Public,
-				Reader:      upload.rfn,
-				infraClient: infraClient,
-			}
-			url, err := uploadBenchmarksToGCS(ctx, def)
-			if err != nil {
-				return nil, fmt.Errorf("uploadBenchmarksToGCS: %q: %v", path, err)
-			}
+		uploaded, err := br.stageAndPromote(ctx, upload.staged, upload.rfn, upload.paths, upload.generations)
+		for path, url := range uploaded {
 			urls[path] = url
 		}
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	htmlBuf := new(bytes.Buffer)
-	benchstat.FormatHTML(htmlBuf, changed)
+	// The baseline was already replaced, hence the run carries on
+	// without an HTML report, rather than fail, if it can't be rendered.
+	var reportURL string
+	html, err := br.formatHTML(changed)
+	if err != nil {
+		span.Annotatef(nil, "Formatting the HTML report: %v", err)
+	} else if reportURL, err = br.uploadBlob(ctx, nowUniqPrefix+"-report.html", []byte(html)); err != nil {
+		return nil, fmt.Errorf("Uploading the HTML report: %v", err)
+	}
 	res := &Result{
+		ReportURL:      reportURL,
 		URLs:           urls,
 		Benchmarks:     newBenchmarksReaderFunc().(*bytes.Buffer).String(),
-		HTMLBenchmarks: htmlBuf.String(),
+		HTMLBenchmarks: html,
+		Rows:           resultRows(changed),
+		Warnings:       runtimeWarnings(beforeBlob, afterBlob),
+		before:         beforeBlob,
+		after:          afterBlob,
+		changed:        changed,
+		baselineRunID:  br.BaselineRunID,
+	}
+	if obj != nil {
+		res.baselineRunID = obj.Metadata[MetadataRunID]
 	}
 	return res, nil
 }
 
 type definition struct {
-	Name        string
-	GCSProject  string
-	Bucket      string
-	Reader      func() io.Reader
-	Public      bool
-	infraClient *infra.Client
+	Name       string
+	GCSProject string
+	Bucket     string
+	Reader     func() io.Reader
+	Public     bool
+
+	// KMSKeyName if set, is the Cloud KMS key with
+	// which the object is encrypted at rest by GCS.
+	KMSKeyName string
+	// EncryptionKey if set, is the key with which the
+	// object is envelope encrypted before uploading.
+	EncryptionKey []byte
+	// Metadata is the custom metadata stamped on the object, along with
+	// the ID of the upload's trace, if uploaded with the storage service.
+	Metadata map[string]string
+
+	infraClient    *infra.Client
+	storageService *storage.Service
+	faults         *Faults
+	// generation if not anyGeneration, is the generation the object
+	// must have to be replaced, 0 meaning that it mustn't exist.
+	// Only uploads with the storage service honor it.
+	generation int64
 }
 
 func uploadBenchmarksToGCS(ctx context.Context, def *definition) (string, error) {
-	ctx, span := trace.StartSpan(ctx, "/upload-benchmarks-to-gcs")
+	ctx, span := startSpan(ctx, "upload-benchmarks-to-gcs")
 	defer span.End()
 
+	if def.faults.failUpload() {
+		return "", fmt.Errorf("Uploading %q: %v", def.Name, ErrInjectedFault)
+	}
+
 	ic := def.infraClient
-	// 1. Ensure that the bucket exists on GCS
-	bc := &infra.BucketCheck{Project: def.GCSProject, Bucket: def.Bucket}
-	if _, err := ic.EnsureBucketExists(bc); err != nil {
-		return "", err
+	// 1. Ensure that the bucket exists on GCS, unless
+	// there is only the storage service e.g. of an EmbeddedStore.
+	if ic == nil && def.storageService == nil {
+		return "", ErrNoStorageService
+	}
+	if ic != nil {
+		bc := &infra.BucketCheck{Project: def.GCSProject, Bucket: def.Bucket}
+		if _, err := ic.EnsureBucketExists(bc); err != nil {
+			return "", err
+		}
+	}
+
+	reader := def.Reader
+	if len(def.EncryptionKey) > 0 {
+		plaintext, err := ioutil.ReadAll(def.Reader())
+		if err != nil {
+			return "", err
+		}
+		sealed, err := sealEnvelope(def.EncryptionKey, plaintext)
+		if err != nil {
+			return "", err
+		}
+		reader = func() io.Reader { return bytes.NewReader(sealed) }
 	}
 
 	// 2. Upload the benchmarks
+	if def.KMSKeyName != "" || def.storageService != nil {
+		// infra.UploadParams has no notion of customer-managed keys nor of metadata.
+		if def.storageService == nil {
+			return "", ErrNoStorageService
+		}
+		obj := &storage.Object{Name: def.Name, Metadata: withTraceID(ctx, def.Metadata)}
+		call := def.storageService.Objects.Insert(def.Bucket, obj).Media(reader()).Context(ctx)
+		if def.KMSKeyName != "" {
+			call = call.KmsKeyName(def.KMSKeyName)
+		}
+		if def.Public {
+			call = call.PredefinedAcl("publicRead")
+		}
+		if def.generation != anyGeneration {
+			call = call.IfGenerationMatch(def.generation)
+		}
+		obj, err := call.Do()
+		if err != nil {
+			return "", err
+		}
+		return infra.ObjectURL(obj), nil
+	}
+
 	params := &infra.UploadParams{
 		Bucket: def.Bucket,
 		Name:   def.Name,
-		Reader: def.Reader,
+		Reader: reader,
 		Public: def.Public,
 	}
 	obj, err := ic.UploadWithParams(params)
@@ -327,9 +1333,49 @@ func uploadBenchmarksToGCS(ctx context.Context, def *definition) (string, error)
 }
 
 var emailTmpl = template.Must(template.New("email").Parse(`
+{{if .RunAt}}
+Run at: {{.RunAt}}
+<br />
+{{end}}
+{{if .Tags}}
+Tags:
+{{range $key, $value := .Tags}}
+<code>{{html $key}}={{html $value}}</code>
+{{end}}
+<br />
+{{end}}
+{{range .Warnings}}
+<b>Warning:</b> {{html .}}
+<br />
+{{end}}
+{{if .EnvironmentDiff}}
+Environment changes:
+<br />
+{{range .EnvironmentDiff}}
+{{html .Field}}: <code>{{html .Before}}</code> &rarr; <code>{{html .After}}</code>
+<br />
+{{end}}
+{{end}}
+{{with .Policy}}
+Policy verdict: <b>{{html .Severity}}</b>
+<br />
+{{range .Violations}}
+{{html .}}
+<br />
+{{end}}
+{{end}}
+{{if .Deltas}}
+<pre>{{html .Deltas}}</pre>
+{{end}}
 {{if .HTMLBenchmarks}}
 {{.HTMLBenchmarks}}
 
+{{end}}
+{{if .Omitted}}
+<br />
+{{if .HTMLBenchmarks}}{{.Omitted}} less changed rows were left out.{{else}}The report of {{.Omitted}} changed rows is too large for email.{{end}}
+{{if .ReportURL}}See the <a href="{{html .ReportURL}}">full report</a>.{{end}}
+<br />
 {{end}}
 
 <br />
@@ -337,9 +1383,29 @@ var emailTmpl = template.Must(template.New("email").Parse(`
   The respective URLs are:
 <br />
 {{range $key, $value := .URLs}}
-{{$key}} : {{$value}}
+{{html $key}} : {{html $value}}
 <br />
 
 {{end}}
 {{end}}
+
+{{if .Profiles}}
+<br />
+  CPU flamegraphs:
+<br />
+{{range $pkg, $url := .Profiles}}
+<a href="{{html $url}}">{{html $pkg}}</a>
+<br />
+{{end}}
+{{end}}
+`))
+
+var condensedEmailTmpl = template.Must(template.New("condensed-email").Parse(`
+The same {{len .Rows}} benchmark metrics changed as in the previous run,
+for {{.Consecutive}} consecutive runs now, hence the full report is omitted.
+<br />
+{{range $key, $value := .URLs}}
+{{html $key}} : {{html $value}}
+<br />
+{{end}}
 `))
@@ -0,0 +1,173 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The bounds of the -benchtime of packages under a time budget, lest
+// benchmarks run too few iterations to be compared, or for ages.
+const (
+	minBudgetBenchTime = 100 * time.Millisecond
+	maxBudgetBenchTime = 10 * time.Second
+)
+
+// benchGroup is packages benchmarked together with the same -benchtime.
+type benchGroup struct {
+	benchtime string
+	packages  []string
+}
+
+// planBudget divides budget across pkgs in proportion to how long they
+// took in the previous run, history, normalized to a -benchtime of 1s.
+// Every package with history runs with the same -benchtime, scaled for
+// their total to fit what's left of the budget once the packages without
+// history are set aside at the mean duration of the others, which run
+// with the default -benchtime as nothing tells how long they take.
+func planBudget(budget time.Duration, history []*PackageSummary, pkgs []string) []*benchGroup {
+	// The seconds each package takes with a -benchtime of 1s.
+	perSecond := make(map[string]float64)
+	for _, ps := range history {
+		if ps.Status != "pass" || ps.Benchmarks == 0 || ps.Elapsed <= 0 {
+			continue
+		}
+		benchtime := time.Second
+		if ps.BenchTime != "" {
+			d, err := time.ParseDuration(ps.BenchTime)
+			if err != nil || d <= 0 {
+				continue
+			}
+			benchtime = d
+		}
+		perSecond[ps.Package] = ps.Elapsed / benchtime.Seconds()
+	}
+
+	var known, unknown []string
+	var knownSeconds float64
+	for _, pkg := range pkgs {
+		if s, ok := perSecond[pkg]; ok {
+			known = append(known, pkg)
+			knownSeconds += s
+		} else {
+			unknown = append(unknown, pkg)
+		}
+	}
+	if len(known) == 0 {
+		return []*benchGroup{{packages: pkgs}}
+	}
+
+	left := budget.Seconds() - knownSeconds/float64(len(known))*float64(len(unknown))
+	benchtime := time.Duration(left / knownSeconds * float64(time.Second))
+	if benchtime < minBudgetBenchTime {
+		benchtime = minBudgetBenchTime
+	} else if benchtime > maxBudgetBenchTime {
+		benchtime = maxBudgetBenchTime
+	}
+	groups := []*benchGroup{{benchtime: benchtime.Round(time.Millisecond).String(), packages: known}}
+	if len(unknown) > 0 {
+		groups = append(groups, &benchGroup{packages: unknown})
+	}
+	return groups
+}
+
+// packageHistory returns the package summaries of the most recent
+// run of the repository on this architecture, if any.
+func (br *Request) packageHistory(ctx context.Context) ([]*PackageSummary, error) {
+	var latest *Run
+	rf := &RunFilter{PageSize: math.MaxInt32, GOARCH: runtime.GOARCH}
+	_, err := br.WalkRuns(ctx, rf, func(run *Run) error {
+		// Runs are walked oldest first.
+		if len(run.Packages) > 0 {
+			latest = run
+		}
+		return nil
+	})
+	if err != nil || latest == nil {
+		return nil, err
+	}
+	return latest.Packages, nil
+}
+
+// runBudgetedBenchmarks runs the benchmarks within the request's
+// TimeBudget, a go test run for every group of packages of the plan.
+func (br *Request) runBudgetedBenchmarks(ctx context.Context) (*goTestRun, error) {
+	ctx, span := br.startSpan(ctx, "run-budgeted-benchmarks")
+	defer span.End()
+
+	out, err := runCheckoutCmd(br.goCmd(ctx, "list", "./..."))
+	if err != nil {
+		return nil, fmt.Errorf("Listing packages: %v", err)
+	}
+	pkgs := strings.Fields(string(out))
+	history, err := br.packageHistory(ctx)
+	if err != nil {
+		// Without history, the budget merely can't be enforced.
+		span.Annotatef(nil, "Retrieving the durations of the previous run: %v", err)
+	}
+
+	var gtr *goTestRun
+	for _, group := range planBudget(br.TimeBudget, history, pkgs) {
+		span.Annotatef(nil, "Benchmarking %d packages with -benchtime=%q", len(group.packages), group.benchtime)
+		run, err := br.runGoTest(ctx, group.benchtime, group.packages)
+		if err == ErrNoBenchmarks {
+			continue
+		}
+		if err != nil {
+			if gtr != nil {
+				gtr.events.Close()
+			}
+			return nil, err
+		}
+		for _, ps := range run.packages {
+			ps.BenchTime = group.benchtime
+		}
+		if gtr == nil {
+			gtr = run
+			continue
+		}
+		if err := gtr.merge(run); err != nil {
+			gtr.events.Close()
+			return nil, err
+		}
+	}
+	if gtr == nil {
+		return nil, ErrNoBenchmarks
+	}
+	return gtr, nil
+}
+
+// merge appends the results of other to those of gtr, closing other.
+func (gtr *goTestRun) merge(other *goTestRun) error {
+	defer other.events.Close()
+
+	if len(gtr.benchmarks) > 0 && len(other.benchmarks) > 0 {
+		gtr.benchmarks = append(gtr.benchmarks, '\n')
+	}
+	gtr.benchmarks = append(gtr.benchmarks, other.benchmarks...)
+	gtr.packages = append(gtr.packages, other.packages...)
+	sort.Slice(gtr.packages, func(i, j int) bool {
+		return gtr.packages[i].Package < gtr.packages[j].Package
+	})
+	_, err := io.Copy(gtr.events, other.events.Reader())
+	return err
+}
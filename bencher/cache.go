@@ -0,0 +1,196 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+	"google.golang.org/api/storage/v1"
+)
+
+const (
+	// maxDownloadAttempts bounds the ranged requests
+	// resuming an interrupted download.
+	maxDownloadAttempts = 3
+	// maxCachedObjects bounds the cache, the least
+	// recently used objects being evicted first.
+	maxCachedObjects = 32
+
+	partialSuffix = ".part"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// cachePath is where the generation of the named object is cached. Cached
+// objects are as stored, hence still encrypted if they were uploaded so.
+func (br *Request) cachePath(objName string, generation int64) string {
+	return filepath.Join(br.CacheDir, fmt.Sprintf("%x-%d", sha256.Sum256([]byte(objName)), generation))
+}
+
+// fetchGeneration retrieves the stored bytes of the named object at the
+// given generation from the cache if it was downloaded before, otherwise
+// downloads them, resuming interrupted downloads with ranged requests,
+// and verifies their checksum before caching them.
+func (br *Request) fetchGeneration(ctx context.Context, name string, generation int64) ([]byte, error) {
+	span := trace.FromContext(ctx)
+	objName := br.inBenchmarksDir(name)
+	obj, err := br.StorageService.Objects.Get(br.GCSBucket, objName).Generation(generation).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	// A corrupted read must come from storage to be verified as one.
+	corrupt := br.Faults.corruptBaselineRead()
+
+	// 1. Generations are immutable, hence a cached one is always current.
+	var path string
+	if br.CacheDir != "" && !corrupt {
+		path = br.cachePath(objName, obj.Generation)
+		if blob, err := ioutil.ReadFile(path); err == nil && verifyChecksum(obj, blob) == nil {
+			span.Annotatef(nil, "Retrieved %q from the cache", name)
+			now := time.Now()
+			_ = os.Chtimes(path, now, now)
+			return blob, nil
+		}
+	}
+
+	// 2. Resume from what an earlier interrupted download left.
+	buf := new(bytes.Buffer)
+	if path != "" {
+		if partial, err := ioutil.ReadFile(path + partialSuffix); err == nil && uint64(len(partial)) < obj.Size {
+			buf.Write(partial)
+		}
+	}
+	for attempt := 1; uint64(buf.Len()) < obj.Size; attempt++ {
+		if attempt > maxDownloadAttempts {
+			return nil, fmt.Errorf("Downloading %q: got %d of %d bytes", name, buf.Len(), obj.Size)
+		}
+		if err := br.downloadRange(ctx, objName, obj.Generation, buf); err != nil {
+			if path != "" {
+				_ = ioutil.WriteFile(path+partialSuffix, buf.Bytes(), 0600)
+			}
+			if attempt == maxDownloadAttempts {
+				return nil, err
+			}
+			span.Annotatef(nil, "Resuming the download of %q from byte %d (attempt %d): %v", name, buf.Len(), attempt, err)
+		}
+	}
+
+	// 3. Verify what was downloaded, lest a resumed download splice in bad bytes.
+	blob := buf.Bytes()
+	if corrupt && len(blob) > 0 {
+		blob[len(blob)/2] ^= 0xff
+		span.Annotatef(nil, "Injected the corruption of %q", name)
+	}
+	if err := verifyChecksum(obj, blob); err != nil {
+		if path != "" {
+			_ = os.Remove(path + partialSuffix)
+		}
+		return nil, fmt.Errorf("Downloading %q: %v", name, err)
+	}
+	if path != "" {
+		_ = os.Remove(path + partialSuffix)
+		if err := br.cache(path, blob); err != nil {
+			span.Annotatef(nil, "Caching %q: %v", name, err)
+		}
+	}
+	return blob, nil
+}
+
+// downloadRange appends the bytes of the object from buf's length onwards to buf.
+func (br *Request) downloadRange(ctx context.Context, objName string, generation int64, buf *bytes.Buffer) error {
+	call := br.StorageService.Objects.Get(br.GCSBucket, objName).Generation(generation).Context(ctx)
+	if buf.Len() > 0 {
+		call.Header().Set("Range", fmt.Sprintf("bytes=%d-", buf.Len()))
+	}
+	resp, err := call.Download()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The whole object is served if the range was ignored.
+	if resp.StatusCode == http.StatusOK {
+		buf.Reset()
+	}
+	n, err := io.Copy(buf, resp.Body)
+	br.transfers.addDownloaded(n)
+	return err
+}
+
+// verifyChecksum checks blob against the object's CRC32C, which
+// unlike its MD5 is also known for composite objects.
+func verifyChecksum(obj *storage.Object, blob []byte) error {
+	want, err := base64.StdEncoding.DecodeString(obj.Crc32c)
+	if err != nil || len(want) != 4 {
+		return fmt.Errorf("invalid CRC32C %q", obj.Crc32c)
+	}
+	if got := crc32.Checksum(blob, castagnoli); got != binary.BigEndian.Uint32(want) {
+		return fmt.Errorf("CRC32C mismatch: got %08x, want %08x", got, binary.BigEndian.Uint32(want))
+	}
+	return nil
+}
+
+// cache writes blob to path, then evicts the least
+// recently used objects if there are too many.
+func (br *Request) cache(path string, blob []byte) error {
+	if err := os.MkdirAll(br.CacheDir, 0700); err != nil {
+		return err
+	}
+	// Renaming makes the cached object appear whole or not at all.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, blob, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	infos, err := ioutil.ReadDir(br.CacheDir)
+	if err != nil {
+		return err
+	}
+	var cached []os.FileInfo
+	for _, info := range infos {
+		if !info.IsDir() && !strings.Contains(info.Name(), ".") {
+			cached = append(cached, info)
+		}
+	}
+	if len(cached) <= maxCachedObjects {
+		return nil
+	}
+	sort.Slice(cached, func(i, j int) bool { return cached[i].ModTime().Before(cached[j].ModTime()) })
+	for _, info := range cached[:len(cached)-maxCachedObjects] {
+		if err := os.Remove(filepath.Join(br.CacheDir, info.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,416 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"contrib.go.opencensus.io/exporter/prometheus"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/zpages"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// adminMux serves the operator endpoints /metrics, /debug and /admin,
+// on a listener separate from the public API's so that they can be
+// firewalled independently.
+var adminMux = http.NewServeMux()
+
+// metricNamespace returns service as a Prometheus metric namespace,
+// with the characters metric names can't have replaced by underscores.
+func metricNamespace(service string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r == ':' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return '_'
+	}, service)
+}
+
+func serveAdmin(port int) {
+	pe, err := prometheus.NewExporter(prometheus.Options{Namespace: metricNamespace(serviceName)})
+	if err != nil {
+		log.Fatalf("Creating the Prometheus exporter: %v", err)
+	}
+	view.RegisterExporter(pe)
+	if err := view.Register(ochttp.DefaultServerViews...); err != nil {
+		log.Fatalf("Registering the HTTP server views: %v", err)
+	}
+	if err := view.Register(bencher.ShadowComparisonsView); err != nil {
+		log.Fatalf("Registering the shadow comparisons view: %v", err)
+	}
+	if err := view.Register(queueViews...); err != nil {
+		log.Fatalf("Registering the queue views: %v", err)
+	}
+
+	adminMux.Handle("/metrics", pe)
+	zpages.Handle(adminMux, "/debug")
+	adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+	adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	adminMux.HandleFunc("/admin/config", handleAdminConfig)
+	adminMux.HandleFunc("/admin/health", handleAdminHealth)
+	adminMux.HandleFunc("/admin/test-notify", handleTestNotify)
+	adminMux.HandleFunc("/admin/dead-letters", handleDeadLetters)
+	adminMux.HandleFunc("/admin/dead-letters/replay", handleReplayDeadLetter)
+	adminMux.HandleFunc("/admin/compact", handleCompact)
+	adminMux.HandleFunc("/admin/check-freshness", handleCheckFreshness)
+	adminMux.HandleFunc("/admin/send-digest", handleSendDigest)
+	adminMux.HandleFunc("/admin/feature-flags", handleFeatureFlags)
+	adminMux.HandleFunc("/admin/self-test", handleSelfTest)
+	adminMux.HandleFunc("/admin/submission-url", handleSubmissionURL)
+	if os.Getenv("BENCHER_FAULT_INJECTION") != "" {
+		faults = new(bencher.Faults)
+		adminMux.HandleFunc("/admin/faults", handleFaults)
+		log.Printf("Fault injection is enabled at /admin/faults")
+	}
+
+	addr := fmt.Sprintf(":%d", port)
+	log.Printf("Running the admin server at %q", addr)
+	if err := http.ListenAndServe(addr, withAdmin(adminMux)); err != nil {
+		log.Fatalf("Admin ListenAndServe: %v", err)
+	}
+}
+
+// withAdmin requires the admin role for /admin and /debug, by API key
+// or by the session of someone signed in on the public port, since a
+// session cookie is shared by every port of the host. /metrics is left
+// alone for scrapers.
+func withAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// There is no signing in here, hence no redirecting to it.
+		if rl := roleOf(r); r.URL.Path != "/metrics" && rl < roleAdmin {
+			http.Error(w, fmt.Sprintf("the admin role is required, not %s", rl), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// handleAdminConfig serves the server's non-secret configuration.
+func handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	cfg := map[string]interface{}{
+		"bucket":          gcsBucket,
+		"project":         gcsProject,
+		"app_email":       appEmail,
+		"timezone":        timezone,
+		"locale":          locale,
+		"kms_key":         kmsKeyName,
+		"credentials":     credentialsMode,
+		"encrypted":       len(encryptionKey) > 0,
+		"api_keys":        len(apiKeys),
+		"public_read":     publicRead,
+		"login":           loginProvider(),
+		"signed_releases": signingKey != nil,
+		"shadow_comparer": shadowComparer,
+		"max_running":     queue.maxRunning,
+		"max_queued":      queue.maxQueued,
+		"quotas":          quotas,
+		"feature_flags":   featureFlags.Flags(),
+		"postmark_auth":   postmarkServerToken != "",
+		"slack":           slackWebhookURL != "",
+		"pagerduty":       pagerDutyRoutingKey != "",
+		"publishers":      bencher.PublisherNames(),
+		"unsubscribe":     unsubscribeKey != nil,
+		"service_name":    serviceName,
+	}
+	blob, _ := json.MarshalIndent(cfg, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
+
+type testNotifyRequest struct {
+	GitRepoURL  string   `json:"git_repo_url"`
+	AlertEmails []string `json:"alert_emails"`
+
+	EmailSubject  string `json:"email_subject"`
+	EmailFrom     string `json:"email_from"`
+	EmailReplyTo  string `json:"email_reply_to"`
+	AttachResults bool   `json:"attach_results"`
+}
+
+// handleTestNotify serves POST /admin/test-notify, sending a made up
+// report for the repository as a real run's would be sent.
+func handleTestNotify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	tn := new(testNotifyRequest)
+	if err := json.NewDecoder(r.Body).Decode(tn); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if tn.GitRepoURL == "" || len(tn.AlertEmails) == 0 {
+		http.Error(w, "expecting a non-blank git_repo_url and alert_emails", http.StatusBadRequest)
+		return
+	}
+
+	brq := newRequest(tn.GitRepoURL)
+	brq.AlertEmails = tn.AlertEmails
+	brq.EmailSubject = firstNonBlank(tn.EmailSubject, emailSubject)
+	brq.EmailFrom = firstNonBlank(tn.EmailFrom, emailFrom)
+	brq.EmailReplyTo = firstNonBlank(tn.EmailReplyTo, emailReplyTo)
+	brq.AttachResults = tn.AttachResults
+	if err := brq.SendTestNotification(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	fmt.Fprintf(w, "Sent a test notification to %s\n", strings.Join(tn.AlertEmails, ", "))
+}
+
+// handleDeadLetters serves GET /admin/dead-letters?repo=<repo>
+// listing the notifications that couldn't be sent.
+func handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	repo := r.URL.Query().Get("repo")
+	if repo == "" {
+		http.Error(w, "expecting a non-blank repo", http.StatusBadRequest)
+		return
+	}
+	dls, err := newRequest(repo).DeadLetters(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, _ := json.MarshalIndent(dls, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
+
+// handleReplayDeadLetter serves POST /admin/dead-letters/replay?repo=<repo>&id=<id>
+// sending the dead letter again and deleting it once sent.
+func handleReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	repo, id := query.Get("repo"), query.Get("id")
+	if repo == "" || id == "" {
+		http.Error(w, "expecting a non-blank repo and id", http.StatusBadRequest)
+		return
+	}
+	if err := newRequest(repo).ReplayDeadLetter(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	fmt.Fprintf(w, "Replayed dead letter %s\n", id)
+}
+
+const defaultCompactAfterDays = 90
+
+// handleCompact serves POST /admin/compact?repo=<repo>&older_than_days=<n>
+// rolling the repository's runs older than n days, 90 by default, into
+// weekly summaries. It is meant to be invoked periodically e.g. by cron.
+func handleCompact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	repo := query.Get("repo")
+	if repo == "" {
+		http.Error(w, "expecting a non-blank repo", http.StatusBadRequest)
+		return
+	}
+	days := defaultCompactAfterDays
+	if s := query.Get("older_than_days"); s != "" {
+		var err error
+		if days, err = strconv.Atoi(s); err != nil || days < 1 {
+			http.Error(w, "expecting older_than_days to be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	c, err := newRequest(repo).Compact(r.Context(), time.Duration(days)*24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, _ := json.MarshalIndent(c, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
+
+const defaultMaxBaselineAgeDays = 7
+
+// handleCheckFreshness serves POST /admin/check-freshness?repo=<repo>&to=<emails>&max_age_days=<n>
+// alerting the comma separated emails if the repository's baseline wasn't
+// refreshed in n days, 7 by default. It is meant to be invoked periodically.
+func handleCheckFreshness(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	repo := query.Get("repo")
+	if repo == "" {
+		http.Error(w, "expecting a non-blank repo", http.StatusBadRequest)
+		return
+	}
+	days := defaultMaxBaselineAgeDays
+	if s := query.Get("max_age_days"); s != "" {
+		var err error
+		if days, err = strconv.Atoi(s); err != nil || days < 1 {
+			http.Error(w, "expecting max_age_days to be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	brq := newRequest(repo)
+	for _, email := range strings.Split(query.Get("to"), ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			brq.AlertEmails = append(brq.AlertEmails, email)
+		}
+	}
+	f, err := brq.CheckFreshness(r.Context(), time.Duration(days)*24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, _ := json.MarshalIndent(f, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
+
+// handleSendDigest serves POST /admin/send-digest?repo=<repo>&to=<emails>
+// emailing the runs that were routed to the repository's digest since it
+// was last sent, to their alert emails and the comma separated emails.
+// It is meant to be invoked periodically e.g. daily.
+func handleSendDigest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	repo := query.Get("repo")
+	if repo == "" {
+		http.Error(w, "expecting a non-blank repo", http.StatusBadRequest)
+		return
+	}
+
+	brq := newRequest(repo)
+	for _, email := range strings.Split(query.Get("to"), ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			brq.AlertEmails = append(brq.AlertEmails, email)
+		}
+	}
+	entries, err := brq.SendDigest(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, _ := json.MarshalIndent(map[string]interface{}{"sent": len(entries), "entries": entries}, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
+
+// handleFeatureFlags serves the toggles of subsystems: GET /admin/feature-flags
+// lists them, POST /admin/feature-flags?feature=<name>&enabled=true|false&repo=<pattern>
+// enables or disables the feature for the repositories matching the pattern,
+// all if blank, and DELETE with the same feature and repo removes that toggle.
+// The toggles apply to runs starting afterwards, until the server restarts.
+func handleFeatureFlags(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	pattern := firstNonBlank(query.Get("repo"), "*")
+	switch r.Method {
+	case "GET":
+	case "POST":
+		enabled, err := strconv.ParseBool(query.Get("enabled"))
+		if err != nil {
+			http.Error(w, "expecting enabled to be true or false", http.StatusBadRequest)
+			return
+		}
+		if err := featureFlags.Set(pattern, query.Get("feature"), enabled); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Feature %q was set to enabled=%t for %q", query.Get("feature"), enabled, pattern)
+	case "DELETE":
+		if !featureFlags.Unset(pattern, query.Get("feature")) {
+			http.Error(w, fmt.Sprintf("no flag of feature %q for %q", query.Get("feature"), pattern), http.StatusNotFound)
+			return
+		}
+		log.Printf("Feature %q was unset for %q", query.Get("feature"), pattern)
+	default:
+		http.Error(w, "only GET, POST and DELETE are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	blob, _ := json.MarshalIndent(map[string]interface{}{
+		"features": bencher.FeatureNames(),
+		"flags":    featureFlags.Flags(),
+	}, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
+
+// handleFaults responds to GET with the faults left to inject, to POST
+// with any of fail_uploads=<n>, corrupt_baseline_reads=<n> and
+// email_delay=<duration> by arming those faults, and to DELETE by
+// disarming all of them.
+func handleFaults(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch r.Method {
+	case "GET":
+	case "POST":
+		for _, name := range []string{"fail_uploads", "corrupt_baseline_reads"} {
+			if query.Get(name) == "" {
+				continue
+			}
+			n, err := strconv.Atoi(query.Get(name))
+			if err != nil || n < 0 {
+				http.Error(w, fmt.Sprintf("expecting %s to be a count", name), http.StatusBadRequest)
+				return
+			}
+			if name == "fail_uploads" {
+				faults.FailUploads(n)
+			} else {
+				faults.CorruptBaselineReads(n)
+			}
+		}
+		if query.Get("email_delay") != "" {
+			d, err := time.ParseDuration(query.Get("email_delay"))
+			if err != nil || d < 0 {
+				http.Error(w, "expecting email_delay to be a duration e.g. 30s", http.StatusBadRequest)
+				return
+			}
+			faults.DelayEmails(d)
+		}
+		log.Printf("Faults were armed: %s", r.URL.RawQuery)
+	case "DELETE":
+		faults.Reset()
+		log.Printf("Faults were disarmed")
+	default:
+		http.Error(w, "only GET, POST and DELETE are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	blob, _ := json.MarshalIndent(faults.State(), "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
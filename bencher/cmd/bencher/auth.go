@@ -0,0 +1,180 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// role is what a caller may do, each role being allowed what the
+// roles before it are.
+type role int
+
+const (
+	// roleViewer reads runs, comparisons, costs and the dashboard.
+	roleViewer role = iota + 1
+	// roleSubmitter also runs benchmarks, which replace the baselines.
+	roleSubmitter
+	// roleAdmin also deletes and restores runs, which promotes
+	// earlier results to the baselines, and calls the admin endpoints.
+	roleAdmin
+)
+
+var roleNames = map[string]role{
+	"viewer":    roleViewer,
+	"submitter": roleSubmitter,
+	"admin":     roleAdmin,
+}
+
+func parseRole(s string) (role, error) {
+	if rl, ok := roleNames[s]; ok {
+		return rl, nil
+	}
+	return 0, fmt.Errorf("unknown role %q, expecting viewer, submitter or admin", s)
+}
+
+func (rl role) String() string {
+	for name, named := range roleNames {
+		if named == rl {
+			return name
+		}
+	}
+	return "none"
+}
+
+type apiKey struct {
+	key  string
+	role role
+}
+
+// apiKeys are the keys allowed to call the API. If empty
+// and login is disabled, the API is accessible without any key.
+var apiKeys []*apiKey
+
+// publicRead lets anyone read the dashboard, runs and comparisons
+// without an API key, while submitting and deleting runs still need one.
+var publicRead bool
+
+// loadAPIKeys reads the API keys from the file at path, one per line
+// optionally followed by its role, ignoring blank lines and those
+// beginning with "#". Keys without a role are admins', as every key
+// was allowed everything before roles were introduced.
+func loadAPIKeys(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var keys []*apiKey
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		key := &apiKey{key: fields[0], role: roleAdmin}
+		if len(fields) > 1 {
+			if key.role, err = parseRole(fields[1]); err != nil {
+				return fmt.Errorf("Line %q: %v", line, err)
+			}
+		}
+		keys = append(keys, key)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	apiKeys = keys
+	return nil
+}
+
+// apiKeyRole returns the role of key, or 0 if it isn't a valid key.
+func apiKeyRole(key string) role {
+	for _, apiKey := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey.key)) == 1 {
+			return apiKey.role
+		}
+	}
+	return 0
+}
+
+// roleOf returns the role of the valid API key in the header
+// "Authorization: Bearer <key>" or of the session of someone signed
+// in that r bears, or admin if neither API keys nor login are
+// configured, or 0 if r is unauthenticated.
+func roleOf(r *http.Request) role {
+	if len(apiKeys) == 0 && login == nil {
+		return roleAdmin
+	}
+	if key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); key != "" {
+		if rl := apiKeyRole(key); rl != 0 {
+			return rl
+		}
+	}
+	if login != nil {
+		if s := login.sessionOf(r); s != nil {
+			rl, _ := parseRole(s.Role)
+			return rl
+		}
+	}
+	return 0
+}
+
+// withRole only lets through requests of callers with at least the role.
+// People browsing without a session are sent to sign in if they can.
+func withRole(min role, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch rl := roleOf(r); {
+		case rl == 0 && login != nil && r.Method == "GET" && r.Header.Get("Authorization") == "":
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		case rl == 0:
+			http.Error(w, "missing or invalid API key", http.StatusUnauthorized)
+		case rl < min:
+			http.Error(w, fmt.Sprintf("the %s role is required, not %s", min, rl), http.StatusForbidden)
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// readsOnly reports whether r only reads stored results.
+// Comparisons are POSTed but change nothing.
+func readsOnly(r *http.Request) bool {
+	return r.Method == "GET" || r.Method == "HEAD" || r.URL.Path == "/compare"
+}
+
+// withPublicRead lets through requests that only read if the server is
+// in public read mode, and otherwise requires the viewer role to read
+// and the admin role to change runs, e.g. deleting them.
+func withPublicRead(h http.Handler) http.Handler {
+	viewers, admins := withRole(roleViewer, h), withRole(roleAdmin, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case publicRead && readsOnly(r):
+			h.ServeHTTP(w, r)
+		case readsOnly(r):
+			viewers.ServeHTTP(w, r)
+		default:
+			admins.ServeHTTP(w, r)
+		}
+	})
+}
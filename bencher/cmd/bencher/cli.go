@@ -0,0 +1,415 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// errPolicyFailed makes the CLI exit with a non-zero status,
+// for CI, when the gating policy's verdict is "fail".
+var errPolicyFailed = errors.New("the gating policy failed")
+
+// stringsFlag collects the values of a flag given several times.
+type stringsFlag []string
+
+func (sf *stringsFlag) String() string { return strings.Join(*sf, ",") }
+
+func (sf *stringsFlag) Set(value string) error {
+	*sf = append(*sf, value)
+	return nil
+}
+
+// isTerminal reports whether f is a terminal rather than e.g. a CI log.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// comparisonFlags are the flags of the commands that compare results.
+type comparisonFlags struct {
+	comparer, outliers, policyPath string
+	quiet                          bool
+
+	summaryPath, stepSummaryPath string
+}
+
+func newComparisonFlags(fs *flag.FlagSet) *comparisonFlags {
+	cf := new(comparisonFlags)
+	fs.StringVar(&cf.comparer, "comparer", "", `how significant changes are decided: "benchstat", "bootstrap" or a registered comparer; "benchstat" if blank`)
+	fs.StringVar(&cf.outliers, "outliers", "", `which samples to discard before comparing: "keep", "minmax" or "mad"; "keep" if blank`)
+	fs.StringVar(&cf.policyPath, "policy", "", "the path to a gating policy, in place of the repository's .bencherpolicy; a failing verdict exits with status 1")
+	fs.BoolVar(&cf.quiet, "quiet", false, "whether to leave out the progress line and colors e.g. in CI logs")
+	fs.StringVar(&cf.summaryPath, "summary-file", "", "the path of a JSON summary of the regressions, improvements, links and policy verdict to write e.g. summary.json, for CI")
+	fs.StringVar(&cf.stepSummaryPath, "step-summary", os.Getenv("GITHUB_STEP_SUMMARY"), "the path of a file to append a Markdown summary to; the GitHub Actions job's step summary by default")
+	return cf
+}
+
+func (cf *comparisonFlags) apply(brq *bencher.Request) error {
+	brq.Comparer = cf.comparer
+	brq.Outliers = cf.outliers
+	if cf.policyPath != "" {
+		blob, err := ioutil.ReadFile(cf.policyPath)
+		if err != nil {
+			return err
+		}
+		brq.Policy = string(blob)
+	}
+	return nil
+}
+
+// printResult prints the changes of a comparison of repo, and
+// writes its summaries, failing if they failed the gating policy.
+func (cf *comparisonFlags) printResult(repo string, results interface{}, err error) error {
+	res, _ := results.(*bencher.Result)
+	if serr := cf.writeSummaries(bencher.NewSummary(repo, res, err)); serr != nil {
+		log.Printf("Writing the summary: %v", serr)
+	}
+	if err == bencher.ErrNoChanges {
+		fmt.Println("No changes detected!")
+		return nil
+	}
+	if err == bencher.ErrNoBenchmarks {
+		fmt.Println("No benchmarks found!")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if res == nil {
+		blob, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Printf("%s\n", blob)
+		return nil
+	}
+	bencher.WriteSummary(os.Stdout, res, !cf.quiet && isTerminal(os.Stdout))
+	if res.Policy != nil && res.Policy.Severity == bencher.SeverityFail {
+		return errPolicyFailed
+	}
+	return nil
+}
+
+// writeSummaries writes s to the summary files, if requested.
+func (cf *comparisonFlags) writeSummaries(s *bencher.Summary) error {
+	if cf.summaryPath != "" {
+		blob, _ := json.MarshalIndent(s, "", "  ")
+		if err := ioutil.WriteFile(cf.summaryPath, append(blob, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	if cf.stepSummaryPath != "" {
+		// Every step of a job appends to the same step summary.
+		f, err := os.OpenFile(cf.stepSummaryPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		err = s.WriteMarkdown(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	return nil
+}
+
+// runFlags registers the flags of "bencher run", which benchmarks a
+// repository on this machine, stores its results and compares them
+// against the baseline, as POST /benchmark does on the server.
+func runFlags(fs *flag.FlagSet) func(context.Context, []string) error {
+	sc := newStorageConfig(fs)
+	cf := newComparisonFlags(fs)
+	var tags, baselines stringsFlag
+	var vcs, revision, sourceURL, harness, gogc, godebug, seed, emails, baselineRun string
+	var profile, force, snapshot, reviewComments bool
+	var timeBudget time.Duration
+	var pullRequest int
+	fs.Var(&tags, "tag", "a key=value tag of the run e.g. branch=master, given once per tag")
+	fs.Var(&baselines, "baseline", "a label=name of stored results to also compare against e.g. v0.22.0=latest@version=v0.22.0, given once per baseline")
+	fs.StringVar(&baselineRun, "baseline-run", "", `the ID of a stored run to compare against instead of "latest", leaving the baselines as they were`)
+	fs.IntVar(&pullRequest, "pull-request", 0, "the number of the pull request whose push is benchmarked, grouping the run with its others and leaving the baseline as it was; 0 if none")
+	fs.BoolVar(&reviewComments, "review-comments", false, "whether to comment on the regressions of benchmarks declared in files changed by -pull-request, at their functions, with $BENCHER_GITHUB_TOKEN")
+	fs.StringVar(&vcs, "vcs", "", `how the sources are checked out: "gopath", "git", "module" or a registered VCS; "gopath" if blank`)
+	fs.StringVar(&revision, "revision", "", "the commit, branch or tag to check out with -vcs=git, or the version with -vcs=module")
+	fs.StringVar(&sourceURL, "source-url", "", "the URL to clone with -vcs=git, if not https:// followed by the repository")
+	fs.StringVar(&harness, "harness", "", `the harness running the benchmarks: "go", "jmh", "pyperf" or a registered one; that of the repository's .bencherharness if blank`)
+	fs.StringVar(&gogc, "gogc", "", "the GOGC of the benchmarks")
+	fs.StringVar(&godebug, "godebug", "", "the GODEBUG of the benchmarks")
+	fs.StringVar(&seed, "seed", "", "passed to the benchmarks as BENCHER_SEED")
+	fs.BoolVar(&profile, "profile", false, "whether to also capture CPU profiles of every package's benchmarks")
+	fs.BoolVar(&snapshot, "snapshot", false, "whether to archive the workspace for the run to be re-executed later")
+	fs.DurationVar(&timeBudget, "time-budget", 0, "how long the Go benchmarks should take in total, dividing it across packages by their durations in the previous run, or 0 for go test's default -benchtime")
+	fs.BoolVar(&force, "force", false, "whether to benchmark even if the results of the same commit with the same settings are cached")
+	fs.StringVar(&emails, "email", "", "the comma separated addresses to email the report to, or blank not to email it")
+
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if err := sc.setUp(ctx); err != nil {
+			return err
+		}
+		brq := newRequest(args[0])
+		if err := cf.apply(brq); err != nil {
+			return err
+		}
+		brq.Tags = parseTagFilters(tags)
+		for _, baseline := range baselines {
+			i := strings.Index(baseline, "=")
+			if i <= 0 || i == len(baseline)-1 {
+				return fmt.Errorf("expecting -baseline to be label=name, got %q", baseline)
+			}
+			brq.Baselines = append(brq.Baselines, &bencher.ResultSet{Label: baseline[:i], Name: baseline[i+1:]})
+		}
+		brq.BaselineRunID = baselineRun
+		brq.PullRequest = pullRequest
+		brq.ReviewComments = reviewComments
+		brq.VCS, brq.Revision, brq.SourceURL = vcs, revision, sourceURL
+		brq.Harness = harness
+		brq.GOGC, brq.GODEBUG, brq.Seed = gogc, godebug, seed
+		brq.Profile = profile
+		brq.Force = force
+		brq.Snapshot = snapshot
+		brq.TimeBudget = timeBudget
+
+		var progress *bencher.Progress
+		if !cf.quiet && isTerminal(os.Stderr) {
+			progress = bencher.NewProgress(os.Stderr, 0)
+			brq.OnTestEvent = progress.OnTestEvent
+		}
+		var results interface{}
+		var err error
+		if emails != "" {
+			for _, email := range strings.Split(emails, ",") {
+				brq.AlertEmails = append(brq.AlertEmails, strings.TrimSpace(email))
+			}
+			results, err = brq.BenchmarkAndEmail(ctx)
+		} else {
+			results, err = brq.Benchmark(ctx)
+		}
+		if progress != nil {
+			progress.Done()
+		}
+		return cf.printResult(args[0], results, err)
+	}
+}
+
+// compareFlags registers the flags of "bencher compare", which compares
+// the latest stored runs carrying two values of a tag, as POST /compare.
+func compareFlags(fs *flag.FlagSet) func(context.Context, []string) error {
+	sc := newStorageConfig(fs)
+	cf := newComparisonFlags(fs)
+
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 4 {
+			return errUsage
+		}
+		if err := sc.setUp(ctx); err != nil {
+			return err
+		}
+		brq := newRequest(args[0])
+		if err := cf.apply(brq); err != nil {
+			return err
+		}
+		results, err := brq.CompareTags(ctx, args[1], args[2], args[3])
+		return cf.printResult(args[0], results, err)
+	}
+}
+
+// historyFlags registers the flags of "bencher history", which lists the
+// means of a benchmark's metrics over the recent runs, oldest first.
+func historyFlags(fs *flag.FlagSet) func(context.Context, []string) error {
+	sc := newStorageConfig(fs)
+	var goarch string
+	var limit int
+	var asJSON bool
+	fs.StringVar(&goarch, "goarch", "", "the architecture whose results to list, or blank for every one")
+	fs.IntVar(&limit, "limit", 20, "the number of most recent runs to go through")
+	fs.BoolVar(&asJSON, "json", false, "whether to print the history as JSON")
+
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 2 {
+			return errUsage
+		}
+		if err := sc.setUp(ctx); err != nil {
+			return err
+		}
+		points, err := newRequest(args[0]).BenchmarkHistory(ctx, args[1], goarch, limit)
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			blob, _ := json.MarshalIndent(points, "", "  ")
+			fmt.Printf("%s\n", blob)
+			return nil
+		}
+		if len(points) == 0 {
+			return fmt.Errorf("no results of %q in the %d most recent runs", args[1], limit)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		defer tw.Flush()
+		fmt.Fprintln(tw, "start time\trun\tgoarch\tmeans")
+		for _, point := range points {
+			var units []string
+			for unit := range point.Means {
+				units = append(units, unit)
+			}
+			sort.Strings(units)
+			var means []string
+			for _, unit := range units {
+				means = append(means, fmt.Sprintf("%.4g %s", point.Means[unit], unit))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", point.StartTime.Format(time.RFC3339), point.RunID, point.GOARCH, strings.Join(means, ", "))
+		}
+		return nil
+	}
+}
+
+// promoteFlags registers the flags of "bencher promote-baseline", which
+// makes a stored run the baseline that the next runs are compared against.
+func promoteFlags(fs *flag.FlagSet) func(context.Context, []string) error {
+	sc := newStorageConfig(fs)
+
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 2 {
+			return errUsage
+		}
+		if err := sc.setUp(ctx); err != nil {
+			return err
+		}
+		if err := newRequest(args[0]).PromoteRun(ctx, args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Run %s is the baseline of %s\n", args[1], args[0])
+		return nil
+	}
+}
+
+// baselineFlags registers the flags of "bencher baseline", which operates
+// on a repository's baseline: downloading it, replacing it with an edited
+// copy, dropping benchmarks from it or rolling it back to an earlier run.
+func baselineFlags(fs *flag.FlagSet) func(context.Context, []string) error {
+	sc := newStorageConfig(fs)
+	var name, out string
+	fs.StringVar(&name, "name", "", `the baseline operated on, e.g. "latest@branch=master", or blank for the one that runs on this platform are compared against`)
+	fs.StringVar(&out, "o", "", "the file to download the baseline to, or blank for stdout")
+
+	return func(ctx context.Context, args []string) error {
+		if len(args) < 2 {
+			return errUsage
+		}
+		action, repo, args := args[0], args[1], args[2:]
+		switch {
+		case action == "download" && len(args) == 0:
+		case action == "upload" && len(args) == 1:
+		case action == "drop" && len(args) > 0:
+		case action == "rollback" && len(args) <= 1:
+		default:
+			return errUsage
+		}
+		if err := sc.setUp(ctx); err != nil {
+			return err
+		}
+		brq := newRequest(repo)
+		baseline := "the baseline"
+		if name != "" {
+			baseline = "baseline " + name
+		}
+
+		switch action {
+		case "download":
+			blob, err := brq.DownloadBaseline(ctx, name)
+			if err != nil {
+				return err
+			}
+			if out == "" {
+				_, err = os.Stdout.Write(blob)
+				return err
+			}
+			return ioutil.WriteFile(out, blob, 0644)
+
+		case "upload":
+			blob, err := ioutil.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			backup, err := brq.ReplaceBaseline(ctx, name, blob)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Replaced %s of %s, the previous one is kept as %s\n", baseline, repo, backup)
+
+		case "drop":
+			dropped, err := brq.DropFromBaseline(ctx, name, args)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Dropped %d results from %s of %s\n", dropped, baseline, repo)
+
+		case "rollback":
+			if len(args) == 1 {
+				if err := brq.PromoteRun(ctx, args[0]); err != nil {
+					return err
+				}
+				fmt.Printf("Rolled the baseline of %s back to run %s\n", repo, args[0])
+				return nil
+			}
+			run, err := brq.RollbackBaseline(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Rolled the baseline of %s back to run %s of %s\n", repo, run.ID, run.StartTime.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
+
+// gcFlags registers the flags of "bencher gc", which compacts old runs
+// into weekly summaries as POST /admin/compact does.
+func gcFlags(fs *flag.FlagSet) func(context.Context, []string) error {
+	sc := newStorageConfig(fs)
+	var days int
+	fs.IntVar(&days, "older-than-days", defaultCompactAfterDays, "the age in days of the runs to compact")
+
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if days < 1 {
+			return fmt.Errorf("expecting -older-than-days to be a positive integer")
+		}
+		if err := sc.setUp(ctx); err != nil {
+			return err
+		}
+		c, err := newRequest(args[0]).Compact(ctx, time.Duration(days)*24*time.Hour)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Compacted %d runs into %d weeks, deleting %d objects of %d bytes\n", c.Runs, len(c.Weeks), c.DeletedObjects, c.FreedBytes)
+		return nil
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/orijtech/infra"
+)
+
+const (
+	// maxInfraClientAge bounds how long an infra client, and
+	// the credentials it obtained when created, are used.
+	maxInfraClientAge = 30 * time.Minute
+	// infraCheckInterval is how often the client's health is checked.
+	infraCheckInterval = 5 * time.Minute
+)
+
+// infraClients hands out the shared infra client, recreating it once it
+// is too old or fails its health check, so that expired credentials are
+// refreshed instead of turning into opaque upload failures.
+type infraClients struct {
+	mu        sync.Mutex
+	client    *infra.Client
+	createdAt time.Time
+	checkedAt time.Time
+	lastErr   error
+	// disabled is set if there is no infra client, e.g. with an embedded store.
+	disabled bool
+}
+
+var infraClientCache = new(infraClients)
+
+// get returns the infra client, with the error of its last health
+// check if it is unhealthy, in which case it may still be used.
+func (ic *infraClients) get() (*infra.Client, error) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	if ic.disabled {
+		return nil, nil
+	}
+	now := time.Now()
+	if ic.client == nil || now.Sub(ic.createdAt) > maxInfraClientAge {
+		if err := ic.recreate(now); err != nil {
+			return ic.client, err
+		}
+	}
+	if now.Sub(ic.checkedAt) < infraCheckInterval {
+		return ic.client, ic.lastErr
+	}
+	if ic.check(now) != nil {
+		// The credentials might have expired, hence try afresh once.
+		if err := ic.recreate(now); err != nil {
+			return ic.client, err
+		}
+		ic.check(now)
+	}
+	return ic.client, ic.lastErr
+}
+
+// disable makes get return no client, without ever creating one.
+func (ic *infraClients) disable() {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	ic.disabled = true
+}
+
+func (ic *infraClients) recreate(now time.Time) error {
+	client, err := infra.NewDefaultClient()
+	if err != nil {
+		ic.lastErr = fmt.Errorf("Creating the infra client: %v", err)
+		return ic.lastErr
+	}
+	ic.client, ic.createdAt, ic.checkedAt = client, now, time.Time{}
+	return nil
+}
+
+// check verifies that the client can access the bucket, as it does
+// before every upload, and records the outcome.
+func (ic *infraClients) check(now time.Time) error {
+	ic.checkedAt = now
+	bc := &infra.BucketCheck{Project: gcsProject, Bucket: gcsBucket}
+	if _, err := ic.client.EnsureBucketExists(bc); err != nil {
+		ic.lastErr = fmt.Errorf("Checking access to bucket %q: %v", gcsBucket, err)
+	} else {
+		ic.lastErr = nil
+	}
+	return ic.lastErr
+}
+
+// handleAdminHealth serves the health of the infra client,
+// checking it right away if it wasn't checked recently.
+func handleAdminHealth(w http.ResponseWriter, r *http.Request) {
+	_, err := infraClientCache.get()
+
+	infraClientCache.mu.Lock()
+	status := map[string]interface{}{
+		"healthy":    err == nil,
+		"created_at": infraClientCache.createdAt,
+		"checked_at": infraClientCache.checkedAt,
+	}
+	infraClientCache.mu.Unlock()
+	if err != nil {
+		status["error"] = err.Error()
+	}
+
+	blob, _ := json.MarshalIndent(status, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(blob)
+}
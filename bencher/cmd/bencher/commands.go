@@ -0,0 +1,160 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// command is a subcommand of bencher e.g. "bencher run".
+type command struct {
+	name string
+	// args describes the arguments following the flags, if any.
+	args    string
+	summary string
+	// interruptible if set, has an interrupt cancel the command's
+	// context, e.g. to remove what it checked out, instead of exiting.
+	interruptible bool
+	// flags registers the command's flags on fs, returning
+	// the function that runs it with the remaining arguments.
+	flags func(fs *flag.FlagSet) func(ctx context.Context, args []string) error
+}
+
+// errUsage is returned by commands given the wrong arguments.
+var errUsage = errors.New("invalid arguments")
+
+// commands are bencher's subcommands, in the order listed by "bencher help".
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{name: "serve", summary: "serve the API, the dashboard and the admin endpoints", flags: serveFlags},
+		{name: "run", interruptible: true, args: "<repo>", summary: "benchmark a repository and compare it against its baseline", flags: runFlags},
+		{name: "compare", interruptible: true, args: "<repo> <tag> <before> <after>", summary: "compare the latest runs of a repository carrying two values of a tag", flags: compareFlags},
+		{name: "watch", interruptible: true, args: "[<dir>]", summary: "re-run the benchmarks of a working tree's packages as they are saved against a pinned baseline", flags: watchFlags},
+		{name: "soak", interruptible: true, args: "<repo> <benchmark>", summary: "run a benchmark continuously, sampling it to flag degradations over time e.g. leaks", flags: soakFlags},
+		{name: "history", interruptible: true, args: "<repo> <benchmark>", summary: "list the means of a benchmark over the recent runs", flags: historyFlags},
+		{name: "promote-baseline", interruptible: true, args: "<repo> <run-id>", summary: "make a stored run the baseline of its repository and tags", flags: promoteFlags},
+		{name: "baseline", interruptible: true, args: "download|upload|drop|rollback <repo> [<file>|<pattern>...|<run-id>]", summary: "download, replace, edit or roll back the baseline of a repository", flags: baselineFlags},
+		{name: "publish-site", interruptible: true, args: "[<repo>...]", summary: "render the history of repositories, every one by default, into a static site", flags: publishSiteFlags},
+		{name: "import", interruptible: true, args: "<repo> <dir>|<tarball>", summary: "import historical results kept outside of bencher as runs", flags: importFlags},
+		{name: "gc", interruptible: true, args: "<repo>", summary: "compact old runs into weekly summaries, freeing their storage", flags: gcFlags},
+		{name: "tui", summary: "browse the repositories, runs and comparisons of a server from the terminal", flags: tuiFlags},
+		{name: "completion", args: "bash|zsh", summary: "print the shell completion script", flags: completionFlags},
+		{name: "help", args: "[command]", summary: "describe a command", flags: helpFlags},
+	}
+}
+
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// runCommand runs the command named by args[0] with the rest of args,
+// returning the process's exit code. Without a command, e.g. when only
+// flags are given as before subcommands existed, bencher serves.
+func runCommand(args []string) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd := lookupCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "bencher: unknown command %q\n\n", name)
+		usage(os.Stderr)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("bencher "+cmd.name, flag.ExitOnError)
+	run := cmd.flags(fs)
+	fs.Usage = func() { commandUsage(fs.Output(), cmd, fs) }
+	_ = fs.Parse(args)
+	if err := setFlagsFromEnv(fs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cmd.interruptible {
+		interrupted := make(chan os.Signal, 1)
+		signal.Notify(interrupted, os.Interrupt)
+		defer signal.Stop(interrupted)
+		// The next interrupt exits right away, as if it weren't handled.
+		go func() {
+			if _, ok := <-interrupted; ok {
+				cancel()
+				signal.Stop(interrupted)
+			}
+		}()
+	}
+
+	switch err := run(ctx, fs.Args()); {
+	case err == errUsage:
+		fs.Usage()
+		return 2
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "bencher %s: %v\n", cmd.name, err)
+		return 1
+	}
+	return 0
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: bencher <command> [flags] [arguments]\n\nThe commands are:\n\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-18s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nWithout a command, bencher serves. Use \"bencher help <command>\" for its flags.\n")
+}
+
+func commandUsage(w io.Writer, cmd *command, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage: bencher %s [flags] %s\n\n%s.\n", cmd.name, cmd.args, strings.ToUpper(cmd.summary[:1])+cmd.summary[1:])
+	hasFlags := false
+	fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+	if hasFlags {
+		fmt.Fprintf(w, "\nFlags, also set by BENCHER_<FLAG> environment variables:\n")
+		fs.SetOutput(w)
+		fs.PrintDefaults()
+	}
+}
+
+func helpFlags(fs *flag.FlagSet) func(context.Context, []string) error {
+	return func(ctx context.Context, args []string) error {
+		if len(args) == 0 {
+			usage(os.Stdout)
+			return nil
+		}
+		cmd := lookupCommand(args[0])
+		if len(args) > 1 || cmd == nil {
+			return errUsage
+		}
+		cfs := flag.NewFlagSet("bencher "+cmd.name, flag.ContinueOnError)
+		cmd.flags(cfs)
+		commandUsage(os.Stdout, cmd, cfs)
+		return nil
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// completionFlags registers the flags of "bencher completion", which
+// prints a completion script generated from the commands and their flags,
+// e.g. to be loaded with `source <(bencher completion bash)`.
+func completionFlags(fs *flag.FlagSet) func(context.Context, []string) error {
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		switch args[0] {
+		case "bash":
+			writeBashCompletion(os.Stdout)
+		case "zsh":
+			writeZshCompletion(os.Stdout)
+		default:
+			return errUsage
+		}
+		return nil
+	}
+}
+
+// commandFlags returns the flags of cmd, in lexical order.
+func commandFlags(cmd *command) []*flag.Flag {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	cmd.flags(fs)
+	var flags []*flag.Flag
+	fs.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, f)
+	})
+	return flags
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	bf, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && bf.IsBoolFlag()
+}
+
+func writeBashCompletion(w io.Writer) {
+	var names []string
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	fmt.Fprintf(w, `_bencher() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	if [ "$COMP_CWORD" -eq 1 ]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return
+	fi
+	case "${COMP_WORDS[1]}" in
+`, strings.Join(names, " "))
+	for _, cmd := range commands {
+		var words []string
+		switch cmd.name {
+		case "completion":
+			words = []string{"bash", "zsh"}
+		case "help":
+			words = names
+		default:
+			for _, f := range commandFlags(cmd) {
+				words = append(words, "-"+f.Name)
+			}
+		}
+		fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", cmd.name, strings.Join(words, " "))
+	}
+	fmt.Fprintf(w, "\tesac\n}\ncomplete -o default -F _bencher bencher\n")
+}
+
+// zshQuote escapes s for a single quoted _arguments spec.
+var zshQuote = strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`)
+
+func writeZshCompletion(w io.Writer) {
+	fmt.Fprintf(w, "#compdef bencher\n\n_bencher() {\n\tlocal -a commands\n\tcommands=(\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "\t\t'%s:%s'\n", cmd.name, zshQuote.Replace(cmd.summary))
+	}
+	fmt.Fprintf(w, "\t)\n\tif (( CURRENT == 2 )); then\n\t\t_describe 'command' commands\n\t\treturn\n\tfi\n\tcase $words[2] in\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "\t%s)\n", cmd.name)
+		switch cmd.name {
+		case "completion":
+			fmt.Fprintf(w, "\t\t_values 'shell' bash zsh\n")
+		case "help":
+			fmt.Fprintf(w, "\t\t_describe 'command' commands\n")
+		default:
+			fmt.Fprintf(w, "\t\t_arguments -S \\\n")
+			for _, f := range commandFlags(cmd) {
+				spec := fmt.Sprintf("-%s[%s]", f.Name, zshQuote.Replace(f.Usage))
+				if !isBoolFlag(f) {
+					action := ""
+					if strings.Contains(f.Usage, "path") || strings.Contains(f.Usage, "directory") {
+						action = "_files"
+					}
+					spec += fmt.Sprintf(":%s:%s", f.Name, action)
+				}
+				fmt.Fprintf(w, "\t\t\t'%s' \\\n", spec)
+			}
+			fmt.Fprintf(w, "\t\t\t'*::argument:_default'\n")
+		}
+		fmt.Fprintf(w, "\t\t;;\n")
+	}
+	fmt.Fprintf(w, "\tesac\n}\n\ncompdef _bencher bencher\n")
+}
@@ -0,0 +1,109 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/storage/v1"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// storageConfig holds the flags shared by the commands that store or read
+// results, or run benchmarks, and sets up the clients they configure.
+type storageConfig struct {
+	encryptionKeyPath string
+	embeddedStore     string
+	network           *bencher.NetworkConfig
+	creds             *credentialsConfig
+}
+
+func newStorageConfig(fs *flag.FlagSet) *storageConfig {
+	sc := &storageConfig{
+		network: new(bencher.NetworkConfig),
+		creds:   &credentialsConfig{mode: credentialsADC},
+	}
+	fs.StringVar(&gcsBucket, "bucket", "census-demos", "the GCS bucket to use")
+	fs.StringVar(&gcsProject, "project", "census-demos", "the GCS project to use")
+	fs.StringVar(&appEmail, "app-email", "emmanuel@orijtech.com", "the email for the app")
+	fs.StringVar(&timezone, "timezone", "UTC", "the default IANA time zone for report timestamps, storage prefixes being in UTC")
+	fs.StringVar(&locale, "locale", "", "the default BCP 47 language tag by whose conventions numbers in HTML reports are formatted")
+	fs.StringVar(&kmsKeyName, "kms-key", "", "the Cloud KMS key with which GCS encrypts uploaded artifacts at rest")
+	fs.StringVar(&sc.encryptionKeyPath, "encryption-key", "", "the path to a file with a base64 encoded 32 byte key with which artifacts are encrypted before uploading")
+	fs.StringVar(&sc.network.ProxyURL, "proxy", "", "the HTTP or SOCKS5 proxy for all outbound connections e.g. socks5://proxy:1080")
+	fs.StringVar(&sc.network.CAFile, "ca-file", "", "the path to a PEM bundle of certificate authorities to trust in addition to the system's")
+	fs.StringVar(&runAs, "run-as", "", "the unprivileged user as whom benchmarks run, with a private HOME, GOPATH and GOCACHE; requires running as root")
+	fs.StringVar(&sc.creds.mode, "credentials", sc.creds.mode, `how to authenticate to GCS: "adc" for application default credentials, "key-file" for -credentials-file or "workload-identity" for the metadata server's`)
+	fs.StringVar(&sc.creds.file, "credentials-file", "", "the path to a service account key, with -credentials=key-file")
+	fs.StringVar(&sc.embeddedStore, "embedded-store", "", "the data file of an embedded store used in place of GCS, e.g. bencher.db for a single binary deployment without any external dependency")
+	fs.StringVar(&cacheDir, "cache-dir", "", "the directory in which to cache downloaded baselines by generation, or blank not to cache them")
+	return sc
+}
+
+// setUp configures outbound connections, loads the encryption key and
+// connects to storage, failing if the credentials can't be used.
+func (sc *storageConfig) setUp(ctx context.Context) error {
+	transport, err := sc.network.Transport()
+	if err != nil {
+		return fmt.Errorf("Configuring outbound connections: %v", err)
+	}
+	// Clients that can't be configured, such as infra's, use the default.
+	http.DefaultTransport = transport
+	httpClient = &http.Client{Transport: transport}
+	childEnv = sc.network.Env()
+
+	if sc.encryptionKeyPath != "" {
+		if encryptionKey, err = loadEncryptionKey(sc.encryptionKeyPath); err != nil {
+			return fmt.Errorf("Loading the encryption key: %v", err)
+		}
+	}
+
+	if sc.embeddedStore != "" {
+		es, err := bencher.OpenEmbeddedStore(sc.embeddedStore)
+		if err != nil {
+			return fmt.Errorf("Opening the embedded store: %v", err)
+		}
+		// Every change is durable once stored, hence the store is left open until exiting.
+		storageService = es.Service()
+		infraClientCache.disable()
+		return nil
+	}
+
+	oauth2Ctx := context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+	credentials, err := sc.creds.find(oauth2Ctx)
+	if err != nil {
+		return fmt.Errorf("Authenticating to GCS: %v", err)
+	}
+	credentialsMode = sc.creds.mode
+
+	// Set the infra client, failing early if it can't be created.
+	if _, err := infraClientCache.get(); err != nil {
+		if infraClientCache.client == nil {
+			return fmt.Errorf("NewDefaultClient: %v", err)
+		}
+		log.Printf("The infra client is unhealthy: %v", err)
+	}
+	gcpClient = oauth2.NewClient(oauth2Ctx, credentials.TokenSource)
+	if storageService, err = storage.New(gcpClient); err != nil {
+		return fmt.Errorf("Creating the storage service: %v", err)
+	}
+	return nil
+}
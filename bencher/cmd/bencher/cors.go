@@ -0,0 +1,73 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsConfig configures Cross-Origin Resource Sharing so that
+// dashboards hosted elsewhere can call the API from browsers.
+type corsConfig struct {
+	// origins are the allowed origins e.g. "https://dash.example.org",
+	// or "*" for any. If empty, cross-origin requests aren't allowed.
+	origins []string
+	methods string
+	headers string
+}
+
+func (cc *corsConfig) allowedOrigin(origin string) string {
+	for _, allowed := range cc.origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return allowed
+		}
+	}
+	return ""
+}
+
+// withCORS handles preflight requests and annotates responses to
+// cross-origin requests from allowed origins. Preflight requests
+// are answered before authentication since browsers send them
+// without credentials.
+func withCORS(cc *corsConfig, h http.Handler) http.Handler {
+	if len(cc.origins) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := cc.allowedOrigin(origin)
+		if origin == "" || allowed == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		hdr := w.Header()
+		hdr.Add("Vary", "Origin")
+		if allowed == "*" {
+			hdr.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			hdr.Set("Access-Control-Allow-Origin", origin)
+		}
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			hdr.Set("Access-Control-Allow-Methods", cc.methods)
+			hdr.Set("Access-Control-Allow-Headers", cc.headers)
+			hdr.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,92 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// handleCosts serves GET /costs?repo=<repo>&month=<2006-01>, the
+// estimated cost of the repository's runs in the month, this one
+// if unset, in the server's time zone.
+func handleCosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	repo := query.Get("repo")
+	if repo == "" {
+		http.Error(w, "expecting a non-blank repo", http.StatusBadRequest)
+		return
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	month := time.Now().In(loc)
+	if m := query.Get("month"); m != "" {
+		if month, err = time.ParseInLocation("2006-01", m, loc); err != nil {
+			http.Error(w, "invalid month, expecting e.g. 2018-05: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	summary, err := newRequest(repo).MonthlyCost(r.Context(), month)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, _ := json.Marshal(summary)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
+
+// handleQuota serves GET /quota?repo=<repo>, the machine time used this
+// month, in the server's time zone, under the repository's quota.
+func handleQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	repo := r.URL.Query().Get("repo")
+	if repo == "" {
+		http.Error(w, "expecting a non-blank repo", http.StatusBadRequest)
+		return
+	}
+	brq := newRequest(repo)
+	quota := brq.Quota()
+	if quota == nil {
+		http.Error(w, "no quota applies to "+repo, http.StatusNotFound)
+		return
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	usage, err := brq.QuotaUsage(r.Context(), quota, time.Now().In(loc))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, _ := json.Marshal(usage)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
@@ -0,0 +1,93 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/storage/v1"
+)
+
+// The values of -credentials.
+const (
+	// credentialsADC finds application default credentials, i.e. the file
+	// named by GOOGLE_APPLICATION_CREDENTIALS, gcloud's user credentials,
+	// or else the metadata server's.
+	credentialsADC = "adc"
+	// credentialsKeyFile uses the service account key in -credentials-file.
+	credentialsKeyFile = "key-file"
+	// credentialsWorkloadIdentity uses the service account bound to the
+	// workload by the metadata server e.g. with GKE Workload Identity.
+	credentialsWorkloadIdentity = "workload-identity"
+)
+
+const credentialsEnvVar = "GOOGLE_APPLICATION_CREDENTIALS"
+
+type credentialsConfig struct {
+	mode string
+	file string
+}
+
+// find resolves the configured credentials and obtains a token with them,
+// so that missing or unusable credentials fail at startup rather than at
+// the first upload. The infra client finds application default credentials
+// on its own, hence the environment is set up for it to find the same.
+func (cc *credentialsConfig) find(ctx context.Context) (*google.Credentials, error) {
+	switch cc.mode {
+	case credentialsADC:
+		if cc.file != "" {
+			return nil, fmt.Errorf("-credentials-file requires -credentials=%s", credentialsKeyFile)
+		}
+
+	case credentialsKeyFile:
+		if cc.file == "" {
+			return nil, fmt.Errorf("-credentials=%s requires -credentials-file", credentialsKeyFile)
+		}
+		if _, err := os.Stat(cc.file); err != nil {
+			return nil, fmt.Errorf("Reading the service account key: %v", err)
+		}
+		if err := os.Setenv(credentialsEnvVar, cc.file); err != nil {
+			return nil, err
+		}
+
+	case credentialsWorkloadIdentity:
+		if cc.file != "" {
+			return nil, fmt.Errorf("-credentials-file requires -credentials=%s", credentialsKeyFile)
+		}
+		// Otherwise a key file would take precedence over the metadata server.
+		if err := os.Unsetenv(credentialsEnvVar); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown -credentials %q, expecting %q, %q or %q",
+			cc.mode, credentialsADC, credentialsKeyFile, credentialsWorkloadIdentity)
+	}
+
+	creds, err := google.FindDefaultCredentials(ctx, storage.DevstorageFullControlScope)
+	if err != nil {
+		return nil, fmt.Errorf("Finding %s credentials: %v", cc.mode, err)
+	}
+	if cc.mode == credentialsWorkloadIdentity && len(creds.JSON) > 0 {
+		return nil, fmt.Errorf("found credentials in a file instead of the metadata server's, see `gcloud auth application-default revoke`")
+	}
+	if _, err := creds.TokenSource.Token(); err != nil {
+		return nil, fmt.Errorf("Obtaining a token with %s credentials: %v", cc.mode, err)
+	}
+	return creds, nil
+}
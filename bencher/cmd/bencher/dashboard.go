@@ -0,0 +1,185 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+const (
+	chartWidth  = 720
+	chartHeight = 240
+)
+
+type chartPoint struct {
+	X, Y  float64
+	Label string
+}
+
+type chart struct {
+	Unit     string
+	GOARCH   string
+	Min, Max float64
+	Points   []*chartPoint
+	Polyline string
+}
+
+// newCharts lays out a chart per unit and architecture of the history.
+func newCharts(history []*bencher.HistoryPoint) []*chart {
+	byUnit := make(map[string]*chart)
+	// Points of the same run, on different architectures, share their x.
+	runs := 0
+	for i, hp := range history {
+		if i > 0 && hp.RunID != history[i-1].RunID {
+			runs++
+		}
+		for unit, mean := range hp.Means {
+			key := unit + " " + hp.GOARCH
+			c, ok := byUnit[key]
+			if !ok {
+				c = &chart{Unit: unit, GOARCH: hp.GOARCH, Min: mean, Max: mean}
+				byUnit[key] = c
+			}
+			if mean < c.Min {
+				c.Min = mean
+			}
+			if mean > c.Max {
+				c.Max = mean
+			}
+			c.Points = append(c.Points, &chartPoint{
+				X:     float64(runs),
+				Y:     mean,
+				Label: fmt.Sprintf("%s: %.4g %s", hp.StartTime.Format("2006-01-02 15:04"), mean, unit),
+			})
+		}
+	}
+
+	var charts []*chart
+	for _, c := range byUnit {
+		span := c.Max - c.Min
+		if span == 0 {
+			span = 1
+		}
+		xs := float64(runs)
+		if xs == 0 {
+			xs = 1
+		}
+		var coords []string
+		for _, p := range c.Points {
+			p.X = 10 + p.X/xs*(chartWidth-20)
+			p.Y = chartHeight - 10 - (p.Y-c.Min)/span*(chartHeight-20)
+			coords = append(coords, fmt.Sprintf("%.1f,%.1f", p.X, p.Y))
+		}
+		c.Polyline = strings.Join(coords, " ")
+		charts = append(charts, c)
+	}
+	sort.Slice(charts, func(i, j int) bool {
+		if charts[i].Unit != charts[j].Unit {
+			return charts[i].Unit < charts[j].Unit
+		}
+		return charts[i].GOARCH < charts[j].GOARCH
+	})
+	return charts
+}
+
+// handleDashboard serves GET /dashboard/<repo>/bench/<benchmark>?limit=<n>&goarch=<arch>
+// charting the benchmark's history, GET /dashboard/<repo>/pull/<number>
+// showing how a pull request's changes evolved across its pushes, and
+// GET /dashboard/<repo> showing the repository's health.
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	// Repositories contain slashes, hence the last "/bench/" separates the name.
+	rest := strings.TrimPrefix(r.URL.Path, "/dashboard/")
+	if j := strings.LastIndex(rest, "/pull/"); j > 0 && !strings.Contains(rest, "/bench/") {
+		handlePullRequestPage(w, r, rest[:j], rest[j+len("/pull/"):])
+		return
+	}
+	i := strings.LastIndex(rest, "/bench/")
+	if i < 0 && rest != "" {
+		handleHealthPage(w, r, strings.TrimSuffix(rest, "/"))
+		return
+	}
+	if i <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	repo := rest[:i]
+	name, err := url.PathUnescape(rest[i+len("/bench/"):])
+	if err != nil || name == "" {
+		http.Error(w, "invalid benchmark name", http.StatusBadRequest)
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = 50
+	}
+
+	goarch := r.URL.Query().Get("goarch")
+	history, err := newRequest(repo).BenchmarkHistory(r.Context(), name, goarch, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Repo":      repo,
+		"Benchmark": name,
+		"Runs":      len(history),
+		"Charts":    newCharts(history),
+		"Width":     chartWidth,
+		"Height":    chartHeight,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := chartTmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var chartTmpl = template.Must(template.New("chart").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Benchmark}} in {{.Repo}}</title>
+<style>
+body { font-family: sans-serif; }
+svg { border: 1px solid #ddd; margin-bottom: 1em; }
+polyline { fill: none; stroke: #264653; stroke-width: 2; }
+circle { fill: #e76f51; }
+</style>
+</head>
+<body>
+<h2>{{.Benchmark}}</h2>
+<p>{{.Repo}}, the last {{.Runs}} runs in which it ran, oldest first.</p>
+{{range .Charts}}
+<h3>{{.Unit}}{{with .GOARCH}} on {{.}}{{end}}</h3>
+<p>min {{printf "%.4g" .Min}}, max {{printf "%.4g" .Max}}</p>
+<svg width="{{$.Width}}" height="{{$.Height}}">
+<polyline points="{{.Polyline}}" />
+{{range .Points}}<circle cx="{{printf "%.1f" .X}}" cy="{{printf "%.1f" .Y}}" r="3"><title>{{.Label}}</title></circle>
+{{end}}
+</svg>
+{{else}}
+<p>No runs of this benchmark were found.</p>
+{{end}}
+</body>
+</html>
+`))
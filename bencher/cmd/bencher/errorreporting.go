@@ -0,0 +1,88 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"google.golang.org/api/clouderrorreporting/v1beta1"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// panicReportTimeout bounds how long reporting a panic may take.
+const panicReportTimeout = 10 * time.Second
+
+// setUpErrorReporting configures where panics and failed runs are
+// reported: "stackdriver", "sentry" or nowhere besides the logs if blank.
+func setUpErrorReporting(kind string) error {
+	switch kind {
+	case "":
+		return nil
+	case "stackdriver":
+		es, err := clouderrorreporting.New(gcpClient)
+		if err != nil {
+			return fmt.Errorf("Creating the error reporting service: %v", err)
+		}
+		errorReporter = bencher.StackdriverReporter(es, gcsProject, serviceName)
+	case "sentry":
+		if sentryDSN == "" {
+			return fmt.Errorf("expecting BENCHER_SENTRY_DSN to be set with -error-reporting=sentry")
+		}
+		er, err := bencher.SentryReporter(sentryDSN, httpClient)
+		if err != nil {
+			return err
+		}
+		errorReporter = er
+	default:
+		return fmt.Errorf(`unknown -error-reporting %q, expecting "stackdriver" or "sentry"`, kind)
+	}
+	log.Printf("Reporting panics and failed runs to %s", kind)
+	return nil
+}
+
+// withPanicReporting reports the panics of h, if errors are reported,
+// before letting them propagate to the server as they otherwise would.
+func withPanicReporting(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if errorReporter != nil && p != http.ErrAbortHandler {
+				er := &bencher.ErrorReport{
+					Err:         fmt.Errorf("panic serving %s: %v", r.URL.Path, p),
+					Repo:        r.URL.Query().Get("repo"),
+					Stack:       debug.Stack(),
+					HTTPRequest: r,
+				}
+				// The request's context may be done by the time it's reported.
+				ctx, cancel := context.WithTimeout(context.Background(), panicReportTimeout)
+				if err := errorReporter.ReportError(ctx, er); err != nil {
+					log.Printf("Reporting a panic: %v", err)
+				}
+				cancel()
+			}
+			panic(p)
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
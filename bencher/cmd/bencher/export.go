@@ -0,0 +1,93 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// anonymizeKey keys the aliases of exported results. Unless loaded from
+// -anonymize-key, it is random, hence aliases change with restarts.
+var anonymizeKey []byte
+
+func setUpAnonymizeKey(path string) (err error) {
+	if path != "" {
+		if anonymizeKey, err = loadEncryptionKey(path); err != nil {
+			return fmt.Errorf("Loading the anonymize key: %v", err)
+		}
+		return nil
+	}
+	anonymizeKey = make([]byte, 32)
+	_, err = rand.Read(anonymizeKey)
+	return err
+}
+
+// handleRunExport serves GET /runs/<run-id>/export?repo=<repo>&format=json|csv|html|text&alias=<name>=<alias>
+// with the run's comparison against the run before it, its repository,
+// packages, tags, email addresses, URLs and paths replaced by aliases, so
+// that it can be shared externally. Every alias parameter replaces the
+// hashed alias of a name with a chosen one.
+func handleRunExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	runID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/runs/"), "/export")
+	repo := query.Get("repo")
+	if repo == "" || runID == "" {
+		http.Error(w, "expecting a non-blank repo and run", http.StatusBadRequest)
+		return
+	}
+	a := &bencher.Anonymizer{Key: anonymizeKey, Aliases: make(map[string]string)}
+	for _, pair := range query["alias"] {
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 || i == len(pair)-1 {
+			http.Error(w, fmt.Sprintf("invalid alias %q, expecting <name>=<alias>", pair), http.StatusBadRequest)
+			return
+		}
+		a.Aliases[pair[:i]] = pair[i+1:]
+	}
+
+	res, err := newRequest(repo).ExportRun(r.Context(), runID, a)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch query.Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		_ = res.WriteCSV(w)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<!DOCTYPE html>\n<title>Benchmarks run at %s</title>\n%s", html.EscapeString(res.RunAt), res.HTMLBenchmarks)
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = io.WriteString(w, res.Benchmarks)
+	default:
+		http.Error(w, "expecting format to be json, csv, html or text", http.StatusBadRequest)
+	}
+}
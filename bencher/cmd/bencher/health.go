@@ -0,0 +1,110 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+const defaultHealthWindow = 20
+
+func healthScore(r *http.Request, repo string) (*bencher.Health, error) {
+	query := r.URL.Query()
+	window, _ := strconv.Atoi(query.Get("window"))
+	if window <= 0 {
+		window = defaultHealthWindow
+	}
+	brq := newRequest(repo)
+	brq.CriticalBenchmarks = query["critical"]
+	return brq.HealthScore(r.Context(), window)
+}
+
+// handleHealthScore serves GET /health-score?repo=<repo>&window=<n>&critical=<benchmark>
+func handleHealthScore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	repo := r.URL.Query().Get("repo")
+	if repo == "" {
+		http.Error(w, "expecting a non-blank repo", http.StatusBadRequest)
+		return
+	}
+
+	h, err := healthScore(r, repo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, _ := json.Marshal(h)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
+
+func handleHealthPage(w http.ResponseWriter, r *http.Request, repo string) {
+	h, err := healthScore(r, repo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := healthTmpl.Execute(w, h); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var healthTmpl = template.Must(template.New("health").Funcs(template.FuncMap{
+	"pct":        func(f float64) float64 { return 100 * f },
+	"pathEscape": url.PathEscape,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Benchmarks health of {{.Repo}}</title>
+<style>
+body { font-family: sans-serif; }
+.score { font-size: 3em; }
+td { padding: 2px 8px; }
+</style>
+</head>
+<body>
+<h2>{{.Repo}}</h2>
+<p class="score">{{printf "%.0f" .Score}}/100</p>
+<p>Over the last {{.Runs}} runs, from {{.From.Format "2006-01-02"}} to {{.To.Format "2006-01-02"}}.</p>
+<table>
+<tr><td>Stable benchmarks</td><td>{{printf "%.1f" (pct .Stable)}}% of {{.Benchmarks}}</td></tr>
+<tr><td>Mean variation</td><td>{{printf "%.2f" (pct .MeanVariation)}}%</td></tr>
+<tr><td>Critical benchmarks present</td><td>{{printf "%.1f" (pct .CriticalCoverage)}}%</td></tr>
+</table>
+{{with .MissingCritical}}
+<h3>Missing critical benchmarks</h3>
+<ul>{{range .}}<li>{{.}}</li>{{end}}</ul>
+{{end}}
+{{with .Unstable}}
+<h3>Unstable benchmarks</h3>
+<table>
+{{range .}}<tr><td><a href="/dashboard/{{$.Repo}}/bench/{{pathEscape .Name}}">{{.Name}}</a></td><td>{{printf "%.2f" (pct .Variation)}}%</td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
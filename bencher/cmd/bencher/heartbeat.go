@@ -0,0 +1,107 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// heartbeatInterval is how often a newline is written while a synchronous
+// run is in progress, lest proxies and load balancers drop the idle
+// connection, or 0 not to. Requests can override it with ?heartbeat=.
+var heartbeatInterval time.Duration
+
+// statusTrailer carries the status of responses whose 200 was
+// already sent by the first heartbeat.
+const statusTrailer = "Bencher-Status"
+
+// heartbeat writes a newline to the response every interval until
+// stopped, which JSON decoders skip as whitespace. Once the first is
+// written, the status can't change anymore and is sent as a trailer.
+type heartbeat struct {
+	http.ResponseWriter
+
+	mu      sync.Mutex
+	started bool
+	done    chan struct{}
+	stopped sync.Once
+	wg      sync.WaitGroup
+}
+
+// startHeartbeat starts writing heartbeats to w, if the interval requested
+// by r, or else the server's, is positive and w can be flushed. The
+// returned stop must be called before anything else is written to w.
+func startHeartbeat(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	interval := heartbeatInterval
+	if s := r.URL.Query().Get("heartbeat"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			interval = d
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if interval <= 0 || !ok {
+		return w, func() {}
+	}
+
+	w.Header().Set("Trailer", statusTrailer)
+	hb := &heartbeat{ResponseWriter: w, done: make(chan struct{})}
+	hb.wg.Add(1)
+	go func() {
+		defer hb.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hb.done:
+				return
+			case <-ticker.C:
+			}
+			hb.mu.Lock()
+			if !hb.started {
+				w.WriteHeader(http.StatusOK)
+				hb.started = true
+			}
+			_, err := w.Write([]byte("\n"))
+			flusher.Flush()
+			hb.mu.Unlock()
+			// The client is gone, the run carries on regardless.
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return hb, hb.stop
+}
+
+func (hb *heartbeat) stop() {
+	hb.stopped.Do(func() {
+		close(hb.done)
+		hb.wg.Wait()
+		if hb.started {
+			hb.Header().Set(statusTrailer, strconv.Itoa(http.StatusOK))
+		}
+	})
+}
+
+func (hb *heartbeat) WriteHeader(code int) {
+	if hb.started {
+		hb.Header().Set(statusTrailer, strconv.Itoa(code))
+		return
+	}
+	hb.ResponseWriter.WriteHeader(code)
+}
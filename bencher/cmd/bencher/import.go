@@ -0,0 +1,98 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// maxImportSize bounds the tarballs POSTed to be imported.
+const maxImportSize = 256 << 20
+
+// importFlags registers the flags of "bencher import", which stores the
+// historical runs archived in a directory or tarball, see bencher.ReadArchive.
+func importFlags(fs *flag.FlagSet) func(context.Context, []string) error {
+	sc := newStorageConfig(fs)
+	var tags stringsFlag
+	var dryRun bool
+	fs.Var(&tags, "tag", "a key=value tag of every imported run e.g. branch=master, given once per tag")
+	fs.BoolVar(&dryRun, "dry-run", false, "whether to only list the runs that would be imported")
+
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 2 {
+			return errUsage
+		}
+		runs, err := bencher.ReadArchive(args[1])
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			for _, run := range runs {
+				fmt.Printf("%s\t%s\t%s\n", run.StartTime.Format(time.RFC3339), run.Commit, run.File)
+			}
+			return nil
+		}
+		if err := sc.setUp(ctx); err != nil {
+			return err
+		}
+		brq := newRequest(args[0])
+		brq.Tags = parseTagFilters(tags)
+		report, err := brq.ImportRuns(ctx, runs)
+		if report != nil {
+			fmt.Printf("Imported %d runs of %s, skipped %d already stored\n", len(report.Imported), args[0], len(report.Skipped))
+		}
+		return err
+	}
+}
+
+// handleImport serves POST /import?repo=<repo>&tag=<key=value> with a
+// tarball, gzipped or not, of historical runs as the body, importing them.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	query := r.URL.Query()
+	repo := query.Get("repo")
+	if repo == "" {
+		http.Error(w, "expecting a non-blank repo", http.StatusBadRequest)
+		return
+	}
+	runs, err := bencher.ReadArchiveTar(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	brq := newRequest(repo)
+	brq.Tags = parseTagFilters(query["tag"])
+	report, err := brq.ImportRuns(r.Context(), runs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
@@ -0,0 +1,354 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+	"golang.org/x/oauth2/google"
+)
+
+// The values of -login.
+const (
+	// loginGoogle signs people in with Google's OpenID Connect,
+	// allowing the email addresses or domains in -login-allow.
+	loginGoogle = "google"
+	// loginGitHub signs people in with GitHub OAuth, allowing the
+	// members of the organizations or "org/team" teams in -login-allow.
+	loginGitHub = "github"
+)
+
+const (
+	sessionCookie  = "bencher_session"
+	stateCookie    = "bencher_oauth_state"
+	sessionMaxAge  = 12 * time.Hour
+	oauthStateSize = 16
+)
+
+type loginConfig struct {
+	provider     string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	allow        string
+	roles        string
+
+	oauth      *oauth2.Config
+	allowed    []string
+	roleOf     map[string]role
+	sessionKey []byte
+}
+
+// login is set if people can sign in to the dashboard.
+var login *loginConfig
+
+// setUp checks the configuration and derives the OAuth
+// client from it, or returns nil if login is disabled.
+func (lc *loginConfig) setUp() (*loginConfig, error) {
+	if lc.provider == "" {
+		return nil, nil
+	}
+	if lc.clientID == "" || lc.clientSecret == "" || lc.redirectURL == "" {
+		return nil, fmt.Errorf("-login requires -login-client-id, -login-client-secret and -login-redirect-url")
+	}
+	for _, allowed := range strings.Split(lc.allow, ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" {
+			lc.allowed = append(lc.allowed, allowed)
+		}
+	}
+	// Anyone with an account would otherwise be let in.
+	if len(lc.allowed) == 0 {
+		return nil, fmt.Errorf("-login requires -login-allow")
+	}
+	lc.roleOf = make(map[string]role)
+	for _, pair := range strings.Split(lc.roles, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid -login-roles entry %q, expecting <who>=<role>", pair)
+		}
+		rl, err := parseRole(pair[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("-login-roles entry %q: %v", pair, err)
+		}
+		lc.roleOf[strings.ToLower(pair[:i])] = rl
+	}
+
+	lc.oauth = &oauth2.Config{
+		ClientID:     lc.clientID,
+		ClientSecret: lc.clientSecret,
+		RedirectURL:  lc.redirectURL,
+	}
+	switch lc.provider {
+	case loginGoogle:
+		lc.oauth.Endpoint = google.Endpoint
+		lc.oauth.Scopes = []string{"openid", "email"}
+	case loginGitHub:
+		lc.oauth.Endpoint = github.Endpoint
+		lc.oauth.Scopes = []string{"read:org"}
+	default:
+		return nil, fmt.Errorf("unknown -login %q, expecting %q or %q", lc.provider, loginGoogle, loginGitHub)
+	}
+
+	// Sessions don't outlive the server, which is a fair price
+	// for not having to distribute yet another secret.
+	lc.sessionKey = make([]byte, 32)
+	if _, err := rand.Read(lc.sessionKey); err != nil {
+		return nil, err
+	}
+	return lc, nil
+}
+
+// loginProvider returns the configured provider, or blank if login is disabled.
+func loginProvider() string {
+	if login == nil {
+		return ""
+	}
+	return login.provider
+}
+
+type session struct {
+	// Identity is e.g. "google:jane@example.org" or "github:jane".
+	Identity string `json:"id"`
+	// Role is decided when signing in, hence changing
+	// -login-roles takes effect on the next sign in.
+	Role   string `json:"role"`
+	Expiry int64  `json:"exp"`
+}
+
+func (lc *loginConfig) sign(payload string) string {
+	mac := hmac.New(sha256.New, lc.sessionKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (lc *loginConfig) setSession(w http.ResponseWriter, identity string, rl role) {
+	blob, _ := json.Marshal(&session{Identity: identity, Role: rl.String(), Expiry: time.Now().Add(sessionMaxAge).Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(blob)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    payload + "." + lc.sign(payload),
+		Path:     "/",
+		MaxAge:   int(sessionMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(lc.redirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionOf returns the unexpired session that r bears, if any.
+func (lc *loginConfig) sessionOf(r *http.Request) *session {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	i := strings.LastIndex(c.Value, ".")
+	if i < 0 || !hmac.Equal([]byte(c.Value[i+1:]), []byte(lc.sign(c.Value[:i]))) {
+		return nil
+	}
+	blob, err := base64.RawURLEncoding.DecodeString(c.Value[:i])
+	if err != nil {
+		return nil
+	}
+	s := new(session)
+	if err := json.Unmarshal(blob, s); err != nil || time.Now().Unix() > s.Expiry {
+		return nil
+	}
+	return s
+}
+
+// handleLogin serves GET /login?next=<path>, sending people to sign in
+// with the provider, which then sends them back to the callback.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	state := make([]byte, oauthStateSize)
+	if _, err := rand.Read(state); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	next := r.URL.Query().Get("next")
+	// Only paths of this server, lest the login redirect elsewhere.
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/dashboard/"
+	}
+	stateValue := base64.RawURLEncoding.EncodeToString(state)
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    stateValue + "|" + url.QueryEscape(next),
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, login.oauth.AuthCodeURL(stateValue), http.StatusFound)
+}
+
+// handleOAuthCallback serves the provider's redirect back, signing the
+// person in if they are allowed to.
+func handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(stateCookie)
+	if err != nil {
+		http.Error(w, "missing login state, please sign in again", http.StatusBadRequest)
+		return
+	}
+	parts := strings.SplitN(c.Value, "|", 2)
+	if len(parts) != 2 || r.URL.Query().Get("state") != parts[0] {
+		http.Error(w, "mismatched login state, please sign in again", http.StatusBadRequest)
+		return
+	}
+	next, _ := url.QueryUnescape(parts[1])
+
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, httpClient)
+	token, err := login.oauth.Exchange(ctx, r.URL.Query().Get("code"))
+	if err != nil {
+		http.Error(w, "Signing in: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	client := login.oauth.Client(ctx, token)
+	identity, rl, err := login.identify(ctx, client)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/", MaxAge: -1})
+	login.setSession(w, identity, rl)
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// identify returns the signed in person's identity and role if they are
+// allowed in. Everyone allowed in is a viewer, unless -login-roles grants
+// them, or an entry of -login-allow that lets them in, a greater role.
+func (lc *loginConfig) identify(ctx context.Context, client *http.Client) (string, role, error) {
+	var identity string
+	var matched []string
+	switch lc.provider {
+	case loginGoogle:
+		var info struct {
+			Email         string `json:"email"`
+			EmailVerified bool   `json:"email_verified"`
+		}
+		if err := getJSON(ctx, client, "https://openidconnect.googleapis.com/v1/userinfo", &info); err != nil {
+			return "", 0, err
+		}
+		if !info.EmailVerified {
+			return "", 0, fmt.Errorf("%s isn't verified", info.Email)
+		}
+		identity = info.Email
+		domain := info.Email[strings.LastIndex(info.Email, "@")+1:]
+		for _, allowed := range lc.allowed {
+			if strings.EqualFold(allowed, info.Email) || strings.EqualFold(allowed, domain) {
+				matched = append(matched, allowed)
+			}
+		}
+		if len(matched) == 0 {
+			return "", 0, fmt.Errorf("%s isn't allowed in", info.Email)
+		}
+
+	default:
+		var user struct {
+			Login string `json:"login"`
+		}
+		if err := getJSON(ctx, client, "https://api.github.com/user", &user); err != nil {
+			return "", 0, err
+		}
+		identity = user.Login
+		// Every membership is checked as each may grant a different role.
+		for _, allowed := range lc.allowed {
+			ok, err := githubMember(ctx, client, allowed, user.Login)
+			if err != nil {
+				return "", 0, err
+			}
+			if ok {
+				matched = append(matched, allowed)
+			}
+		}
+		if len(matched) == 0 {
+			return "", 0, fmt.Errorf("%s isn't a member of any of %s", user.Login, strings.Join(lc.allowed, ", "))
+		}
+	}
+
+	rl := roleViewer
+	for _, who := range append(matched, identity) {
+		if granted := lc.roleOf[strings.ToLower(who)]; granted > rl {
+			rl = granted
+		}
+	}
+	return lc.provider + ":" + identity, rl, nil
+}
+
+// githubMember reports whether user is a member of orgOrTeam,
+// an organization e.g. "census-instrumentation" or a team of one
+// e.g. "census-instrumentation/go-maintainers".
+func githubMember(ctx context.Context, client *http.Client, orgOrTeam, user string) (bool, error) {
+	if i := strings.Index(orgOrTeam, "/"); i > 0 {
+		var membership struct {
+			State string `json:"state"`
+		}
+		u := fmt.Sprintf("https://api.github.com/orgs/%s/teams/%s/memberships/%s",
+			url.PathEscape(orgOrTeam[:i]), url.PathEscape(orgOrTeam[i+1:]), url.PathEscape(user))
+		err := getJSON(ctx, client, u, &membership)
+		if err == errNotFound {
+			return false, nil
+		}
+		return membership.State == "active", err
+	}
+
+	u := fmt.Sprintf("https://api.github.com/orgs/%s/members/%s", url.PathEscape(orgOrTeam), url.PathEscape(user))
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusNoContent, nil
+}
+
+var errNotFound = fmt.Errorf("not found")
+
+func getJSON(ctx context.Context, client *http.Client, u string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -15,70 +15,144 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
-	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
-	"golang.org/x/crypto/acme/autocert"
+	"go.opencensus.io/trace"
+	"google.golang.org/api/storage/v1"
 
-	"github.com/orijtech/infra"
 	"github.com/orijtech/opencensus-tools/bencher"
 )
 
 var (
 	gcsBucket, appEmail, gcsProject string
 
-	postmarkServerToken = os.Getenv("BENCHER_POSTMARK_SERVER_TOKEN")
+	timezone, locale string
+
+	kmsKeyName    string
+	encryptionKey []byte
+
+	httpClient *http.Client
+	childEnv   []string
+	runAs      string
+
+	credentialsMode string
+
+	pricing *bencher.Pricing
+	quotas  []*bencher.Quota
+
+	featureFlags *bencher.FeatureFlags
+
+	traceSampler trace.Sampler
+	// serviceName and spanConvention name the service and spans
+	// reported to the tracing backend and the exporters.
+	serviceName    = bencher.DefaultServiceName
+	spanConvention = bencher.DefaultSpanConvention
+
+	dashboardURL string
+
+	cacheDir string
+
+	shadowComparer string
+
+	emailSubject, emailFrom, emailReplyTo string
+
+	postmarkServerToken  = os.Getenv("BENCHER_POSTMARK_SERVER_TOKEN")
 	postmarkAccountToken = os.Getenv("BENCHER_POSTMARK_ACCOUNT_TOKEN")
 
-	infraClient *infra.Client
+	slackWebhookURL     = os.Getenv("BENCHER_SLACK_WEBHOOK_URL")
+	pagerDutyRoutingKey = os.Getenv("BENCHER_PAGERDUTY_ROUTING_KEY")
+
+	githubToken      = os.Getenv("BENCHER_GITHUB_TOKEN")
+	artifactoryToken = os.Getenv("BENCHER_ARTIFACTORY_TOKEN")
+
+	sentryDSN = os.Getenv("BENCHER_SENTRY_DSN")
+
+	storageService *storage.Service
+	// gcpClient is authenticated to Google Cloud APIs with the
+	// credentials of the storage service.
+	gcpClient *http.Client
+
+	errorReporter bencher.ErrorReporter
+
+	// faults are only injectable through /admin/faults with
+	// $BENCHER_FAULT_INJECTION set, e.g. in staging.
+	faults *bencher.Faults
 )
 
 func main() {
 	log.SetFlags(0)
+	os.Exit(runCommand(os.Args[1:]))
+}
 
-	var port int
-	var http2 bool
-	var domains string
-	flag.IntVar(&port, "port", 7788, "the port to run the server")
-	flag.StringVar(&gcsBucket, "bucket", "census-demos", "the GCS bucket to use")
-	flag.StringVar(&gcsProject, "project", "census-demos", "the GCS project to use")
-	flag.StringVar(&appEmail, "app-email", "emmanuel@orijtech.com", "the email for the app")
-	flag.BoolVar(&http2, "http2", false, "whether to run it as an HTTP/2 and HTTPS enabled server")
-	flag.StringVar(&domains, "domains", "", "the comma separated list of domains e.g. foo.example.org,baz.example.com")
-	flag.Parse()
-
-	mux := http.NewServeMux()
-	mux.Handle("/benchmark", http.HandlerFunc(handleBenchmarking))
-	mux.Handle("/ping", http.HandlerFunc(health))
-
-	// Set the infra client
-	var err error
-	infraClient, err = infra.NewDefaultClient()
+// newRequest returns a request for gitRepoURL configured
+// with the server's clients, storage and defaults.
+func newRequest(gitRepoURL string) *bencher.Request {
+	infraClient, err := infraClientCache.get()
 	if err != nil {
-		log.Fatalf("NewDefaultClient: %v", err)
+		log.Printf("The infra client is unhealthy: %v", err)
 	}
-
-	if !http2 {
-		addr := fmt.Sprintf(":%d", port)
-		log.Printf("Running non-HTTP/2 bencher server at %q", addr)
-		if err := http.ListenAndServe(addr, mux); err != nil {
-			log.Fatalf("ListenAndServe: %v", err)
-		}
-		return
+	return &bencher.Request{
+		AppEmail:            appEmail,
+		EmailServerToken:    postmarkServerToken,
+		EmailAccountToken:   postmarkAccountToken,
+		InfraClient:         infraClient,
+		StorageService:      storageService,
+		GitRepoURL:          gitRepoURL,
+		GCSBucket:           gcsBucket,
+		GCSProject:          gcsProject,
+		Timezone:            timezone,
+		Locale:              locale,
+		KMSKeyName:          kmsKeyName,
+		EncryptionKey:       encryptionKey,
+		HTTPClient:          httpClient,
+		Env:                 childEnv,
+		RunAs:               runAs,
+		Pricing:             pricing,
+		Quotas:              quotas,
+		Features:            featureFlags,
+		DashboardURL:        dashboardURL,
+		EmailSubject:        emailSubject,
+		EmailFrom:           emailFrom,
+		EmailReplyTo:        emailReplyTo,
+		TraceSampler:        traceSampler,
+		ServiceName:         serviceName,
+		SpanConvention:      spanConvention,
+		CacheDir:            cacheDir,
+		ShadowComparer:      shadowComparer,
+		SlackWebhookURL:     slackWebhookURL,
+		PagerDutyRoutingKey: pagerDutyRoutingKey,
+		ErrorReporter:       errorReporter,
+		Faults:              faults,
+		UnsubscribeKey:      unsubscribeKey,
+		GitHubToken:         githubToken,
+		PublisherTokens: map[string]string{
+			bencher.PublisherGitHubRelease: githubToken,
+			bencher.PublisherArtifactory:   artifactoryToken,
+		},
 	}
+}
 
-	allDomains := strings.Split(domains, ",")
-	if len(allDomains) == 0 || strings.TrimSpace(allDomains[0]) == "" {
-		log.Fatal("expecting at least one non-blank domain, separated by comma if many")
+func loadEncryptionKey(path string) ([]byte, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(blob)))
+	if err != nil {
+		return nil, err
 	}
-	// Otherwise time to run it as an HTTP/2 and HTTPS enabled server
-	log.Fatal(http.Serve(autocert.NewListener(allDomains...), mux))
+	if len(key) != 32 {
+		return nil, fmt.Errorf("expecting a 32 byte key, got %d bytes", len(key))
+	}
+	return key, nil
 }
 
 type benchRequest struct {
@@ -87,49 +161,258 @@ type benchRequest struct {
 	AlertEmails []string `json:"alert_emails"`
 	Secret      string   `json:"secret"`
 	Public      bool     `json:"public"`
+	Profile     bool     `json:"profile"`
+
+	Tags    map[string]string `json:"tags"`
+	GroupBy []string          `json:"group_by"`
+
+	RepeatNotifications string `json:"repeat_notifications"`
+
+	Timezone string `json:"timezone"`
+	Locale   string `json:"locale"`
+	Comparer string `json:"comparer"`
+	Outliers string `json:"outliers"`
+
+	NumberFormat string `json:"number_format"`
+
+	UnitsOfWork map[string]string `json:"units_of_work"`
+
+	GOGC    string `json:"gogc"`
+	GODEBUG string `json:"godebug"`
+	Seed    string `json:"seed"`
+
+	// Suite if set, lists the repositories to benchmark
+	// instead of git_repo_url, for a combined report.
+	Suite []string `json:"suite"`
+
+	EmailSubject string `json:"email_subject"`
+	EmailFrom    string `json:"email_from"`
+	EmailReplyTo string `json:"email_reply_to"`
+
+	AttachResults bool `json:"attach_results"`
+	MaxEmailRows  int  `json:"max_email_rows"`
+
+	Policy string `json:"policy"`
+	Routes string `json:"routes"`
+
+	AlertOwners string `json:"alert_owners"`
+
+	ZeroAllocs []string `json:"zero_allocs"`
+
+	VCS       string `json:"vcs"`
+	Revision  string `json:"revision"`
+	SourceURL string `json:"source_url"`
+	Harness   string `json:"harness"`
+	Snapshot  bool   `json:"snapshot"`
+
+	PublishTo []string `json:"publish_to"`
+
+	NotifyNoBenchmarks bool `json:"notify_no_benchmarks"`
+
+	// TimeBudget e.g. "10m" if set, is how long the Go benchmarks take in total.
+	TimeBudget string `json:"time_budget"`
+
+	Baselines     []*bencher.ResultSet `json:"baselines"`
+	BaselineRunID string               `json:"baseline_run_id"`
+	PullRequest   int                  `json:"pull_request"`
+
+	ReviewComments bool `json:"review_comments"`
+
+	Force bool `json:"force"`
 }
 
 func handleBenchmarking(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	br := new(benchRequest)
-	dec := json.NewDecoder(r.Body)
-	if err := dec.Decode(&br); err != nil {
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, br)
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	// 1. TODO: Match up those secrets
+	st, submitted := r.Context().Value(submissionTokenKey{}).(*submissionToken)
+	if submitted {
+		if err := st.claim(br, body); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
 
-	brq := &bencher.Request{
-		AppEmail:         appEmail,
-		EmailServerToken: postmarkServerToken,
-		AlertEmails:      br.AlertEmails,
-		EmailAccountToken: postmarkAccountToken,
-		InfraClient:      infraClient,
-		GitRepoURL:       br.GitRepoURL,
-		GCSBucket:        gcsBucket,
-		GCSProject:       gcsProject,
-		Public:           br.Public,
-		Secret:           br.Secret,
+	brq := newRequest(br.GitRepoURL)
+	brq.AlertEmails = br.AlertEmails
+	brq.Public = br.Public
+	brq.Secret = br.Secret
+	brq.Profile = br.Profile
+	brq.Tags = br.Tags
+	brq.GroupBy = br.GroupBy
+	brq.RepeatNotifications = br.RepeatNotifications
+	brq.Timezone = firstNonBlank(br.Timezone, timezone)
+	brq.Locale = firstNonBlank(br.Locale, locale)
+	brq.Comparer = br.Comparer
+	brq.Outliers = br.Outliers
+	brq.NumberFormat = br.NumberFormat
+	brq.UnitsOfWork = br.UnitsOfWork
+	brq.GOGC = br.GOGC
+	brq.GODEBUG = br.GODEBUG
+	brq.Seed = br.Seed
+	brq.EmailSubject = firstNonBlank(br.EmailSubject, emailSubject)
+	brq.EmailFrom = firstNonBlank(br.EmailFrom, emailFrom)
+	brq.EmailReplyTo = firstNonBlank(br.EmailReplyTo, emailReplyTo)
+	brq.AttachResults = br.AttachResults
+	brq.MaxEmailRows = br.MaxEmailRows
+	brq.Policy = br.Policy
+	brq.Routes = br.Routes
+	brq.AlertOwners = br.AlertOwners
+	brq.ZeroAllocs = br.ZeroAllocs
+	brq.VCS = br.VCS
+	brq.Revision = br.Revision
+	brq.SourceURL = br.SourceURL
+	brq.Harness = br.Harness
+	brq.Snapshot = br.Snapshot
+	brq.PublishTo = br.PublishTo
+	brq.NotifyNoBenchmarks = br.NotifyNoBenchmarks
+	if br.TimeBudget != "" {
+		budget, err := time.ParseDuration(br.TimeBudget)
+		if err != nil || budget <= 0 {
+			http.Error(w, fmt.Sprintf("expecting time_budget to be a positive duration e.g. 10m, got %q", br.TimeBudget), http.StatusBadRequest)
+			return
+		}
+		brq.TimeBudget = budget
 	}
+	brq.Baselines = br.Baselines
+	brq.BaselineRunID = br.BaselineRunID
+	brq.PullRequest = br.PullRequest
+	brq.ReviewComments = br.ReviewComments
+	brq.Force = br.Force
+	brq.Submitted = submitted
 
 	// 2. Run those benchmarks
-	results, err := brq.BenchmarkAndEmail(r.Context())
+	w, stopHeartbeat := startHeartbeat(w, r)
+	var results interface{}
+	if len(br.Suite) > 0 {
+		brq.Suite = br.Suite
+		results, err = brq.BenchmarkSuiteAndEmail(r.Context())
+	} else {
+		results, err = brq.BenchmarkAndEmail(r.Context())
+	}
+	stopHeartbeat()
 
 	switch {
 	case err == bencher.ErrNoChanges:
 		fmt.Fprintf(w, "No changes detected!")
 		return
 
+	case err == bencher.ErrNoBenchmarks && results != nil:
+		// The run was recorded, with its status in the result.
+		writeResult(w, r, results)
+		return
+
+	case err == bencher.ErrBaselineConflict:
+		http.Error(w, err.Error()+", retry the run", http.StatusConflict)
+		return
+
+	case err == bencher.ErrQuotaExceeded:
+		http.Error(w, err.Error()+" for "+br.GitRepoURL, http.StatusTooManyRequests)
+		return
+
 	case err != nil:
 		// A generic error
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 
 	default:
-		blob, _ := json.Marshal(results)
-		_, _ = w.Write(blob)
+		writeResult(w, r, results)
+	}
+}
+
+type compareRequest struct {
+	GitRepoURL string `json:"git_repo_url"`
+	Tag        string `json:"tag"`
+	Before     string `json:"before"`
+	After      string `json:"after"`
+
+	// Sets if set, are compared side by side instead.
+	Sets []*bencher.ResultSet `json:"sets"`
+
+	Comparer string `json:"comparer"`
+	Outliers string `json:"outliers"`
+
+	UnitsOfWork map[string]string `json:"units_of_work"`
+
+	Policy string `json:"policy"`
+}
+
+func handleCompare(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	cr := new(compareRequest)
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(cr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	brq := newRequest(cr.GitRepoURL)
+	brq.Compare = cr.Sets
+	brq.Comparer = cr.Comparer
+	brq.Outliers = cr.Outliers
+	brq.UnitsOfWork = cr.UnitsOfWork
+	brq.Policy = cr.Policy
+
+	var results *bencher.Result
+	var err error
+	if len(cr.Sets) > 0 {
+		results, err = brq.CompareSets(r.Context())
+	} else {
+		results, err = brq.CompareTags(r.Context(), cr.Tag, cr.Before, cr.After)
+	}
+
+	switch {
+	case err == bencher.ErrNoChanges:
+		fmt.Fprintf(w, "No changes detected!")
+		return
+
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+
+	default:
+		writeResult(w, r, results)
+	}
+}
+
+// writeResult writes results as JSON or, if requested with format=csv
+// or "Accept: text/csv", writes their changed rows as CSV.
+func writeResult(w http.ResponseWriter, r *http.Request, results interface{}) {
+	res, ok := results.(*bencher.Result)
+	if ok && res.Shadow != nil && (res.Shadow.Disagrees || res.Shadow.Error != "") {
+		log.Printf("Shadow comparer %q on %s: added %q, missed %q, verdict %q, error %q",
+			res.Shadow.Comparer, r.URL.Path, res.Shadow.Added, res.Shadow.Missed, res.Shadow.Severity, res.Shadow.Error)
+	}
+	// CI can gate on the header without parsing the results.
+	if ok && res.Policy != nil {
+		w.Header().Set("Bencher-Policy-Severity", res.Policy.Severity)
+	}
+	if ok && (r.URL.Query().Get("format") == "csv" || r.Header.Get("Accept") == "text/csv") {
+		w.Header().Set("Content-Type", "text/csv")
+		_ = res.WriteCSV(w)
+		return
+	}
+	blob, _ := json.Marshal(results)
+	_, _ = w.Write(blob)
+}
+
+func firstNonBlank(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return value
+		}
 	}
+	return ""
 }
 
 func health(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,119 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// unsubscribeKey signs the links through which alert emails unsubscribe
+// from, or tune, notifications. Without it, emails carry no such links.
+var unsubscribeKey []byte
+
+// handlePreferences serves the page of the signed link in notifications
+// at /preferences?repo=<repo>&email=<email>&token=<token>, through which
+// the email unsubscribes from the repository's notifications or chooses
+// how and of which runs it is notified. A POST with unsubscribe=1, as mail
+// clients send for one-click unsubscription, unsubscribes right away.
+func handlePreferences(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	repo, email := query.Get("repo"), query.Get("email")
+	if !bencher.VerifyUnsubscribeToken(unsubscribeKey, repo, email, query.Get("token")) {
+		http.Error(w, "invalid or expired link", http.StatusForbidden)
+		return
+	}
+	brq := newRequest(repo)
+
+	data := map[string]interface{}{
+		"Repo":  repo,
+		"Email": email,
+		"Tiers": []string{bencher.TierInfo, bencher.TierWarn, bencher.TierCritical},
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		rp := &bencher.RecipientPreferences{
+			Email:    email,
+			Delivery: r.FormValue("delivery"),
+			MinTier:  r.FormValue("min_tier"),
+		}
+		if query.Get("unsubscribe") != "" {
+			rp.Delivery, rp.MinTier = bencher.DeliveryNone, ""
+		}
+		if err := brq.SetRecipientPreferences(r.Context(), rp); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("%s chose the %q delivery of %s runs of %s", email, rp.Delivery, firstNonBlank(rp.MinTier, bencher.TierInfo), repo)
+		data["Saved"] = true
+	default:
+		http.Error(w, "only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	current := &bencher.RecipientPreferences{Delivery: bencher.DeliveryImmediate, MinTier: bencher.TierInfo}
+	prefs, err := brq.RecipientPreferences(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, rp := range prefs {
+		if rp.Email == strings.ToLower(strings.TrimSpace(email)) {
+			current = rp
+		}
+	}
+	data["Current"] = current
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := preferencesTmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var preferencesTmpl = template.Must(template.New("preferences").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Notifications of {{.Repo}}</title>
+<style>
+body { font-family: sans-serif; }
+fieldset { border: 1px solid #ddd; margin-bottom: 1em; }
+</style>
+</head>
+<body>
+<h2>Notifications of {{.Repo}}</h2>
+<p>For {{.Email}}.{{if .Saved}} Your preferences were saved.{{end}}</p>
+<form method="post">
+<fieldset>
+<legend>Delivery</legend>
+<label><input type="radio" name="delivery" value="immediate"{{if eq .Current.Delivery "immediate"}} checked{{end}}> Email every report</label><br>
+<label><input type="radio" name="delivery" value="digest"{{if eq .Current.Delivery "digest"}} checked{{end}}> Add reports to the digest</label><br>
+<label><input type="radio" name="delivery" value="none"{{if eq .Current.Delivery "none"}} checked{{end}}> Unsubscribe</label>
+</fieldset>
+<fieldset>
+<legend>Only runs at least as severe as</legend>
+<select name="min_tier">
+{{range .Tiers}}<option value="{{.}}"{{if eq . ($.Current.MinTier)}} selected{{end}}>{{.}}</option>
+{{end}}</select>
+</fieldset>
+<button type="submit">Save</button>
+</form>
+</body>
+</html>
+`))
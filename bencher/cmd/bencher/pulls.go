@@ -0,0 +1,110 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// handlePullRequest serves GET /pulls?repo=<repo>&number=<n>, the runs of
+// the pushes to a pull request with how its changes evolved across them.
+func handlePullRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	repo := query.Get("repo")
+	number, err := strconv.Atoi(query.Get("number"))
+	if repo == "" || err != nil || number <= 0 {
+		http.Error(w, "expecting a non-blank repo and a pull request number", http.StatusBadRequest)
+		return
+	}
+
+	prh, err := newRequest(repo).PullRequestHistory(r.Context(), number)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, _ := json.Marshal(prh)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
+
+// handlePullRequestPage serves GET /dashboard/<repo>/pull/<number>.
+func handlePullRequestPage(w http.ResponseWriter, r *http.Request, repo, num string) {
+	number, err := strconv.Atoi(num)
+	if err != nil || number <= 0 {
+		http.Error(w, "invalid pull request number", http.StatusBadRequest)
+		return
+	}
+	prh, err := newRequest(repo).PullRequestHistory(r.Context(), number)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pullTmpl.Execute(w, prh); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var pullTmpl = template.Must(template.New("pull").Funcs(template.FuncMap{
+	"short": func(rev *bencher.PullRevision) string {
+		switch {
+		case len(rev.Commit) > 7:
+			return rev.Commit[:7]
+		case rev.Commit != "":
+			return rev.Commit
+		case rev.Revision != "":
+			return rev.Revision
+		}
+		return rev.StartTime.Format("2006-01-02 15:04")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>#{{.Number}} of {{.Repo}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ddd; padding: 4px 8px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.regressed { color: #c0392b; }
+.improved { color: #27ae60; }
+</style>
+</head>
+<body>
+<h2>Pull request #{{.Number}}</h2>
+<p>{{.Repo}}, the changes against the baseline of each of its {{len .Revisions}} benchmarked pushes, oldest first.</p>
+{{if .Benchmarks}}
+<table>
+<tr><th>Benchmark</th>{{range .Revisions}}<th title="{{.StartTime.Format "2006-01-02 15:04"}}">{{if .ReportURL}}<a href="{{.ReportURL}}">{{short .}}</a>{{else}}{{short .}}{{end}}</th>{{end}}</tr>
+{{range .Benchmarks}}
+<tr class="{{if lt .Change 0}}regressed{{else if gt .Change 0}}improved{{end}}"><td>{{.Benchmark}} {{.Metric}}{{with .Group}} ({{.}}){{end}}</td>{{range .Deltas}}<td>{{.}}</td>{{end}}</tr>
+{{end}}
+</table>
+{{else}}
+<p>None of its pushes significantly changed any benchmark.</p>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,168 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// queueDepthHeader is the number of runs waiting for their turn,
+// sent with every queued response, whether accepted or rejected.
+const queueDepthHeader = "Bencher-Queue-Depth"
+
+// defaultRunDuration estimates how long a run takes until one finished.
+const defaultRunDuration = 5 * time.Minute
+
+// runQueue bounds the runs benchmarking at once, lest they contend for the
+// CPU, and the runs waiting for their turn, beyond which requests are
+// rejected with 503 and Retry-After rather than accepted as unbounded work.
+type runQueue struct {
+	maxRunning, maxQueued int
+
+	once    sync.Once
+	running chan struct{}
+
+	mu     sync.Mutex
+	queued int
+	// avgDuration is the moving average of the runs' durations.
+	avgDuration time.Duration
+}
+
+var queue = new(runQueue)
+
+var (
+	keyQueueOutcome = tag.MustNewKey("outcome")
+
+	mQueueDepth    = stats.Int64("bencher/queue_depth", "The runs waiting for their turn", stats.UnitDimensionless)
+	mQueueRequests = stats.Int64("bencher/queue_requests", "The runs requested", stats.UnitDimensionless)
+)
+
+// queueViews are the depth of the queue and the requested runs
+// by outcome, "accepted" or "rejected".
+var queueViews = []*view.View{
+	{
+		Name:        "bencher/queue_depth",
+		Description: "The runs waiting for their turn",
+		Measure:     mQueueDepth,
+		Aggregation: view.LastValue(),
+	},
+	{
+		Name:        "bencher/queue_requests",
+		Description: "The runs requested, by outcome",
+		Measure:     mQueueRequests,
+		TagKeys:     []tag.Key{keyQueueOutcome},
+		Aggregation: view.Count(),
+	},
+}
+
+// wait waits for the turn of a run, returning a function ending it, or
+// false if the queue is full. It fails if ctx is done while waiting.
+func (q *runQueue) wait(ctx context.Context) (func(), bool, error) {
+	q.once.Do(func() { q.running = make(chan struct{}, q.maxRunning) })
+
+	q.mu.Lock()
+	if q.queued >= q.maxQueued && len(q.running) == cap(q.running) {
+		q.mu.Unlock()
+		return nil, false, nil
+	}
+	q.queued++
+	q.recordDepth(ctx)
+	q.mu.Unlock()
+
+	leave := func() {
+		q.mu.Lock()
+		q.queued--
+		q.recordDepth(ctx)
+		q.mu.Unlock()
+	}
+	select {
+	case <-ctx.Done():
+		leave()
+		return nil, false, ctx.Err()
+	case q.running <- struct{}{}:
+		leave()
+	}
+
+	start := time.Now()
+	return func() {
+		<-q.running
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if elapsed := time.Since(start); q.avgDuration == 0 {
+			q.avgDuration = elapsed
+		} else {
+			q.avgDuration = (4*q.avgDuration + elapsed) / 5
+		}
+	}, true, nil
+}
+
+// recordDepth records the queue's depth, with q.mu held.
+func (q *runQueue) recordDepth(ctx context.Context) {
+	stats.Record(ctx, mQueueDepth.M(int64(q.queued)))
+}
+
+// depth returns the number of waiting runs.
+func (q *runQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.queued
+}
+
+// retryAfter estimates when the queue will have room again.
+func (q *runQueue) retryAfter() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	avg := q.avgDuration
+	if avg == 0 {
+		avg = defaultRunDuration
+	}
+	// The first waiting run starts once one of the running ones ends.
+	return time.Duration(math.Ceil(float64(avg) / float64(q.maxRunning)))
+}
+
+// withQueue runs h in its turn, at most -max-running at a time, and
+// rejects the request if -max-queued runs are already waiting.
+func withQueue(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		done, ok, err := queue.wait(r.Context())
+		w.Header().Set(queueDepthHeader, strconv.Itoa(queue.depth()))
+		if err != nil {
+			// The caller is gone.
+			return
+		}
+		if !ok {
+			_ = stats.RecordWithTags(r.Context(), []tag.Mutator{tag.Upsert(keyQueueOutcome, "rejected")}, mQueueRequests.M(1))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(queue.retryAfter().Seconds()))))
+			http.Error(w, "too many runs are queued, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		_ = stats.RecordWithTags(r.Context(), []tag.Mutator{tag.Upsert(keyQueueOutcome, "accepted")}, mQueueRequests.M(1))
+		defer done()
+		h.ServeHTTP(w, r)
+	})
+}
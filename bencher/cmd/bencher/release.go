@@ -0,0 +1,89 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// signingKey if set, signs the release reports.
+var signingKey ed25519.PrivateKey
+
+type releaseRequest struct {
+	// Suite are the module paths whose release is benchmarked.
+	Suite    []string `json:"suite"`
+	Release  string   `json:"release"`
+	Previous string   `json:"previous"`
+	// Format is "markdown", the default, or "html".
+	Format string `json:"format"`
+
+	Comparer string `json:"comparer"`
+	Outliers string `json:"outliers"`
+
+	UnitsOfWork map[string]string `json:"units_of_work"`
+
+	Policy string `json:"policy"`
+}
+
+// handleReleaseReport serves POST /release-report, benchmarking a release
+// of a suite of modules against the previous one, as a signed document.
+func handleReleaseReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	rr := new(releaseRequest)
+	if err := json.NewDecoder(r.Body).Decode(rr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rr.Format != "" && rr.Format != bencher.ReportMarkdown && rr.Format != bencher.ReportHTML {
+		http.Error(w, `expecting format "markdown" or "html"`, http.StatusBadRequest)
+		return
+	}
+
+	brq := newRequest("")
+	brq.Suite = rr.Suite
+	brq.Comparer = rr.Comparer
+	brq.Outliers = rr.Outliers
+	brq.UnitsOfWork = rr.UnitsOfWork
+	brq.Policy = rr.Policy
+
+	w, stopHeartbeat := startHeartbeat(w, r)
+	report, err := brq.ReleaseReport(r.Context(), rr.Release, rr.Previous)
+	var doc []byte
+	if err == nil {
+		doc, err = report.Render(rr.Format, signingKey)
+	}
+	stopHeartbeat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if rr.Format == bencher.ReportHTML {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	}
+	w.Header().Set("Bencher-Policy-Severity", report.Severity)
+	_, _ = w.Write(doc)
+}
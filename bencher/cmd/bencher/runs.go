@@ -0,0 +1,342 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// parseTagFilters parses tags given as "key=value" pairs.
+func parseTagFilters(pairs []string) map[string]string {
+	tags := make(map[string]string)
+	for _, pair := range pairs {
+		if i := strings.Index(pair, "="); i > 0 {
+			tags[pair[:i]] = pair[i+1:]
+		}
+	}
+	return tags
+}
+
+// handleListRepos serves GET /repos, the repositories with stored results.
+func handleListRepos(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	repos, err := newRequest("").ListRepos(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, _ := json.Marshal(map[string]interface{}{"repos": repos})
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
+
+// maxStreamPageSize bounds the page size of NDJSON streamed
+// listings which, unlike JSON ones, aren't held in memory.
+const maxStreamPageSize = 10000
+
+// handleListRuns serves GET /runs?repo=<repo>&page=<token>&page_size=<n>&tag=<key=value>&goarch=<arch>&pull_request=<n>&deleted=true
+// as a JSON object or, if requested with "Accept: application/x-ndjson" or
+// format=ndjson, as a stream of runs, one JSON object per line, followed
+// by {"next_page": "<token>"} if more runs remain.
+func handleListRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	repo := query.Get("repo")
+	if repo == "" {
+		http.Error(w, "expecting a non-blank repo", http.StatusBadRequest)
+		return
+	}
+	rf := &bencher.RunFilter{
+		Page:           query.Get("page"),
+		Tags:           parseTagFilters(query["tag"]),
+		GOARCH:         query.Get("goarch"),
+		IncludeDeleted: query.Get("deleted") == "true",
+	}
+	if ps := query.Get("page_size"); ps != "" {
+		pageSize, err := strconv.Atoi(ps)
+		if err != nil {
+			http.Error(w, "invalid page_size: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rf.PageSize = pageSize
+	}
+	if pr := query.Get("pull_request"); pr != "" {
+		number, err := strconv.Atoi(pr)
+		if err != nil {
+			http.Error(w, "invalid pull_request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rf.PullRequest = number
+	}
+
+	if query.Get("format") == "ndjson" || r.Header.Get("Accept") == "application/x-ndjson" {
+		if rf.PageSize > maxStreamPageSize {
+			rf.PageSize = maxStreamPageSize
+		}
+		streamRuns(w, r, repo, rf)
+		return
+	}
+
+	page, err := newRequest(repo).ListRuns(r.Context(), rf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, _ := json.Marshal(page)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
+
+// handleRun serves the endpoints of a single run under /runs/<run-id>/.
+func handleRun(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/delete"):
+		handleRunDeletion(w, r, "/delete")
+	case strings.HasSuffix(r.URL.Path, "/restore"):
+		handleRunDeletion(w, r, "/restore")
+	case strings.HasSuffix(r.URL.Path, "/preview"):
+		handleRunPreview(w, r)
+	case strings.HasSuffix(r.URL.Path, "/export"):
+		handleRunExport(w, r)
+	case strings.HasSuffix(r.URL.Path, "/rerun"):
+		withQueue(http.HandlerFunc(handleRunRerun)).ServeHTTP(w, r)
+	case strings.HasSuffix(r.URL.Path, "/publish"):
+		handleRunPublish(w, r)
+	default:
+		handleRunArtifact(w, r)
+	}
+}
+
+// handleRunDeletion serves POST /runs/<run-id>/delete?repo=<repo>&reason=<reason>
+// and POST /runs/<run-id>/restore?repo=<repo>
+func handleRunDeletion(w http.ResponseWriter, r *http.Request, action string) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	runID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/runs/"), action)
+	repo := query.Get("repo")
+	if repo == "" || runID == "" {
+		http.Error(w, "expecting a non-blank repo and run", http.StatusBadRequest)
+		return
+	}
+
+	brq := newRequest(repo)
+	var err error
+	if action == "/delete" {
+		err = brq.DeleteRun(r.Context(), runID, query.Get("reason"))
+	} else {
+		err = brq.RestoreRun(r.Context(), runID)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRunPreview serves GET /runs/<run-id>/preview?repo=<repo>&channel=email|slack|markdown
+// with the notification the run would have sent, rendered with the server's
+// templates unless overridden by the email_subject, email_from, email_reply_to
+// and policy parameters. Email headers are returned in Bencher-Email-* headers,
+// or everything as JSON with format=json.
+func handleRunPreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	runID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/runs/"), "/preview")
+	repo := query.Get("repo")
+	if repo == "" || runID == "" {
+		http.Error(w, "expecting a non-blank repo and run", http.StatusBadRequest)
+		return
+	}
+
+	brq := newRequest(repo)
+	brq.EmailSubject = firstNonBlank(query.Get("email_subject"), emailSubject)
+	brq.EmailFrom = firstNonBlank(query.Get("email_from"), emailFrom)
+	brq.EmailReplyTo = firstNonBlank(query.Get("email_reply_to"), emailReplyTo)
+	brq.Policy = query.Get("policy")
+	channel := firstNonBlank(query.Get("channel"), bencher.PreviewEmail)
+	preview, err := brq.PreviewNotification(r.Context(), runID, channel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if query.Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(preview)
+		return
+	}
+	for header, value := range map[string]string{
+		"Bencher-Email-Subject":  preview.Subject,
+		"Bencher-Email-From":     preview.From,
+		"Bencher-Email-Reply-To": preview.ReplyTo,
+	} {
+		if value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.Header().Set("Content-Type", preview.ContentType)
+	_, _ = io.WriteString(w, preview.Body)
+}
+
+// handleRunRerun serves POST /runs/<run-id>/rerun?repo=<repo>&policy=<policy>
+// by re-executing the run from its workspace snapshot, responding with the
+// comparison of the rerun's results against the run's as from /compare.
+func handleRunRerun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	runID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/runs/"), "/rerun")
+	repo := query.Get("repo")
+	if repo == "" || runID == "" {
+		http.Error(w, "expecting a non-blank repo and run", http.StatusBadRequest)
+		return
+	}
+
+	brq := newRequest(repo)
+	brq.Policy = query.Get("policy")
+	w, stopHeartbeat := startHeartbeat(w, r)
+	results, err := brq.RerunSnapshot(r.Context(), runID)
+	stopHeartbeat()
+
+	switch {
+	case err == bencher.ErrNoChanges:
+		fmt.Fprintf(w, "No changes detected!")
+		return
+
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+
+	default:
+		writeResult(w, r, results)
+	}
+}
+
+// handleRunPublish serves POST /runs/<run-id>/publish?repo=<repo>&to=<publisher>:<target>
+// by publishing the run's report to every to target, responding with
+// the URLs at which it was published and the targets that failed.
+func handleRunPublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	runID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/runs/"), "/publish")
+	repo := query.Get("repo")
+	if repo == "" || runID == "" || len(query["to"]) == 0 {
+		http.Error(w, "expecting a non-blank repo, run and to", http.StatusBadRequest)
+		return
+	}
+
+	brq := newRequest(repo)
+	brq.PublishTo = query["to"]
+	published, warnings, err := brq.PublishRun(r.Context(), runID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	blob, _ := json.Marshal(map[string]interface{}{"published": published, "warnings": warnings})
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
+
+// handleRunArtifact serves GET /runs/<run-id>/artifact/<name>?repo=<repo>
+func handleRunArtifact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Run IDs contain slashes, hence the last "/artifact/" separates the name.
+	rest := strings.TrimPrefix(r.URL.Path, "/runs/")
+	i := strings.LastIndex(rest, "/artifact/")
+	if i <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	runID, name := rest[:i], rest[i+len("/artifact/"):]
+	repo := r.URL.Query().Get("repo")
+	if repo == "" || name == "" {
+		http.Error(w, "expecting a non-blank repo and artifact name", http.StatusBadRequest)
+		return
+	}
+
+	rc, err := newRequest(repo).OpenArtifact(r.Context(), runID, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer rc.Close()
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, _ = io.Copy(w, rc)
+}
+
+func streamRuns(w http.ResponseWriter, r *http.Request, repo string, rf *bencher.RunFilter) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	wrote := false
+	next, err := newRequest(repo).WalkRuns(r.Context(), rf, func(run *bencher.Run) error {
+		wrote = true
+		if err := enc.Encode(run); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if !wrote {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		// Otherwise the truncated stream, lacking
+		// a next page, is all that can be reported.
+		return
+	}
+	if next != "" {
+		_ = enc.Encode(map[string]string{"next_page": next})
+	}
+}
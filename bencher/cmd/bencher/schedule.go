@@ -0,0 +1,135 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// refreshSchedule benchmarks repositories daily e.g. nightly, refreshing
+// their baselines. Each starts after a random delay within the jitter, with
+// at most concurrency of them at a time, lest runs starting at once contend
+// for the CPU and inflate the variance of their results.
+type refreshSchedule struct {
+	repos       []string
+	at          string
+	loc         *time.Location
+	concurrency int
+	jitter      time.Duration
+
+	// offset is at, as the time elapsed since midnight.
+	offset time.Duration
+}
+
+func (rs *refreshSchedule) setUp(repos string) error {
+	seen := make(map[string]bool)
+	for _, repo := range strings.Split(repos, ",") {
+		// Runs of the same repository would share its sources.
+		if repo = strings.TrimSpace(repo); repo != "" && !seen[repo] {
+			seen[repo] = true
+			rs.repos = append(rs.repos, repo)
+		}
+	}
+	at, err := time.Parse("15:04", rs.at)
+	if err != nil {
+		return fmt.Errorf("expecting -refresh-at to be a time of day e.g. 02:30, got %q", rs.at)
+	}
+	rs.offset = time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute
+	if rs.concurrency < 1 {
+		return fmt.Errorf("expecting -refresh-concurrency to be a positive integer")
+	}
+	if rs.jitter < 0 {
+		return fmt.Errorf("expecting -refresh-jitter not to be negative")
+	}
+	if rs.loc, err = time.LoadLocation(timezone); err != nil {
+		return fmt.Errorf("Loading timezone %q: %v", timezone, err)
+	}
+	return nil
+}
+
+// next returns when the repositories are next refreshed after now.
+func (rs *refreshSchedule) next(now time.Time) time.Time {
+	now = now.In(rs.loc)
+	y, m, d := now.Date()
+	t := time.Date(y, m, d, 0, 0, 0, 0, rs.loc).Add(rs.offset)
+	if !t.After(now) {
+		t = time.Date(y, m, d+1, 0, 0, 0, 0, rs.loc).Add(rs.offset)
+	}
+	return t
+}
+
+// run refreshes the repositories daily until ctx is done.
+func (rs *refreshSchedule) run(ctx context.Context) {
+	for {
+		next := rs.next(time.Now())
+		log.Printf("Refreshing the baselines of %d repositories at %s", len(rs.repos), next.Format(time.RFC1123))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		rs.refreshAll(ctx)
+	}
+}
+
+func (rs *refreshSchedule) refreshAll(ctx context.Context) {
+	sem := make(chan struct{}, rs.concurrency)
+	var wg sync.WaitGroup
+	for _, repo := range rs.repos {
+		var delay time.Duration
+		if rs.jitter > 0 {
+			delay = time.Duration(rand.Int63n(int64(rs.jitter)))
+		}
+		wg.Add(1)
+		go func(repo string, delay time.Duration) {
+			defer wg.Done()
+
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case sem <- struct{}{}:
+			}
+			defer func() { <-sem }()
+
+			start := time.Now()
+			switch _, err := newRequest(repo).Benchmark(ctx); err {
+			case nil, bencher.ErrNoChanges:
+				log.Printf("Refreshed the baseline of %s in %s", repo, time.Since(start).Round(time.Second))
+			case bencher.ErrNoBenchmarks:
+				log.Printf("Found no benchmarks in %s, leaving its baseline as it was", repo)
+			default:
+				log.Printf("Refreshing the baseline of %s: %v", repo, err)
+			}
+		}(repo, delay)
+	}
+	wg.Wait()
+}
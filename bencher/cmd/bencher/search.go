@@ -0,0 +1,43 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleSearch serves GET /search?bench=<benchmark>, the benchmark's
+// latest means in every repository in whose latest results it is found.
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("bench")
+	if name == "" {
+		http.Error(w, "expecting a non-blank bench", http.StatusBadRequest)
+		return
+	}
+
+	hits, err := newRequest("").SearchBenchmark(r.Context(), name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, _ := json.Marshal(map[string]interface{}{"hits": hits})
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
@@ -0,0 +1,118 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+var (
+	selfTestMu   sync.Mutex
+	lastSelfTest *bencher.SelfTestReport
+
+	// selfTest is the configuration of the periodic self-test, also
+	// used by the self-tests run on demand from the admin port.
+	selfTest = new(selfTestConfig)
+)
+
+// selfTestConfig periodically runs the pipeline end to end on
+// the canary repository, alerting operators when it breaks.
+type selfTestConfig struct {
+	interval          time.Duration
+	emails, operators string
+}
+
+func (stc *selfTestConfig) run(ctx context.Context) {
+	ticker := time.NewTicker(stc.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := runSelfTest(ctx, splitEmails(stc.emails), splitEmails(stc.operators)); err != nil {
+			log.Printf("Running the self-test: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runSelfTest runs a self-test, notifying emails and, if it fails,
+// alerting operators, one self-test at a time.
+func runSelfTest(ctx context.Context, emails, operators []string) (*bencher.SelfTestReport, error) {
+	selfTestMu.Lock()
+	defer selfTestMu.Unlock()
+
+	brq := newRequest(bencher.CanaryRepo)
+	brq.AlertEmails = emails
+	report, err := brq.SelfTest(ctx, operators)
+	if report != nil {
+		lastSelfTest = report
+		if !report.Passed {
+			log.Printf("The self-test failed: %+v", report.Steps[len(report.Steps)-1])
+		}
+	}
+	return report, err
+}
+
+func splitEmails(s string) []string {
+	var emails []string
+	for _, email := range strings.Split(s, ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+// handleSelfTest serves GET /admin/self-test, the report of the last
+// self-test, and POST /admin/self-test, running one now.
+func handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	var report *bencher.SelfTestReport
+	switch r.Method {
+	case "GET":
+		selfTestMu.Lock()
+		report = lastSelfTest
+		selfTestMu.Unlock()
+		if report == nil {
+			http.Error(w, "no self-test has run yet", http.StatusNotFound)
+			return
+		}
+	case "POST":
+		var err error
+		report, err = runSelfTest(r.Context(), splitEmails(selfTest.emails), splitEmails(selfTest.operators))
+		if err != nil && report == nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	blob, _ := json.MarshalIndent(report, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Passed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(blob)
+}
@@ -0,0 +1,268 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// serveFlags registers the flags of "bencher serve", which serves the API.
+func serveFlags(fs *flag.FlagSet) func(context.Context, []string) error {
+	var port, adminPort int
+	var http2 bool
+	var domains string
+	var apiKeysPath string
+	var signingKeyPath string
+	var submissionKeyPath string
+	var anonymizeKeyPath string
+	var unsubscribeKeyPath string
+	tlsOpts := new(tlsOptions)
+	cors := new(corsConfig)
+	var corsOrigins string
+	rates := new(bencher.Pricing)
+	var sampler, spanNames string
+	var quotaSpec string
+	var featureSpec string
+	lc := new(loginConfig)
+	rs := new(refreshSchedule)
+	var refreshRepos string
+	var errorReporting string
+	sc := newStorageConfig(fs)
+	fs.IntVar(&port, "port", 7788, "the port to run the server")
+	fs.IntVar(&adminPort, "admin-port", 7789, "the port serving /metrics, /debug and /admin, or 0 to disable them")
+	fs.BoolVar(&http2, "http2", false, "whether to run it as an HTTP/2 and HTTPS enabled server")
+	fs.StringVar(&domains, "domains", "", "the comma separated list of domains e.g. foo.example.org,baz.example.com")
+	fs.StringVar(&apiKeysPath, "api-keys", "", "the path to a file listing the API keys allowed to call the API, one per line optionally followed by its role: viewer, submitter or admin")
+	fs.BoolVar(&publicRead, "public-read", false, "whether anyone may read the dashboard, runs and comparisons without an API key, e.g. for open source projects")
+	fs.StringVar(&signingKeyPath, "release-signing-key", "", "the path to a file with a base64 encoded 32 byte ed25519 seed with which release reports are signed, or blank not to sign them")
+	fs.StringVar(&submissionKeyPath, "submission-key", "", "the path to a file with a base64 encoded 32 byte key signing the tokens of submission URLs, or blank for a random key, with which they don't outlive the server")
+	fs.StringVar(&anonymizeKeyPath, "anonymize-key", "", "the path to a file with a base64 encoded 32 byte key deriving the aliases of exported runs, or blank for a random key, with which they change with restarts")
+	fs.StringVar(&unsubscribeKeyPath, "unsubscribe-key", "", "the path to a file with a base64 encoded 32 byte key signing the links through which alert emails unsubscribe or change their preferences, requires -dashboard-url; blank not to add such links")
+	fs.StringVar(&submissionsDir, "submissions-dir", submissionsDir, "the directory recording the submission URLs that were used, lest they are used again")
+	fs.StringVar(&tlsOpts.certFile, "tls-cert", "", "the path to a TLS certificate to serve instead of obtaining one from Let's Encrypt for -domains")
+	fs.StringVar(&tlsOpts.keyFile, "tls-key", "", "the path to the key of -tls-cert")
+	fs.StringVar(&tlsOpts.clientCAFile, "client-ca-file", "", "the path to a PEM bundle of certificate authorities of which callers must present a client certificate, requires -http2")
+	fs.StringVar(&corsOrigins, "cors-origins", "", "the comma separated origins allowed to call the API from browsers e.g. https://dash.example.org, or * for any")
+	fs.StringVar(&cors.methods, "cors-methods", "GET, POST, OPTIONS", "the methods allowed in cross-origin requests")
+	fs.StringVar(&cors.headers, "cors-headers", "Authorization, Content-Type", "the headers allowed in cross-origin requests")
+	fs.StringVar(&dashboardURL, "dashboard-url", "", "the public base URL of this server e.g. https://bench.example.org, to link benchmarks in reports to their history charts")
+	fs.StringVar(&emailSubject, "email-subject", "", `the default template of notification subjects e.g. "[bench][{{.Repo}}@{{.Ref}}] {{.Regressions}} regressions"`)
+	fs.StringVar(&emailFrom, "email-from", "", "the default template of the notifications' sender, -app-email if blank")
+	fs.StringVar(&emailReplyTo, "email-reply-to", "", "the default template of the notifications' Reply-To address")
+	fs.Float64Var(&rates.MachineHourly, "machine-hourly-rate", 0, "the hourly cost of the benchmarking machine, to estimate the cost of runs")
+	fs.Float64Var(&rates.StorageGBMonth, "storage-gb-month-rate", 0, "the monthly cost of storing a GB, to estimate the cost of runs")
+	fs.Float64Var(&rates.EgressGB, "egress-gb-rate", 0, "the cost of retrieving a GB from storage, to estimate the cost of runs")
+	fs.StringVar(&quotaSpec, "machine-minute-quotas", "", `the comma separated monthly machine minutes that runs of repositories matching a pattern may take, e.g. "go.opencensus.io=600,github.com/orijtech/*=1200", or blank for none`)
+	fs.StringVar(&featureSpec, "feature-flags", "", `the comma separated initial toggles of subsystems, per repository pattern or for all, e.g. "profiling=off,go.opencensus.io:profiling=on"; see /admin/feature-flags`)
+	fs.DurationVar(&heartbeatInterval, "heartbeat", 0, "how often to write a newline to /benchmark responses while the benchmarks run, lest proxies drop idle connections, or 0 not to")
+	fs.StringVar(&uploadsDir, "uploads-dir", uploadsDir, "the directory holding the chunked uploads of artifacts until they are complete")
+	fs.IntVar(&queue.maxRunning, "max-running", 1, "the number of runs benchmarking at once, lest they contend for the CPU")
+	fs.IntVar(&queue.maxQueued, "max-queued", 16, "the number of runs waiting for their turn, beyond which requests are rejected with 503 and Retry-After")
+	fs.StringVar(&shadowComparer, "shadow-comparer", "", "the name of a comparer to run alongside each request's, only recording and logging where it disagrees, or blank not to")
+	fs.StringVar(&serviceName, "service-name", bencher.DefaultServiceName, "the service the server's spans, metrics and error reports are of, as reported to the tracing backend, Prometheus and -error-reporting")
+	fs.StringVar(&spanNames, "span-convention", "default", `how the server's spans are named: "default" e.g. "bencher.benchmark-and-email", with the service, repository and run as attributes, or "legacy" e.g. "/benchmark-and-email" without any`)
+	fs.StringVar(&sampler, "trace-sampler", "", `how the server's traces are sampled: "always", "never" or with a probability e.g. "0.01"; the OpenCensus default if blank`)
+	fs.StringVar(&lc.provider, "login", "", `how people sign in to the dashboard and admin endpoints: "google" or "github", or blank to only use API keys`)
+	fs.StringVar(&lc.clientID, "login-client-id", "", "the OAuth client ID registered with the -login provider")
+	fs.StringVar(&lc.clientSecret, "login-client-secret", "", "the OAuth client secret registered with the -login provider")
+	fs.StringVar(&lc.redirectURL, "login-redirect-url", "", "the OAuth redirect URL registered with the -login provider e.g. https://bench.example.org/oauth/callback")
+	fs.StringVar(&lc.allow, "login-allow", "", `the comma separated email addresses or domains with -login=google, or organizations or "org/team" teams with -login=github, allowed to sign in`)
+	fs.StringVar(&lc.roles, "login-roles", "", `the comma separated roles of people signed in, by identity or -login-allow entry e.g. "census-instrumentation/go-maintainers=admin,jane=submitter"; everyone else is a viewer`)
+	fs.StringVar(&errorReporting, "error-reporting", "", `where panics and failed runs are reported besides the logs: "stackdriver" for Stackdriver Error Reporting in -project, "sentry" for the Sentry project of $BENCHER_SENTRY_DSN, or blank for neither`)
+	fs.StringVar(&refreshRepos, "refresh-repos", "", "the comma separated repositories to benchmark daily, refreshing their baselines, or blank not to")
+	fs.StringVar(&rs.at, "refresh-at", "00:00", "the time of day in -timezone at which -refresh-repos are refreshed")
+	fs.IntVar(&rs.concurrency, "refresh-concurrency", 1, "the number of -refresh-repos benchmarked at a time")
+	fs.DurationVar(&rs.jitter, "refresh-jitter", 30*time.Minute, "the window after -refresh-at within which each of -refresh-repos starts at random, lest they all start at once")
+	fs.DurationVar(&selfTest.interval, "self-test-interval", 0, "how often to run the pipeline end to end on a canary repository, or 0 not to")
+	fs.StringVar(&selfTest.emails, "self-test-emails", "", "the comma separated addresses, e.g. of a test channel, notified by every self-test")
+	fs.StringVar(&selfTest.operators, "self-test-operators", "", "the comma separated addresses of the operators alerted when a self-test fails")
+
+	return func(ctx context.Context, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		for _, origin := range strings.Split(corsOrigins, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				cors.origins = append(cors.origins, origin)
+			}
+		}
+
+		defaults := &bencher.Request{EmailSubject: emailSubject, EmailFrom: emailFrom, EmailReplyTo: emailReplyTo, AppEmail: appEmail}
+		if err := defaults.ValidateTemplates(); err != nil {
+			return fmt.Errorf("Invalid email templates: %v", err)
+		}
+
+		if queue.maxRunning < 1 || queue.maxQueued < 0 {
+			return fmt.Errorf("expecting -max-running to be positive and -max-queued not to be negative")
+		}
+
+		if *rates != (bencher.Pricing{}) {
+			pricing = rates
+		}
+
+		var err error
+		if quotas, err = bencher.ParseQuotas(quotaSpec); err != nil {
+			return fmt.Errorf("Invalid -machine-minute-quotas: %v", err)
+		}
+		if featureFlags, err = bencher.ParseFeatureFlags(featureSpec); err != nil {
+			return fmt.Errorf("Invalid -feature-flags: %v", err)
+		}
+		if spanConvention, err = bencher.ParseSpanConvention(spanNames); err != nil {
+			return fmt.Errorf("Invalid -span-convention: %v", err)
+		}
+		if serviceName == "" {
+			return fmt.Errorf("expecting a non-blank -service-name")
+		}
+		if sampler != "" {
+			if traceSampler, err = bencher.ParseSampler(sampler); err != nil {
+				return fmt.Errorf("Invalid -trace-sampler: %v", err)
+			}
+		}
+
+		if signingKeyPath != "" {
+			seed, err := loadEncryptionKey(signingKeyPath)
+			if err != nil {
+				return fmt.Errorf("Loading the release signing key: %v", err)
+			}
+			signingKey = ed25519.NewKeyFromSeed(seed)
+			log.Printf("Signing release reports with public key %s", base64.StdEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey)))
+		}
+
+		if err := setUpSubmissionKey(submissionKeyPath); err != nil {
+			return err
+		}
+		if err := setUpAnonymizeKey(anonymizeKeyPath); err != nil {
+			return err
+		}
+		if unsubscribeKeyPath != "" {
+			if dashboardURL == "" {
+				return fmt.Errorf("expecting -dashboard-url with -unsubscribe-key, to link to")
+			}
+			if unsubscribeKey, err = loadEncryptionKey(unsubscribeKeyPath); err != nil {
+				return fmt.Errorf("Loading the unsubscribe key: %v", err)
+			}
+		}
+
+		if login, err = lc.setUp(); err != nil {
+			return fmt.Errorf("Configuring login: %v", err)
+		}
+		if apiKeysPath == "" {
+			if login == nil {
+				log.Printf("No API keys configured, the API is accessible by anyone")
+			}
+		} else if err := loadAPIKeys(apiKeysPath); err != nil {
+			return fmt.Errorf("Loading API keys: %v", err)
+		}
+
+		mux := http.NewServeMux()
+		submit := withQueue(http.HandlerFunc(handleBenchmarking))
+		mux.Handle("/benchmark", withSubmissionToken(submit, withRole(roleSubmitter, submit)))
+		mux.Handle("/compare", withPublicRead(http.HandlerFunc(handleCompare)))
+		mux.Handle("/compare-versions", withRole(roleSubmitter, withQueue(http.HandlerFunc(handleCompareVersions))))
+		mux.Handle("/release-report", withRole(roleSubmitter, withQueue(http.HandlerFunc(handleReleaseReport))))
+		mux.Handle("/repos", withPublicRead(http.HandlerFunc(handleListRepos)))
+		mux.Handle("/runs", withPublicRead(http.HandlerFunc(handleListRuns)))
+		mux.Handle("/runs/", withPublicRead(http.HandlerFunc(handleRun)))
+		mux.Handle("/pulls", withPublicRead(http.HandlerFunc(handlePullRequest)))
+		mux.Handle("/import", withRole(roleAdmin, http.HandlerFunc(handleImport)))
+		mux.Handle("/costs", withRole(roleViewer, http.HandlerFunc(handleCosts)))
+		mux.Handle("/quota", withRole(roleViewer, http.HandlerFunc(handleQuota)))
+		mux.Handle("/health-score", withPublicRead(http.HandlerFunc(handleHealthScore)))
+		mux.Handle("/search", withPublicRead(http.HandlerFunc(handleSearch)))
+		mux.Handle("/simulate-policy", withRole(roleViewer, http.HandlerFunc(handleSimulatePolicy)))
+		mux.Handle("/uploads", withRole(roleSubmitter, http.HandlerFunc(handleCreateUpload)))
+		mux.Handle("/uploads/", withRole(roleSubmitter, http.HandlerFunc(handleUpload)))
+		mux.Handle("/dashboard/", withPublicRead(http.HandlerFunc(handleDashboard)))
+		mux.Handle("/ping", http.HandlerFunc(health))
+		if unsubscribeKey != nil {
+			mux.HandleFunc("/preferences", handlePreferences)
+		}
+		if login != nil {
+			mux.HandleFunc("/login", handleLogin)
+			mux.HandleFunc("/oauth/callback", handleOAuthCallback)
+		}
+
+		if err := sc.setUp(context.Background()); err != nil {
+			return err
+		}
+		if err := setUpErrorReporting(errorReporting); err != nil {
+			return err
+		}
+
+		if adminPort > 0 {
+			go serveAdmin(adminPort)
+		}
+		if refreshRepos != "" {
+			if err := rs.setUp(refreshRepos); err != nil {
+				return err
+			}
+			go rs.run(ctx)
+		}
+		if selfTest.interval > 0 {
+			go selfTest.run(ctx)
+		}
+		handler := &ochttp.Handler{
+			Handler:      withPanicReporting(withCORS(cors, mux)),
+			StartOptions: trace.StartOptions{Sampler: traceSampler},
+		}
+
+		if !http2 {
+			addr := fmt.Sprintf(":%d", port)
+			log.Printf("Running non-HTTP/2 bencher server at %q", addr)
+			if err := http.ListenAndServe(addr, handler); err != nil {
+				return fmt.Errorf("ListenAndServe: %v", err)
+			}
+			return nil
+		}
+
+		allDomains := strings.Split(domains, ",")
+		if tlsOpts.certFile == "" && (len(allDomains) == 0 || strings.TrimSpace(allDomains[0]) == "") {
+			return fmt.Errorf("expecting at least one non-blank domain, separated by comma if many")
+		}
+		if tlsOpts.certFile == "" && tlsOpts.clientCAFile == "" {
+			// Otherwise time to run it as an HTTP/2 and HTTPS enabled server
+			return http.Serve(autocert.NewListener(allDomains...), handler)
+		}
+
+		tlsOpts.domains = allDomains
+		tlsConfig, err := serverTLSConfig(tlsOpts)
+		if err != nil {
+			return fmt.Errorf("Configuring TLS: %v", err)
+		}
+		ln, err := tls.Listen("tcp", ":443", tlsConfig)
+		if err != nil {
+			return fmt.Errorf("Listening for TLS: %v", err)
+		}
+		if tlsOpts.clientCAFile != "" {
+			log.Printf("Requiring client certificates signed by the authorities in %q", tlsOpts.clientCAFile)
+		}
+		return http.Serve(ln, handler)
+	}
+}
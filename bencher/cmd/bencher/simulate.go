@@ -0,0 +1,64 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// maxPolicySize bounds the policies POSTed to be simulated.
+const maxPolicySize = 64 << 10
+
+// handleSimulatePolicy serves POST /simulate-policy?repo=<repo>&window=<n>&tag=<key=value>
+// with a gating policy as the body, how it would have judged the stored runs.
+func handleSimulatePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	query := r.URL.Query()
+	repo := query.Get("repo")
+	if repo == "" {
+		http.Error(w, "expecting a non-blank repo", http.StatusBadRequest)
+		return
+	}
+	window, _ := strconv.Atoi(query.Get("window"))
+	text, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPolicySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy, err := bencher.ParsePolicy(string(text))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sim, err := newRequest(repo).SimulatePolicy(r.Context(), policy, parseTagFilters(query["tag"]), window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, _ := json.Marshal(sim)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
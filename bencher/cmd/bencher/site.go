@@ -0,0 +1,306 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+func publishSiteFlags(fs *flag.FlagSet) func(context.Context, []string) error {
+	sc := newStorageConfig(fs)
+	var out, to, goarch string
+	var limit int
+	fs.StringVar(&out, "out", "", "the directory to write the site to")
+	fs.StringVar(&to, "to", "", "where to publish the site, as <publisher>:<target> e.g. gcs-site:bench.example.org/opencensus")
+	fs.StringVar(&goarch, "goarch", "", "the architecture whose results to chart, or blank for every one")
+	fs.IntVar(&limit, "limit", 30, "the number of most recent runs of each repository to render")
+
+	return func(ctx context.Context, args []string) error {
+		if out == "" && to == "" {
+			return fmt.Errorf("expecting -out, -to or both")
+		}
+		if err := sc.setUp(ctx); err != nil {
+			return err
+		}
+		repos := args
+		if len(repos) == 0 {
+			infos, err := newRequest("").ListRepos(ctx)
+			if err != nil {
+				return err
+			}
+			for _, ri := range infos {
+				repos = append(repos, ri.Repo)
+			}
+		}
+
+		sb := &siteBuilder{goarch: goarch, limit: limit}
+		if err := sb.build(ctx, repos); err != nil {
+			return err
+		}
+		if out != "" {
+			for _, page := range sb.pages {
+				path := filepath.Join(out, filepath.FromSlash(page.Name))
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					return err
+				}
+				if err := ioutil.WriteFile(path, page.Body, 0644); err != nil {
+					return err
+				}
+			}
+			fmt.Printf("Wrote %d pages to %s\n", len(sb.pages), out)
+		}
+		if to != "" {
+			url, err := newRequest("").Publish(ctx, to, sb.pages)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Published %d pages to %s\n", len(sb.pages), url)
+		}
+		return nil
+	}
+}
+
+// siteBuilder renders the stored history of repositories into the pages
+// of a static site, linked relatively so that it can be served from any
+// origin: an index of the repositories, and for each repository an index
+// of its recent runs and benchmarks, a page charting the trend of each
+// benchmark, and a page with the comparison of each run.
+type siteBuilder struct {
+	goarch string
+	limit  int
+	pages  []*bencher.PublishedArtifact
+}
+
+type siteRepo struct {
+	Repo string
+	Dir  string
+	Runs int
+	Last time.Time
+}
+
+type siteRun struct {
+	*bencher.Run
+	// Page is the run's comparison page, blank if it has none e.g.
+	// because it is the first run or has no results.
+	Page string
+}
+
+type siteBenchmark struct {
+	Name, Page string
+}
+
+func (sb *siteBuilder) build(ctx context.Context, repos []string) error {
+	var index []*siteRepo
+	for _, repo := range repos {
+		sr, err := sb.buildRepo(ctx, repo)
+		if err != nil {
+			return fmt.Errorf("Rendering %s: %v", repo, err)
+		}
+		index = append(index, sr)
+	}
+	data := map[string]interface{}{
+		"Repos":       index,
+		"GeneratedAt": time.Now().UTC().Format(time.RFC3339),
+	}
+	return sb.render("index.html", siteIndexTmpl, data)
+}
+
+func (sb *siteBuilder) buildRepo(ctx context.Context, repo string) (*siteRepo, error) {
+	brq := newRequest(repo)
+	var runs []*bencher.Run
+	rf := &bencher.RunFilter{PageSize: math.MaxInt32}
+	_, err := brq.WalkRuns(ctx, rf, func(run *bencher.Run) error {
+		if runs = append(runs, run); len(runs) > sb.limit {
+			runs = runs[1:]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	histories, err := brq.BenchmarkHistories(ctx, sb.goarch, sb.limit)
+	if err != nil {
+		return nil, err
+	}
+
+	sr := &siteRepo{Repo: repo, Dir: repo + "/", Runs: len(runs)}
+	if len(runs) > 0 {
+		sr.Last = runs[len(runs)-1].StartTime
+	}
+
+	// Runs are listed newest first.
+	siteRuns := make([]*siteRun, 0, len(runs))
+	for i := len(runs) - 1; i >= 0; i-- {
+		run := &siteRun{Run: runs[i]}
+		siteRuns = append(siteRuns, run)
+		if run.Status == bencher.RunStatusNoBenchmarks || run.Compacted != "" {
+			continue
+		}
+		res, err := brq.ExportRun(ctx, run.ID, nil)
+		if err != nil {
+			// The first run has nothing to be compared against.
+			log.Printf("Skipping the comparison of run %s of %s: %v", run.ID, repo, err)
+			continue
+		}
+		run.Page = "runs/" + siteFileName(run.ID) + ".html"
+		data := map[string]interface{}{
+			"Repo":   repo,
+			"Run":    run.Run,
+			"Report": template.HTML(res.HTMLBenchmarks),
+		}
+		if err := sb.render(sr.Dir+run.Page, siteRunTmpl, data); err != nil {
+			return nil, err
+		}
+	}
+
+	benchmarks := make([]*siteBenchmark, 0, len(histories))
+	for name, history := range histories {
+		sbm := &siteBenchmark{Name: name, Page: "bench/" + siteFileName(name) + ".html"}
+		benchmarks = append(benchmarks, sbm)
+		data := map[string]interface{}{
+			"Repo":      repo,
+			"Benchmark": name,
+			"Charts":    newCharts(history),
+			"Width":     chartWidth,
+			"Height":    chartHeight,
+		}
+		if err := sb.render(sr.Dir+sbm.Page, siteBenchmarkTmpl, data); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(benchmarks, func(i, j int) bool { return benchmarks[i].Name < benchmarks[j].Name })
+
+	data := map[string]interface{}{
+		"Repo":       repo,
+		"Runs":       siteRuns,
+		"Benchmarks": benchmarks,
+	}
+	return sr, sb.render(sr.Dir+"index.html", siteRepoTmpl, data)
+}
+
+// render adds the page rendered from tmpl with data, along with "Root",
+// the relative path from the page to the site's root.
+func (sb *siteBuilder) render(name string, tmpl *template.Template, data map[string]interface{}) error {
+	data["Root"] = strings.Repeat("../", strings.Count(name, "/"))
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, data); err != nil {
+		return err
+	}
+	sb.pages = append(sb.pages, &bencher.PublishedArtifact{
+		Name:        name,
+		ContentType: "text/html; charset=utf-8",
+		Body:        buf.Bytes(),
+	})
+	return nil
+}
+
+var siteUnsafeRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// siteFileName makes a run ID or benchmark name e.g. "Encode/small-8"
+// usable as a file name, without characters that need escaping in URLs.
+func siteFileName(name string) string {
+	return siteUnsafeRe.ReplaceAllString(name, "_")
+}
+
+const siteStyle = `<style>
+body { font-family: sans-serif; max-width: 960px; margin: auto; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 0.8em; text-align: left; border-bottom: 1px solid #eee; }
+svg { border: 1px solid #ddd; margin-bottom: 1em; }
+polyline { fill: none; stroke: #264653; stroke-width: 2; }
+circle { fill: #e76f51; }
+</style>`
+
+var siteTmpl = template.Must(template.New("site").Parse(`{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}}</title>
+` + siteStyle + `
+</head>
+<body>
+{{end}}`))
+
+var siteIndexTmpl = template.Must(template.Must(siteTmpl.Clone()).Parse(`{{template "head" "Benchmarks"}}
+<h2>Benchmarks</h2>
+<table>
+<tr><th>Repository</th><th>Runs</th><th>Last run</th></tr>
+{{range .Repos}}<tr><td><a href="{{$.Root}}{{.Dir}}index.html">{{.Repo}}</a></td><td>{{.Runs}}</td><td>{{if not .Last.IsZero}}{{.Last.Format "2006-01-02 15:04 MST"}}{{end}}</td></tr>
+{{end}}
+</table>
+<p>Generated at {{.GeneratedAt}}.</p>
+</body>
+</html>
+`))
+
+var siteRepoTmpl = template.Must(template.Must(siteTmpl.Clone()).Parse(`{{template "head" .Repo}}
+<p><a href="{{.Root}}index.html">All repositories</a></p>
+<h2>{{.Repo}}</h2>
+<h3>Recent runs</h3>
+<table>
+<tr><th>Start time</th><th>Revision</th><th>Status</th></tr>
+{{range .Runs}}<tr><td>{{if .Page}}<a href="{{.Page}}">{{.StartTime.Format "2006-01-02 15:04 MST"}}</a>{{else}}{{.StartTime.Format "2006-01-02 15:04 MST"}}{{end}}</td><td>{{or .Commit .Revision}}</td><td>{{if .Compacted}}compacted{{else}}{{or .Status "ok"}}{{end}}</td></tr>
+{{else}}<tr><td colspan="3">No runs were found.</td></tr>
+{{end}}
+</table>
+<h3>Benchmarks</h3>
+<ul>
+{{range .Benchmarks}}<li><a href="{{.Page}}">{{.Name}}</a></li>
+{{else}}<li>No benchmarks were found.</li>
+{{end}}
+</ul>
+</body>
+</html>
+`))
+
+var siteBenchmarkTmpl = template.Must(template.Must(siteTmpl.Clone()).Parse(`{{template "head" .Benchmark}}
+<p><a href="{{.Root}}index.html">All repositories</a> / <a href="../index.html">{{.Repo}}</a></p>
+<h2>{{.Benchmark}}</h2>
+{{range .Charts}}
+<h3>{{.Unit}}{{with .GOARCH}} on {{.}}{{end}}</h3>
+<p>min {{printf "%.4g" .Min}}, max {{printf "%.4g" .Max}}</p>
+<svg width="{{$.Width}}" height="{{$.Height}}">
+<polyline points="{{.Polyline}}" />
+{{range .Points}}<circle cx="{{printf "%.1f" .X}}" cy="{{printf "%.1f" .Y}}" r="3"><title>{{.Label}}</title></circle>
+{{end}}
+</svg>
+{{end}}
+</body>
+</html>
+`))
+
+var siteRunTmpl = template.Must(template.Must(siteTmpl.Clone()).Parse(`{{template "head" .Repo}}
+<p><a href="{{.Root}}index.html">All repositories</a> / <a href="../index.html">{{.Repo}}</a></p>
+<h2>Run at {{.Run.StartTime.Format "2006-01-02 15:04 MST"}}</h2>
+<p>{{with .Run.Commit}}Commit {{.}}, {{end}}compared against the run before it.</p>
+{{.Report}}
+</body>
+</html>
+`))
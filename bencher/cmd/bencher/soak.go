@@ -0,0 +1,82 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// soakFlags registers the flags of "bencher soak", which runs a
+// benchmark of a repository continuously, printing its samples, and
+// fails if it degraded over time.
+func soakFlags(fs *flag.FlagSet) func(context.Context, []string) error {
+	sc := newStorageConfig(fs)
+	spec := new(bencher.SoakSpec)
+	var vcs, revision, emails string
+	fs.StringVar(&spec.Package, "pkg", ".", "the package of the benchmark e.g. ./trace")
+	fs.DurationVar(&spec.Duration, "duration", time.Hour, "how long to run the benchmark for")
+	fs.DurationVar(&spec.Interval, "interval", 10*time.Second, "how long every sample is measured for")
+	fs.Float64Var(&spec.MaxDegradation, "max-degradation", 10, "by how many percent a metric may worsen from the first to the last quarter of the samples")
+	fs.StringVar(&vcs, "vcs", "", `how the sources are checked out: "gopath", "git", "module" or a registered VCS; "gopath" if blank`)
+	fs.StringVar(&revision, "revision", "", "the commit, branch or tag to check out with -vcs=git, or the version with -vcs=module")
+	fs.StringVar(&emails, "email", "", "the comma separated addresses to email degradations to, or blank not to email them")
+
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 2 {
+			return errUsage
+		}
+		if err := sc.setUp(ctx); err != nil {
+			return err
+		}
+		brq := newRequest(args[0])
+		brq.VCS, brq.Revision = vcs, revision
+		if emails != "" {
+			for _, email := range strings.Split(emails, ",") {
+				brq.AlertEmails = append(brq.AlertEmails, strings.TrimSpace(email))
+			}
+		}
+		spec.Benchmark = strings.TrimPrefix(args[1], "Benchmark")
+		spec.OnSample = func(s *bencher.SoakSample) {
+			fmt.Printf("%8s  %12.1f ns/op  %12.0f ops/s  %8.0f B/op  %6.0f allocs/op\n",
+				s.Elapsed.Round(time.Second), s.NsPerOp, s.OpsPerSec, s.BytesPerOp, s.AllocsPerOp)
+		}
+
+		report, err := brq.Soak(ctx, spec)
+		if err != nil {
+			return err
+		}
+		metrics := make([]string, 0, len(report.Trends))
+		for metric := range report.Trends {
+			metrics = append(metrics, metric)
+		}
+		sort.Strings(metrics)
+		fmt.Println()
+		for _, metric := range metrics {
+			fmt.Printf("%s: %+.2f%% from the first to the last quarter\n", metric, report.Trends[metric])
+		}
+		fmt.Printf("Stored at %s\n", report.URL)
+		if len(report.Degradations) > 0 {
+			return fmt.Errorf("%s degraded:\n  %s", report.Benchmark, strings.Join(report.Degradations, "\n  "))
+		}
+		return nil
+	}
+}
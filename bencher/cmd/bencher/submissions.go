@@ -0,0 +1,270 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSubmissionTTL = time.Hour
+	// maxSubmissionTTL bounds how long a submission URL is valid,
+	// and so how long its use is remembered.
+	maxSubmissionTTL = 7 * 24 * time.Hour
+)
+
+// submissionKey signs the tokens of submission URLs. Unless loaded from
+// -submission-key, it is random, hence tokens don't outlive the server.
+var submissionKey []byte
+
+// submissionsDir records the tokens that were used, on disk so that a
+// token can't be used again after a restart of the server.
+var submissionsDir = filepath.Join(os.TempDir(), "bencher-submissions")
+
+// submissionToken allows a single /benchmark submission of a repository,
+// and of a revision if Ref is set, without an API key.
+type submissionToken struct {
+	Repo   string `json:"repo"`
+	Ref    string `json:"ref,omitempty"`
+	Expiry int64  `json:"exp"`
+	Nonce  string `json:"nonce"`
+}
+
+func setUpSubmissionKey(path string) (err error) {
+	if path != "" {
+		if submissionKey, err = loadEncryptionKey(path); err != nil {
+			return fmt.Errorf("Loading the submission key: %v", err)
+		}
+		return nil
+	}
+	submissionKey = make([]byte, 32)
+	_, err = rand.Read(submissionKey)
+	return err
+}
+
+func signSubmission(payload string) string {
+	mac := hmac.New(sha256.New, submissionKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newSubmissionToken returns the signed token of a submission of
+// repo at ref, valid for ttl.
+func newSubmissionToken(repo, ref string, ttl time.Duration) (string, *submissionToken, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	st := &submissionToken{
+		Repo:   repo,
+		Ref:    ref,
+		Expiry: time.Now().Add(ttl).Unix(),
+		Nonce:  hex.EncodeToString(nonce),
+	}
+	blob, err := json.Marshal(st)
+	if err != nil {
+		return "", nil, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(blob)
+	return payload + "." + signSubmission(payload), st, nil
+}
+
+// parseSubmissionToken returns the unexpired token signed by this server.
+func parseSubmissionToken(value string) (*submissionToken, error) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 || !hmac.Equal([]byte(value[i+1:]), []byte(signSubmission(value[:i]))) {
+		return nil, fmt.Errorf("invalid submission token")
+	}
+	blob, err := base64.RawURLEncoding.DecodeString(value[:i])
+	if err != nil {
+		return nil, fmt.Errorf("invalid submission token")
+	}
+	st := new(submissionToken)
+	if err := json.Unmarshal(blob, st); err != nil || st.Nonce == "" {
+		return nil, fmt.Errorf("invalid submission token")
+	}
+	if time.Now().Unix() > st.Expiry {
+		return nil, fmt.Errorf("expired submission token")
+	}
+	return st, nil
+}
+
+// claim uses up the token for the submission br, whose JSON is body, if
+// it is one of the token's repository and revision, so that it can't be
+// submitted again. Submissions can only set the fields of submissionFields,
+// hence can't choose what is checked out or run, the baseline, who is
+// notified or where, which need the server's credentials.
+func (st *submissionToken) claim(br *benchRequest, body []byte) error {
+	switch {
+	case br.GitRepoURL != st.Repo || len(br.Suite) > 0:
+		return fmt.Errorf("the submission token is only valid for %q", st.Repo)
+	case st.Ref != "" && br.Revision != st.Ref:
+		return fmt.Errorf("the submission token is only valid for revision %q of %q", st.Ref, st.Repo)
+	}
+	fields, err := privilegedFields(body)
+	if err != nil {
+		return err
+	}
+	if len(fields) > 0 {
+		return fmt.Errorf("the submission token doesn't allow setting %s", strings.Join(fields, ", "))
+	}
+	if err := os.MkdirAll(submissionsDir, 0700); err != nil {
+		return err
+	}
+	sweepSubmissions()
+	// Creating the file exclusively is what makes the token single use.
+	f, err := os.OpenFile(filepath.Join(submissionsDir, st.Nonce), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return fmt.Errorf("the submission token was already used")
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// submissionFields are the fields of benchRequest that submissions with
+// a token may set: the revision benchmarked, the knobs of the benchmarks
+// and how their report reads.
+var submissionFields = map[string]bool{
+	"git_repo_url":  true,
+	"revision":      true,
+	"profile":       true,
+	"gogc":          true,
+	"godebug":       true,
+	"seed":          true,
+	"time_budget":   true,
+	"zero_allocs":   true,
+	"comparer":      true,
+	"outliers":      true,
+	"group_by":      true,
+	"timezone":      true,
+	"locale":        true,
+	"number_format": true,
+	"units_of_work": true,
+}
+
+// privilegedFields returns the sorted JSON names of the fields set in
+// body, other than to null, false, zero or empty values, that submissions
+// with a token can't set.
+func privilegedFields(body []byte) ([]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	var fields []string
+	for name, value := range raw {
+		if submissionFields[name] {
+			continue
+		}
+		switch string(bytes.TrimSpace(value)) {
+		case "null", "false", "0", `""`, "[]", "{}":
+			continue
+		}
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
+
+// sweepSubmissions forgets the used tokens that have expired anyway.
+func sweepSubmissions() {
+	infos, err := ioutil.ReadDir(submissionsDir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if time.Since(info.ModTime()) > maxSubmissionTTL {
+			os.Remove(filepath.Join(submissionsDir, info.Name()))
+		}
+	}
+}
+
+type submissionTokenKey struct{}
+
+// withSubmissionToken serves requests bearing a valid submission token
+// in "token" with h, with the token in their context for the handler to
+// claim, and any other request with authed.
+func withSubmissionToken(h, authed http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.URL.Query().Get("token")
+		if value == "" {
+			authed.ServeHTTP(w, r)
+			return
+		}
+		st, err := parseSubmissionToken(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), submissionTokenKey{}, st)))
+	})
+}
+
+// handleSubmissionURL serves POST /admin/submission-url?repo=<repo>&ref=<revision>&ttl=<duration>
+// with a URL allowing a single /benchmark submission of the repository,
+// and of the revision if given, for ttl, an hour by default, e.g. for
+// the CI of a one-off external contributor instead of an API key.
+func handleSubmissionURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	repo := query.Get("repo")
+	if repo == "" {
+		http.Error(w, "expecting a non-blank repo", http.StatusBadRequest)
+		return
+	}
+	ttl := defaultSubmissionTTL
+	if value := query.Get("ttl"); value != "" {
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil || ttl <= 0 || ttl > maxSubmissionTTL {
+			http.Error(w, fmt.Sprintf("expecting ttl to be a positive duration of at most %s", maxSubmissionTTL), http.StatusBadRequest)
+			return
+		}
+	}
+
+	token, st, err := newSubmissionToken(repo, query.Get("ref"), ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	submitURL := strings.TrimSuffix(dashboardURL, "/") + "/benchmark?token=" + url.QueryEscape(token)
+	blob, _ := json.Marshal(map[string]interface{}{
+		"url":     submitURL,
+		"repo":    st.Repo,
+		"ref":     st.Ref,
+		"expires": time.Unix(st.Expiry, 0).UTC(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(blob)
+}
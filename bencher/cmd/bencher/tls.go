@@ -0,0 +1,96 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type tlsOptions struct {
+	domains []string
+	// certFile and keyFile if set, are a static certificate
+	// and its key served instead of those from Let's Encrypt.
+	certFile, keyFile string
+	// clientCAFile if set, is a PEM bundle of the certificate
+	// authorities of which callers must present a certificate.
+	clientCAFile string
+}
+
+// serverTLSConfig returns the TLS configuration of the HTTPS listener.
+func serverTLSConfig(opts *tlsOptions) (*tls.Config, error) {
+	var cfg *tls.Config
+	// acmeChallenges is set if the listener answers Let's Encrypt's TLS-ALPN challenges.
+	acmeChallenges := false
+	switch {
+	case opts.certFile != "" || opts.keyFile != "":
+		cert, err := tls.LoadX509KeyPair(opts.certFile, opts.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Loading the TLS certificate: %v", err)
+		}
+		cfg = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	case len(opts.domains) > 0:
+		// Mirrors autocert.NewListener's defaults.
+		cacheDir := filepath.Join(os.Getenv("HOME"), ".cache", "golang-autocert")
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(opts.domains...),
+			Cache:      autocert.DirCache(cacheDir),
+		}
+		cfg = m.TLSConfig()
+		acmeChallenges = true
+
+	default:
+		return nil, errors.New("expecting either a TLS certificate and key or at least one domain")
+	}
+	cfg.NextProtos = append([]string{"h2", "http/1.1"}, cfg.NextProtos...)
+
+	if opts.clientCAFile == "" {
+		return cfg, nil
+	}
+	pem, err := ioutil.ReadFile(opts.clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", opts.clientCAFile)
+	}
+
+	mtlsCfg := cfg.Clone()
+	mtlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	mtlsCfg.ClientCAs = pool
+	// Let's Encrypt's TLS-ALPN challenges present no client certificate.
+	// They offer nothing but the challenge protocol, as autocert requires,
+	// and are only let in to negotiate it, never to go on to HTTP.
+	challengeCfg := cfg.Clone()
+	challengeCfg.NextProtos = []string{acme.ALPNProto}
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if acmeChallenges && len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+			return challengeCfg, nil
+		}
+		return mtlsCfg, nil
+	}
+	return cfg, nil
+}
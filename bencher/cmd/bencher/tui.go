@@ -0,0 +1,372 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// tuiPageSize is the number of runs listed per page.
+const tuiPageSize = 20
+
+// errQuit unwinds the screens of the TUI when quitting.
+var errQuit = errors.New("quit")
+
+// apiClient calls the API of a bencher server.
+type apiClient struct {
+	server string
+	apiKey string
+	client *http.Client
+}
+
+func (ac *apiClient) do(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	var rd io.Reader
+	if body != nil {
+		blob, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		rd = bytes.NewReader(blob)
+	}
+	u := strings.TrimSuffix(ac.server, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, rd)
+	if err != nil {
+		return nil, err
+	}
+	if ac.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+ac.apiKey)
+	}
+	res, err := ac.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4<<10))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, res.Status, bytes.TrimSpace(msg))
+	}
+	return res, nil
+}
+
+func (ac *apiClient) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	res, err := ac.do(ctx, "GET", path, query, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// tui browses a server's repositories, runs and comparisons a screen at a
+// time, reading commands a line at a time so that it works over any ssh
+// session or terminal.
+type tui struct {
+	api  *apiClient
+	in   *bufio.Scanner
+	out  io.Writer
+	term bool
+}
+
+// tuiFlags registers the flags of "bencher tui", which browses the
+// repositories, runs and comparisons of a server from the terminal.
+func tuiFlags(fs *flag.FlagSet) func(context.Context, []string) error {
+	ac := &apiClient{client: http.DefaultClient}
+	fs.StringVar(&ac.server, "server", "http://localhost:7788", "the base URL of the bencher server")
+	fs.StringVar(&ac.apiKey, "api-key", "", "the API key with which to call the server, if it requires one")
+
+	return func(ctx context.Context, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		t := &tui{api: ac, in: bufio.NewScanner(os.Stdin), out: os.Stdout, term: isTerminal(os.Stdout)}
+		if err := t.browseRepos(ctx); err != errQuit {
+			return err
+		}
+		return nil
+	}
+}
+
+func (t *tui) clear() {
+	if t.term {
+		fmt.Fprint(t.out, "\033[H\033[2J")
+	}
+}
+
+// prompt reads a command, errQuit at the end of the input or for "q".
+func (t *tui) prompt(choices string) (string, error) {
+	fmt.Fprintf(t.out, "\n%s, q(uit)> ", choices)
+	if !t.in.Scan() {
+		fmt.Fprintln(t.out)
+		return "", errQuit
+	}
+	line := strings.TrimSpace(t.in.Text())
+	if line == "q" {
+		return "", errQuit
+	}
+	return line, nil
+}
+
+// pick parses line as the number of one of n listed entries.
+func pick(line string, n int) (int, bool) {
+	i, err := strconv.Atoi(line)
+	return i - 1, err == nil && i >= 1 && i <= n
+}
+
+// show shows text through $PAGER, "less -R" by default, on a terminal.
+func (t *tui) show(text string) error {
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = "less -R"
+	}
+	if fields := strings.Fields(pager); t.term && len(fields) > 0 {
+		if _, err := exec.LookPath(fields[0]); err == nil {
+			cmd := exec.Command(fields[0], fields[1:]...)
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = strings.NewReader(text), os.Stdout, os.Stderr
+			return cmd.Run()
+		}
+	}
+	fmt.Fprintln(t.out, text)
+	_, err := t.prompt("Enter to go back")
+	return err
+}
+
+// failed shows err until acknowledged, unless it is errQuit.
+func (t *tui) failed(err error) error {
+	if err == errQuit {
+		return err
+	}
+	fmt.Fprintf(t.out, "\nError: %v\n", err)
+	_, err = t.prompt("Enter to go back")
+	return err
+}
+
+func (t *tui) browseRepos(ctx context.Context) error {
+	for {
+		var page struct {
+			Repos []*bencher.RepoInfo `json:"repos"`
+		}
+		if err := t.api.getJSON(ctx, "/repos", nil, &page); err != nil {
+			return err
+		}
+		t.clear()
+		fmt.Fprintf(t.out, "Repositories on %s\n\n", t.api.server)
+		for i, repo := range page.Repos {
+			fmt.Fprintf(t.out, "%4d  %-50s  updated %s\n", i+1, repo.Repo, repo.UpdatedAt.Local().Format(time.RFC822))
+		}
+		line, err := t.prompt("Number to browse its runs, Enter to refresh")
+		if err != nil {
+			return err
+		}
+		if i, ok := pick(line, len(page.Repos)); ok {
+			if err := t.browseRuns(ctx, page.Repos[i].Repo); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (t *tui) browseRuns(ctx context.Context, repo string) error {
+	// pages are the tokens of the pages browsed, the current one last.
+	pages := []string{""}
+	for {
+		query := url.Values{"repo": {repo}, "page_size": {strconv.Itoa(tuiPageSize)}}
+		if token := pages[len(pages)-1]; token != "" {
+			query.Set("page", token)
+		}
+		page := new(bencher.RunsPage)
+		if err := t.api.getJSON(ctx, "/runs", query, page); err != nil {
+			return t.failed(err)
+		}
+
+		t.clear()
+		fmt.Fprintf(t.out, "Runs of %s, oldest first, page %d\n\n", repo, len(pages))
+		for i, run := range page.Runs {
+			fmt.Fprintf(t.out, "%4d  %s  %s  %s\n", i+1, run.StartTime.Local().Format(time.RFC822), run.ID, runLabels(run))
+		}
+		line, err := t.prompt("Number to view, n(ext page), p(revious page), b(ack)")
+		if err != nil {
+			return err
+		}
+		switch i, ok := pick(line, len(page.Runs)); {
+		case ok:
+			if err := t.viewRun(ctx, repo, page.Runs, i); err != nil {
+				return err
+			}
+		case line == "n" && page.NextPage != "":
+			pages = append(pages, page.NextPage)
+		case line == "p" && len(pages) > 1:
+			pages = pages[:len(pages)-1]
+		case line == "b":
+			return nil
+		}
+	}
+}
+
+// runLabels summarizes the tags and state of a run on one line.
+func runLabels(run *bencher.Run) string {
+	var labels []string
+	for key, value := range run.Tags {
+		labels = append(labels, key+"="+value)
+	}
+	sort.Strings(labels)
+	if run.Deleted != nil {
+		labels = append(labels, "[deleted]")
+	}
+	if run.Compacted != "" {
+		labels = append(labels, "[compacted into "+run.Compacted+"]")
+	}
+	return strings.Join(labels, " ")
+}
+
+func (t *tui) viewRun(ctx context.Context, repo string, runs []*bencher.Run, i int) error {
+	run := runs[i]
+	for {
+		t.clear()
+		fmt.Fprintf(t.out, "Run %s of %s\n\n", run.ID, repo)
+		fmt.Fprintf(t.out, "Started   %s on %s/%s\n", run.StartTime.Local().Format(time.RFC1123), run.GOOS, run.GOARCH)
+		if labels := runLabels(run); labels != "" {
+			fmt.Fprintf(t.out, "Tags      %s\n", labels)
+		}
+		if run.Cost != nil {
+			fmt.Fprintf(t.out, "Cost      %.4f\n", run.Cost.Total)
+		}
+		if len(run.Packages) > 0 {
+			fmt.Fprintf(t.out, "\n%-50s  %-6s  %10s  %s\n", "package", "status", "elapsed", "benchmarks")
+			for _, ps := range run.Packages {
+				fmt.Fprintf(t.out, "%-50s  %-6s  %9.1fs  %d\n", ps.Package, ps.Status, ps.Elapsed, ps.Benchmarks)
+			}
+		}
+
+		choices := "r(esults), l (diff against the baseline)"
+		if i > 0 {
+			choices = "d(iff against the previous run), " + choices
+		}
+		line, err := t.prompt(choices + ", a <artifact> to view, s <artifact> <file> to save, b(ack)")
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		switch {
+		case line == "b":
+			return nil
+		case line == "r":
+			err = t.showArtifact(ctx, repo, run.ID, "benchmarks")
+		case line == "d" && i > 0:
+			err = t.showDiff(ctx, repo, runs[i-1].ID, run.ID)
+		case line == "l":
+			err = t.showDiff(ctx, repo, "latest", run.ID)
+		case len(fields) == 2 && fields[0] == "a":
+			err = t.showArtifact(ctx, repo, run.ID, fields[1])
+		case len(fields) == 3 && fields[0] == "s":
+			err = t.saveArtifact(ctx, repo, run.ID, fields[1], fields[2])
+		}
+		if err != nil {
+			if err := t.failed(err); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (t *tui) openArtifact(ctx context.Context, repo, runID, name string) (io.ReadCloser, error) {
+	res, err := t.api.do(ctx, "GET", "/runs/"+runID+"/artifact/"+name, url.Values{"repo": {repo}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (t *tui) showArtifact(ctx context.Context, repo, runID, name string) error {
+	rc, err := t.openArtifact(ctx, repo, runID, name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	blob, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	return t.show(string(blob))
+}
+
+func (t *tui) saveArtifact(ctx context.Context, repo, runID, name, path string) error {
+	rc, err := t.openArtifact(ctx, repo, runID, name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, rc)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(t.out, "Saved %d bytes to %s\n", n, path)
+	_, err = t.prompt("Enter to go back")
+	return err
+}
+
+// showDiff shows the benchstat tables comparing the stored results before
+// and after, each a run ID or e.g. "latest", as POST /compare does.
+func (t *tui) showDiff(ctx context.Context, repo, before, after string) error {
+	cr := &compareRequest{
+		GitRepoURL: repo,
+		Sets:       []*bencher.ResultSet{{Label: before, Name: before}, {Label: after, Name: after}},
+	}
+	res, err := t.api.do(ctx, "POST", "/compare", nil, cr)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	blob, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	// Unless anything changed, the server replies with plain text.
+	if !bytes.HasPrefix(blob, []byte("{")) {
+		return t.show(string(blob))
+	}
+	result := new(bencher.Result)
+	if err := json.Unmarshal(blob, result); err != nil {
+		return err
+	}
+	return t.show(result.Benchmarks)
+}
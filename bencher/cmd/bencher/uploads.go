@@ -0,0 +1,299 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+const (
+	// maxUploadSize bounds the size of an uploaded artifact.
+	maxUploadSize = 16 << 30
+	// maxChunkSize bounds the size of a single PUT of an upload.
+	maxChunkSize = 64 << 20
+	// uploadTTL is how long an unfinished upload can be resumed.
+	uploadTTL = 24 * time.Hour
+
+	partSuffix    = ".part"
+	sessionSuffix = ".json"
+)
+
+// uploadsDir holds the sessions of chunked uploads and their received
+// bytes, on disk so that uploads survive restarts of the server.
+var uploadsDir = filepath.Join(os.TempDir(), "bencher-uploads")
+
+// uploadSession is a chunked upload of an artifact of a stored run.
+type uploadSession struct {
+	ID     string    `json:"id"`
+	Repo   string    `json:"repo"`
+	RunID  string    `json:"run_id"`
+	Name   string    `json:"name"`
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256"`
+	Start  time.Time `json:"start"`
+
+	// Offset is how many bytes were received, reported but not stored.
+	Offset int64 `json:"offset"`
+	// URL is that of the stored artifact once the upload completes.
+	URL string `json:"url,omitempty"`
+	// Artifact is the name with which it is served under /runs/<run-id>/artifact/.
+	Artifact string `json:"artifact,omitempty"`
+}
+
+// uploadLocks serializes the chunks of each upload.
+var uploadLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+func lockUpload(id string) func() {
+	uploadLocks.Lock()
+	mu, ok := uploadLocks.m[id]
+	if !ok {
+		mu = new(sync.Mutex)
+		uploadLocks.m[id] = mu
+	}
+	uploadLocks.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+func uploadPath(id, suffix string) string {
+	return filepath.Join(uploadsDir, id+suffix)
+}
+
+func loadUploadSession(id string) (*uploadSession, error) {
+	blob, err := ioutil.ReadFile(uploadPath(id, sessionSuffix))
+	if err != nil {
+		return nil, err
+	}
+	us := new(uploadSession)
+	if err := json.Unmarshal(blob, us); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(uploadPath(id, partSuffix))
+	if err != nil {
+		return nil, err
+	}
+	us.Offset = info.Size()
+	return us, nil
+}
+
+func removeUploadSession(id string) {
+	_ = os.Remove(uploadPath(id, partSuffix))
+	_ = os.Remove(uploadPath(id, sessionSuffix))
+}
+
+// sweepUploads removes the uploads that weren't finished in time.
+func sweepUploads() {
+	infos, err := ioutil.ReadDir(uploadsDir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), sessionSuffix) && time.Since(info.ModTime()) > uploadTTL {
+			removeUploadSession(strings.TrimSuffix(info.Name(), sessionSuffix))
+		}
+	}
+}
+
+func writeUploadSession(w http.ResponseWriter, status int, us *uploadSession) {
+	blob, _ := json.Marshal(us)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(blob)
+}
+
+// handleCreateUpload serves POST /uploads?repo=<repo>&run=<run-id>&name=<name>&size=<bytes>&sha256=<hex>,
+// starting a chunked upload of an artifact of the stored run.
+func handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	us := &uploadSession{
+		Repo:   query.Get("repo"),
+		RunID:  query.Get("run"),
+		Name:   query.Get("name"),
+		SHA256: strings.ToLower(query.Get("sha256")),
+		Start:  time.Now(),
+	}
+	if us.Repo == "" || us.RunID == "" || us.Name == "" || strings.Contains(us.Name, "..") {
+		http.Error(w, "expecting a non-blank repo, run and name", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseInt(query.Get("size"), 10, 64)
+	if err != nil || size <= 0 || size > maxUploadSize {
+		http.Error(w, fmt.Sprintf("expecting a size of 1 to %d bytes", int64(maxUploadSize)), http.StatusBadRequest)
+		return
+	}
+	us.Size = size
+	if sum, err := hex.DecodeString(us.SHA256); err != nil || len(sum) != sha256.Size {
+		http.Error(w, "expecting the hex encoded SHA-256 of the artifact", http.StatusBadRequest)
+		return
+	}
+
+	sweepUploads()
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	us.ID = hex.EncodeToString(id)
+	if err := os.MkdirAll(uploadsDir, 0700); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, _ := json.Marshal(us)
+	if err := ioutil.WriteFile(uploadPath(us.ID, partSuffix), nil, 0600); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := ioutil.WriteFile(uploadPath(us.ID, sessionSuffix), blob, 0600); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeUploadSession(w, http.StatusCreated, us)
+}
+
+// handleUpload serves GET /uploads/<id>, how much of the upload was
+// received, and PUT /uploads/<id> with the chunk starting at the offset
+// given as "Content-Range: bytes <start>-<end>/<size>". Once every byte is
+// received and matches the SHA-256, the artifact is uploaded to storage.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		http.NotFound(w, r)
+		return
+	}
+	defer lockUpload(id)()
+
+	us, err := loadUploadSession(id)
+	if err != nil {
+		http.Error(w, "no such upload, it may have expired", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		writeUploadSession(w, http.StatusOK, us)
+		return
+	case "PUT":
+	default:
+		http.Error(w, "only GET and PUT are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	var start int64
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		if _, err := fmt.Sscanf(cr, "bytes %d-", &start); err != nil {
+			http.Error(w, "invalid Content-Range "+cr, http.StatusBadRequest)
+			return
+		}
+	}
+	// A chunk that isn't the next one is refused, with the offset to resume from.
+	if start != us.Offset {
+		writeUploadSession(w, http.StatusConflict, us)
+		return
+	}
+
+	f, err := os.OpenFile(uploadPath(id, partSuffix), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	limit := us.Size - us.Offset
+	if limit > maxChunkSize {
+		limit = maxChunkSize
+	}
+	// Bytes beyond the size are refused rather than silently dropped.
+	n, err := io.Copy(f, io.LimitReader(r.Body, limit+1))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	us.Offset += n
+	if err == nil && us.Offset > us.Size {
+		err = fmt.Errorf("chunk exceeds the upload's size of %d bytes or the chunk limit of %d bytes", us.Size, int64(maxChunkSize))
+		// Truncating restores the upload to where the chunk started.
+		if terr := os.Truncate(uploadPath(id, partSuffix), start); terr != nil {
+			err = terr
+		}
+		us.Offset = start
+	}
+	if err != nil {
+		http.Error(w, "Receiving the chunk: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if us.Offset < us.Size {
+		writeUploadSession(w, http.StatusOK, us)
+		return
+	}
+
+	if err := finishUpload(r, us); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeUploadSession(w, http.StatusOK, us)
+}
+
+// finishUpload verifies the received artifact and streams it to storage.
+func finishUpload(r *http.Request, us *uploadSession) error {
+	f, err := os.Open(uploadPath(us.ID, partSuffix))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != us.SHA256 {
+		// Nothing received can be trusted, hence the upload starts over.
+		removeUploadSession(us.ID)
+		return fmt.Errorf("SHA-256 mismatch: received %s, want %s; start a new upload", sum, us.SHA256)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	url, err := newRequest(us.Repo).UploadArtifact(r.Context(), us.RunID, us.Name, f)
+	if err != nil {
+		// The received bytes are kept so that the client can retry
+		// by PUTting an empty chunk at the upload's size.
+		log.Printf("Uploading artifact %q of run %q: %v", us.Name, us.RunID, err)
+		return err
+	}
+	removeUploadSession(us.ID)
+	us.URL, us.Artifact = url, bencher.ArtifactName(us.Name)
+	return nil
+}
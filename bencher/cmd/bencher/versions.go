@@ -0,0 +1,83 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+type versionsRequest struct {
+	// GitRepoURL is the module path e.g. "go.opencensus.io".
+	GitRepoURL string `json:"git_repo_url"`
+	Before     string `json:"before"`
+	After      string `json:"after"`
+
+	Comparer string `json:"comparer"`
+	Outliers string `json:"outliers"`
+
+	UnitsOfWork map[string]string `json:"units_of_work"`
+
+	GOGC    string `json:"gogc"`
+	GODEBUG string `json:"godebug"`
+	Seed    string `json:"seed"`
+
+	Policy string `json:"policy"`
+}
+
+// handleCompareVersions serves POST /compare-versions, benchmarking two
+// published versions of a module fetched through GOPROXY against each other.
+func handleCompareVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	vr := new(versionsRequest)
+	if err := json.NewDecoder(r.Body).Decode(vr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	brq := newRequest(vr.GitRepoURL)
+	brq.Comparer = vr.Comparer
+	brq.Outliers = vr.Outliers
+	brq.UnitsOfWork = vr.UnitsOfWork
+	brq.GOGC = vr.GOGC
+	brq.GODEBUG = vr.GODEBUG
+	brq.Seed = vr.Seed
+	brq.Policy = vr.Policy
+
+	w, stopHeartbeat := startHeartbeat(w, r)
+	results, err := brq.CompareVersions(r.Context(), vr.Before, vr.After)
+	stopHeartbeat()
+
+	switch {
+	case err == bencher.ErrNoChanges:
+		fmt.Fprintf(w, "No changes detected!")
+		return
+
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+
+	default:
+		writeResult(w, r, results)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/orijtech/opencensus-tools/bencher"
+)
+
+// watchFlags registers the flags of "bencher watch", which re-runs the
+// benchmarks of the packages of a local working tree as they are saved,
+// printing how they changed against a baseline pinned when it started.
+func watchFlags(fs *flag.FlagSet) func(context.Context, []string) error {
+	var benchtime, comparer, outliers string
+	var interval time.Duration
+	fs.StringVar(&benchtime, "benchtime", "100ms", "how long each benchmark runs, shorter than go test's default of 1s for a quicker loop")
+	fs.DurationVar(&interval, "interval", 500*time.Millisecond, "how often the working tree is checked for saved changes")
+	fs.StringVar(&comparer, "comparer", "", `how significant changes are decided: "benchstat", "bootstrap" or a registered comparer; "benchstat" if blank`)
+	fs.StringVar(&outliers, "outliers", "", `which samples to discard before comparing: "keep", "minmax" or "mad"; "keep" if blank`)
+
+	return func(ctx context.Context, args []string) error {
+		dir := "."
+		switch len(args) {
+		case 0:
+		case 1:
+			dir = args[0]
+		default:
+			return errUsage
+		}
+		if interval <= 0 {
+			return fmt.Errorf("expecting -interval to be a positive duration")
+		}
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		brq := newRequest("")
+		brq.Comparer, brq.Outliers = comparer, outliers
+
+		signatures, err := packageSignatures(dir)
+		if err != nil {
+			return err
+		}
+		pkgs := make([]string, 0, len(signatures))
+		for pkg := range signatures {
+			pkgs = append(pkgs, pkg)
+		}
+		sort.Strings(pkgs)
+		fmt.Printf("Pinning the baseline of %d packages in %s\n", len(pkgs), dir)
+		baseline, err := brq.BenchmarkPackages(ctx, dir, benchtime, pkgs)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Pinned %d packages with benchmarks, watching for changes\n", len(baseline))
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+			latest, err := packageSignatures(dir)
+			if err != nil {
+				return err
+			}
+			var changed []string
+			for pkg, sig := range latest {
+				if signatures[pkg] != sig {
+					changed = append(changed, pkg)
+				}
+			}
+			signatures = latest
+			sort.Strings(changed)
+			for _, pkg := range changed {
+				if ctx.Err() != nil {
+					return nil
+				}
+				watchPackage(ctx, brq, dir, benchtime, pkg, baseline)
+			}
+		}
+	}
+}
+
+// watchPackage re-runs the benchmarks of pkg and prints how they
+// changed against its baseline, pinning them if it has none yet.
+func watchPackage(ctx context.Context, brq *bencher.Request, dir, benchtime, pkg string, baseline map[string][]byte) {
+	fmt.Printf("\n%s %s changed, benchmarking\n", time.Now().Format("15:04:05"), pkg)
+	results, err := brq.BenchmarkPackages(ctx, dir, benchtime, []string{pkg})
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Println(err)
+		}
+		return
+	}
+	after, ok := results[pkg]
+	if !ok {
+		fmt.Printf("%s has no benchmarks\n", pkg)
+		return
+	}
+	before, ok := baseline[pkg]
+	if !ok {
+		baseline[pkg] = after
+		fmt.Printf("Pinned the baseline of %s\n", pkg)
+		return
+	}
+	res, err := brq.CompareResults(ctx, before, after)
+	switch {
+	case err == bencher.ErrNoChanges:
+		fmt.Printf("No changes detected in %s\n", pkg)
+	case err != nil:
+		fmt.Println(err)
+	default:
+		for _, warning := range res.Warnings {
+			fmt.Printf("Warning: %s\n", warning)
+		}
+		fmt.Print(res.Benchmarks)
+	}
+}
+
+// packageSignatures returns a signature of the Go files of every package
+// with tests in the tree under dir, by its relative pattern e.g. "./trace",
+// which changes whenever any of them is saved, added or removed.
+func packageSignatures(dir string) (map[string]string, error) {
+	sigs := make(map[string]*strings.Builder)
+	hasTests := make(map[string]bool)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() {
+			// As the go command does, hidden and underscored directories,
+			// testdata and vendored packages are left out.
+			if path != dir && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" || name == "vendor") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(name, ".go") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		pkg := "./" + filepath.ToSlash(rel)
+		if rel == "." {
+			pkg = "."
+		}
+		if sigs[pkg] == nil {
+			sigs[pkg] = new(strings.Builder)
+		}
+		fmt.Fprintf(sigs[pkg], "%s %d %d\n", name, info.Size(), info.ModTime().UnixNano())
+		if strings.HasSuffix(name, "_test.go") {
+			hasTests[pkg] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	signatures := make(map[string]string, len(hasTests))
+	for pkg := range hasTests {
+		signatures[pkg] = sigs[pkg].String()
+	}
+	return signatures, nil
+}
@@ -0,0 +1,297 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const summariesDir = "summaries/"
+
+// BenchmarkSummary summarizes the samples of one metric
+// of a benchmark of a package on one architecture over a week.
+type BenchmarkSummary struct {
+	Name    string `json:"name"`
+	Package string `json:"package,omitempty"`
+	GOARCH  string `json:"goarch,omitempty"`
+	Unit    string `json:"unit"`
+
+	Samples int     `json:"samples"`
+	Mean    float64 `json:"mean"`
+	StdDev  float64 `json:"stddev"`
+	// CI is the half-width of the 95% confidence interval
+	// of the mean relative to it, in percent, if known.
+	CI float64 `json:"ci,omitempty"`
+}
+
+// add merges the samples of other into s, as if they had been summarized together.
+func (s *BenchmarkSummary) add(other *BenchmarkSummary) {
+	n := s.Samples + other.Samples
+	if n == 0 {
+		return
+	}
+	delta := other.Mean - s.Mean
+	// Chan et al.'s pairwise update of the sums of squared deviations.
+	m2 := sumSquares(s) + sumSquares(other) + delta*delta*float64(s.Samples)*float64(other.Samples)/float64(n)
+	s.Mean += delta * float64(other.Samples) / float64(n)
+	s.Samples = n
+	s.StdDev = 0
+	if n > 1 {
+		s.StdDev = math.Sqrt(m2 / float64(n-1))
+	}
+	s.CI, _ = relativeCI(s.Samples, s.Mean, s.StdDev)
+}
+
+func sumSquares(s *BenchmarkSummary) float64 {
+	if s.Samples < 2 {
+		return 0
+	}
+	return s.StdDev * s.StdDev * float64(s.Samples-1)
+}
+
+// WeeklySummary holds the summaries of the benchmarks
+// of the compacted runs of an ISO week e.g. "2018-W41".
+type WeeklySummary struct {
+	Week  string    `json:"week"`
+	Start time.Time `json:"start"`
+	// Runs are the IDs of the runs rolled into the summary.
+	Runs       []string            `json:"runs"`
+	Benchmarks []*BenchmarkSummary `json:"benchmarks"`
+}
+
+// Compaction reports what a call to Compact did.
+type Compaction struct {
+	Runs           int      `json:"runs"`
+	Weeks          []string `json:"weeks"`
+	DeletedObjects int      `json:"deleted_objects"`
+	FreedBytes     int64    `json:"freed_bytes"`
+}
+
+// weekOf returns the name of t's ISO week and the Monday it starts on.
+func weekOf(t time.Time) (string, time.Time) {
+	t = t.UTC()
+	year, week := t.ISOWeek()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	offset := (int(day.Weekday()) + 6) % 7
+	return fmt.Sprintf("%d-W%02d", year, week), day.AddDate(0, 0, -offset)
+}
+
+// Compact rolls the runs that started over olderThan ago into weekly
+// summaries of the mean and confidence interval of every benchmark's
+// metrics, then deletes their artifacts except for their metadata, which
+// records the summary they were rolled into. Soft-deleted runs are left
+// as they are, so that they can still be restored.
+func (br *Request) Compact(ctx context.Context, olderThan time.Duration) (*Compaction, error) {
+	ctx, span := br.startSpan(ctx, "compact")
+	defer span.End()
+
+	if br.StorageService == nil {
+		return nil, ErrNoStorageService
+	}
+
+	// 1. Find the runs to compact, by week.
+	cutoff := br.now().Add(-olderThan)
+	byWeek := make(map[string][]*Run)
+	var weeks []string
+	rf := &RunFilter{PageSize: math.MaxInt32}
+	_, err := br.WalkRuns(ctx, rf, func(run *Run) error {
+		if !run.hasResults() || !run.StartTime.Before(cutoff) {
+			return nil
+		}
+		week, _ := weekOf(run.StartTime)
+		if byWeek[week] == nil {
+			weeks = append(weeks, week)
+		}
+		byWeek[week] = append(byWeek[week], run)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Compaction{Weeks: weeks}
+	for _, week := range weeks {
+		// 2. Roll the runs into the week's summary, which earlier
+		// compactions may have begun, before deleting anything.
+		ws, err := br.weeklySummary(ctx, week)
+		if err != nil {
+			return c, err
+		}
+		if ws == nil {
+			_, start := weekOf(byWeek[week][0].StartTime)
+			ws = &WeeklySummary{Week: week, Start: start}
+		}
+		summarized := make(map[string]bool)
+		for _, id := range ws.Runs {
+			summarized[id] = true
+		}
+		for _, run := range byWeek[week] {
+			// Runs summarized by an interrupted compaction aren't counted twice.
+			if summarized[run.ID] {
+				continue
+			}
+			// Only the results that made it into the baseline are summarized, not
+			// e.g. those of pull requests, which are compacted all the same.
+			if !run.replacedBaseline() {
+				continue
+			}
+			blob, err := br.downloadBlob(ctx, run.ID)
+			if err != nil {
+				return c, fmt.Errorf("Retrieving results of run %q: %v", run.ID, err)
+			}
+			ws.addResults(run, parseResults(blob))
+			ws.Runs = append(ws.Runs, run.ID)
+		}
+		blob, err := json.Marshal(ws)
+		if err != nil {
+			return c, err
+		}
+		if _, err := br.uploadBlob(ctx, summariesDir+week+".json", blob); err != nil {
+			return c, fmt.Errorf("Uploading the summary of %s: %v", week, err)
+		}
+
+		// 3. Only then delete the runs' artifacts.
+		for _, run := range byWeek[week] {
+			if err := br.compactRun(ctx, run, week, c); err != nil {
+				return c, err
+			}
+			c.Runs++
+		}
+	}
+	return c, nil
+}
+
+// addResults merges the samples of the results of run into the summary.
+func (ws *WeeklySummary) addResults(run *Run, results []*benchResult) {
+	type key struct{ name, pkg, goarch, unit string }
+	samples := make(map[key][]float64)
+	var keys []key
+	for _, res := range results {
+		goarch := run.GOARCH
+		if goarch == "" {
+			// Imported runs only have the architecture their results were labeled with.
+			goarch = res.Labels["goarch"]
+		}
+		for unit, value := range res.Values {
+			k := key{res.Name, res.Labels["pkg"], goarch, unit}
+			if samples[k] == nil {
+				keys = append(keys, k)
+			}
+			samples[k] = append(samples[k], value)
+		}
+	}
+
+	index := make(map[key]*BenchmarkSummary)
+	for _, bs := range ws.Benchmarks {
+		index[key{bs.Name, bs.Package, bs.GOARCH, bs.Unit}] = bs
+	}
+	for _, k := range keys {
+		values := samples[k]
+		m := mean(values)
+		ss := 0.0
+		for _, v := range values {
+			ss += (v - m) * (v - m)
+		}
+		sum := &BenchmarkSummary{Name: k.name, Package: k.pkg, GOARCH: k.goarch, Unit: k.unit, Samples: len(values), Mean: m}
+		if len(values) > 1 {
+			sum.StdDev = math.Sqrt(ss / float64(len(values)-1))
+		}
+		bs, ok := index[k]
+		if !ok {
+			bs = &BenchmarkSummary{Name: k.name, Package: k.pkg, GOARCH: k.goarch, Unit: k.unit}
+			index[k] = bs
+			ws.Benchmarks = append(ws.Benchmarks, bs)
+		}
+		bs.add(sum)
+	}
+	sort.Slice(ws.Benchmarks, func(i, j int) bool {
+		a, b := ws.Benchmarks[i], ws.Benchmarks[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		if a.GOARCH != b.GOARCH {
+			return a.GOARCH < b.GOARCH
+		}
+		return a.Unit < b.Unit
+	})
+}
+
+// weeklySummary retrieves the summary of the week, or nil if there's none yet.
+func (br *Request) weeklySummary(ctx context.Context, week string) (*WeeklySummary, error) {
+	name := summariesDir + week + ".json"
+	_, err := br.StorageService.Objects.Get(br.GCSBucket, br.inBenchmarksDir(name)).Context(ctx).Do()
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving the summary of %s: %v", week, err)
+	}
+	blob, err := br.downloadBlob(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving the summary of %s: %v", week, err)
+	}
+	ws := new(WeeklySummary)
+	if err := json.Unmarshal(blob, ws); err != nil {
+		return nil, fmt.Errorf("Parsing the summary of %s: %v", week, err)
+	}
+	return ws, nil
+}
+
+// compactRun records that run was rolled into the week's summary and
+// deletes its artifacts but for its metadata.
+func (br *Request) compactRun(ctx context.Context, run *Run, week string, c *Compaction) error {
+	run.Compacted = week
+	if _, err := br.uploadRunMeta(ctx, run); err != nil {
+		return fmt.Errorf("Updating metadata of run %q: %v", run.ID, err)
+	}
+
+	objects := br.StorageService.Objects
+	prefix := br.inBenchmarksDir(run.ID)
+	pageToken := ""
+	for {
+		call := objects.List(br.GCSBucket).Prefix(prefix).Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		objs, err := call.Do()
+		if err != nil {
+			return fmt.Errorf("Listing artifacts of run %q: %v", run.ID, err)
+		}
+		for _, obj := range objs.Items {
+			if obj.Name == prefix+runMetaSuffix {
+				continue
+			}
+			if err := objects.Delete(br.GCSBucket, obj.Name).Context(ctx).Do(); err != nil {
+				return fmt.Errorf("Deleting %q: %v", obj.Name, err)
+			}
+			c.DeletedObjects++
+			c.FreedBytes += int64(obj.Size)
+		}
+		if pageToken = objs.NextPageToken; pageToken == "" {
+			return nil
+		}
+	}
+}
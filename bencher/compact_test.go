@@ -0,0 +1,40 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import "testing"
+
+func TestWeeklySummarySplitsPackagesAndArchitectures(t *testing.T) {
+	gtr := readTestEvents(t, "go-test-two-packages.json")
+	ws := new(WeeklySummary)
+	ws.addResults(&Run{GOARCH: "amd64"}, parseResults(gtr.benchmarks))
+	ws.addResults(&Run{GOARCH: "arm64"}, parseResults(gtr.benchmarks))
+	ws.addResults(&Run{GOARCH: "arm64"}, parseResults(gtr.benchmarks))
+
+	type key struct{ name, pkg, goarch, unit string }
+	got := make(map[key]*BenchmarkSummary)
+	for _, bs := range ws.Benchmarks {
+		got[key{bs.Name, bs.Package, bs.GOARCH, bs.Unit}] = bs
+	}
+	for _, pkg := range []string{"example.com/tm/a", "example.com/tm/b"} {
+		amd64, arm64 := got[key{"Sum", pkg, "amd64", "ns/op"}], got[key{"Sum", pkg, "arm64", "ns/op"}]
+		if amd64 == nil || arm64 == nil {
+			t.Fatalf("missing summaries of Sum in %s on amd64 or arm64, got %+v", pkg, ws.Benchmarks)
+		}
+		if arm64.Samples != 2*amd64.Samples {
+			t.Errorf("%s on arm64 has %d samples, want twice the %d on amd64", pkg, arm64.Samples, amd64.Samples)
+		}
+	}
+}
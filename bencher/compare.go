@@ -0,0 +1,360 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+
+	"golang.org/x/perf/benchstat"
+	"google.golang.org/api/storage/v1"
+)
+
+var defaultSplitBy = []string{"pkg", "goos", "goarch"}
+
+func (br *Request) splitBy() []string {
+	splitBy := append([]string(nil), defaultSplitBy...)
+	return append(splitBy, br.GroupBy...)
+}
+
+// latestPaths returns the names to which the most recent results are
+// written: the baseline of the platform, "latest" and, for every tag,
+// "latest@<key>=<value>", unless they mustn't replace the baseline. The
+// platform's baseline, which is replaced only at the generation compared
+// against, comes first so that no other is replaced if it was meanwhile.
+func (br *Request) latestPaths() []string {
+	if !br.replacesBaseline() {
+		return nil
+	}
+	var tagged []string
+	for key, value := range br.Tags {
+		tagged = append(tagged, latestForTag(key, value))
+	}
+	sort.Strings(tagged)
+	return append([]string{br.baselineName(), "latest"}, tagged...)
+}
+
+// baselineName returns the name of the baseline that runs are compared
+// against, that of the platform they run on, lest servers of different
+// platforms sharing a bucket compare against each other's results.
+func (br *Request) baselineName() string {
+	return platformBaseline(runtime.GOOS, runtime.GOARCH)
+}
+
+// platformTag is the tag key of the baselines of platforms,
+// which runs can't be tagged with.
+const platformTag = "platform"
+
+// platformBaseline returns the name of the baseline of the
+// runs on goos and goarch e.g. "latest@platform=linux-arm64".
+func platformBaseline(goos, goarch string) string {
+	return latestForTag(platformTag, goos+"-"+goarch)
+}
+
+// resultsPlatform returns the goos and goarch that results
+// are labeled with, blank if they aren't e.g. older results.
+func resultsPlatform(blob []byte) (goos, goarch string) {
+	for _, res := range parseResults(blob) {
+		if res.Labels["goos"] != "" || res.Labels["goarch"] != "" {
+			return res.Labels["goos"], res.Labels["goarch"]
+		}
+	}
+	return "", ""
+}
+
+// replacesBaseline reports whether the run's results replace the
+// baseline: unless they lack the results of packages that failed, were
+// compared against a chosen run, are those of a pull request or were
+// submitted with a submission token.
+func (br *Request) replacesBaseline() bool {
+	return !br.partial && br.BaselineRunID == "" && br.PullRequest == 0 && !br.Submitted
+}
+
+func latestForTag(key, value string) string {
+	return "latest@" + key + "=" + value
+}
+
+func (br *Request) downloadBlob(ctx context.Context, name string) ([]byte, error) {
+	ctx, span := br.startSpan(ctx, "download-blob")
+	defer span.End()
+
+	var rc io.ReadCloser
+	if br.InfraClient == nil && br.StorageService != nil {
+		resp, err := br.StorageService.Objects.Get(br.GCSBucket, br.inBenchmarksDir(name)).Context(ctx).Download()
+		if err != nil {
+			return nil, err
+		}
+		rc = resp.Body
+	} else {
+		var err error
+		if rc, err = br.InfraClient.Download(br.GCSBucket, br.inBenchmarksDir(name)); err != nil {
+			return nil, err
+		}
+	}
+	defer rc.Close()
+
+	buf := new(bytes.Buffer)
+	n, err := io.Copy(buf, rc)
+	br.transfers.addDownloaded(n)
+	if err != nil {
+		return nil, err
+	}
+	return openEnvelope(br.EncryptionKey, buf.Bytes())
+}
+
+// statObject returns the named object under the repository's benchmarks
+// directory, through the storage service if there is no infra client,
+// e.g. with an EmbeddedStore.
+func (br *Request) statObject(ctx context.Context, name string) (*storage.Object, error) {
+	if br.InfraClient == nil && br.StorageService != nil {
+		return br.StorageService.Objects.Get(br.GCSBucket, br.inBenchmarksDir(name)).Context(ctx).Do()
+	}
+	return br.InfraClient.Object(br.GCSBucket, br.inBenchmarksDir(name))
+}
+
+// changedTables compares before against after and returns
+// only the tables and rows whose difference is significant.
+func changedTables(ctx context.Context, before, after []byte, splitBy []string) []*benchstat.Table {
+	ctx, span := startSpan(ctx, "compute-benchmark-differences")
+	defer span.End()
+
+	tables := compareConfigs([]string{"before", "after"}, [][]byte{before, after}, splitBy)
+	// Filter out the unchanged values
+	var changed []*benchstat.Table
+	for _, table := range tables {
+		var rows []*benchstat.Row
+		for _, row := range table.Rows {
+			if row.Change != unchanged {
+				rows = append(rows, row)
+			}
+		}
+		if len(rows) == 0 {
+			continue
+		}
+
+		table.Rows = rows
+		// Otherwise now swap out the old rows
+		// and this is a changed table result.
+		changed = append(changed, table)
+	}
+	return changed
+}
+
+// compareConfigs compares the results in blobs, each labeled with the
+// respective entry of labels. With more than two configurations, the
+// tables have a column per configuration instead of a delta.
+func compareConfigs(labels []string, blobs [][]byte, splitBy []string) []*benchstat.Table {
+	c := &benchstat.Collection{
+		Alpha:      0.05,
+		AddGeoMean: false,
+		DeltaTest:  benchstat.UTest,
+		SplitBy:    splitBy,
+	}
+	for i, label := range labels {
+		c.AddConfig(label, blobs[i])
+	}
+	return c.Tables()
+}
+
+// Row is a single benchmark metric that changed between two runs.
+type Row struct {
+	Metric    string
+	Group     string `json:",omitempty"`
+	Benchmark string
+	Before    string
+	After     string
+	Delta     string
+	PctDelta  float64
+	// Change is +1 for an improvement and -1 for a regression.
+	Change int
+	// BeforeCI and AfterCI are the half-widths of the 95% confidence
+	// intervals of the means, relative to them, in percent.
+	BeforeCI float64 `json:",omitempty"`
+	AfterCI  float64 `json:",omitempty"`
+	// PValue is that of the Mann-Whitney U-test of the samples,
+	// -1 if it couldn't be computed e.g. for lack of samples.
+	PValue float64
+	// Samples are the numbers of samples before and after.
+	Samples []int `json:",omitempty"`
+}
+
+func resultRows(tables []*benchstat.Table) []*Row {
+	var rows []*Row
+	for _, table := range tables {
+		for _, row := range table.Rows {
+			if len(row.Metrics) < 2 {
+				continue
+			}
+			r := &Row{
+				Metric:    table.Metric,
+				Group:     row.Group,
+				Benchmark: row.Benchmark,
+				Before:    row.Metrics[0].Format(row.Scaler),
+				After:     row.Metrics[1].Format(row.Scaler),
+				Delta:     row.Delta,
+				PctDelta:  row.PctDelta,
+				Change:    row.Change,
+			}
+			r.BeforeCI, _ = confidenceInterval(row.Metrics[0].RValues)
+			r.AfterCI, _ = confidenceInterval(row.Metrics[1].RValues)
+			r.PValue = -1
+			if pval, err := benchstat.UTest(row.Metrics[0], row.Metrics[1]); err == nil {
+				r.PValue = pval
+			}
+			r.Samples = []int{len(row.Metrics[0].RValues), len(row.Metrics[1].RValues)}
+			rows = append(rows, r)
+		}
+	}
+	return rows
+}
+
+// CompareTags compares the latest results of the repository that were
+// tagged with key=before against those tagged with key=after, for example
+// to evaluate the performance impact of an experiment behind a flag.
+func (br *Request) CompareTags(ctx context.Context, key, before, after string) (*Result, error) {
+	ctx, span := br.startSpan(ctx, "compare-tags")
+	defer span.End()
+
+	if before == after {
+		return nil, fmt.Errorf("expecting two different values of tag %q", key)
+	}
+	beforeBlob, err := br.downloadBlob(ctx, latestForTag(key, before))
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving benchmarks for %s=%s: %v", key, before, err)
+	}
+	afterBlob, err := br.downloadBlob(ctx, latestForTag(key, after))
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving benchmarks for %s=%s: %v", key, after, err)
+	}
+	res, err := br.compareTagged(ctx, key, before, after, beforeBlob, afterBlob)
+	if err != nil {
+		return nil, err
+	}
+	res.EnvironmentDiff = diffEnvironments(
+		br.runEnvironment(ctx, br.baselineRunID(ctx, latestForTag(key, before))),
+		br.runEnvironment(ctx, br.baselineRunID(ctx, latestForTag(key, after))))
+	// Nothing is checked out to read a policy file from.
+	if br.Policy != "" {
+		if br.policy, err = ParsePolicy(br.Policy); err != nil {
+			return nil, err
+		}
+		if err := br.gate(res); err != nil {
+			return nil, fmt.Errorf("Evaluating the policy: %v", err)
+		}
+	}
+	return res, nil
+}
+
+// compareTagged compares the results tagged with key=before
+// against those tagged with key=after.
+func (br *Request) compareTagged(ctx context.Context, key, before, after string, beforeBlob, afterBlob []byte) (*Result, error) {
+	// The compared tag differs by definition, so it must not be a grouping key.
+	var splitBy []string
+	for _, sk := range br.splitBy() {
+		if sk != key {
+			splitBy = append(splitBy, sk)
+		}
+	}
+	changed, err := br.compare(ctx, beforeBlob, afterBlob, splitBy)
+	if err != nil {
+		return nil, err
+	}
+	if len(changed) == 0 {
+		return nil, ErrNoChanges
+	}
+
+	textBuf := new(bytes.Buffer)
+	formatText(textBuf, changed)
+	html, err := br.formatHTML(changed)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{
+		Benchmarks:     textBuf.String(),
+		HTMLBenchmarks: html,
+		Rows:           resultRows(changed),
+		Tags:           map[string]string{key: before + " vs " + after},
+		Warnings:       runtimeWarnings(beforeBlob, afterBlob),
+		before:         beforeBlob,
+		after:          afterBlob,
+	}
+	return res, nil
+}
+
+// ResultSet identifies stored results to be compared under Label.
+type ResultSet struct {
+	Label string `json:"label"`
+	// Name is the name of the stored results relative to the repository's
+	// benchmarks directory, e.g. a run ID, "latest" or "latest@branch=pr-1234".
+	Name string `json:"name"`
+}
+
+// CompareSets compares the result sets in br.Compare side by side, with
+// a column per set, for example to evaluate competing optimizations.
+func (br *Request) CompareSets(ctx context.Context) (*Result, error) {
+	ctx, span := br.startSpan(ctx, "compare-sets")
+	defer span.End()
+
+	if len(br.Compare) < 2 {
+		return nil, fmt.Errorf("expecting at least two result sets to compare, got %d", len(br.Compare))
+	}
+	seen := make(map[string]bool)
+	for i, set := range br.Compare {
+		switch {
+		case set == nil || set.Name == "":
+			return nil, fmt.Errorf("expecting the name of the results of result set %d", i+1)
+		case set.Label == "" || seen[set.Label]:
+			return nil, fmt.Errorf("expecting a unique non-blank label for result set %q", set.Name)
+		}
+		seen[set.Label] = true
+	}
+	labels := make([]string, 0, len(br.Compare))
+	blobs := make([][]byte, 0, len(br.Compare))
+	for _, set := range br.Compare {
+		blob, err := br.downloadBlob(ctx, set.Name)
+		if err != nil {
+			return nil, fmt.Errorf("Retrieving result set %q: %v", set.Label, err)
+		}
+		if len(parseResults(blob)) == 0 {
+			return nil, fmt.Errorf("result set %q has no benchmark results", set.Label)
+		}
+		if blob, err = dropOutliers(blob, br.Outliers); err != nil {
+			return nil, err
+		}
+		blob = normalize(blob, br.UnitsOfWork)
+		labels = append(labels, set.Label)
+		blobs = append(blobs, blob)
+	}
+
+	tables := compareConfigs(labels, blobs, br.splitBy())
+	if len(tables) == 0 {
+		return nil, ErrNoBenchmarks
+	}
+	textBuf := new(bytes.Buffer)
+	formatText(textBuf, tables)
+	html, err := br.formatHTML(tables)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{
+		Benchmarks:     textBuf.String(),
+		HTMLBenchmarks: html,
+	}
+	return res, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCompareSetsRejectsInvalidSets(t *testing.T) {
+	es, _ := openTestStore(t)
+	ctx := context.Background()
+	br := &Request{GitRepoURL: "example.com/tm", GCSBucket: "bencher", StorageService: es.Service()}
+	runs := storeTestRuns(t, br, 1)
+	if _, err := br.uploadBlob(ctx, "empty", []byte("goos: linux\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := [][]*ResultSet{
+		{nil, {Label: "a", Name: runs[0].ID}},
+		{{Label: "a", Name: runs[0].ID}, {Label: "b"}},
+		{{Label: "a", Name: runs[0].ID}, {Label: "a", Name: runs[0].ID}},
+		{{Label: "a", Name: runs[0].ID}, {Label: "b", Name: "empty"}},
+	}
+	for _, sets := range tests {
+		br.Compare = sets
+		if _, err := br.CompareSets(ctx); err == nil {
+			t.Errorf("comparing %v succeeded, want an error", sets)
+		}
+	}
+}
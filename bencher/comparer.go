@@ -0,0 +1,189 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// Comparer compares the benchmark results of two runs. Results are in
+// the Go benchmark format and splitBy lists the configuration keys by
+// which benchmarks are grouped. Implementations return only the tables
+// and rows that changed significantly, expressing them as benchstat
+// tables so that they're reported like benchstat's own.
+type Comparer interface {
+	Compare(ctx context.Context, before, after []byte, splitBy []string) ([]*benchstat.Table, error)
+}
+
+// ComparerFunc adapts a function to a Comparer.
+type ComparerFunc func(ctx context.Context, before, after []byte, splitBy []string) ([]*benchstat.Table, error)
+
+func (cf ComparerFunc) Compare(ctx context.Context, before, after []byte, splitBy []string) ([]*benchstat.Table, error) {
+	return cf(ctx, before, after, splitBy)
+}
+
+// DefaultComparer is the name of the comparer used when none is requested.
+const DefaultComparer = "benchstat"
+
+var comparersMu sync.RWMutex
+var comparers = map[string]Comparer{
+	DefaultComparer: ComparerFunc(func(ctx context.Context, before, after []byte, splitBy []string) ([]*benchstat.Table, error) {
+		return changedTables(ctx, before, after, splitBy), nil
+	}),
+	"bootstrap": ComparerFunc(bootstrapCompare),
+}
+
+// RegisterComparer makes c selectable by name in Request.Comparer,
+// replacing any comparer previously registered under that name.
+func RegisterComparer(name string, c Comparer) {
+	comparersMu.Lock()
+	defer comparersMu.Unlock()
+
+	comparers[name] = c
+}
+
+func (br *Request) comparer() (Comparer, error) {
+	if br.customComparer != nil {
+		return br.customComparer, nil
+	}
+	name := br.Comparer
+	if name == "" {
+		name = DefaultComparer
+	}
+	comparersMu.RLock()
+	defer comparersMu.RUnlock()
+
+	c, ok := comparers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown comparer %q", name)
+	}
+	return c, nil
+}
+
+func (br *Request) compare(ctx context.Context, before, after []byte, splitBy []string) ([]*benchstat.Table, error) {
+	c, err := br.comparer()
+	if err != nil {
+		return nil, err
+	}
+	if before, after, err = br.prepare(before, after); err != nil {
+		return nil, err
+	}
+	nf := br.numberFormat
+	if nf == nil && br.NumberFormat != "" {
+		if nf, err = ParseNumberFormat(br.NumberFormat); err != nil {
+			return nil, err
+		}
+	}
+	tables, err := c.Compare(ctx, before, after, splitBy)
+	if err != nil {
+		return nil, err
+	}
+	nf.scale(tables)
+	return tables, nil
+}
+
+// prepare returns the results as they are compared, without outliers
+// and ignored benchmarks and with the derived units of work.
+func (br *Request) prepare(before, after []byte) ([]byte, []byte, error) {
+	var err error
+	if before, err = dropOutliers(before, br.Outliers); err != nil {
+		return nil, nil, err
+	}
+	if after, err = dropOutliers(after, br.Outliers); err != nil {
+		return nil, nil, err
+	}
+	before, after = dropIgnored(before, br.ignore), dropIgnored(after, br.ignore)
+	before, after = normalize(before, br.UnitsOfWork), normalize(after, br.UnitsOfWork)
+	return before, after, nil
+}
+
+const (
+	bootstrapResamples  = 2000
+	bootstrapConfidence = 0.95
+)
+
+// bootstrapCompare deems a change significant if the bootstrapped
+// confidence interval of the relative difference of means excludes zero.
+// Unlike the Mann-Whitney U-test, it can flag changes with as few as 2
+// samples per side, at the cost of assuming the samples are exchangeable.
+func bootstrapCompare(ctx context.Context, before, after []byte, splitBy []string) ([]*benchstat.Table, error) {
+	c := &benchstat.Collection{
+		Alpha: 0.05,
+		// Every delta is computed and its direction judged by benchstat,
+		// while its significance is decided by the bootstrap below.
+		DeltaTest: func(old, new *benchstat.Metrics) (float64, error) { return 0, nil },
+		SplitBy:   splitBy,
+	}
+	c.AddConfig("before", before)
+	c.AddConfig("after", after)
+
+	// A fixed seed keeps the verdicts reproducible.
+	rng := rand.New(rand.NewSource(1))
+	var changed []*benchstat.Table
+	for _, table := range c.Tables() {
+		var rows []*benchstat.Row
+		for _, row := range table.Rows {
+			if len(row.Metrics) < 2 || row.Change == unchanged {
+				continue
+			}
+			lo, hi, ok := bootstrapCI(rng, row.Metrics[0].RValues, row.Metrics[1].RValues)
+			if !ok || (lo <= 0 && hi >= 0) {
+				continue
+			}
+			row.Note = fmt.Sprintf("(%.0f%% CI [%+.2f%%, %+.2f%%])", 100*bootstrapConfidence, 100*lo, 100*hi)
+			rows = append(rows, row)
+		}
+		if len(rows) > 0 {
+			table.Rows = rows
+			changed = append(changed, table)
+		}
+	}
+	return changed, nil
+}
+
+// bootstrapCI returns the confidence interval of mean(after)/mean(before)-1.
+func bootstrapCI(rng *rand.Rand, before, after []float64) (lo, hi float64, ok bool) {
+	if len(before) < 2 || len(after) < 2 {
+		return 0, 0, false
+	}
+	resampledMean := func(xs []float64) float64 {
+		sum := 0.0
+		for range xs {
+			sum += xs[rng.Intn(len(xs))]
+		}
+		return sum / float64(len(xs))
+	}
+
+	deltas := make([]float64, 0, bootstrapResamples)
+	for i := 0; i < bootstrapResamples; i++ {
+		if b := resampledMean(before); b != 0 {
+			deltas = append(deltas, resampledMean(after)/b-1)
+		}
+	}
+	if len(deltas) == 0 {
+		return 0, 0, false
+	}
+	sort.Float64s(deltas)
+	tail := (1 - bootstrapConfidence) / 2
+	lo = deltas[int(tail*float64(len(deltas)-1))]
+	hi = deltas[int((1-tail)*float64(len(deltas)-1))]
+	return lo, hi, true
+}
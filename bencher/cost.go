@@ -0,0 +1,152 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Pricing holds the rates, in any one currency, by which the cost of runs
+// is estimated. Blank rates are treated as free.
+type Pricing struct {
+	// MachineHourly is the cost of an hour of the benchmarking machine.
+	MachineHourly float64
+	// StorageGBMonth is the cost of storing a GB for a month.
+	StorageGBMonth float64
+	// EgressGB is the cost of transferring a GB out of storage.
+	EgressGB float64
+}
+
+// RunCost is the estimated cost of a run.
+type RunCost struct {
+	MachineMinutes float64 `json:"machine_minutes"`
+	// StoredBytes is the size of the run's uploads and copies.
+	StoredBytes int64 `json:"stored_bytes"`
+	// DownloadedBytes is the size of what the run retrieved from storage.
+	DownloadedBytes int64 `json:"downloaded_bytes"`
+
+	Machine float64 `json:"machine"`
+	// Storage is the cost of storing the run's artifacts for a month.
+	Storage float64 `json:"storage_per_month"`
+	Egress  float64 `json:"egress"`
+	Total   float64 `json:"total"`
+}
+
+// transfers counts the bytes a request transferred to and from storage.
+type transfers struct {
+	mu                 sync.Mutex
+	stored, downloaded int64
+}
+
+func (t *transfers) addStored(n int64) {
+	t.mu.Lock()
+	t.stored += n
+	t.mu.Unlock()
+}
+
+func (t *transfers) addDownloaded(n int64) {
+	t.mu.Lock()
+	t.downloaded += n
+	t.mu.Unlock()
+}
+
+func (t *transfers) reset() {
+	t.mu.Lock()
+	t.stored, t.downloaded = 0, 0
+	t.mu.Unlock()
+}
+
+type countingReader struct {
+	r io.Reader
+	n func(int64)
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n(int64(n))
+	return n, err
+}
+
+// estimateCost estimates the cost of a run that took elapsed so far.
+func (br *Request) estimateCost(elapsed time.Duration) *RunCost {
+	if br.Pricing == nil {
+		return nil
+	}
+	const gb = 1 << 30
+	br.transfers.mu.Lock()
+	rc := &RunCost{
+		MachineMinutes:  elapsed.Minutes(),
+		StoredBytes:     br.transfers.stored,
+		DownloadedBytes: br.transfers.downloaded,
+	}
+	br.transfers.mu.Unlock()
+	rc.Machine = elapsed.Hours() * br.Pricing.MachineHourly
+	rc.Storage = float64(rc.StoredBytes) / gb * br.Pricing.StorageGBMonth
+	rc.Egress = float64(rc.DownloadedBytes) / gb * br.Pricing.EgressGB
+	rc.Total = rc.Machine + rc.Storage + rc.Egress
+	return rc
+}
+
+// CostSummary sums the estimated costs of a repository's runs in a month.
+type CostSummary struct {
+	Repo  string `json:"repo"`
+	Month string `json:"month"`
+	Runs  int    `json:"runs"`
+	// Unestimated is the number of runs without a cost estimate.
+	Unestimated int `json:"unestimated,omitempty"`
+
+	MachineMinutes float64 `json:"machine_minutes"`
+	Machine        float64 `json:"machine"`
+	// Storage is the monthly cost of storing the month's artifacts.
+	Storage float64 `json:"storage_per_month"`
+	Egress  float64 `json:"egress"`
+	Total   float64 `json:"total"`
+}
+
+// MonthlyCost sums the estimated costs of the runs that started in the
+// month of t, in t's location, from their usage markers, hence including
+// the runs that detected no changes.
+func (br *Request) MonthlyCost(ctx context.Context, t time.Time) (*CostSummary, error) {
+	ctx, span := br.startSpan(ctx, "monthly-cost")
+	defer span.End()
+
+	if br.StorageService == nil {
+		return nil, ErrNoStorageService
+	}
+	from := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	to := from.AddDate(0, 1, 0)
+	cs := &CostSummary{Repo: br.GitRepoURL, Month: from.Format("2006-01")}
+	// Deleted runs were paid for all the same.
+	err := br.walkUsage(ctx, from, to, func(usage *runUsage) {
+		cs.Runs++
+		if usage.Cost == nil {
+			cs.Unestimated++
+			return
+		}
+		cs.MachineMinutes += usage.Cost.MachineMinutes
+		cs.Machine += usage.Cost.Machine
+		cs.Storage += usage.Cost.Storage
+		cs.Egress += usage.Cost.Egress
+		cs.Total += usage.Cost.Total
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Listing the usage of %s: %v", br.GitRepoURL, err)
+	}
+	return cs, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// envelopeMagic prefixes envelope encrypted objects. It is followed by
+// the data key sealed with the key encryption key, then the data sealed
+// with the data key, each sealed value being prefixed by its nonce.
+var envelopeMagic = []byte("bencher-aes256gcm-v1\n")
+
+const dataKeySize = 32
+
+var ErrEncrypted = errors.New("object is encrypted but no encryption key was configured")
+
+func seal(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// sealEnvelope encrypts plaintext with a fresh random data key,
+// itself encrypted with kek, so that kek never encrypts much data.
+func sealEnvelope(kek, plaintext []byte) ([]byte, error) {
+	if len(kek) != 32 {
+		return nil, errors.New("expecting a 32 byte encryption key")
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	sealedKey, err := seal(kek, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	sealedData, err := seal(dataKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(envelopeMagic)+len(sealedKey)+len(sealedData))
+	out = append(out, envelopeMagic...)
+	out = append(out, sealedKey...)
+	return append(out, sealedData...), nil
+}
+
+// openEnvelope decrypts blob if it was sealed by sealEnvelope and
+// otherwise returns it as is, since it was stored unencrypted.
+func openEnvelope(kek, blob []byte) ([]byte, error) {
+	if !bytes.HasPrefix(blob, envelopeMagic) {
+		return blob, nil
+	}
+	if len(kek) == 0 {
+		return nil, ErrEncrypted
+	}
+	blob = blob[len(envelopeMagic):]
+	// A sealed data key is its nonce, the key and the GCM tag.
+	sealedKeySize := 12 + dataKeySize + 16
+	if len(blob) < sealedKeySize {
+		return nil, errors.New("truncated encrypted object")
+	}
+	dataKey, err := open(kek, blob[:sealedKeySize])
+	if err != nil {
+		return nil, err
+	}
+	return open(dataKey, blob[sealedKeySize:])
+}
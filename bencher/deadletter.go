@@ -0,0 +1,166 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keighl/postmark"
+)
+
+const (
+	maxNotifyAttempts = 3
+	deadLettersDir    = "dead-letters/"
+)
+
+// DeadLetter is a notification that couldn't be sent after retries,
+// stored so that it can be replayed rather than silently lost.
+type DeadLetter struct {
+	ID       string         `json:"id"`
+	FailedAt time.Time      `json:"failed_at"`
+	Attempts int            `json:"attempts"`
+	Error    string         `json:"error"`
+	Email    postmark.Email `json:"email"`
+}
+
+func (br *Request) postmarkClient() *postmark.Client {
+	pmClient := postmark.NewClient(br.EmailServerToken, br.EmailAccountToken)
+	if br.HTTPClient != nil {
+		pmClient.HTTPClient = br.HTTPClient
+	}
+	return pmClient
+}
+
+// deliver sends email, retrying with a linear backoff, and stores it as
+// a dead letter if all the attempts fail.
+func (br *Request) deliver(ctx context.Context, email postmark.Email) error {
+	ctx, span := br.startSpan(ctx, "deliver-notification")
+	defer span.End()
+
+	var err error
+	for attempt := 1; attempt <= maxNotifyAttempts; attempt++ {
+		if err = br.sendMail(ctx, email); err == nil {
+			return nil
+		}
+		span.Annotatef(nil, "Sending the notification failed (attempt %d): %v", attempt, err)
+		if attempt == maxNotifyAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+
+	dl := &DeadLetter{
+		ID:       br.ids().NewID(),
+		FailedAt: br.now(),
+		Attempts: maxNotifyAttempts,
+		Error:    err.Error(),
+		Email:    email,
+	}
+	if serr := br.saveDeadLetter(ctx, dl); serr != nil {
+		return fmt.Errorf("Sending the notification: %v, and storing it as a dead letter: %v", err, serr)
+	}
+	return fmt.Errorf("Sending the notification: %v, stored as dead letter %q", err, dl.ID)
+}
+
+func (br *Request) saveDeadLetter(ctx context.Context, dl *DeadLetter) error {
+	blob, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	_, err = br.uploadBlob(ctx, deadLettersDir+dl.ID+".json", blob)
+	return err
+}
+
+// DeadLetters lists the repository's notifications that
+// couldn't be sent, oldest first.
+func (br *Request) DeadLetters(ctx context.Context) ([]*DeadLetter, error) {
+	ctx, span := br.startSpan(ctx, "list-dead-letters")
+	defer span.End()
+
+	if br.StorageService == nil {
+		return nil, ErrNoStorageService
+	}
+	prefix := br.inBenchmarksDir("")
+	var dls []*DeadLetter
+	pageToken := ""
+	for {
+		call := br.StorageService.Objects.List(br.GCSBucket).Prefix(prefix + deadLettersDir).Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		objs, err := call.Do()
+		if err != nil {
+			return nil, fmt.Errorf("Listing dead letters: %v", err)
+		}
+		for _, obj := range objs.Items {
+			blob, err := br.downloadBlob(ctx, strings.TrimPrefix(obj.Name, prefix))
+			if err != nil {
+				return nil, fmt.Errorf("Retrieving dead letter %q: %v", obj.Name, err)
+			}
+			dl := new(DeadLetter)
+			if err := json.Unmarshal(blob, dl); err != nil {
+				return nil, fmt.Errorf("Parsing dead letter %q: %v", obj.Name, err)
+			}
+			dls = append(dls, dl)
+		}
+		if pageToken = objs.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+	sort.Slice(dls, func(i, j int) bool { return dls[i].FailedAt.Before(dls[j].FailedAt) })
+	return dls, nil
+}
+
+// ReplayDeadLetter sends the identified dead letter again, once, and
+// deletes it if it was sent. Otherwise its error and attempts are updated.
+func (br *Request) ReplayDeadLetter(ctx context.Context, id string) error {
+	ctx, span := br.startSpan(ctx, "replay-dead-letter")
+	defer span.End()
+
+	if br.StorageService == nil {
+		return ErrNoStorageService
+	}
+	name := deadLettersDir + id + ".json"
+	blob, err := br.downloadBlob(ctx, name)
+	if err != nil {
+		return fmt.Errorf("Retrieving dead letter %q: %v", id, err)
+	}
+	dl := new(DeadLetter)
+	if err := json.Unmarshal(blob, dl); err != nil {
+		return fmt.Errorf("Parsing dead letter %q: %v", id, err)
+	}
+
+	if err := br.sendMail(ctx, dl.Email); err != nil {
+		dl.Attempts++
+		dl.Error = err.Error()
+		if serr := br.saveDeadLetter(ctx, dl); serr != nil {
+			span.Annotatef(nil, "Updating dead letter %q: %v", id, serr)
+		}
+		return fmt.Errorf("Replaying dead letter %q: %v", id, err)
+	}
+	if err := br.StorageService.Objects.Delete(br.GCSBucket, br.inBenchmarksDir(name)).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("Deleting replayed dead letter %q: %v", id, err)
+	}
+	return nil
+}
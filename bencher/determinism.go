@@ -0,0 +1,117 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// seedEnvKey is the environment variable passing Request.Seed
+// to the benchmarks, for them to seed their random sources with.
+const seedEnvKey = "BENCHER_SEED"
+
+// runtimeKeys are the configuration lines recording, in the stored results,
+// the runtime settings under which they were measured, by environment variable.
+var runtimeKeys = []struct{ key, env string }{
+	{"gogc", "GOGC"},
+	{"godebug", "GODEBUG"},
+	{"seed", seedEnvKey},
+}
+
+func (br *Request) runtimeSettings() map[string]string {
+	settings := make(map[string]string)
+	for key, value := range map[string]string{"gogc": br.GOGC, "godebug": br.GODEBUG, "seed": br.Seed} {
+		if value != "" {
+			settings[key] = value
+		}
+	}
+	return settings
+}
+
+func (br *Request) validateRuntimeSettings() error {
+	if br.GOGC != "" && br.GOGC != "off" {
+		if _, err := strconv.Atoi(br.GOGC); err != nil {
+			return fmt.Errorf("invalid GOGC %q, expecting an integer or \"off\"", br.GOGC)
+		}
+	}
+	if br.Seed != "" {
+		if _, err := strconv.ParseInt(br.Seed, 10, 64); err != nil {
+			return fmt.Errorf("invalid seed %q, expecting an integer", br.Seed)
+		}
+	}
+	// GODEBUG is recorded as a configuration line.
+	if strings.ContainsAny(br.GODEBUG, " \t\r\n") {
+		return fmt.Errorf("invalid GODEBUG %q, expecting no whitespace", br.GODEBUG)
+	}
+	for _, rk := range runtimeKeys {
+		if _, ok := br.Tags[rk.key]; ok {
+			return fmt.Errorf("tag %q is reserved for recording %s", rk.key, rk.env)
+		}
+	}
+	return nil
+}
+
+// runtimeEnv returns the environment variables applying the runtime settings.
+func (br *Request) runtimeEnv() []string {
+	settings := br.runtimeSettings()
+	var env []string
+	for _, rk := range runtimeKeys {
+		if value, ok := settings[rk.key]; ok {
+			env = append(env, rk.env+"="+value)
+		}
+	}
+	return env
+}
+
+// runtimeWarnings warns of the runtime settings that differ between the
+// before and after results, as e.g. a different GOGC changes how much time
+// is spent collecting garbage and so masquerades as a regression.
+func runtimeWarnings(before, after []byte) []string {
+	settingsOf := func(blob []byte) map[string][]string {
+		seen := make(map[string]map[string]bool)
+		for _, res := range parseResults(blob) {
+			for _, rk := range runtimeKeys {
+				if seen[rk.key] == nil {
+					seen[rk.key] = make(map[string]bool)
+				}
+				seen[rk.key][res.Labels[rk.key]] = true
+			}
+		}
+		settings := make(map[string][]string)
+		for key, values := range seen {
+			for value := range values {
+				if value == "" {
+					value = "unset"
+				}
+				settings[key] = append(settings[key], value)
+			}
+			sort.Strings(settings[key])
+		}
+		return settings
+	}
+
+	b, a := settingsOf(before), settingsOf(after)
+	var warnings []string
+	for _, rk := range runtimeKeys {
+		bv, av := strings.Join(b[rk.key], ", "), strings.Join(a[rk.key], ", ")
+		if bv != "" && av != "" && bv != av {
+			warnings = append(warnings, fmt.Sprintf("%s differs between the compared runs: %s before, %s after", rk.env, bv, av))
+		}
+	}
+	return warnings
+}
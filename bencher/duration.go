@@ -0,0 +1,85 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+)
+
+// suiteDurationWindow is the number of previous runs whose
+// suite durations a run's is compared against.
+const suiteDurationWindow = 10
+
+// SuiteDuration compares how long the benchmarks of a run took, their
+// wall clock duration, with the previous runs on the same architecture,
+// since a slowly inflating suite eats into CI budgets and often betrays
+// accidentally quadratic setup.
+type SuiteDuration struct {
+	Seconds float64 `json:"seconds"`
+	// Median is the median duration of the Runs previous runs
+	// that recorded theirs, or 0 if none did.
+	Median float64 `json:"median,omitempty"`
+	Runs   int     `json:"runs,omitempty"`
+	// PctDelta is the change of Seconds against Median, in percent.
+	PctDelta float64 `json:"pct_delta,omitempty"`
+}
+
+// suiteDuration compares the duration of the run's benchmarks with the
+// previous runs'. Without a history to compare with, only the duration
+// is returned.
+func (br *Request) suiteDuration(ctx context.Context, elapsed time.Duration, goarch string) *SuiteDuration {
+	ctx, span := br.startSpan(ctx, "suite-duration")
+	defer span.End()
+
+	sd := &SuiteDuration{Seconds: elapsed.Seconds()}
+	if br.StorageService == nil {
+		return sd
+	}
+	var durations []float64
+	rf := &RunFilter{PageSize: math.MaxInt32, GOARCH: goarch}
+	_, err := br.WalkRuns(ctx, rf, func(run *Run) error {
+		if run.SuiteSeconds <= 0 {
+			return nil
+		}
+		if durations = append(durations, run.SuiteSeconds); len(durations) > suiteDurationWindow {
+			durations = durations[1:]
+		}
+		return nil
+	})
+	if err != nil {
+		span.Annotatef(nil, "Listing the previous runs: %v", err)
+		return sd
+	}
+	if len(durations) == 0 {
+		return sd
+	}
+	sort.Float64s(durations)
+	sd.Runs = len(durations)
+	if n := len(durations); n%2 == 1 {
+		sd.Median = durations[n/2]
+	} else {
+		sd.Median = (durations[n/2-1] + durations[n/2]) / 2
+	}
+	sd.PctDelta = 100 * (sd.Seconds - sd.Median) / sd.Median
+	return sd
+}
+
+// roundSeconds formats seconds as a duration e.g. "7m30s".
+func roundSeconds(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+}
@@ -0,0 +1,150 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func openTestStore(t *testing.T) (*EmbeddedStore, string) {
+	dir, err := ioutil.TempDir("", "bencher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "bencher.db")
+	es, err := OpenEmbeddedStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { es.Close() })
+	return es, file
+}
+
+func TestEmbeddedStoreRoundTrip(t *testing.T) {
+	es, file := openTestStore(t)
+	ctx := context.Background()
+	br := &Request{GitRepoURL: "example.com/tm", GCSBucket: "bencher", StorageService: es.Service()}
+
+	if _, err := br.uploadBlob(ctx, "runs/a.json", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	// Large enough to be uploaded in resumable chunks.
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1<<20+1)
+	if _, err := br.uploadBlob(ctx, "runs/b.json", large); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := br.downloadBlob(ctx, "runs/b.json"); err != nil || !bytes.Equal(got, large) {
+		t.Fatalf("downloading the large object: got %d bytes, %v, want %d", len(got), err, len(large))
+	}
+	obj, err := br.statObject(ctx, "runs/b.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Downloads are verified against the checksums, and resumed by range.
+	got, err := br.downloadGeneration(ctx, "runs/b.json", obj.Generation)
+	if err != nil || !bytes.Equal(got, large) {
+		t.Fatalf("downloading generation %d: got %d bytes, %v", obj.Generation, len(got), err)
+	}
+	buf := bytes.NewBuffer(large[:10:10])
+	if err := br.downloadRange(ctx, br.inBenchmarksDir("runs/b.json"), obj.Generation, buf); err != nil || !bytes.Equal(buf.Bytes(), large) {
+		t.Fatalf("resuming the download: got %d bytes, %v", buf.Len(), err)
+	}
+
+	// Promoting is guarded by generations.
+	if _, err := br.promote(ctx, "runs/a.json", "latest", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := br.promote(ctx, "runs/b.json", "latest", 0); err != ErrBaselineConflict {
+		t.Fatalf("promoting over an existing baseline: got %v, want ErrBaselineConflict", err)
+	}
+	latest, err := br.statObject(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := br.promote(ctx, "runs/b.json", "latest", latest.Generation); err != nil {
+		t.Fatal(err)
+	}
+
+	objs, err := es.Service().Objects.List("bencher").Prefix(br.inBenchmarksDir("runs/")).MaxResults(1).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs.Items) != 1 || !strings.HasSuffix(objs.Items[0].Name, "runs/a.json") || objs.NextPageToken == "" {
+		t.Fatalf("got the first page %v, want runs/a.json and a next page", objs)
+	}
+	objs, err = es.Service().Objects.List("bencher").Prefix(br.inBenchmarksDir("runs/")).PageToken(objs.NextPageToken).Do()
+	if err != nil || len(objs.Items) != 1 || !strings.HasSuffix(objs.Items[0].Name, "runs/b.json") {
+		t.Fatalf("got the second page %v, %v, want runs/b.json", objs, err)
+	}
+	if err := es.Service().Objects.Delete("bencher", br.inBenchmarksDir("runs/a.json")).Do(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = br.statObject(ctx, "runs/a.json")
+	if gerr, ok := err.(*googleapi.Error); !ok || gerr.Code != 404 {
+		t.Fatalf("getting a deleted object: got %v, want a 404", err)
+	}
+
+	// The objects survive reopening the store, as last changed.
+	if err := es.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenEmbeddedStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	br.StorageService = reopened.Service()
+	if got, err := br.downloadBlob(ctx, "latest"); err != nil || !bytes.Equal(got, large) {
+		t.Fatalf("downloading latest after reopening: got %d bytes, %v", len(got), err)
+	}
+	if _, err := br.statObject(ctx, "runs/a.json"); err == nil {
+		t.Fatal("got the deleted object after reopening")
+	}
+}
+
+func TestEmbeddedStoreDropsTornChange(t *testing.T) {
+	es, file := openTestStore(t)
+	br := &Request{GitRepoURL: "example.com/tm", GCSBucket: "bencher", StorageService: es.Service()}
+	if _, err := br.uploadBlob(context.Background(), "a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	es.Close()
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"object":{"bucket":"bencher","na`)
+	f.Close()
+
+	reopened, err := OpenEmbeddedStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	br.StorageService = reopened.Service()
+	if got, err := br.downloadBlob(context.Background(), "a"); err != nil || string(got) != "a" {
+		t.Fatalf("got %q, %v, want the object stored before the torn change", got, err)
+	}
+}
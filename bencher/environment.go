@@ -0,0 +1,152 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Environment fingerprints the machine, toolchain and settings with
+// which a run ran, so that readers of a comparison can spot deltas
+// that the code didn't cause e.g. a different Go version or CPU.
+type Environment struct {
+	GoVersion string `json:"go_version,omitempty"`
+	GOOS      string `json:"goos,omitempty"`
+	GOARCH    string `json:"goarch,omitempty"`
+	// CPU is the model of the CPU e.g. "Intel(R) Xeon(R) CPU @ 2.20GHz",
+	// if known, and NumCPU the number of logical CPUs.
+	CPU    string `json:"cpu,omitempty"`
+	NumCPU int    `json:"num_cpu,omitempty"`
+
+	GOGC    string `json:"gogc,omitempty"`
+	GODEBUG string `json:"godebug,omitempty"`
+	// BencherVersion is the Version of bencher that ran it.
+	BencherVersion string `json:"bencher_version,omitempty"`
+}
+
+// EnvironmentChange is a field of the Environment
+// that differs between the compared runs.
+type EnvironmentChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// environment returns the Environment of the benchmarks run by the request.
+func (br *Request) environment(ctx context.Context) *Environment {
+	env := &Environment{
+		GOOS:           runtime.GOOS,
+		GOARCH:         runtime.GOARCH,
+		CPU:            cpuModel(),
+		NumCPU:         runtime.NumCPU(),
+		GOGC:           br.GOGC,
+		GODEBUG:        br.GODEBUG,
+		BencherVersion: Version,
+	}
+	if goVersion, err := runCheckoutCmd(br.checkoutCmd(ctx, "go", "version")); err == nil {
+		env.GoVersion = string(bytes.TrimSpace(goVersion))
+	}
+	return env
+}
+
+// cpuModel returns the model of the machine's CPU, or "" if unknown
+// e.g. on systems without /proc/cpuinfo.
+func cpuModel() string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		key, value := sc.Text(), ""
+		if i := strings.Index(key, ":"); i >= 0 {
+			key, value = strings.TrimSpace(key[:i]), strings.TrimSpace(key[i+1:])
+		}
+		if key == "model name" {
+			return value
+		}
+	}
+	return ""
+}
+
+// runEnvironment returns the Environment of the stored run with runID,
+// or nil if it has none e.g. because it ran before they were recorded.
+func (br *Request) runEnvironment(ctx context.Context, runID string) *Environment {
+	if runID == "" {
+		return nil
+	}
+	blob, err := br.downloadBlob(ctx, runID+runMetaSuffix)
+	if err != nil {
+		return nil
+	}
+	run := new(Run)
+	if err := json.Unmarshal(blob, run); err != nil {
+		return nil
+	}
+	return run.Environment
+}
+
+// baselineRunID returns the ID of the run whose results the stored
+// results named e.g. "latest@branch=master" are, or "" if unknown.
+func (br *Request) baselineRunID(ctx context.Context, name string) string {
+	obj, err := br.statObject(ctx, name)
+	if err != nil || obj == nil {
+		return ""
+	}
+	return obj.Metadata[MetadataRunID]
+}
+
+// diffEnvironments returns the fields of the environments that differ,
+// or nil if either is unknown. Fields unknown on either side are left out.
+func diffEnvironments(before, after *Environment) []*EnvironmentChange {
+	if before == nil || after == nil {
+		return nil
+	}
+	numCPU := func(n int) string {
+		if n <= 0 {
+			return ""
+		}
+		return strconv.Itoa(n)
+	}
+	fields := []struct {
+		name          string
+		before, after string
+	}{
+		{"Go version", before.GoVersion, after.GoVersion},
+		{"GOOS", before.GOOS, after.GOOS},
+		{"GOARCH", before.GOARCH, after.GOARCH},
+		{"CPU", before.CPU, after.CPU},
+		{"CPUs", numCPU(before.NumCPU), numCPU(after.NumCPU)},
+		{"GOGC", firstNonEmpty(before.GOGC, "unset"), firstNonEmpty(after.GOGC, "unset")},
+		{"GODEBUG", firstNonEmpty(before.GODEBUG, "unset"), firstNonEmpty(after.GODEBUG, "unset")},
+		{"bencher version", before.BencherVersion, after.BencherVersion},
+	}
+	var changes []*EnvironmentChange
+	for _, field := range fields {
+		if field.before != "" && field.after != "" && field.before != field.after {
+			changes = append(changes, &EnvironmentChange{Field: field.name, Before: field.before, After: field.after})
+		}
+	}
+	return changes
+}
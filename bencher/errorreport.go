@@ -0,0 +1,194 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+	"google.golang.org/api/clouderrorreporting/v1beta1"
+)
+
+// ErrorReporter reports failures, e.g. to Stackdriver Error Reporting
+// or Sentry, where they are noticed, unlike logs that are routinely missed.
+type ErrorReporter interface {
+	ReportError(ctx context.Context, er *ErrorReport) error
+}
+
+// ErrorReporterFunc adapts a function to an ErrorReporter.
+type ErrorReporterFunc func(ctx context.Context, er *ErrorReport) error
+
+func (ef ErrorReporterFunc) ReportError(ctx context.Context, er *ErrorReport) error {
+	return ef(ctx, er)
+}
+
+// ErrorReport describes a failure.
+type ErrorReport struct {
+	Err  error
+	Repo string
+	// RunID is the ID of the run that failed, blank if it failed
+	// before it had one, e.g. while checking out the sources.
+	RunID string
+	// Stack is the stack trace of a panic, if the failure was one.
+	Stack []byte
+	// HTTPRequest is the request being served when it failed, if any.
+	HTTPRequest *http.Request
+}
+
+// message describes the failure, with its stack trace if any.
+func (er *ErrorReport) message() string {
+	msg := er.Err.Error()
+	switch {
+	case er.Repo != "" && er.RunID != "":
+		msg = fmt.Sprintf("Run %s of %s failed: %s", er.RunID, er.Repo, msg)
+	case er.Repo != "":
+		msg = fmt.Sprintf("Benchmarking %s failed: %s", er.Repo, msg)
+	}
+	if len(er.Stack) > 0 {
+		msg += "\n" + string(er.Stack)
+	}
+	return msg
+}
+
+// reportError reports the failure of the run with runID, if the
+// request has an ErrorReporter, unless it is an expected outcome
+// e.g. that nothing changed.
+func (br *Request) reportError(ctx context.Context, runID string, err error) {
+	if br.ErrorReporter == nil {
+		return
+	}
+	switch err {
+	case nil, ErrNoChanges, ErrNoBenchmarks, ErrQuotaExceeded:
+		return
+	}
+	er := &ErrorReport{Err: err, Repo: br.GitRepoURL, RunID: runID}
+	if rerr := br.ErrorReporter.ReportError(ctx, er); rerr != nil {
+		trace.FromContext(ctx).Annotatef(nil, "Reporting the failure: %v", rerr)
+	}
+}
+
+// StackdriverReporter reports failures to the Stackdriver Error Reporting
+// of project, as those of service e.g. "bencher" at the bencher Version.
+func StackdriverReporter(es *clouderrorreporting.Service, project, service string) ErrorReporter {
+	return ErrorReporterFunc(func(ctx context.Context, er *ErrorReport) error {
+		event := &clouderrorreporting.ReportedErrorEvent{
+			EventTime: time.Now().UTC().Format(time.RFC3339Nano),
+			Message:   er.message(),
+			ServiceContext: &clouderrorreporting.ServiceContext{
+				Service: service,
+				Version: Version,
+			},
+			Context: new(clouderrorreporting.ErrorContext),
+		}
+		// Errors without a stack trace are grouped by where they were reported.
+		if len(er.Stack) == 0 {
+			event.Context.ReportLocation = &clouderrorreporting.SourceLocation{
+				FilePath:     "bencher.go",
+				FunctionName: "bencher.(*Request).Benchmark",
+			}
+		}
+		if r := er.HTTPRequest; r != nil {
+			event.Context.HttpRequest = &clouderrorreporting.HttpRequestContext{
+				Method:    r.Method,
+				Url:       r.URL.String(),
+				UserAgent: r.UserAgent(),
+				Referrer:  r.Referer(),
+			}
+		}
+		_, err := es.Projects.Events.Report("projects/"+project, event).Context(ctx).Do()
+		return err
+	})
+}
+
+// SentryReporter reports failures to the Sentry project of dsn e.g.
+// "https://<key>@sentry.io/<project>", tagged with their repository
+// and run, with client, or the default client if nil.
+func SentryReporter(dsn string, client *http.Client) (ErrorReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid Sentry DSN %q", dsn)
+	}
+	i := strings.LastIndex(u.Path, "/")
+	project := u.Path[i+1:]
+	if project == "" {
+		return nil, fmt.Errorf("expecting the Sentry DSN %q to end with the project", dsn)
+	}
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=bencher/%s, sentry_key=%s", Version, u.User.Username())
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	endpoint := fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, u.Path[:i], project)
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return ErrorReporterFunc(func(ctx context.Context, er *ErrorReport) error {
+		id := make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, id); err != nil {
+			return err
+		}
+		tags := map[string]string{}
+		if er.Repo != "" {
+			tags["repo"] = er.Repo
+		}
+		if er.RunID != "" {
+			tags["run_id"] = er.RunID
+		}
+		event := map[string]interface{}{
+			"event_id":  hex.EncodeToString(id),
+			"timestamp": time.Now().UTC().Format("2006-01-02T15:04:05"),
+			"level":     "error",
+			"platform":  "go",
+			"logger":    "bencher",
+			"release":   Version,
+			"message":   er.message(),
+			"tags":      tags,
+		}
+		if r := er.HTTPRequest; r != nil {
+			event["request"] = map[string]string{"method": r.Method, "url": r.URL.String()}
+		}
+		blob, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("POST", endpoint, bytes.NewReader(blob))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sentry-Auth", auth)
+		res, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+			return fmt.Errorf("Sentry responded with %s: %s", res.Status, bytes.TrimSpace(body))
+		}
+		return nil
+	}), nil
+}
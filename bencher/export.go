@@ -0,0 +1,55 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+var csvHeader = []string{
+	"metric", "group", "benchmark", "before", "after", "delta", "pct_delta",
+	"change", "before_ci", "after_ci", "p_value", "before_samples", "after_samples",
+}
+
+// WriteCSV writes the changed rows of res as CSV, with a header, for
+// downstream tools that gate on p-values and sample counts themselves.
+func (res *Result) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	ftoa := func(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }
+	for _, row := range res.Rows {
+		samples := []string{"", ""}
+		for i, n := range row.Samples {
+			if i < len(samples) {
+				samples[i] = strconv.Itoa(n)
+			}
+		}
+		record := []string{
+			row.Metric, row.Group, row.Benchmark, row.Before, row.After, row.Delta,
+			ftoa(row.PctDelta), strconv.Itoa(row.Change),
+			ftoa(row.BeforeCI), ftoa(row.AfterCI), ftoa(row.PValue),
+			samples[0], samples[1],
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,133 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrInjectedFault is the error of the operations that Faults fails.
+var ErrInjectedFault = errors.New("injected fault")
+
+// Faults injects failures on purpose, so that operators can exercise
+// the retries, dead letters and alerts in staging before relying on
+// them in production. The zero value injects none, as does a nil
+// *Faults. They are safe for concurrent use.
+type Faults struct {
+	mu                   sync.Mutex
+	failUploads          int
+	corruptBaselineReads int
+	emailDelay           time.Duration
+}
+
+// FaultState is what Faults will inject.
+type FaultState struct {
+	// FailUploads is the number of uploads to storage left to fail.
+	FailUploads int `json:"fail_uploads"`
+	// CorruptBaselineReads is the number of baseline downloads left to corrupt.
+	CorruptBaselineReads int `json:"corrupt_baseline_reads"`
+	// EmailDelay is how long every email is held before being sent.
+	EmailDelay time.Duration `json:"email_delay"`
+}
+
+// FailUploads makes the next n uploads to storage fail with ErrInjectedFault.
+func (f *Faults) FailUploads(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failUploads = n
+}
+
+// CorruptBaselineReads corrupts the next n downloads of baselines,
+// which then fail their checksum as if storage returned bad bytes.
+func (f *Faults) CorruptBaselineReads(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.corruptBaselineReads = n
+}
+
+// DelayEmails holds every email for d before sending it, until reset with 0.
+func (f *Faults) DelayEmails(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.emailDelay = d
+}
+
+// Reset disarms all faults.
+func (f *Faults) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failUploads, f.corruptBaselineReads, f.emailDelay = 0, 0, 0
+}
+
+// State returns what is left to inject.
+func (f *Faults) State() *FaultState {
+	if f == nil {
+		return new(FaultState)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return &FaultState{
+		FailUploads:          f.failUploads,
+		CorruptBaselineReads: f.corruptBaselineReads,
+		EmailDelay:           f.emailDelay,
+	}
+}
+
+// take reports whether a fault is left in *n, using it up if so.
+func (f *Faults) take(n *int) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if *n <= 0 {
+		return false
+	}
+	*n--
+	return true
+}
+
+func (f *Faults) failUpload() bool {
+	return f != nil && f.take(&f.failUploads)
+}
+
+func (f *Faults) corruptBaselineRead() bool {
+	return f != nil && f.take(&f.corruptBaselineReads)
+}
+
+// delayEmail waits for the email delay, or until ctx is done.
+func (f *Faults) delayEmail(ctx context.Context) error {
+	d := f.State().EmailDelay
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
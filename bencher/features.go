@@ -0,0 +1,182 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The subsystems that FeatureFlags can toggle at runtime, all enabled
+// unless a flag disables them but for those of optInFeatures.
+const (
+	// FeatureProfiling captures profiles of runs with Request.Profile.
+	FeatureProfiling = "profiling"
+	// FeatureFixtures starts the fixture services of .bencherharness
+	// with docker compose, without which runs needing them fail. As
+	// compose runs as the server, it is disabled unless a flag enables it.
+	FeatureFixtures = "fixtures"
+	// FeatureSnapshots archives the workspaces of runs with Request.Snapshot.
+	FeatureSnapshots = "snapshots"
+	// FeatureRouting routes notifications by severity tier, without
+	// which every report is emailed.
+	FeatureRouting = "routing"
+)
+
+// optInFeatures are the features disabled unless a flag enables them.
+var optInFeatures = map[string]bool{FeatureFixtures: true}
+
+// FeatureNames returns the names of the features that can be toggled.
+func FeatureNames() []string {
+	return []string{FeatureFixtures, FeatureProfiling, FeatureRouting, FeatureSnapshots}
+}
+
+// FeatureFlag enables or disables a feature for the repositories
+// matching Pattern, in the syntax of path.Match e.g. "*" for all.
+type FeatureFlag struct {
+	Pattern string `json:"pattern"`
+	Feature string `json:"feature"`
+	Enabled bool   `json:"enabled"`
+}
+
+// FeatureFlags toggle features per repository, e.g. to roll out a
+// subsystem incrementally or to turn one off without a redeploy. The
+// last flag set that matches a repository wins. They are safe for
+// concurrent use.
+type FeatureFlags struct {
+	mu    sync.RWMutex
+	flags []*FeatureFlag
+}
+
+// ParseFeatureFlags parses comma separated flags of the form
+// "[<pattern>:]<feature>=on|off" e.g. "profiling=off,go.opencensus.io:profiling=on",
+// whose pattern defaults to "*".
+func ParseFeatureFlags(s string) (*FeatureFlags, error) {
+	ff := new(FeatureFlags)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid feature flag %q, expecting [<pattern>:]<feature>=on|off", pair)
+		}
+		pattern, feature := "*", pair[:i]
+		if j := strings.LastIndex(feature, ":"); j >= 0 {
+			pattern, feature = feature[:j], feature[j+1:]
+		}
+		var enabled bool
+		switch value := pair[i+1:]; value {
+		case "on":
+			enabled = true
+		case "off":
+		default:
+			var err error
+			if enabled, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("invalid value of feature flag %q, expecting on or off", pair)
+			}
+		}
+		if err := ff.Set(pattern, feature, enabled); err != nil {
+			return nil, fmt.Errorf("invalid feature flag %q: %v", pair, err)
+		}
+	}
+	return ff, nil
+}
+
+// Enabled reports whether feature is enabled for repo.
+func (ff *FeatureFlags) Enabled(repo, feature string) bool {
+	ff.mu.RLock()
+	defer ff.mu.RUnlock()
+
+	for i := len(ff.flags) - 1; i >= 0; i-- {
+		flag := ff.flags[i]
+		if flag.Feature != feature {
+			continue
+		}
+		if ok, _ := path.Match(flag.Pattern, repo); ok {
+			return flag.Enabled
+		}
+	}
+	return !optInFeatures[feature]
+}
+
+// Set enables or disables feature for the repositories matching pattern,
+// replacing any flag of the same pattern and feature.
+func (ff *FeatureFlags) Set(pattern, feature string, enabled bool) error {
+	if !isFeature(feature) {
+		return fmt.Errorf("unknown feature %q, expecting one of %s", feature, strings.Join(FeatureNames(), ", "))
+	}
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return fmt.Errorf("invalid pattern %q", pattern)
+	}
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+
+	ff.unset(pattern, feature)
+	ff.flags = append(ff.flags, &FeatureFlag{Pattern: pattern, Feature: feature, Enabled: enabled})
+	return nil
+}
+
+// Unset removes the flag of pattern and feature, reporting whether there was one.
+func (ff *FeatureFlags) Unset(pattern, feature string) bool {
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+
+	return ff.unset(pattern, feature)
+}
+
+func (ff *FeatureFlags) unset(pattern, feature string) bool {
+	for i, flag := range ff.flags {
+		if flag.Pattern == pattern && flag.Feature == feature {
+			ff.flags = append(ff.flags[:i], ff.flags[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Flags returns copies of the flags, in the order they were set.
+func (ff *FeatureFlags) Flags() []*FeatureFlag {
+	ff.mu.RLock()
+	defer ff.mu.RUnlock()
+
+	flags := make([]*FeatureFlag, 0, len(ff.flags))
+	for _, flag := range ff.flags {
+		fc := *flag
+		flags = append(flags, &fc)
+	}
+	return flags
+}
+
+func isFeature(name string) bool {
+	for _, feature := range FeatureNames() {
+		if feature == name {
+			return true
+		}
+	}
+	return false
+}
+
+// featureEnabled reports whether the request's
+// feature flags enable feature for its repository.
+func (br *Request) featureEnabled(feature string) bool {
+	if br.Features == nil {
+		return !optInFeatures[feature]
+	}
+	return br.Features.Enabled(br.GitRepoURL, feature)
+}
@@ -0,0 +1,291 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+const (
+	defaultFixtureTimeout = 2 * time.Minute
+	// fixtureTeardownTimeout bounds tearing down the fixtures, which
+	// mustn't be skipped because the run's context is done.
+	fixtureTeardownTimeout = time.Minute
+)
+
+// startFixtures starts the fixture services, e.g. a local Jaeger or
+// Prometheus for exporter benchmarks, declared in the harness file as
+//
+//	fixtures: bench/docker-compose.yml
+//	fixture-services: jaeger prometheus
+//	fixture-ready: http://localhost:14269/ http://localhost:9090/-/ready
+//	fixture-timeout: 2m
+//
+// with docker compose, under a project of their own so that concurrent
+// runs don't share them, waiting for their health checks to pass and for
+// the fixture-ready URLs to respond. The returned function tears them
+// down along with their volumes, and is nil if there are no fixtures.
+// The benchmarks, and profiling them, are told the project's name in
+// BENCHER_FIXTURES. Fixtures must be enabled for the repository by a
+// flag, compose files with services that could reach the host, e.g.
+// privileged ones or bind mounts, are refused, and so are fixture-ready
+// URLs other than those of ports that the services publish on localhost.
+func (br *Request) startFixtures(ctx context.Context) (func(), error) {
+	config, err := readHarnessFile(br.projectDir())
+	if err != nil {
+		return nil, fmt.Errorf("Reading %s: %v", harnessFileName, err)
+	}
+	file := config["fixtures"]
+	if file == "" {
+		return nil, nil
+	}
+	if !br.featureEnabled(FeatureFixtures) {
+		return nil, fmt.Errorf("fixture services are disabled for %s", br.GitRepoURL)
+	}
+	parent := trace.FromContext(ctx)
+	ctx, span := br.startSpan(ctx, "start-fixtures")
+	defer span.End()
+
+	if filepath.IsAbs(file) || strings.HasPrefix(filepath.Clean(file), "..") {
+		return nil, fmt.Errorf("expecting fixtures within the repository, got %q", file)
+	}
+	timeout := defaultFixtureTimeout
+	if value := config["fixture-timeout"]; value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid fixture-timeout %q, expecting a positive duration", value)
+		}
+	}
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	project := "bencher-" + hex.EncodeToString(suffix)
+	span.AddAttributes(trace.StringAttribute("project", project))
+
+	// Docker isn't available to the user of a jail, hence compose
+	// runs as the server, like the commands checking out the sources.
+	compose := func(ctx context.Context, args ...string) ([]byte, error) {
+		cmd := br.checkoutCmd(ctx, "docker", append([]string{"compose", "--file", file, "--project-name", project}, args...)...)
+		cmd.Dir = br.projectDir()
+		return runCheckoutCmd(cmd)
+	}
+	stop := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), fixtureTeardownTimeout)
+		defer cancel()
+		if _, err := compose(ctx, "down", "--volumes", "--remove-orphans"); err != nil {
+			parent.Annotatef(nil, "Tearing down the fixtures of %s: %v", project, err)
+		}
+	}
+
+	upCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// The services are checked as compose resolves them, e.g. with the
+	// short syntax of volumes expanded and other files merged in.
+	resolved, err := compose(upCtx, "config", "--format", "json")
+	if err != nil {
+		return nil, fmt.Errorf("Reading the fixtures: %v", err)
+	}
+	ports, err := checkComposeConfig(resolved)
+	if err != nil {
+		return nil, fmt.Errorf("Refusing the fixtures of %s: %v", file, err)
+	}
+	readyURLs := strings.Fields(config["fixture-ready"])
+	for _, url := range readyURLs {
+		if err := checkReadyURL(url, ports); err != nil {
+			return nil, fmt.Errorf("Refusing the fixtures of %s: %v", file, err)
+		}
+	}
+	args := []string{"up", "--detach", "--wait"}
+	args = append(args, strings.Fields(config["fixture-services"])...)
+	if _, err := compose(upCtx, args...); err != nil {
+		stop()
+		return nil, fmt.Errorf("Starting the fixtures: %v", err)
+	}
+	for _, url := range readyURLs {
+		if err := waitReady(upCtx, url); err != nil {
+			stop()
+			return nil, fmt.Errorf("Waiting for fixture %s: %v", url, err)
+		}
+	}
+	br.fixtures = project
+	return func() {
+		br.fixtures = ""
+		stop()
+	}, nil
+}
+
+// composeConfig is the part of a resolved compose file that
+// checkComposeConfig checks.
+type composeConfig struct {
+	Services map[string]struct {
+		Privileged  bool          `json:"privileged"`
+		CapAdd      []string      `json:"cap_add"`
+		Devices     []interface{} `json:"devices"`
+		NetworkMode string        `json:"network_mode"`
+		Pid         string        `json:"pid"`
+		Ipc         string        `json:"ipc"`
+		Uts         string        `json:"uts"`
+		UsernsMode  string        `json:"userns_mode"`
+		Cgroup      string        `json:"cgroup"`
+		SecurityOpt []string      `json:"security_opt"`
+		Volumes     []struct {
+			Type   string `json:"type"`
+			Source string `json:"source"`
+		} `json:"volumes"`
+		Ports []struct {
+			// Published is a string or a number depending on compose's version.
+			Published interface{} `json:"published"`
+		} `json:"ports"`
+	} `json:"services"`
+	Volumes map[string]struct {
+		Driver     string            `json:"driver"`
+		DriverOpts map[string]string `json:"driver_opts"`
+		// External is a boolean or, in older files, an object.
+		External interface{} `json:"external"`
+	} `json:"volumes"`
+}
+
+// checkComposeConfig returns an error if a service of the compose
+// file, resolved by "docker compose config --format json", would have
+// access to the host, which the fixtures of a benchmark don't need, and
+// otherwise the ports that the services publish on the host.
+func checkComposeConfig(resolved []byte) (map[string]bool, error) {
+	var config composeConfig
+	if err := json.Unmarshal(resolved, &config); err != nil {
+		return nil, err
+	}
+	// Volumes may only be created afresh by the default driver,
+	// lest they are e.g. bind mounts in disguise.
+	volumes := make([]string, 0, len(config.Volumes))
+	for name := range config.Volumes {
+		volumes = append(volumes, name)
+	}
+	sort.Strings(volumes)
+	for _, name := range volumes {
+		volume := config.Volumes[name]
+		switch {
+		case volume.External != nil && volume.External != false:
+			return nil, fmt.Errorf("volume %s is external", name)
+		case volume.Driver != "" && volume.Driver != "local":
+			return nil, fmt.Errorf("volume %s uses driver %s", name, volume.Driver)
+		case len(volume.DriverOpts) > 0:
+			return nil, fmt.Errorf("volume %s sets driver options", name)
+		}
+	}
+
+	ports := make(map[string]bool)
+	names := make([]string, 0, len(config.Services))
+	for name := range config.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		service := config.Services[name]
+		switch {
+		case service.Privileged:
+			return nil, fmt.Errorf("service %s is privileged", name)
+		case len(service.CapAdd) > 0:
+			return nil, fmt.Errorf("service %s adds capabilities %s", name, strings.Join(service.CapAdd, ", "))
+		case len(service.Devices) > 0:
+			return nil, fmt.Errorf("service %s maps devices of the host", name)
+		case len(service.SecurityOpt) > 0:
+			return nil, fmt.Errorf("service %s sets security options %s", name, strings.Join(service.SecurityOpt, ", "))
+		}
+		for _, mode := range []string{service.NetworkMode, service.Pid, service.Ipc, service.Uts, service.UsernsMode, service.Cgroup} {
+			if mode == "host" {
+				return nil, fmt.Errorf("service %s shares namespaces of the host", name)
+			}
+		}
+		for _, volume := range service.Volumes {
+			if volume.Type != "volume" && volume.Type != "tmpfs" {
+				return nil, fmt.Errorf("service %s mounts %s of type %s", name, volume.Source, volume.Type)
+			}
+		}
+		for _, port := range service.Ports {
+			if port.Published != nil {
+				ports[fmt.Sprint(port.Published)] = true
+			}
+		}
+	}
+	return ports, nil
+}
+
+// checkReadyURL returns an error unless url is that of a port that
+// the fixtures publish on the loopback interface, so that repositories
+// can't have the server probe other hosts.
+func checkReadyURL(rawURL string, ports map[string]bool) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("expecting an http or https fixture-ready URL, got %q", rawURL)
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("expecting fixture-ready URL %q to be of localhost", rawURL)
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	if !ports[port] {
+		return fmt.Errorf("expecting fixture-ready URL %q to be of a port the fixtures publish", rawURL)
+	}
+	return nil
+}
+
+// readyClient probes the fixtures without following
+// redirects, which could lead away from them.
+var readyClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// waitReady polls url until it responds without a server error.
+func waitReady(ctx context.Context, url string) error {
+	for {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		res, err := readyClient.Do(req.WithContext(ctx))
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode < 500 {
+				return nil
+			}
+			err = fmt.Errorf("%s", res.Status)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("not ready: %v", err)
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import "testing"
+
+func TestCheckComposeConfig(t *testing.T) {
+	tests := []struct {
+		resolved string
+		ok       bool
+	}{
+		{`{"services":{"jaeger":{"image":"jaegertracing/all-in-one","volumes":[{"type":"volume","source":"data","target":"/data"}]}}}`, true},
+		{`{"services":{"jaeger":{"image":"jaegertracing/all-in-one","privileged":true}}}`, false},
+		{`{"services":{"jaeger":{"image":"jaegertracing/all-in-one","volumes":[{"type":"bind","source":"/var/run/docker.sock","target":"/var/run/docker.sock"}]}}}`, false},
+		{`{"services":{"jaeger":{"image":"jaegertracing/all-in-one","cap_add":["SYS_ADMIN"]}}}`, false},
+		{`{"services":{"jaeger":{"image":"jaegertracing/all-in-one","network_mode":"host"}}}`, false},
+		{`{"services":{"jaeger":{"image":"jaegertracing/all-in-one","ipc":"host"}}}`, false},
+		{`{"services":{"jaeger":{"image":"jaegertracing/all-in-one","userns_mode":"host"}}}`, false},
+		{`{"services":{"jaeger":{"image":"jaegertracing/all-in-one","security_opt":["seccomp:unconfined"]}}}`, false},
+		{`{"services":{"jaeger":{"image":"jaegertracing/all-in-one","volumes":[{"type":"volume","source":"root","target":"/host"}]}},` +
+			`"volumes":{"root":{"driver_opts":{"type":"none","o":"bind","device":"/"}}}}`, false},
+		{`{"services":{"jaeger":{"image":"jaegertracing/all-in-one","volumes":[{"type":"volume","source":"data","target":"/data"}]}},` +
+			`"volumes":{"data":{"external":true}}}`, false},
+	}
+	for _, tt := range tests {
+		if _, err := checkComposeConfig([]byte(tt.resolved)); (err == nil) != tt.ok {
+			t.Errorf("checkComposeConfig(%s): got %v, want ok %v", tt.resolved, err, tt.ok)
+		}
+	}
+}
+
+func TestCheckReadyURL(t *testing.T) {
+	ports, err := checkComposeConfig([]byte(`{"services":{"jaeger":{"ports":[{"target":14269,"published":"14269"}]},` +
+		`"prometheus":{"ports":[{"target":9090,"published":9090}]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"http://localhost:14269/", true},
+		{"http://127.0.0.1:9090/-/ready", true},
+		{"http://[::1]:9090/-/ready", true},
+		{"http://localhost:8080/", false},
+		{"http://169.254.169.254:9090/computeMetadata/v1/", false},
+		{"http://metadata.google.internal:9090/", false},
+		{"file:///etc/passwd", false},
+	}
+	for _, tt := range tests {
+		if err := checkReadyURL(tt.url, ports); (err == nil) != tt.ok {
+			t.Errorf("checkReadyURL(%q): got %v, want ok %v", tt.url, err, tt.ok)
+		}
+	}
+}
+
+func TestFixturesAreOptIn(t *testing.T) {
+	br := &Request{GitRepoURL: "go.opencensus.io/exporter"}
+	if br.featureEnabled(FeatureFixtures) {
+		t.Error("fixtures enabled without feature flags")
+	}
+	if !br.featureEnabled(FeatureProfiling) {
+		t.Error("profiling disabled without feature flags")
+	}
+	ff, err := ParseFeatureFlags("go.opencensus.io/*:fixtures=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	br.Features = ff
+	if !br.featureEnabled(FeatureFixtures) {
+		t.Error("fixtures disabled for a repository that a flag enables them for")
+	}
+	br.GitRepoURL = "github.com/census-instrumentation/opencensus-service"
+	if br.featureEnabled(FeatureFixtures) {
+		t.Error("fixtures enabled for a repository that no flag enables them for")
+	}
+}
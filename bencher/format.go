@@ -0,0 +1,375 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/perf/benchstat"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+func (br *Request) location() (*time.Location, error) {
+	if br.Timezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(br.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %v", br.Timezone, err)
+	}
+	return loc, nil
+}
+
+// datedPrefix returns the unique, lexically sortable storage
+// prefix of a run started at t e.g. "2018-05-03/2018-05-03T14:05:06Z".
+// It is in UTC whatever t's location, lest the runs of requests in
+// different time zones sort out of order.
+func datedPrefix(t time.Time) string {
+	t = t.UTC()
+	return t.Format("2006-01-02") + "/" + t.Format(time.RFC3339)
+}
+
+var numberRe = regexp.MustCompile(`[0-9]+(\.[0-9]+)?`)
+
+// localizeNumbers reformats every decimal number in s
+// according to the number formatting conventions of p.
+func localizeNumbers(p *message.Printer, s string) string {
+	return numberRe.ReplaceAllStringFunc(s, func(num string) string {
+		v, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return num
+		}
+		decimals := 0
+		if i := strings.IndexByte(num, '.'); i >= 0 {
+			decimals = len(num) - i - 1
+		}
+		return p.Sprintf("%.*f", decimals, v)
+	})
+}
+
+// copyTables returns copies of tables and their rows, which can be
+// altered for presentation while leaving tables themselves untouched.
+func copyTables(tables []*benchstat.Table) []*benchstat.Table {
+	copies := make([]*benchstat.Table, 0, len(tables))
+	for _, table := range tables {
+		tc := *table
+		tc.Rows = make([]*benchstat.Row, 0, len(table.Rows))
+		for _, row := range table.Rows {
+			rc := *row
+			tc.Rows = append(tc.Rows, &rc)
+		}
+		copies = append(copies, &tc)
+	}
+	return copies
+}
+
+// mostChanged returns copies of tables with only the n rows that
+// changed the most relatively, in their original order, and the
+// number of rows that were left out.
+func mostChanged(tables []*benchstat.Table, n int) ([]*benchstat.Table, int) {
+	var all []*benchstat.Row
+	for _, table := range tables {
+		all = append(all, table.Rows...)
+	}
+	if len(all) <= n {
+		return copyTables(tables), 0
+	}
+	sort.SliceStable(all, func(i, j int) bool { return math.Abs(all[i].PctDelta) > math.Abs(all[j].PctDelta) })
+	keep := make(map[*benchstat.Row]bool, n)
+	for _, row := range all[:n] {
+		keep[row] = true
+	}
+
+	var kept []*benchstat.Table
+	for _, table := range tables {
+		tc := *table
+		tc.Rows = nil
+		for _, row := range table.Rows {
+			if keep[row] {
+				rc := *row
+				tc.Rows = append(tc.Rows, &rc)
+			}
+		}
+		if len(tc.Rows) > 0 {
+			kept = append(kept, &tc)
+		}
+	}
+	return kept, len(all) - n
+}
+
+// localize formats the means and deltas of tables for locale.
+func localize(locale string, tables []*benchstat.Table) error {
+	if locale == "" {
+		return nil
+	}
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return fmt.Errorf("invalid locale %q: %v", locale, err)
+	}
+	p := message.NewPrinter(tag)
+
+	for _, table := range tables {
+		for _, row := range table.Rows {
+			if scaler := row.Scaler; scaler != nil {
+				row.Scaler = func(v float64) string { return localizeNumbers(p, scaler(v)) }
+			}
+			row.Delta = localizeNumbers(p, row.Delta)
+		}
+	}
+	return nil
+}
+
+// BenchmarkChartURL returns the URL of the dashboard page charting the
+// history of the repository's benchmark, named as benchstat reports it.
+func BenchmarkChartURL(dashboardURL, repo, benchmark string) string {
+	return strings.TrimSuffix(dashboardURL, "/") + "/dashboard/" + repo + "/bench/" + url.PathEscape(benchmark)
+}
+
+func (br *Request) formatHTML(tables []*benchstat.Table) (string, error) {
+	tables = copyTables(tables)
+	annotateCIs(tables)
+	if err := localize(br.Locale, tables); err != nil {
+		return "", err
+	}
+
+	// benchstat escapes benchmark names, hence links are
+	// substituted for placeholders after formatting.
+	var links []string
+	if br.DashboardURL != "" {
+		for _, table := range tables {
+			for _, row := range table.Rows {
+				placeholder := fmt.Sprintf("bencherlink%08d", len(links))
+				link := fmt.Sprintf(`<a href="%s">%s</a>`,
+					html.EscapeString(BenchmarkChartURL(br.DashboardURL, br.GitRepoURL, row.Benchmark)),
+					html.EscapeString(row.Benchmark))
+				links = append(links, placeholder, link)
+				row.Benchmark = placeholder
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	for _, section := range archSections(tables) {
+		if section.value != "" {
+			fmt.Fprintf(buf, "<h3>goarch: %s</h3>\n", html.EscapeString(section.value))
+		}
+		formatPackagesHTML(buf, section.value, section.tables)
+	}
+	return strings.NewReplacer(links...).Replace(buf.String()), nil
+}
+
+// formatPackagesHTML formats tables like benchstat in a collapsible
+// section per package, so that the reports of monorepos stay readable.
+// Each section is summarized by its geometric mean delta per metric and
+// is expanded if it has regressions, below an index linking to them all.
+// Tables of a single package are formatted as they are.
+func formatPackagesHTML(buf *bytes.Buffer, goarch string, tables []*benchstat.Table) {
+	sections := labelSections(tables, "pkg")
+	if len(sections) <= 1 {
+		benchstat.FormatHTML(buf, tables)
+		return
+	}
+
+	type packageSummary struct {
+		anchor, name, deltas string
+		worse, better        int
+	}
+	summaries := make([]*packageSummary, 0, len(sections))
+	for _, section := range sections {
+		ps := &packageSummary{anchor: packageAnchor(goarch, section.value), name: section.value}
+		if ps.name == "" {
+			ps.name = "(no package)"
+		}
+		var deltas []string
+		for _, table := range section.tables {
+			if delta, ok := geomeanDelta(table.Rows); ok {
+				deltas = append(deltas, fmt.Sprintf("%s %+.2f%%", table.Metric, 100*delta))
+			}
+			for _, row := range table.Rows {
+				switch row.Change {
+				case -1:
+					ps.worse++
+				case +1:
+					ps.better++
+				}
+			}
+		}
+		ps.deltas = strings.Join(deltas, ", ")
+		summaries = append(summaries, ps)
+	}
+
+	buf.WriteString("<ul>\n")
+	for _, ps := range summaries {
+		fmt.Fprintf(buf, "<li><a href=\"#%s\">%s</a>", ps.anchor, html.EscapeString(ps.name))
+		if ps.deltas != "" {
+			fmt.Fprintf(buf, " %s", html.EscapeString(ps.deltas))
+		}
+		buf.WriteString("</li>\n")
+	}
+	buf.WriteString("</ul>\n")
+
+	for i, section := range sections {
+		ps := summaries[i]
+		open := ""
+		if ps.worse > 0 {
+			open = " open"
+		}
+		fmt.Fprintf(buf, "<details id=\"%s\"%s>\n<summary><b>%s</b>", ps.anchor, open, html.EscapeString(ps.name))
+		if ps.deltas != "" {
+			fmt.Fprintf(buf, " geomean %s", html.EscapeString(ps.deltas))
+		}
+		fmt.Fprintf(buf, " (%d worse, %d better)</summary>\n", ps.worse, ps.better)
+		benchstat.FormatHTML(buf, section.tables)
+		buf.WriteString("</details>\n")
+	}
+}
+
+var anchorRe = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// packageAnchor returns the id of the section of pkg in the report.
+func packageAnchor(goarch, pkg string) string {
+	anchor := "pkg-" + pkg
+	if goarch != "" {
+		anchor = "pkg-" + goarch + "-" + pkg
+	}
+	return strings.Trim(anchorRe.ReplaceAllString(anchor, "-"), "-")
+}
+
+// geomeanDelta returns the relative change of the geometric mean of
+// the compared rows, as benchstat's geomean row would have it.
+func geomeanDelta(rows []*benchstat.Row) (float64, bool) {
+	var sum float64
+	var n int
+	for _, row := range rows {
+		if row.Benchmark == geomeanBenchmark || len(row.Metrics) != 2 {
+			continue
+		}
+		before, after := row.Metrics[0].Mean, row.Metrics[1].Mean
+		if before <= 0 || after <= 0 {
+			continue
+		}
+		sum += math.Log(after / before)
+		n++
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return math.Exp(sum/float64(n)) - 1, true
+}
+
+// formatText formats tables like benchstat, with confidence intervals,
+// in a section per architecture.
+func formatText(buf *bytes.Buffer, tables []*benchstat.Table) {
+	tables = copyTables(tables)
+	annotateCIs(tables)
+	for i, section := range archSections(tables) {
+		if section.value != "" {
+			if i > 0 {
+				buf.WriteString("\n")
+			}
+			fmt.Fprintf(buf, "goarch: %s\n\n", section.value)
+		}
+		benchstat.FormatText(buf, section.tables)
+	}
+}
+
+type labelSection struct {
+	value  string
+	tables []*benchstat.Table
+}
+
+// archSections splits tables by the architecture of their rows, which
+// benchstat groups by "goarch:<arch>", so that rows of different
+// architectures aren't mixed.
+func archSections(tables []*benchstat.Table) []*labelSection {
+	return labelSections(tables, "goarch")
+}
+
+// labelSections splits tables by the value of the key label of their
+// rows' groups e.g. "pkg:<path>", sorted by value. The label is dropped
+// from the rows' groups. Tables with a single value are left as they are.
+func labelSections(tables []*benchstat.Table, key string) []*labelSection {
+	prefix := key + ":"
+	valueOf := func(group string) string {
+		for _, label := range strings.Fields(group) {
+			if strings.HasPrefix(label, prefix) {
+				return strings.TrimPrefix(label, prefix)
+			}
+		}
+		return ""
+	}
+	var values []string
+	seen := make(map[string]bool)
+	for _, table := range tables {
+		for _, row := range table.Rows {
+			if value := valueOf(row.Group); !seen[value] {
+				seen[value] = true
+				values = append(values, value)
+			}
+		}
+	}
+	if len(values) <= 1 {
+		return []*labelSection{{tables: tables}}
+	}
+	sort.Strings(values)
+
+	var sections []*labelSection
+	for _, value := range values {
+		section := &labelSection{value: value}
+		for _, table := range tables {
+			tc := *table
+			tc.Rows = nil
+			tc.Groups = nil
+			for _, row := range table.Rows {
+				if valueOf(row.Group) != value {
+					continue
+				}
+				var labels []string
+				for _, label := range strings.Fields(row.Group) {
+					if !strings.HasPrefix(label, prefix) {
+						labels = append(labels, label)
+					}
+				}
+				row.Group = strings.Join(labels, " ")
+				tc.Rows = append(tc.Rows, row)
+				addGroup(&tc.Groups, row.Group)
+			}
+			if len(tc.Rows) > 0 {
+				section.tables = append(section.tables, &tc)
+			}
+		}
+		sections = append(sections, section)
+	}
+	return sections
+}
+
+func addGroup(groups *[]string, group string) {
+	for _, g := range *groups {
+		if g == group {
+			return
+		}
+	}
+	*groups = append(*groups, group)
+}
@@ -0,0 +1,68 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLabelSectionsSplitsPackages(t *testing.T) {
+	gtr := readTestEvents(t, "go-test-two-packages.json")
+	tables := compareConfigs([]string{"before", "after"}, [][]byte{gtr.benchmarks, gtr.benchmarks}, defaultSplitBy)
+
+	sections := labelSections(tables, "pkg")
+	if len(sections) != 2 {
+		t.Fatalf("got %d sections, want 2", len(sections))
+	}
+	for i, want := range []string{"example.com/tm/a", "example.com/tm/b"} {
+		section := sections[i]
+		if section.value != want {
+			t.Errorf("section %d: got package %q, want %q", i, section.value, want)
+		}
+		if len(section.tables) == 0 {
+			t.Errorf("section %s: got no tables", want)
+		}
+		for _, table := range section.tables {
+			for _, row := range table.Rows {
+				if strings.Contains(row.Group, "pkg:") {
+					t.Errorf("section %s: row %s keeps the package in its group %q", want, row.Benchmark, row.Group)
+				}
+			}
+		}
+	}
+}
+
+func TestFormatPackagesHTML(t *testing.T) {
+	gtr := readTestEvents(t, "go-test-two-packages.json")
+	tables := compareConfigs([]string{"before", "after"}, [][]byte{gtr.benchmarks, gtr.benchmarks}, defaultSplitBy)
+
+	var buf bytes.Buffer
+	formatPackagesHTML(&buf, "amd64", tables)
+	out := buf.String()
+	for _, pkg := range []string{"example.com/tm/a", "example.com/tm/b"} {
+		anchor := packageAnchor("amd64", pkg)
+		if !strings.Contains(out, `<a href="#`+anchor+`">`+pkg+`</a>`) {
+			t.Errorf("no index entry of %s in:\n%s", pkg, out)
+		}
+		if !strings.Contains(out, `<details id="`+anchor+`">`) {
+			t.Errorf("no collapsed section of %s in:\n%s", pkg, out)
+		}
+	}
+	if got := strings.Count(out, "<details"); got != 2 {
+		t.Errorf("got %d sections, want 2", got)
+	}
+}
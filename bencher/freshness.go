@@ -0,0 +1,102 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keighl/postmark"
+)
+
+const stalenessStateName = "latest-staleness-alert.json"
+
+// Freshness reports how recently the repository's baseline was refreshed.
+type Freshness struct {
+	Repo      string        `json:"repo"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Age       time.Duration `json:"age"`
+	Stale     bool          `json:"stale"`
+	// Alerted is set if a staleness alert was sent by this check.
+	Alerted bool `json:"alerted"`
+}
+
+// stalenessState records the baseline generation last alerted about.
+type stalenessState struct {
+	Generation int64     `json:"generation"`
+	SentAt     time.Time `json:"sent_at"`
+}
+
+// CheckFreshness checks that the repository's baseline was refreshed
+// within maxAge, e.g. lest a nightly job broke silently, and if it
+// wasn't, alerts the AlertEmails once per stale baseline, as comparing
+// against an ancient baseline produces misleading results.
+func (br *Request) CheckFreshness(ctx context.Context, maxAge time.Duration) (*Freshness, error) {
+	ctx, span := br.startSpan(ctx, "check-freshness")
+	defer span.End()
+
+	if br.StorageService == nil {
+		return nil, ErrNoStorageService
+	}
+	obj, err := br.StorageService.Objects.Get(br.GCSBucket, br.inBenchmarksDir("latest")).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving the baseline: %v", err)
+	}
+	updated, err := time.Parse(time.RFC3339, obj.Updated)
+	if err != nil {
+		return nil, fmt.Errorf("Parsing the baseline's update time %q: %v", obj.Updated, err)
+	}
+
+	f := &Freshness{Repo: br.GitRepoURL, UpdatedAt: updated, Age: br.now().Sub(updated)}
+	f.Stale = f.Age > maxAge
+	if !f.Stale || len(br.AlertEmails) == 0 {
+		return f, nil
+	}
+
+	prev := new(stalenessState)
+	if blob, err := br.downloadBlob(ctx, stalenessStateName); err == nil {
+		_ = json.Unmarshal(blob, prev)
+	}
+	if prev.Generation == obj.Generation {
+		return f, nil
+	}
+
+	days := int(f.Age.Hours() / 24)
+	email := postmark.Email{
+		From:    br.AppEmail,
+		To:      strings.Join(br.AlertEmails, ","),
+		Subject: fmt.Sprintf("Stale benchmarks baseline for %s", br.GitRepoURL),
+		TextBody: fmt.Sprintf("The benchmarks baseline of %s was last refreshed %d days ago, at %s.\n\n"+
+			"Runs that are meant to refresh it, such as nightly jobs, may be failing silently, and\n"+
+			"comparisons against it may be misleading until a new run refreshes it.\n",
+			br.GitRepoURL, days, updated.Format(time.RFC1123)),
+	}
+	if err := br.deliver(ctx, email); err != nil {
+		return f, err
+	}
+	f.Alerted = true
+
+	blob, err := json.Marshal(&stalenessState{Generation: obj.Generation, SentAt: br.now()})
+	if err != nil {
+		return f, err
+	}
+	if _, err := br.uploadBlob(ctx, stalenessStateName, blob); err != nil {
+		return f, fmt.Errorf("Uploading staleness state: %v", err)
+	}
+	return f, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// githubRepo returns the "owner/repo" of the repository's GitHub
+// repository, from its SourceURL if set, else from its import path.
+func (br *Request) githubRepo() (string, error) {
+	repo := br.GitRepoURL
+	if br.SourceURL != "" {
+		repo = br.SourceURL
+		if i := strings.Index(repo, "://"); i >= 0 {
+			repo = repo[i+len("://"):]
+		}
+	}
+	repo = strings.TrimSuffix(strings.TrimSuffix(repo, "/"), ".git")
+	parts := strings.Split(repo, "/")
+	if len(parts) != 3 || parts[0] != "github.com" {
+		return "", fmt.Errorf("%q isn't a GitHub repository", repo)
+	}
+	return parts[1] + "/" + parts[2], nil
+}
+
+// githubGet decodes into v the GitHub API's response to a GET of
+// the path, authenticated with the GitHubToken.
+func (br *Request) githubGet(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequest("GET", githubAPIURL+path, nil)
+	if err != nil {
+		return err
+	}
+	return br.githubDo(ctx, req, v)
+}
+
+// githubPost posts body as JSON to the path of the GitHub API,
+// decoding its response into v if set.
+func (br *Request) githubPost(ctx context.Context, path string, body, v interface{}) error {
+	blob, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", githubAPIURL+path, bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return br.githubDo(ctx, req, v)
+}
+
+func (br *Request) githubDo(ctx context.Context, req *http.Request, v interface{}) error {
+	if br.GitHubToken == "" {
+		return fmt.Errorf("no GitHub token is configured")
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "token "+br.GitHubToken)
+	client := br.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(body))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,428 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"go.opencensus.io/trace"
+)
+
+// harnessFileName is the file at the root of the target repository
+// configuring the harness that runs its benchmarks, as "key: value" lines
+// e.g.
+//
+//	harness: jmh
+//	command: ./gradlew --no-daemon jmh
+//	results: build/results/jmh/results.json
+//
+// Blank lines and lines starting with "#" are skipped. Repositories
+// without one are benchmarked with go test. It also declares the fixture
+// services that the benchmarks need, see startFixtures, and the hooks
+// that run before and after them, see runHook.
+const harnessFileName = ".bencherharness"
+
+// Harness runs the benchmarks of a project written in some language, for
+// their results to be compared, stored and reported like those of Go's.
+type Harness interface {
+	// Run runs the benchmarks described by hr and returns their
+	// results in the Go benchmark format.
+	Run(ctx context.Context, hr *HarnessRun) ([]byte, error)
+}
+
+// HarnessFunc adapts a function to a Harness.
+type HarnessFunc func(ctx context.Context, hr *HarnessRun) ([]byte, error)
+
+func (hf HarnessFunc) Run(ctx context.Context, hr *HarnessRun) ([]byte, error) {
+	return hf(ctx, hr)
+}
+
+// HarnessRun describes the benchmarks to run.
+type HarnessRun struct {
+	// Repo is the import path of the project e.g. "github.com/census-instrumentation/opencensus-java".
+	Repo string
+	// Dir is the directory of the project's checked out sources.
+	Dir string
+	// Config are the settings of the repository's harness file
+	// e.g. "command" and "results".
+	Config map[string]string
+	// Command returns a command running name with args in Dir, with the
+	// environment, runtime settings and jail of the benchmarks.
+	Command func(ctx context.Context, name string, args ...string) *exec.Cmd
+}
+
+// The built-in harnesses.
+const (
+	// HarnessGo runs the benchmarks with go test. Unlike the others, it
+	// reports how each package's benchmarks ran, and can profile them.
+	HarnessGo = "go"
+	// HarnessJMH runs the jmh task of the JMH Gradle plugin, and parses
+	// its JSON results, with time per op in ns/op and, if profiled with
+	// the GC profiler, allocations in B/op. Throughputs are inverted into
+	// times per op, so that less is better as with every other metric.
+	HarnessJMH = "jmh"
+	// HarnessPyperf runs the harness file's command, which must write
+	// pyperf's JSON results to its "results" file, pyperf.json by default.
+	HarnessPyperf = "pyperf"
+)
+
+// DefaultHarness is the name of the harness used when none is configured.
+const DefaultHarness = HarnessGo
+
+var harnessesMu sync.RWMutex
+var harnesses = map[string]Harness{
+	HarnessJMH: &commandHarness{
+		command: "./gradlew --no-daemon jmh",
+		results: "build/results/jmh/results.json",
+		parse:   parseJMHResults,
+	},
+	HarnessPyperf: &commandHarness{
+		results: "pyperf.json",
+		parse:   parsePyperfResults,
+	},
+}
+
+// RegisterHarness makes h selectable by name in harness files and in
+// Request.Harness, replacing any harness registered under that name.
+// HarnessGo is built into the benchmarking pipeline and can't be replaced.
+func RegisterHarness(name string, h Harness) {
+	if name == HarnessGo {
+		panic("bencher: the " + HarnessGo + " harness can't be replaced")
+	}
+	harnessesMu.Lock()
+	defer harnessesMu.Unlock()
+
+	harnesses[name] = h
+}
+
+// HarnessNames returns the names of the registered harnesses.
+func HarnessNames() []string {
+	harnessesMu.RLock()
+	defer harnessesMu.RUnlock()
+
+	names := []string{HarnessGo}
+	for name := range harnesses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readHarnessFile returns the settings of the target repository's harness
+// file, or none if it has no such file.
+func readHarnessFile(dir string) (map[string]string, error) {
+	blob, err := ioutil.ReadFile(filepath.Join(dir, harnessFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(blob))
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expecting \"key: value\", got %q", harnessFileName, line, text)
+		}
+		config[strings.TrimSpace(text[:i])] = strings.TrimSpace(text[i+1:])
+	}
+	return config, sc.Err()
+}
+
+// runBenchmarks runs the benchmarks of the checked out sources with the
+// harness of the request if set, or else of the repository's harness file.
+func (br *Request) runBenchmarks(ctx context.Context) (*goTestRun, error) {
+	config, err := readHarnessFile(br.projectDir())
+	if err != nil {
+		return nil, fmt.Errorf("Reading %s: %v", harnessFileName, err)
+	}
+	name := firstNonEmpty(br.Harness, config["harness"], DefaultHarness)
+	if br.runner != nil {
+		// A Service's runner replaces whichever harness is configured.
+		name = "custom"
+	}
+	br.harness = name
+	if name == HarnessGo {
+		return br.runGoBenchmarks(ctx)
+	}
+
+	h := br.runner
+	if h == nil {
+		harnessesMu.RLock()
+		h = harnesses[name]
+		harnessesMu.RUnlock()
+	}
+	if h == nil {
+		return nil, fmt.Errorf("unknown harness %q", name)
+	}
+
+	ctx, span := br.startSpan(ctx, "run-harness")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("harness", name))
+
+	hr := &HarnessRun{
+		Repo:    br.GitRepoURL,
+		Dir:     br.projectDir(),
+		Config:  config,
+		Command: br.harnessCmd,
+	}
+	blob, err := h.Run(ctx, hr)
+	if err != nil {
+		return nil, fmt.Errorf("Running the %s harness: %v", name, err)
+	}
+	if len(parseResults(blob)) == 0 {
+		return nil, ErrNoBenchmarks
+	}
+	// Only go test streams events, hence the events uploaded are none.
+	return &goTestRun{benchmarks: blob, events: new(spool)}, nil
+}
+
+// harnessCmd returns a command that runs name with args in the target
+// project's directory, with only the environment that it needs.
+func (br *Request) harnessCmd(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = br.projectDir()
+	cmd.Env = append(append(childEnv(), br.Env...), br.runtimeEnv()...)
+	if br.fixtures != "" {
+		cmd.Env = append(cmd.Env, "BENCHER_FIXTURES="+br.fixtures)
+	}
+	if br.jail != nil {
+		br.jail.confine(cmd)
+	}
+	return cmd
+}
+
+// commandHarness runs a command writing results to a file, which
+// parse converts to the Go benchmark format.
+type commandHarness struct {
+	// command and results are the defaults of the
+	// harness file's "command" and "results".
+	command, results string
+	parse            func(blob []byte) ([]byte, error)
+}
+
+func (ch *commandHarness) Run(ctx context.Context, hr *HarnessRun) ([]byte, error) {
+	args := strings.Fields(firstNonEmpty(hr.Config["command"], ch.command))
+	if len(args) == 0 {
+		return nil, fmt.Errorf("expecting a command in %s", harnessFileName)
+	}
+	results := firstNonEmpty(hr.Config["results"], ch.results)
+	if filepath.IsAbs(results) || strings.HasPrefix(filepath.Clean(results), "..") {
+		return nil, fmt.Errorf("expecting results within the repository, got %q", results)
+	}
+	results = filepath.Join(hr.Dir, results)
+	// Stale results of an earlier run mustn't pass for this run's.
+	if err := os.Remove(results); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	cmd := hr.Command(ctx, args[0], args[1:]...)
+	stderr := &cappedBuffer{max: 64 << 10}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	blob, err := ioutil.ReadFile(results)
+	if err != nil {
+		return nil, fmt.Errorf("Reading the results: %v", err)
+	}
+	return ch.parse(blob)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// benchmarkName makes a benchmark name of parts, valid in the
+// Go benchmark format e.g. "BenchmarkSpanBenchmark/startSpan".
+func benchmarkName(parts ...string) string {
+	name := strings.Join(parts, "/")
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return '_'
+		}
+		return r
+	}, name)
+	// Benchmark names start with an uppercase letter.
+	r, size := utf8.DecodeRuneInString(name)
+	return "Benchmark" + string(unicode.ToUpper(r)) + name[size:]
+}
+
+// nsPerUnit converts the time units of JMH and pyperf to nanoseconds.
+var nsPerUnit = map[string]float64{
+	"ns": 1, "us": 1e3, "ms": 1e6, "s": 1e9, "second": 1e9,
+}
+
+// jmhResult is a benchmark result of JMH's JSON output.
+type jmhResult struct {
+	// Benchmark is qualified by its package and class e.g.
+	// "io.opencensus.trace.SpanBenchmark.startSpan".
+	Benchmark        string               `json:"benchmark"`
+	Params           map[string]string    `json:"params"`
+	PrimaryMetric    jmhMetric            `json:"primaryMetric"`
+	SecondaryMetrics map[string]jmhMetric `json:"secondaryMetrics"`
+}
+
+type jmhMetric struct {
+	// ScoreUnit is e.g. "ns/op" or "ops/s".
+	ScoreUnit string `json:"scoreUnit"`
+	// RawData are the measurements of every iteration of every fork.
+	RawData [][]float64 `json:"rawData"`
+}
+
+// jmhAllocMetric is the allocations per op measured by JMH's GC profiler.
+const jmhAllocMetric = "·gc.alloc.rate.norm"
+
+func parseJMHResults(blob []byte) ([]byte, error) {
+	var results []*jmhResult
+	if err := json.Unmarshal(blob, &results); err != nil {
+		return nil, fmt.Errorf("Parsing JMH results: %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	var pkg string
+	for _, res := range results {
+		i := strings.LastIndex(res.Benchmark, ".")
+		j := -1
+		if i > 0 {
+			j = strings.LastIndex(res.Benchmark[:i], ".")
+		}
+		if j < 0 {
+			return nil, fmt.Errorf("unexpected JMH benchmark name %q", res.Benchmark)
+		}
+		if res.Benchmark[:j] != pkg {
+			pkg = res.Benchmark[:j]
+			fmt.Fprintf(buf, "pkg: %s\n", pkg)
+		}
+		parts := []string{res.Benchmark[j+1 : i], res.Benchmark[i+1:]}
+		keys := make([]string, 0, len(res.Params))
+		for key := range res.Params {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			parts = append(parts, key+"="+res.Params[key])
+		}
+		name := benchmarkName(parts...)
+
+		toNsPerOp, err := jmhToNsPerOp(res.PrimaryMetric.ScoreUnit)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", res.Benchmark, err)
+		}
+		alloc := res.SecondaryMetrics[jmhAllocMetric]
+		for fork, iterations := range res.PrimaryMetric.RawData {
+			for k, value := range iterations {
+				fmt.Fprintf(buf, "%s\t1\t%g ns/op", name, toNsPerOp(value))
+				if fork < len(alloc.RawData) && k < len(alloc.RawData[fork]) {
+					fmt.Fprintf(buf, "\t%g B/op", alloc.RawData[fork][k])
+				}
+				buf.WriteString("\n")
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// jmhToNsPerOp returns a function converting scores in unit, a time per
+// op e.g. "us/op" or a throughput e.g. "ops/ms", to nanoseconds per op.
+func jmhToNsPerOp(unit string) (func(float64) float64, error) {
+	if strings.HasSuffix(unit, "/op") {
+		if ns, ok := nsPerUnit[strings.TrimSuffix(unit, "/op")]; ok {
+			return func(v float64) float64 { return v * ns }, nil
+		}
+	}
+	if strings.HasPrefix(unit, "ops/") {
+		if ns, ok := nsPerUnit[strings.TrimPrefix(unit, "ops/")]; ok {
+			return func(v float64) float64 { return ns / v }, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported JMH score unit %q", unit)
+}
+
+// pyperfSuite is pyperf's JSON output, of a single benchmark or a suite.
+type pyperfSuite struct {
+	Metadata   map[string]interface{} `json:"metadata"`
+	Benchmarks []struct {
+		Metadata map[string]interface{} `json:"metadata"`
+		Runs     []struct {
+			// Values exclude the warmups.
+			Values []float64 `json:"values"`
+		} `json:"runs"`
+	} `json:"benchmarks"`
+}
+
+func parsePyperfResults(blob []byte) ([]byte, error) {
+	suite := new(pyperfSuite)
+	if err := json.Unmarshal(blob, suite); err != nil {
+		return nil, fmt.Errorf("Parsing pyperf results: %v", err)
+	}
+	// Benchmark metadata defaults to that common to the suite.
+	metadata := func(md map[string]interface{}, key string) string {
+		if value, ok := md[key]; ok {
+			return fmt.Sprint(value)
+		}
+		if value, ok := suite.Metadata[key]; ok {
+			return fmt.Sprint(value)
+		}
+		return ""
+	}
+
+	buf := new(bytes.Buffer)
+	for _, bench := range suite.Benchmarks {
+		name := metadata(bench.Metadata, "name")
+		if name == "" {
+			return nil, fmt.Errorf("expecting the name of every pyperf benchmark")
+		}
+		unit, scale := metadata(bench.Metadata, "unit"), 1.0
+		switch unit {
+		case "second", "":
+			unit, scale = "ns/op", nsPerUnit["second"]
+		case "byte":
+			unit = "B/op"
+		default:
+			unit += "/op"
+		}
+		for _, run := range bench.Runs {
+			for _, value := range run.Values {
+				fmt.Fprintf(buf, "%s\t1\t%g %s\n", benchmarkName(name), value*scale, unit)
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
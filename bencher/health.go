@@ -0,0 +1,193 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// stableCV is the coefficient of variation, i.e. the standard deviation
+// relative to the mean, at or below which a benchmark is deemed stable.
+const stableCV = 0.05
+
+// Weights of the components of the health score.
+const (
+	stableWeight   = 0.5
+	varianceWeight = 0.25
+	coverageWeight = 0.25
+)
+
+// Health summarizes how trustworthy a repository's benchmarks are over
+// its recent runs, so that many repositories can be watched at a glance.
+type Health struct {
+	Repo string    `json:"repo"`
+	Runs int       `json:"runs"`
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+
+	// Benchmarks is the number of distinct benchmarks in the runs.
+	Benchmarks int `json:"benchmarks"`
+	// Stable is the fraction of benchmarks whose samples vary by at
+	// most 5% of their mean, within runs, on average over the runs.
+	Stable float64 `json:"stable"`
+	// MeanVariation is the mean over all benchmarks of
+	// the coefficient of variation of their samples.
+	MeanVariation float64 `json:"mean_variation"`
+	// CriticalCoverage is the fraction of the critical benchmarks
+	// present in the latest run, 1 if none were designated.
+	CriticalCoverage float64 `json:"critical_coverage"`
+	// MissingCritical lists the critical benchmarks absent from the latest run.
+	MissingCritical []string `json:"missing_critical,omitempty"`
+
+	// Score combines the above into a single number from 0 to 100.
+	Score float64 `json:"score"`
+
+	// Unstable lists the benchmarks that aren't, the most variable first.
+	Unstable []*BenchmarkVariation `json:"unstable,omitempty"`
+}
+
+type BenchmarkVariation struct {
+	Name      string  `json:"name"`
+	Variation float64 `json:"variation"`
+}
+
+// gomaxprocsSuffixRe matches the "-8" suffix that the
+// testing package appends to names when GOMAXPROCS > 1.
+var gomaxprocsSuffixRe = regexp.MustCompile(`-\d+$`)
+
+// HealthScore computes the health of the repository's
+// benchmarks over at most the window most recent runs.
+func (br *Request) HealthScore(ctx context.Context, window int) (*Health, error) {
+	ctx, span := br.startSpan(ctx, "health-score")
+	defer span.End()
+
+	runs, err := br.recentRuns(ctx, window)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("no stored runs for %q", br.GitRepoURL)
+	}
+
+	// 1. Average every benchmark's within-run variation over the runs.
+	variations := make(map[string][]float64)
+	var latest map[string]bool
+	for _, run := range runs {
+		// Compacted runs' samples aren't kept.
+		if !run.hasResults() {
+			continue
+		}
+		blob, err := br.downloadBlob(ctx, run.ID)
+		if err != nil {
+			return nil, fmt.Errorf("Retrieving results of run %q: %v", run.ID, err)
+		}
+		latest = make(map[string]bool)
+		for name, samples := range primarySamples(parseResults(blob)) {
+			latest[gomaxprocsSuffixRe.ReplaceAllString(name, "")] = true
+			if cv, ok := coefficientOfVariation(samples); ok {
+				variations[name] = append(variations[name], cv)
+			}
+		}
+	}
+
+	h := &Health{
+		Repo:       br.GitRepoURL,
+		Runs:       len(runs),
+		From:       runs[0].StartTime,
+		To:         runs[len(runs)-1].StartTime,
+		Benchmarks: len(variations),
+	}
+	stable, sumCV := 0, 0.0
+	for name, cvs := range variations {
+		cv := mean(cvs)
+		sumCV += cv
+		if cv <= stableCV {
+			stable++
+		} else {
+			h.Unstable = append(h.Unstable, &BenchmarkVariation{Name: name, Variation: cv})
+		}
+	}
+	sort.Slice(h.Unstable, func(i, j int) bool { return h.Unstable[i].Variation > h.Unstable[j].Variation })
+	if h.Benchmarks > 0 {
+		h.Stable = float64(stable) / float64(h.Benchmarks)
+		h.MeanVariation = sumCV / float64(h.Benchmarks)
+	}
+
+	// 2. Check that the critical benchmarks still run.
+	h.CriticalCoverage = 1
+	if len(br.CriticalBenchmarks) > 0 {
+		for _, name := range br.CriticalBenchmarks {
+			if !latest[gomaxprocsSuffixRe.ReplaceAllString(name, "")] {
+				h.MissingCritical = append(h.MissingCritical, name)
+			}
+		}
+		h.CriticalCoverage = 1 - float64(len(h.MissingCritical))/float64(len(br.CriticalBenchmarks))
+	}
+
+	// 3. Variation counts against the score until it reaches 4x the stable bound.
+	varianceScore := 1 - math.Min(h.MeanVariation/(4*stableCV), 1)
+	h.Score = 100 * (stableWeight*h.Stable + varianceWeight*varianceScore + coverageWeight*h.CriticalCoverage)
+	return h, nil
+}
+
+// primarySamples groups the samples of every benchmark's
+// first unit, conventionally its time e.g. "ns/op", by name.
+func primarySamples(results []*benchResult) map[string][]float64 {
+	samples := make(map[string][]float64)
+	for _, res := range results {
+		unit := primaryUnit(res.Line)
+		if value, ok := res.Values[unit]; ok {
+			samples[res.Name] = append(samples[res.Name], value)
+		}
+	}
+	return samples
+}
+
+// primaryUnit returns the unit of the first value of a result line.
+func primaryUnit(line string) string {
+	var name, unit string
+	var n int
+	var value float64
+	fmt.Sscan(line, &name, &n, &value, &unit)
+	return unit
+}
+
+func coefficientOfVariation(samples []float64) (float64, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+	m := mean(samples)
+	if m == 0 {
+		return 0, false
+	}
+	ss := 0.0
+	for _, x := range samples {
+		ss += (x - m) * (x - m)
+	}
+	return math.Sqrt(ss/float64(len(samples)-1)) / m, true
+}
+
+func mean(xs []float64) float64 {
+	sum := 0.0
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
@@ -0,0 +1,333 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultPageSize = 20
+
+var ErrNoStorageService = errors.New("no storage service configured")
+
+// RunsPage is a page of stored runs, ordered from the oldest.
+type RunsPage struct {
+	Runs []*Run `json:"runs"`
+	// NextPage if non-blank, is the page token of the next page.
+	NextPage string `json:"next_page,omitempty"`
+}
+
+// RunFilter selects runs when listing them.
+type RunFilter struct {
+	// Page is the token returned as the previous page's NextPage.
+	Page     string
+	PageSize int
+	// Tags if set, only selects runs that carry all of them.
+	Tags map[string]string
+	// GOARCH if set, only selects runs on that architecture e.g. "arm64".
+	GOARCH string
+	// PullRequest if set, only selects the runs of that pull request.
+	PullRequest int
+	// IncludeDeleted also selects soft-deleted runs.
+	IncludeDeleted bool
+}
+
+func (rf *RunFilter) matches(run *Run) bool {
+	if run.Deleted != nil && !rf.IncludeDeleted {
+		return false
+	}
+	if rf.GOARCH != "" && run.GOARCH != rf.GOARCH {
+		return false
+	}
+	if rf.PullRequest != 0 && run.PullRequest != rf.PullRequest {
+		return false
+	}
+	for key, value := range rf.Tags {
+		if run.Tags[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ListRuns lists the stored runs of the repository.
+func (br *Request) ListRuns(ctx context.Context, rf *RunFilter) (*RunsPage, error) {
+	page := new(RunsPage)
+	next, err := br.WalkRuns(ctx, rf, func(run *Run) error {
+		page.Runs = append(page.Runs, run)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	page.NextPage = next
+	return page, nil
+}
+
+// WalkRuns invokes fn with every stored run of the repository selected by
+// rf, as they are listed, without holding the page in memory. It returns
+// the token of the next page, which is blank once all runs were walked.
+func (br *Request) WalkRuns(ctx context.Context, rf *RunFilter, fn func(*Run) error) (string, error) {
+	ctx, span := br.startSpan(ctx, "walk-runs")
+	defer span.End()
+
+	if br.StorageService == nil {
+		return "", ErrNoStorageService
+	}
+	if rf == nil {
+		rf = new(RunFilter)
+	}
+	pageSize := rf.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+
+	// The page token is the ID of the last run of the previous page, from
+	// whose metadata the listing resumes, exclusively, in lexical order.
+	prefix := br.inBenchmarksDir("")
+	var startOffset string
+	if rf.Page != "" {
+		startOffset = prefix + rf.Page + runMetaSuffix
+	}
+
+	n := 0
+	gcsPageToken := ""
+	for {
+		call := br.StorageService.Objects.List(br.GCSBucket).Prefix(prefix).Context(ctx)
+		if startOffset != "" {
+			call = call.StartOffset(startOffset)
+		}
+		if gcsPageToken != "" {
+			call = call.PageToken(gcsPageToken)
+		}
+		objs, err := call.Do()
+		if err != nil {
+			return "", fmt.Errorf("Listing runs: %v", err)
+		}
+
+		for _, obj := range objs.Items {
+			if obj.Name == startOffset || !strings.HasSuffix(obj.Name, runMetaSuffix) {
+				continue
+			}
+			blob, err := br.downloadBlob(ctx, strings.TrimPrefix(obj.Name, prefix))
+			if err != nil {
+				return "", fmt.Errorf("Retrieving run metadata %q: %v", obj.Name, err)
+			}
+			run := new(Run)
+			if err := json.Unmarshal(blob, run); err != nil {
+				return "", fmt.Errorf("Parsing run metadata %q: %v", obj.Name, err)
+			}
+			if !rf.matches(run) {
+				continue
+			}
+			if err := fn(run); err != nil {
+				return "", err
+			}
+			if n++; n == pageSize {
+				return run.ID, nil
+			}
+		}
+
+		if gcsPageToken = objs.NextPageToken; gcsPageToken == "" {
+			return "", nil
+		}
+	}
+}
+
+// recentRuns returns at most the limit most recent runs, oldest first.
+func (br *Request) recentRuns(ctx context.Context, limit int) ([]*Run, error) {
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	var recent []*Run
+	rf := &RunFilter{PageSize: math.MaxInt32}
+	_, err := br.WalkRuns(ctx, rf, func(run *Run) error {
+		if recent = append(recent, run); len(recent) > limit {
+			recent = recent[1:]
+		}
+		return nil
+	})
+	return recent, err
+}
+
+// HistoryPoint holds the means of a benchmark's metrics
+// in a single run, on a single architecture.
+type HistoryPoint struct {
+	RunID     string    `json:"run_id"`
+	StartTime time.Time `json:"start_time"`
+	GOARCH    string    `json:"goarch,omitempty"`
+	// Means maps units e.g. "ns/op" to the mean of the run's samples.
+	Means map[string]float64 `json:"means"`
+}
+
+// BenchmarkHistory returns the history of the benchmark, named as benchstat
+// reports it e.g. "StartSpan-8", over at most the limit most recent runs,
+// oldest first. Runs in which the benchmark didn't run are skipped. If goarch
+// is set, only results on that architecture are considered, otherwise runs
+// with results from several architectures have a point per architecture.
+// Compacted runs are charted by a point per week, from the weekly summary.
+func (br *Request) BenchmarkHistory(ctx context.Context, name, goarch string, limit int) ([]*HistoryPoint, error) {
+	ctx, span := br.startSpan(ctx, "benchmark-history")
+	defer span.End()
+
+	histories, err := br.histories(ctx, func(n string) bool { return n == name }, goarch, limit)
+	if err != nil {
+		return nil, err
+	}
+	return histories[name], nil
+}
+
+// BenchmarkHistories returns the history, as BenchmarkHistory does, of
+// every benchmark in at most the limit most recent runs by name, going
+// through the runs once rather than once per benchmark.
+func (br *Request) BenchmarkHistories(ctx context.Context, goarch string, limit int) (map[string][]*HistoryPoint, error) {
+	ctx, span := br.startSpan(ctx, "benchmark-histories")
+	defer span.End()
+
+	return br.histories(ctx, func(string) bool { return true }, goarch, limit)
+}
+
+// histories returns the histories of the benchmarks whose names match.
+func (br *Request) histories(ctx context.Context, match func(name string) bool, goarch string, limit int) (map[string][]*HistoryPoint, error) {
+	recent, err := br.recentRuns(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	histories := make(map[string][]*HistoryPoint)
+	charted := make(map[string]bool)
+	for _, run := range recent {
+		if run.Status == RunStatusNoBenchmarks {
+			continue
+		}
+		if run.Compacted != "" {
+			if charted[run.Compacted] {
+				continue
+			}
+			charted[run.Compacted] = true
+			if err := br.addSummaryPoints(ctx, histories, run.Compacted, match, goarch); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// A run ran on a single architecture, as recorded in its metadata.
+		if goarch != "" && run.GOARCH != "" && run.GOARCH != goarch {
+			continue
+		}
+		blob, err := br.downloadBlob(ctx, run.ID)
+		if err != nil {
+			return nil, fmt.Errorf("Retrieving results of run %q: %v", run.ID, err)
+		}
+		// Means are computed per benchmark and architecture, then per unit.
+		type key struct{ name, arch string }
+		sums := make(map[key]map[string]float64)
+		counts := make(map[key]map[string]int)
+		var keys []key
+		for _, res := range parseResults(blob) {
+			k := key{res.Name, run.GOARCH}
+			if k.arch == "" {
+				// Imported runs only have the architecture their results were labeled with.
+				k.arch = res.Labels["goarch"]
+			}
+			if !match(k.name) || (goarch != "" && k.arch != goarch) {
+				continue
+			}
+			if sums[k] == nil {
+				sums[k] = make(map[string]float64)
+				counts[k] = make(map[string]int)
+				keys = append(keys, k)
+			}
+			for unit, value := range res.Values {
+				sums[k][unit] += value
+				counts[k][unit]++
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].arch < keys[j].arch })
+		for _, k := range keys {
+			point := &HistoryPoint{RunID: run.ID, StartTime: run.StartTime, GOARCH: k.arch, Means: make(map[string]float64)}
+			for unit, sum := range sums[k] {
+				point.Means[unit] = sum / float64(counts[k][unit])
+			}
+			histories[k.name] = append(histories[k.name], point)
+		}
+	}
+	return histories, nil
+}
+
+// addSummaryPoints adds the history points of the matching
+// benchmarks in the week's summary to histories.
+func (br *Request) addSummaryPoints(ctx context.Context, histories map[string][]*HistoryPoint, week string, match func(name string) bool, goarch string) error {
+	ws, err := br.weeklySummary(ctx, week)
+	if err != nil {
+		return err
+	}
+	if ws == nil {
+		return fmt.Errorf("missing summary of %s", week)
+	}
+	type key struct{ name, arch string }
+	points := make(map[key]*HistoryPoint)
+	// Benchmarks of the same name in different packages are charted
+	// together, as they are for runs, by the mean of all their samples.
+	samples := make(map[key]map[string]int)
+	for _, bs := range ws.Benchmarks {
+		k := key{bs.Name, bs.GOARCH}
+		if !match(k.name) || (goarch != "" && k.arch != goarch) || bs.Samples == 0 {
+			continue
+		}
+		point, ok := points[k]
+		if !ok {
+			point = &HistoryPoint{RunID: summariesDir + week, StartTime: ws.Start, GOARCH: bs.GOARCH, Means: make(map[string]float64)}
+			points[k] = point
+			samples[k] = make(map[string]int)
+			histories[k.name] = append(histories[k.name], point)
+		}
+		n := samples[k][bs.Unit] + bs.Samples
+		point.Means[bs.Unit] += (bs.Mean - point.Means[bs.Unit]) * float64(bs.Samples) / float64(n)
+		samples[k][bs.Unit] = n
+	}
+	return nil
+}
+
+// OpenArtifact opens the named artifact of the stored run with runID. The
+// artifact "benchmarks" is the run's raw results while any other name is
+// that of an artifact stored alongside them e.g. "events.json",
+// "meta.json", "results", "report.html" or "profiles/go.opencensus.io_trace.html".
+func (br *Request) OpenArtifact(ctx context.Context, runID, name string) (io.ReadCloser, error) {
+	ctx, span := br.startSpan(ctx, "open-artifact")
+	defer span.End()
+
+	if runID == "" || strings.Contains(runID, "..") || strings.Contains(name, "..") {
+		return nil, fmt.Errorf("invalid artifact %q of run %q", name, runID)
+	}
+	objName := runID
+	if name != "benchmarks" {
+		objName += "-" + name
+	}
+	blob, err := br.downloadBlob(ctx, objName)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(blob)), nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+const defaultHookTimeout = 10 * time.Minute
+
+// The hooks that the harness file can declare.
+const (
+	hookPreRun  = "pre-run"
+	hookPostRun = "post-run"
+)
+
+// runHook runs the shell command of the named hook, declared in the
+// harness file as e.g.
+//
+//	pre-run: make generate
+//	post-run: rm -rf testdata/generated
+//	hook-timeout: 5m
+//
+// like the benchmarks, in the project's directory and in the jail if
+// any, for at most hook-timeout. The pre-run hook runs before the
+// benchmarks, e.g. to generate code that they need to compile, and the
+// post-run hook after them, whether or not they succeeded.
+func (br *Request) runHook(ctx context.Context, hook string) error {
+	config, err := readHarnessFile(br.projectDir())
+	if err != nil {
+		return fmt.Errorf("Reading %s: %v", harnessFileName, err)
+	}
+	command := config[hook]
+	if command == "" {
+		return nil
+	}
+	ctx, span := br.startSpan(ctx, "run-hook")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("hook", hook))
+
+	timeout := defaultHookTimeout
+	if value := config["hook-timeout"]; value != "" {
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid hook-timeout %q, expecting a positive duration", value)
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := br.harnessCmd(ctx, "sh", "-c", command)
+	cmd.Env = append(cmd.Env, "BENCHER_HOOK="+hook)
+	if _, err := runCheckoutCmd(cmd); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("The %s hook timed out after %s", hook, timeout)
+		}
+		return fmt.Errorf("Running the %s hook: %v", hook, err)
+	}
+	return nil
+}
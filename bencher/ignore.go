@@ -0,0 +1,107 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFileName is the file at the root of the target repository listing
+// the benchmarks to leave out of comparisons and alerts, one pattern per
+// line in the syntax of path.Match e.g. "Flaky*" or "Export/*". Blank
+// lines and lines starting with "#" are skipped. The benchmarks still
+// run and their results are stored, so muting them loses no history.
+const ignoreFileName = ".bencherignore"
+
+// readIgnoreFile returns the patterns of the target repository's ignore
+// file, or none if it has no such file.
+func readIgnoreFile(dir string) ([]string, error) {
+	return readPatternFile(dir, ignoreFileName)
+}
+
+// readPatternFile returns the benchmark patterns of the target
+// repository's file name, one per line, or none if it has no such file.
+func readPatternFile(dir, name string) ([]string, error) {
+	blob, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []string
+	sc := bufio.NewScanner(bytes.NewReader(blob))
+	for line := 1; sc.Scan(); line++ {
+		pattern := strings.TrimSpace(sc.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		// Benchmarks are named as benchstat reports them, but
+		// patterns copied from the source are forgiven their prefix.
+		pattern = strings.TrimPrefix(pattern, "Benchmark")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid pattern %q: %v", name, line, pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, sc.Err()
+}
+
+func ignored(name string, patterns []string) bool {
+	bare := gomaxprocsSuffixRe.ReplaceAllString(name, "")
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, bare); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// dropIgnored returns blob without the result lines of the benchmarks
+// matching any of patterns.
+func dropIgnored(blob []byte, patterns []string) []byte {
+	if len(patterns) == 0 {
+		return blob
+	}
+	drop := make(map[int]bool)
+	for _, res := range parseResults(blob) {
+		if ignored(res.Name, patterns) {
+			drop[res.Index] = true
+		}
+	}
+	if len(drop) == 0 {
+		return blob
+	}
+
+	lines := bytes.Split(blob, []byte("\n"))
+	kept := lines[:0]
+	for i, line := range lines {
+		if !drop[i] {
+			kept = append(kept, line)
+		}
+	}
+	return bytes.Join(kept, []byte("\n"))
+}
@@ -0,0 +1,343 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveManifest is the name of the optional file of an archive of
+// historical results that describes its runs, see ReadArchive.
+const ArchiveManifest = "manifest.json"
+
+// ArchivedRun is a historical run to import, e.g. from a directory
+// of results kept by hand with benchstat before using bencher.
+type ArchivedRun struct {
+	// File is the name of the results' file in the archive.
+	File      string            `json:"file"`
+	StartTime time.Time         `json:"time"`
+	Commit    string            `json:"commit,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	// Results are the results in the Go benchmark format.
+	Results []byte `json:"-"`
+}
+
+// ImportReport lists the runs imported by ImportRuns, by ID.
+type ImportReport struct {
+	Imported []string `json:"imported,omitempty"`
+	// Skipped are the runs that were already stored,
+	// e.g. by an earlier import of the same archive.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// archiveTimeLayouts are the layouts of the start times of runs in the
+// names of archived files, the colon free ones being for file systems
+// that don't allow colons.
+var archiveTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15-04-05Z0700",
+	"2006-01-02T15-04-05",
+	"20060102T150405Z",
+	"20060102T150405",
+	"2006-01-02",
+	"20060102",
+}
+
+// parseArchiveName parses the name of an archived file without a
+// manifest: its start time, optionally followed by "_" and its commit,
+// e.g. "2018-05-03T14-05-06Z_a1b2c3d.txt" or "20180503.txt".
+func parseArchiveName(name string) (time.Time, string, error) {
+	base := path.Base(name)
+	if ext := path.Ext(base); ext != base {
+		base = strings.TrimSuffix(base, ext)
+	}
+	stamp, commit := base, ""
+	if i := strings.Index(base, "_"); i >= 0 {
+		stamp, commit = base[:i], base[i+1:]
+	}
+	for _, layout := range archiveTimeLayouts {
+		if t, err := time.Parse(layout, stamp); err == nil {
+			return t.UTC(), commit, nil
+		}
+	}
+	return time.Time{}, "", fmt.Errorf("expecting the name of %q to begin with a time e.g. 2018-05-03T14-05-06Z, optionally followed by _<commit>, or a %s describing it", name, ArchiveManifest)
+}
+
+// ReadArchive reads the historical runs archived in a directory, or in a
+// tarball, gzipped or not, of files of results in the Go benchmark format.
+// The start time and commit of every run is either given by the archive's
+// ArchiveManifest, a JSON array of ArchivedRun, or parsed from the name of
+// its file e.g. "2018-05-03T14-05-06Z_a1b2c3d.txt", in which case every
+// file is a run except hidden ones.
+func ReadArchive(archivePath string) ([]*ArchivedRun, error) {
+	fi, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		f, err := os.Open(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ReadArchiveTar(f)
+	}
+
+	files := make(map[string][]byte)
+	err = filepath.Walk(archivePath, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(archivePath, p)
+		if err != nil {
+			return err
+		}
+		blob, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = blob
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return archivedRuns(files)
+}
+
+// ReadArchiveTar reads the historical runs archived in a tarball read
+// from r, gzipped or not, as ReadArchive does.
+func ReadArchiveTar(r io.Reader) ([]*ArchivedRun, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Reading the archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		blob, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("Reading %q from the archive: %v", hdr.Name, err)
+		}
+		files[path.Clean(strings.TrimPrefix(hdr.Name, "./"))] = blob
+	}
+	return archivedRuns(files)
+}
+
+// archivedRuns returns the runs archived as files, keyed by their
+// slash separated paths in the archive, oldest first.
+func archivedRuns(files map[string][]byte) ([]*ArchivedRun, error) {
+	var runs []*ArchivedRun
+	if manifest, ok := files[ArchiveManifest]; ok {
+		if err := json.Unmarshal(manifest, &runs); err != nil {
+			return nil, fmt.Errorf("Parsing %s: %v", ArchiveManifest, err)
+		}
+		for _, run := range runs {
+			blob, ok := files[path.Clean(run.File)]
+			if !ok {
+				return nil, fmt.Errorf("%s lists %q, which isn't archived", ArchiveManifest, run.File)
+			}
+			if run.StartTime.IsZero() {
+				return nil, fmt.Errorf("%s lists %q without a time", ArchiveManifest, run.File)
+			}
+			run.StartTime, run.Results = run.StartTime.UTC(), blob
+		}
+	} else {
+		for name, blob := range files {
+			if strings.HasPrefix(path.Base(name), ".") {
+				continue
+			}
+			t, commit, err := parseArchiveName(name)
+			if err != nil {
+				return nil, err
+			}
+			runs = append(runs, &ArchivedRun{File: name, StartTime: t, Commit: commit, Results: blob})
+		}
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].StartTime.Before(runs[j].StartTime)
+	})
+	for i, run := range runs {
+		if len(parseResults(run.Results)) == 0 {
+			return nil, fmt.Errorf("%q holds no benchmark results", run.File)
+		}
+		if err := validateTags(run.Tags); err != nil {
+			return nil, fmt.Errorf("%q: %v", run.File, err)
+		}
+		// Run IDs are start times to the second.
+		if i > 0 && run.StartTime.Truncate(time.Second).Equal(runs[i-1].StartTime.Truncate(time.Second)) {
+			return nil, fmt.Errorf("%q and %q have the same time %s", runs[i-1].File, run.File, run.StartTime.Format(time.RFC3339))
+		}
+	}
+	return runs, nil
+}
+
+// ImportRuns stores the historical runs, e.g. read with ReadArchive, as if
+// they ran at their start times with the request's tags besides their own,
+// so that they are listed, charted and compared against like any other.
+// Runs already stored under the same IDs are skipped, hence an archive can
+// be imported again after a failure. The baselines are then reconciled,
+// leaving "latest" to the most recent run, imported or not.
+func (br *Request) ImportRuns(ctx context.Context, runs []*ArchivedRun) (*ImportReport, error) {
+	ctx, span := br.startSpan(ctx, "import-runs")
+	defer span.End()
+
+	if br.StorageService == nil {
+		return nil, ErrNoStorageService
+	}
+	if err := validateTags(br.Tags); err != nil {
+		return nil, err
+	}
+
+	report := new(ImportReport)
+	tags := make(map[string]string)
+	imported := make(map[string]bool)
+	for _, archived := range runs {
+		run, err := br.importRun(ctx, archived)
+		if err != nil {
+			return report, fmt.Errorf("Importing %q: %v", archived.File, err)
+		}
+		if run == nil {
+			report.Skipped = append(report.Skipped, br.ids().RunID(archived.StartTime))
+			continue
+		}
+		report.Imported = append(report.Imported, run.ID)
+		imported[run.ID] = true
+		for key, value := range run.Tags {
+			tags[key] = value
+		}
+	}
+	if len(report.Imported) == 0 {
+		return report, nil
+	}
+	if err := br.reconcileImported(ctx, tags, imported); err != nil {
+		return report, fmt.Errorf("Reconciling the baselines: %v", err)
+	}
+	return report, nil
+}
+
+// reconcileImported makes the baselines, of "latest", of every platform
+// and "latest@<key>=<value>" for each of tags, whose most recent run is
+// one of those imported hold its results, creating missing ones. The
+// others are left alone, e.g. if they were edited since their last run.
+func (br *Request) reconcileImported(ctx context.Context, tags map[string]string, imported map[string]bool) error {
+	ctx, span := br.startSpan(ctx, "reconcile-imported")
+	defer span.End()
+
+	latest, err := br.latestRuns(ctx, tags, "")
+	if err != nil {
+		return err
+	}
+	for path, run := range latest {
+		if !imported[run.ID] {
+			continue
+		}
+		held, generation, err := br.baselineHolder(ctx, path)
+		if err != nil {
+			return err
+		}
+		if generation != 0 && held == run.ID {
+			continue
+		}
+		if _, err := br.promoteAs(ctx, run.ID, run.ID, path, generation); err != nil {
+			return fmt.Errorf("Restoring baseline %q from run %q: %v", path, run.ID, err)
+		}
+	}
+	return nil
+}
+
+// importRun stores the results and metadata of the archived run,
+// returning nil if a run with its ID was already stored.
+func (br *Request) importRun(ctx context.Context, archived *ArchivedRun) (*Run, error) {
+	ctx, span := br.startSpan(ctx, "import-run")
+	defer span.End()
+
+	runID := br.ids().RunID(archived.StartTime)
+	if obj, err := br.statObject(ctx, runID+runMetaSuffix); err == nil && obj != nil {
+		return nil, nil
+	}
+	br.runID, br.commit = runID, archived.Commit
+	defer func() { br.runID, br.commit = "", "" }()
+
+	tags := make(map[string]string)
+	for key, value := range br.Tags {
+		tags[key] = value
+	}
+	for key, value := range archived.Tags {
+		tags[key] = value
+	}
+	results := archived.Results
+	if len(tags) > 0 {
+		results = append(tagsHeader(tags), results...)
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+
+	run := &Run{
+		ID:        runID,
+		Repo:      br.GitRepoURL,
+		Tags:      tags,
+		StartTime: archived.StartTime,
+		Status:    RunStatusOK,
+		Commit:    archived.Commit,
+		Imported:  archived.File,
+	}
+	// The platform is that of the first results, as recorded by go test.
+	if labels := parseResults(archived.Results)[0].Labels; labels != nil {
+		run.GOOS, run.GOARCH = labels["goos"], labels["goarch"]
+	}
+	if _, err := br.uploadBlob(ctx, runID, results); err != nil {
+		return nil, fmt.Errorf("Uploading results: %v", err)
+	}
+	// The metadata is uploaded last, lest a failed import be skipped.
+	if _, err := br.uploadRunMeta(ctx, run); err != nil {
+		return nil, fmt.Errorf("Uploading run metadata: %v", err)
+	}
+	return run, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// BenchmarkPackages runs the Go benchmarks of each of pkgs e.g. "./trace"
+// in turn, in the working tree dir as it is, without checking out or
+// storing anything, e.g. while editing it, for benchtime each, go test's
+// default if blank. The results are keyed by package, leaving out those
+// without benchmarks, and ignore the benchmarks of dir's ignore file.
+func (br *Request) BenchmarkPackages(ctx context.Context, dir, benchtime string, pkgs []string) (map[string][]byte, error) {
+	ctx, span := br.startSpan(ctx, "benchmark-packages")
+	defer span.End()
+
+	if err := br.validateRuntimeSettings(); err != nil {
+		return nil, err
+	}
+	br.workDir = dir
+	defer func() { br.workDir = "" }()
+	var err error
+	if br.ignore, err = readIgnoreFile(dir); err != nil {
+		return nil, fmt.Errorf("Reading %s: %v", ignoreFileName, err)
+	}
+
+	results := make(map[string][]byte)
+	for _, pkg := range pkgs {
+		gtr, err := br.runGoTest(ctx, benchtime, []string{pkg})
+		if err == ErrNoBenchmarks {
+			continue
+		}
+		if err != nil {
+			return results, fmt.Errorf("Benchmarking %s: %v", pkg, err)
+		}
+		gtr.events.Close()
+		if failed := gtr.failedPackages(); len(failed) > 0 {
+			return results, fmt.Errorf("Benchmarks failed in packages: %s", strings.Join(failed, ", "))
+		}
+		blob := gtr.benchmarks
+		if settings := br.runtimeSettings(); len(settings) > 0 {
+			blob = append(tagsHeader(settings), blob...)
+		}
+		results[pkg] = blob
+	}
+	return results, nil
+}
+
+// CompareResults compares the results before and after, in the Go
+// benchmark format, as a run is compared against its baseline, without
+// storing them, e.g. those of BenchmarkPackages. It returns ErrNoChanges
+// if no benchmark changed significantly.
+func (br *Request) CompareResults(ctx context.Context, before, after []byte) (*Result, error) {
+	ctx, span := br.startSpan(ctx, "compare-results")
+	defer span.End()
+
+	changed, err := br.compare(ctx, before, after, br.splitBy())
+	if err != nil {
+		return nil, err
+	}
+	if len(changed) == 0 {
+		return nil, ErrNoChanges
+	}
+	buf := new(bytes.Buffer)
+	formatText(buf, changed)
+	res := &Result{
+		Benchmarks: buf.String(),
+		Rows:       resultRows(changed),
+		Warnings:   runtimeWarnings(before, after),
+		before:     before,
+		after:      after,
+		changed:    changed,
+	}
+	return res, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+
+	"go.opencensus.io/trace"
+)
+
+// Version is bencher's version, stamped on the objects it uploads. It is
+// set when building, e.g. with
+// -ldflags "-X github.com/orijtech/opencensus-tools/bencher.Version=v0.3.0".
+var Version = "devel"
+
+// The keys of the custom metadata stamped on uploaded objects, so that
+// objects found in the bucket can be traced back to the run and code
+// that produced them.
+const (
+	MetadataRunID   = "bencher-run-id"
+	MetadataTraceID = "bencher-trace-id"
+	MetadataCommit  = "bencher-commit"
+	MetadataVersion = "bencher-version"
+	// MetadataUsage is the machine time of a run, on its usage marker.
+	MetadataUsage = "bencher-usage"
+)
+
+// objectMetadata returns the metadata of the objects uploaded for the
+// run with runID, if any, as the request's checked out sources.
+func (br *Request) objectMetadata(runID string) map[string]string {
+	md := map[string]string{MetadataVersion: Version}
+	if runID != "" {
+		md[MetadataRunID] = runID
+	}
+	if br.commit != "" {
+		md[MetadataCommit] = br.commit
+	}
+	return md
+}
+
+// withTraceID returns md along with the ID of the trace of ctx, if any.
+func withTraceID(ctx context.Context, md map[string]string) map[string]string {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return md
+	}
+	stamped := make(map[string]string, len(md)+1)
+	for key, value := range md {
+		stamped[key] = value
+	}
+	stamped[MetadataTraceID] = span.SpanContext().TraceID.String()
+	return stamped
+}
@@ -0,0 +1,83 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// NetworkConfig configures outbound connections, for
+// deployments inside networks that intercept TLS.
+type NetworkConfig struct {
+	// ProxyURL if set, is the proxy through which all outbound
+	// connections go e.g. "http://proxy:3128" or "socks5://proxy:1080".
+	ProxyURL string
+	// CAFile if set, is a PEM bundle of certificate authorities
+	// trusted in addition to the system's.
+	CAFile string
+}
+
+// Transport returns an HTTP transport that honors the configuration.
+func (nc *NetworkConfig) Transport() (*http.Transport, error) {
+	tr := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConns:        100,
+	}
+	if nc.ProxyURL != "" {
+		proxyURL, err := url.Parse(nc.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q: %v", nc.ProxyURL, err)
+		}
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+	if nc.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(nc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", nc.CAFile)
+		}
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return tr, nil
+}
+
+// Env returns the environment variables through which the go command,
+// and git when it fetches modules, honor the configuration.
+func (nc *NetworkConfig) Env() []string {
+	var env []string
+	if nc.ProxyURL != "" {
+		for _, key := range []string{"HTTP_PROXY", "HTTPS_PROXY", "ALL_PROXY", "http_proxy", "https_proxy", "all_proxy"} {
+			env = append(env, key+"="+nc.ProxyURL)
+		}
+	}
+	if nc.CAFile != "" {
+		env = append(env, "SSL_CERT_FILE="+nc.CAFile, "GIT_SSL_CAINFO="+nc.CAFile)
+	}
+	return env
+}
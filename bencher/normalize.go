@@ -0,0 +1,64 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// anyBenchmark is the key of Request.UnitsOfWork
+// applying to the benchmarks not otherwise listed.
+const anyBenchmark = "*"
+
+// normalize returns blob with every result line that reports its declared
+// unit of work e.g. "spans/op" extended with its other per-op metrics per
+// unit of work e.g. "ns/spans" and "B/spans", so that they're compared too.
+// Lines without a declared unit of work, or reporting none, are kept as is.
+func normalize(blob []byte, unitsOfWork map[string]string) []byte {
+	if len(unitsOfWork) == 0 {
+		return blob
+	}
+
+	lines := bytes.Split(blob, []byte("\n"))
+	for _, res := range parseResults(blob) {
+		work, ok := unitsOfWork[gomaxprocsSuffixRe.ReplaceAllString(res.Name, "")]
+		if !ok {
+			work = unitsOfWork[anyBenchmark]
+		}
+		perOp := res.Values[work]
+		if work == "" || perOp <= 0 || !strings.HasSuffix(work, "/op") {
+			continue
+		}
+		noun := strings.TrimSuffix(work, "/op")
+
+		units := make([]string, 0, len(res.Values))
+		for unit := range res.Values {
+			if unit != work && strings.HasSuffix(unit, "/op") {
+				units = append(units, unit)
+			}
+		}
+		sort.Strings(units)
+
+		buf := bytes.NewBufferString(res.Line)
+		for _, unit := range units {
+			fmt.Fprintf(buf, "\t%g %s/%s", res.Values[unit]/perOp, strings.TrimSuffix(unit, "/op"), noun)
+		}
+		lines[res.Index] = buf.Bytes()
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
@@ -0,0 +1,388 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/keighl/postmark"
+)
+
+// The values of Request.RepeatNotifications.
+const (
+	// RepeatSend always sends the full report, the default.
+	RepeatSend = "send"
+	// RepeatCondense sends a short "still regressed" note instead
+	// of the full report when the changes match the previous run's.
+	RepeatCondense = "condense"
+	// RepeatSuppress sends nothing when the changes
+	// match those that were previously notified.
+	RepeatSuppress = "suppress"
+)
+
+const notificationStateName = "latest-notification.json"
+
+// notificationState records the last notification sent for a repository.
+type notificationState struct {
+	Fingerprint string    `json:"fingerprint"`
+	Consecutive int       `json:"consecutive"`
+	SentAt      time.Time `json:"sent_at"`
+}
+
+// fingerprint hashes the set of changed rows, ignoring their exact values,
+// so that two runs with the same regressions and improvements match.
+func fingerprint(rows []*Row) string {
+	keys := make([]string, 0, len(rows))
+	for _, row := range rows {
+		keys = append(keys, fmt.Sprintf("%s\x00%s\x00%s\x00%d", row.Metric, row.Group, row.Benchmark, row.Change))
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, key := range keys {
+		h.Write([]byte(key))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checkRepeat updates the stored notification state with res and reports
+// for how many consecutive runs, including this one, the same set of
+// changes has been notified. A missing or unreadable state starts afresh.
+func (br *Request) checkRepeat(ctx context.Context, res *Result) (int, error) {
+	ctx, span := br.startSpan(ctx, "check-repeat-notification")
+	defer span.End()
+
+	prev := new(notificationState)
+	if blob, err := br.downloadBlob(ctx, notificationStateName); err == nil {
+		_ = json.Unmarshal(blob, prev)
+	}
+
+	state := &notificationState{
+		Fingerprint: fingerprint(res.Rows),
+		Consecutive: 1,
+		SentAt:      br.now(),
+	}
+	if len(res.Rows) > 0 && state.Fingerprint == prev.Fingerprint {
+		state.Consecutive = prev.Consecutive + 1
+	}
+
+	blob, err := json.Marshal(state)
+	if err != nil {
+		return state.Consecutive, err
+	}
+	if _, err := br.uploadBlob(ctx, notificationStateName, blob); err != nil {
+		return state.Consecutive, fmt.Errorf("Uploading notification state: %v", err)
+	}
+	return state.Consecutive, nil
+}
+
+func ordinal(n int) string {
+	suffix := "th"
+	switch n % 10 {
+	case 1:
+		suffix = "st"
+	case 2:
+		suffix = "nd"
+	case 3:
+		suffix = "rd"
+	}
+	if n%100 >= 11 && n%100 <= 13 {
+		suffix = "th"
+	}
+	return fmt.Sprintf("%d%s", n, suffix)
+}
+
+// EmailHeaderData is what the EmailSubject, EmailFrom
+// and EmailReplyTo templates of a Request are executed with.
+type EmailHeaderData struct {
+	Repo string
+	// Ref is the value of the run's "ref" tag, else of its "branch" tag.
+	Ref  string
+	Tags map[string]string
+	// Regressions and Improvements count the significantly changed metrics.
+	Regressions  int
+	Improvements int
+	// Consecutive is the number of consecutive runs with the
+	// same changes, if repeated notifications are condensed.
+	Consecutive int
+	// Status is "still regressed" or "still changed" for condensed repeats.
+	Status string
+	// Severity is the verdict of the gating policy e.g. "fail",
+	// or blank if there is no policy.
+	Severity string
+	// Tier is the severity tier e.g. "critical" by which the
+	// notification is routed, or blank if it isn't routed.
+	Tier string
+}
+
+func newEmailHeaderData(repo string, res *Result) *EmailHeaderData {
+	data := &EmailHeaderData{Repo: repo}
+	if res == nil {
+		return data
+	}
+	data.Tags = res.Tags
+	data.Ref = res.Tags["ref"]
+	if data.Ref == "" {
+		data.Ref = res.Tags["branch"]
+	}
+	data.Consecutive = res.Consecutive
+	if res.Policy != nil {
+		data.Severity = res.Policy.Severity
+	}
+	for _, row := range res.Rows {
+		if row.Change < 0 {
+			data.Regressions++
+		} else if row.Change > 0 {
+			data.Improvements++
+		}
+	}
+	return data
+}
+
+// executeHeader renders the email header template text with data, or
+// returns def if text is blank. Newlines are dropped from the result
+// as they'd otherwise allow injecting headers.
+func executeHeader(name, text, def string, data *EmailHeaderData) (string, error) {
+	if strings.TrimSpace(text) == "" {
+		return def, nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("Parsing the %s template: %v", name, err)
+	}
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("Executing the %s template: %v", name, err)
+	}
+	return strings.Join(strings.Fields(buf.String()), " "), nil
+}
+
+// ValidateTemplates checks that the request's email header templates
+// parse and execute, e.g. for a server to check its defaults at startup.
+func (br *Request) ValidateTemplates() error {
+	_, _, _, err := br.emailHeaders("", new(EmailHeaderData))
+	return err
+}
+
+// emailHeaders returns the subject, sender and reply-to address of the
+// notification, templated if so configured, and otherwise the defaults.
+func (br *Request) emailHeaders(defaultSubject string, data *EmailHeaderData) (subject, from, replyTo string, err error) {
+	if subject, err = executeHeader("email_subject", br.EmailSubject, defaultSubject, data); err != nil {
+		return "", "", "", err
+	}
+	if from, err = executeHeader("email_from", br.EmailFrom, br.AppEmail, data); err != nil {
+		return "", "", "", err
+	}
+	if replyTo, err = executeHeader("email_reply_to", br.EmailReplyTo, "", data); err != nil {
+		return "", "", "", err
+	}
+	return subject, from, replyTo, nil
+}
+
+const defaultMaxEmailRows = 50
+
+// maxEmailBodySize is below Postmark's limit of 5MB per body.
+const maxEmailBodySize = 4 << 20
+
+// emailBody renders results with tmpl, keeping only the rows that changed
+// the most if there are too many, and omitting the report altogether if
+// it is still too large, in which case the email links to it instead.
+func (br *Request) emailBody(tmpl *template.Template, results interface{}) (*bytes.Buffer, error) {
+	res, ok := results.(*Result)
+	if !ok {
+		buf := new(bytes.Buffer)
+		err := tmpl.Execute(buf, results)
+		return buf, err
+	}
+
+	// The result itself is returned to the caller in full.
+	emailed := *res
+	maxRows := br.MaxEmailRows
+	if maxRows <= 0 {
+		maxRows = defaultMaxEmailRows
+	}
+	if len(res.Rows) > maxRows && len(res.changed) > 0 {
+		tables, omitted := mostChanged(res.changed, maxRows)
+		html, err := br.formatHTML(tables)
+		if err != nil {
+			return nil, err
+		}
+		emailed.HTMLBenchmarks, emailed.Omitted = html, omitted
+	}
+
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, &emailed); err != nil {
+		return nil, err
+	}
+	if buf.Len() <= maxEmailBodySize {
+		return buf, nil
+	}
+	emailed.HTMLBenchmarks, emailed.Omitted = "", len(res.Rows)
+	buf.Reset()
+	err := tmpl.Execute(buf, &emailed)
+	return buf, err
+}
+
+// attachments returns the raw results and their comparison as
+// email attachments, named after the run's start time if known.
+func (res *Result) attachments() []postmark.Attachment {
+	prefix := "benchmarks"
+	if res.RunAt != "" {
+		prefix += "-" + strings.Replace(res.RunAt, ":", "", -1)
+	}
+	type file struct {
+		name string
+		blob []byte
+	}
+	files := []file{
+		{prefix + "-before.txt", res.before},
+		{prefix + "-after.txt", res.after},
+	}
+	// Benchmarks is the comparison, unless it was the first run.
+	if res.before != nil {
+		files = append(files, file{prefix + "-benchstat.txt", []byte(res.Benchmarks)})
+	}
+
+	var attachments []postmark.Attachment
+	for _, file := range files {
+		if len(file.blob) == 0 {
+			continue
+		}
+		attachments = append(attachments, postmark.Attachment{
+			Name:        file.name,
+			Content:     base64.StdEncoding.EncodeToString(file.blob),
+			ContentType: "text/plain",
+		})
+	}
+	return attachments
+}
+
+// textEmail renders results as a plain text email with the benchstat
+// table, for when the HTML email can't be rendered.
+func textEmail(results interface{}) string {
+	if sr, ok := results.(*SuiteResult); ok {
+		buf := new(bytes.Buffer)
+		for _, rr := range sr.Repos {
+			fmt.Fprintf(buf, "%s\n\n", rr.Repo)
+			if rr.Result == nil {
+				fmt.Fprintf(buf, "%s\n\n", rr.Error)
+				continue
+			}
+			fmt.Fprintf(buf, "%s\n", textEmail(rr.Result))
+		}
+		return buf.String()
+	}
+	res, ok := results.(*Result)
+	if !ok {
+		return fmt.Sprintf("%v", results)
+	}
+	buf := new(bytes.Buffer)
+	if res.RunAt != "" {
+		fmt.Fprintf(buf, "Run at: %s\n", res.RunAt)
+	}
+	if len(res.Tags) > 0 {
+		fmt.Fprintf(buf, "Tags:\n%s", tagsHeader(res.Tags))
+	}
+	for _, warning := range res.Warnings {
+		fmt.Fprintf(buf, "Warning: %s\n", warning)
+	}
+	if len(res.EnvironmentDiff) > 0 {
+		fmt.Fprintf(buf, "Environment changes:\n")
+		for _, ec := range res.EnvironmentDiff {
+			fmt.Fprintf(buf, "  %s: %s -> %s\n", ec.Field, ec.Before, ec.After)
+		}
+	}
+	if res.Policy != nil {
+		fmt.Fprintf(buf, "Policy verdict: %s\n", res.Policy.Severity)
+		for _, violation := range res.Policy.Violations {
+			fmt.Fprintf(buf, "%s\n", violation)
+		}
+	}
+	if res.Deltas != "" {
+		fmt.Fprintf(buf, "\n%s", res.Deltas)
+	}
+	fmt.Fprintf(buf, "\n%s\n", res.Benchmarks)
+	if res.ReportURL != "" {
+		fmt.Fprintf(buf, "Full report: %s\n", res.ReportURL)
+	}
+	keys := make([]string, 0, len(res.URLs))
+	for key := range res.URLs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%s : %s\n", key, res.URLs[key])
+	}
+	return buf.String()
+}
+
+// sampleBefore and sampleAfter are made up results of a benchmark
+// that regressed by about 20%, for test notifications.
+var sampleBefore, sampleAfter = sampleResults(1000), sampleResults(1200)
+
+func sampleResults(nsPerOp int) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "pkg: example.com/bencher/sample\n")
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(buf, "BenchmarkSample-8\t1000000\t%d ns/op\t%d B/op\t2 allocs/op\n", nsPerOp+i*5, 64)
+	}
+	return buf.Bytes()
+}
+
+// SendTestNotification sends a made up report through the configured
+// notification channels, so that their credentials and templates can be
+// checked without waiting for a run. The subject is marked as a test.
+func (br *Request) SendTestNotification(ctx context.Context) error {
+	ctx, span := br.startSpan(ctx, "send-test-notification")
+	defer span.End()
+
+	if err := br.ValidateTemplates(); err != nil {
+		return err
+	}
+	tables := changedTables(ctx, sampleBefore, sampleAfter, defaultSplitBy)
+	textBuf := new(bytes.Buffer)
+	formatText(textBuf, tables)
+	html, err := br.formatHTML(tables)
+	if err != nil {
+		return err
+	}
+	res := &Result{
+		URLs:           map[string]string{},
+		Benchmarks:     textBuf.String(),
+		HTMLBenchmarks: html,
+		Rows:           resultRows(tables),
+		Tags:           map[string]string{"test": "true"},
+		RunAt:          br.now().Format(time.RFC3339),
+		before:         sampleBefore,
+		after:          sampleAfter,
+		changed:        tables,
+	}
+	if br.EmailSubject != "" {
+		br.EmailSubject = "[test] " + br.EmailSubject
+	}
+	subject := fmt.Sprintf("[test] Benchmarks for %s", br.GitRepoURL)
+	return br.sendEmail(ctx, subject, emailTmpl, res, newEmailHeaderData(br.GitRepoURL, res))
+}
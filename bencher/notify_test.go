@@ -0,0 +1,46 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestEmailBodyEscapesResultFields(t *testing.T) {
+	res := &Result{
+		Tags:            map[string]string{"branch": "<b>main</b>"},
+		Warnings:        []string{"<script>alert(1)</script>"},
+		EnvironmentDiff: []*EnvironmentChange{{Field: "cpu", Before: "<i>a</i>", After: "b&c"}},
+		Policy:          &PolicyVerdict{Severity: SeverityFail, Violations: []string{"<img src=x>"}},
+	}
+	br := new(Request)
+	for _, tmpl := range []*template.Template{emailTmpl, condensedEmailTmpl} {
+		body, err := br.emailBody(tmpl, res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, unescaped := range []string{"<b>main", "<script>", "<i>", "b&c", "<img"} {
+			if strings.Contains(body.String(), unescaped) {
+				t.Errorf("%s: %q is unescaped in:\n%s", tmpl.Name(), unescaped, body)
+			}
+		}
+	}
+	body, _ := br.emailBody(emailTmpl, res)
+	if !strings.Contains(body.String(), "&lt;script&gt;") {
+		t.Errorf("the warning is missing from:\n%s", body)
+	}
+}
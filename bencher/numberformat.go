@@ -0,0 +1,232 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// numberFormatFileName is the file of the target repository with how
+// the means in its reports are formatted, used unless the request has one.
+const numberFormatFileName = ".bencherformat"
+
+// defaultDigits is how many significant digits benchstat formats means with.
+const defaultDigits = 3
+
+// NumberFormat formats the means in reports, which benchstat otherwise
+// rounds to three significant digits in a unit picked by magnitude,
+// hiding what changed in benchmarks of a few nanoseconds. It is written
+// as comma separated settings e.g.
+//
+//	digits=5, time/op=ns, alloc/op=KiB
+//
+// where digits is the number of significant digits, and the others fix
+// the unit of a metric named as benchstat reports it: ns, µs (or us),
+// ms or s for times, B, kB, MB, GB, KiB, MiB or GiB for bytes, and k,
+// M, G or 1 for counts. Speeds keep benchstat's formatting.
+type NumberFormat struct {
+	// Digits is the number of significant digits, 3 if 0.
+	Digits int
+	// Units are the fixed units by metric.
+	Units map[string]string
+}
+
+// unitScale is a unit that a metric's values are divided by.
+type unitScale struct {
+	dimension string
+	factor    float64
+	suffix    string
+}
+
+// The dimensions of metrics, which the units of a metric must have.
+const (
+	dimensionTime  = "time"
+	dimensionBytes = "bytes"
+	dimensionCount = "count"
+)
+
+var unitScales = map[string]unitScale{
+	"ns":  {dimensionTime, 1, "ns"},
+	"µs":  {dimensionTime, 1e3, "µs"},
+	"us":  {dimensionTime, 1e3, "µs"},
+	"ms":  {dimensionTime, 1e6, "ms"},
+	"s":   {dimensionTime, 1e9, "s"},
+	"B":   {dimensionBytes, 1, "B"},
+	"kB":  {dimensionBytes, 1e3, "kB"},
+	"MB":  {dimensionBytes, 1e6, "MB"},
+	"GB":  {dimensionBytes, 1e9, "GB"},
+	"KiB": {dimensionBytes, 1 << 10, "KiB"},
+	"MiB": {dimensionBytes, 1 << 20, "MiB"},
+	"GiB": {dimensionBytes, 1 << 30, "GiB"},
+	"1":   {dimensionCount, 1, ""},
+	"k":   {dimensionCount, 1e3, "k"},
+	"M":   {dimensionCount, 1e6, "M"},
+	"G":   {dimensionCount, 1e9, "G"},
+}
+
+// autoUnits are the units picked by magnitude for a metric
+// without a fixed unit, by increasing factor as benchstat does.
+var autoUnits = map[string][]string{
+	dimensionTime:  {"ns", "µs", "ms", "s"},
+	dimensionBytes: {"B", "kB", "MB", "GB"},
+	dimensionCount: {"1", "k", "M", "G"},
+}
+
+// ParseNumberFormat parses a NumberFormat of comma separated settings.
+func ParseNumberFormat(s string) (*NumberFormat, error) {
+	nf := &NumberFormat{Units: make(map[string]string)}
+	for _, setting := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if setting = strings.TrimSpace(setting); setting == "" || strings.HasPrefix(setting, "#") {
+			continue
+		}
+		i := strings.LastIndex(setting, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid setting %q, expecting digits=<n> or <metric>=<unit>", setting)
+		}
+		key, value := strings.TrimSpace(setting[:i]), strings.TrimSpace(setting[i+1:])
+		if key == "digits" {
+			digits, err := strconv.Atoi(value)
+			if err != nil || digits < 1 || digits > 15 {
+				return nil, fmt.Errorf("invalid digits %q, expecting 1 to 15", value)
+			}
+			nf.Digits = digits
+			continue
+		}
+		scale, ok := unitScales[value]
+		if !ok {
+			return nil, fmt.Errorf("unknown unit %q of %q", value, key)
+		}
+		if dim := metricDimension(key); dim != "" && dim != scale.dimension {
+			return nil, fmt.Errorf("unit %q of %q isn't a unit of %s", value, key, dim)
+		}
+		nf.Units[key] = value
+	}
+	return nf, nil
+}
+
+// metricDimension returns the dimension of a metric named as benchstat
+// reports it, or blank for speeds, whose formatting isn't changed.
+func metricDimension(metric string) string {
+	switch {
+	case metric == "speed":
+		return ""
+	case strings.HasSuffix(metric, "time/op"):
+		return dimensionTime
+	case strings.HasSuffix(metric, "alloc/op"):
+		return dimensionBytes
+	default:
+		return dimensionCount
+	}
+}
+
+// scale replaces the scalers of the rows of tables with ones in the
+// format's units and digits.
+func (nf *NumberFormat) scale(tables []*benchstat.Table) {
+	if nf == nil || (nf.Digits == 0 && len(nf.Units) == 0) {
+		return
+	}
+	digits := nf.Digits
+	if digits == 0 {
+		digits = defaultDigits
+	}
+	for _, table := range tables {
+		dim := metricDimension(table.Metric)
+		if dim == "" {
+			continue
+		}
+		for _, row := range table.Rows {
+			unit, ok := nf.Units[table.Metric]
+			if !ok {
+				unit = pickUnit(dim, smallestMean(row.Metrics))
+			}
+			us := unitScales[unit]
+			row.Scaler = func(v float64) string {
+				return formatSignificant(v/us.factor, digits) + us.suffix
+			}
+		}
+	}
+}
+
+// smallestMean returns the smallest non-zero mean of metrics, by whose
+// magnitude benchstat picks the unit.
+func smallestMean(metrics []*benchstat.Metrics) float64 {
+	var min float64
+	for _, m := range metrics {
+		if m != nil && m.Mean != 0 && (min == 0 || math.Abs(m.Mean) < min) {
+			min = math.Abs(m.Mean)
+		}
+	}
+	return min
+}
+
+// pickUnit returns the largest unit of dim in which v is at least 1.
+func pickUnit(dim string, v float64) string {
+	units := autoUnits[dim]
+	unit := units[0]
+	for _, u := range units[1:] {
+		if v < unitScales[u].factor*0.995 {
+			break
+		}
+		unit = u
+	}
+	return unit
+}
+
+// formatSignificant formats v rounded to digits significant digits.
+func formatSignificant(v float64, digits int) string {
+	if v == 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	decimals := digits - 1 - int(math.Floor(math.Log10(math.Abs(v))))
+	if decimals < 0 {
+		p := math.Pow10(-decimals)
+		v, decimals = math.Round(v/p)*p, 0
+	}
+	return strconv.FormatFloat(v, 'f', decimals, 64)
+}
+
+// readNumberFormatFile returns the target repository's number
+// format, or nil if it has no number format file.
+func readNumberFormatFile(dir string) (*NumberFormat, error) {
+	blob, err := ioutil.ReadFile(filepath.Join(dir, numberFormatFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseNumberFormat(string(blob))
+}
+
+// loadNumberFormat sets the request's number format, parsed from
+// NumberFormat if set, or else from the target repository's file.
+func (br *Request) loadNumberFormat() (err error) {
+	if br.NumberFormat != "" {
+		br.numberFormat, err = ParseNumberFormat(br.NumberFormat)
+		return err
+	}
+	if br.numberFormat, err = readNumberFormatFile(br.projectDir()); err != nil {
+		return fmt.Errorf("Reading %s: %v", numberFormatFileName, err)
+	}
+	return nil
+}
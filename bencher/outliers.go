@@ -0,0 +1,133 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// The values of Request.Outliers.
+const (
+	// OutliersKeep compares every sample, the default.
+	OutliersKeep = "keep"
+	// OutliersMinMax discards the fastest and the slowest
+	// sample of every benchmark with at least 5 samples.
+	OutliersMinMax = "minmax"
+	// OutliersMAD discards the samples further from the median than
+	// 3 times the scaled median absolute deviation, a robust estimate
+	// of the standard deviation.
+	OutliersMAD = "mad"
+)
+
+const (
+	minMinMaxSamples = 5
+	madThreshold     = 3
+	// madScale makes the MAD estimate the standard
+	// deviation of normally distributed samples.
+	madScale = 1.4826
+)
+
+// dropOutliers returns blob without the result lines whose samples are
+// outliers among those of the same benchmark and configuration, judged
+// by the benchmark's first unit. Other lines are kept as they are.
+func dropOutliers(blob []byte, method string) ([]byte, error) {
+	switch method {
+	case "", OutliersKeep:
+		return blob, nil
+	case OutliersMinMax, OutliersMAD:
+	default:
+		return nil, fmt.Errorf("unknown outliers method %q, expecting %q, %q or %q", method, OutliersKeep, OutliersMinMax, OutliersMAD)
+	}
+
+	type sample struct {
+		index int
+		value float64
+	}
+	samples := make(map[string][]sample)
+	for _, res := range parseResults(blob) {
+		value, ok := res.Values[primaryUnit(res.Line)]
+		if !ok {
+			continue
+		}
+		key := labelsKey(res.Labels) + "\x00" + res.Name
+		samples[key] = append(samples[key], sample{res.Index, value})
+	}
+
+	drop := make(map[int]bool)
+	for _, ss := range samples {
+		sort.Slice(ss, func(i, j int) bool { return ss[i].value < ss[j].value })
+		switch method {
+		case OutliersMinMax:
+			if len(ss) >= minMinMaxSamples {
+				drop[ss[0].index] = true
+				drop[ss[len(ss)-1].index] = true
+			}
+		case OutliersMAD:
+			values := make([]float64, len(ss))
+			for i, s := range ss {
+				values[i] = s.value
+			}
+			med := median(values)
+			deviations := make([]float64, len(values))
+			for i, v := range values {
+				deviations[i] = math.Abs(v - med)
+			}
+			sort.Float64s(deviations)
+			mad := madScale * median(deviations)
+			if mad == 0 {
+				continue
+			}
+			for _, s := range ss {
+				if math.Abs(s.value-med) > madThreshold*mad {
+					drop[s.index] = true
+				}
+			}
+		}
+	}
+	if len(drop) == 0 {
+		return blob, nil
+	}
+
+	lines := bytes.Split(blob, []byte("\n"))
+	kept := lines[:0]
+	for i, line := range lines {
+		if !drop[i] {
+			kept = append(kept, line)
+		}
+	}
+	return bytes.Join(kept, []byte("\n")), nil
+}
+
+// median returns the median of sorted values.
+func median(sorted []float64) float64 {
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+func labelsKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
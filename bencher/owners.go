@@ -0,0 +1,283 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// AlertOwnersCodeOwners as AlertOwners resolves the alert emails from
+// the owners of the changed packages in the target repository's CODEOWNERS.
+const AlertOwnersCodeOwners = "codeowners"
+
+// codeOwnersPaths are where GitHub looks for CODEOWNERS, in order.
+var codeOwnersPaths = []string{"CODEOWNERS", ".github/CODEOWNERS", "docs/CODEOWNERS"}
+
+// CodeOwners are the rules of a CODEOWNERS file.
+type CodeOwners struct {
+	Rules []*CodeOwnersRule
+}
+
+// CodeOwnersRule assigns the files matching Pattern to Owners,
+// GitHub users e.g. "@odeke-em", teams e.g. "@census-instrumentation/go"
+// or emails.
+type CodeOwnersRule struct {
+	Pattern string
+	Owners  []string
+
+	re *regexp.Regexp
+}
+
+// ParseCodeOwners parses the CODEOWNERS file read from r, in GitHub's syntax:
+// a gitignore style pattern followed by its owners per line.
+func ParseCodeOwners(r io.Reader) (*CodeOwners, error) {
+	co := new(CodeOwners)
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		re, err := codeOwnersRegexp(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		co.Rules = append(co.Rules, &CodeOwnersRule{Pattern: fields[0], Owners: fields[1:], re: re})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return co, nil
+}
+
+// codeOwnersRegexp compiles pattern, in which "*" matches within a
+// directory and "**" across them, and that is anchored to the root if
+// it contains a slash other than a trailing one, matching a directory's
+// files too.
+func codeOwnersRegexp(pattern string) (*regexp.Regexp, error) {
+	orig := pattern
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return nil, fmt.Errorf("invalid pattern %q", orig)
+	}
+
+	var expr strings.Builder
+	if anchored {
+		expr.WriteString("^")
+	} else {
+		expr.WriteString("(^|/)")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if dirOnly {
+		expr.WriteString("/.*$")
+	} else {
+		expr.WriteString("(/.*)?$")
+	}
+	return regexp.Compile(expr.String())
+}
+
+// Owners returns the owners of the file at the slash separated path
+// relative to the repository's root: those of the last matching rule.
+func (co *CodeOwners) Owners(file string) []string {
+	for i := len(co.Rules) - 1; i >= 0; i-- {
+		if co.Rules[i].re.MatchString(file) {
+			return co.Rules[i].Owners
+		}
+	}
+	return nil
+}
+
+// readCodeOwnersFile returns the CODEOWNERS in dir, if any.
+func readCodeOwnersFile(dir string) (*CodeOwners, error) {
+	for _, name := range codeOwnersPaths {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ParseCodeOwners(f)
+	}
+	return nil, nil
+}
+
+// loadCodeOwners sets the request's codeOwners from the target
+// repository's CODEOWNERS, if its alert emails are resolved from it.
+func (br *Request) loadCodeOwners() (err error) {
+	if br.AlertOwners != AlertOwnersCodeOwners {
+		return nil
+	}
+	if br.codeOwners, err = readCodeOwnersFile(br.projectDir()); err != nil {
+		return fmt.Errorf("Reading CODEOWNERS: %v", err)
+	}
+	return nil
+}
+
+// resolveAlertOwners replaces the alert emails with those of the
+// AlertOwners of res: the owners of the packages of its changed rows
+// in CODEOWNERS, or the members of a GitHub team. The alert emails
+// are kept if no owner has an email.
+func (br *Request) resolveAlertOwners(ctx context.Context, res *Result) error {
+	ctx, span := br.startSpan(ctx, "resolve-alert-owners")
+	defer span.End()
+
+	var owners []string
+	switch {
+	case br.AlertOwners == "":
+		return nil
+	case br.AlertOwners == AlertOwnersCodeOwners:
+		if br.codeOwners == nil || res == nil {
+			return nil
+		}
+		owners = br.packageOwners(res.Rows)
+	case strings.HasPrefix(br.AlertOwners, "@") && strings.Count(br.AlertOwners, "/") == 1:
+		owners = []string{br.AlertOwners}
+	default:
+		return fmt.Errorf("unknown alert_owners %q", br.AlertOwners)
+	}
+
+	emails, err := br.ownerEmails(ctx, owners)
+	if err != nil {
+		return err
+	}
+	span.Annotatef(nil, "Resolved %d owners to %d emails", len(owners), len(emails))
+	if len(emails) > 0 {
+		br.AlertEmails = emails
+	}
+	return nil
+}
+
+// packageOwners returns the CODEOWNERS owners of the packages of rows.
+func (br *Request) packageOwners(rows []*Row) []string {
+	seen := make(map[string]bool)
+	var owners []string
+	for _, row := range rows {
+		pkg := groupLabel(row.Group, "pkg")
+		if pkg == "" {
+			continue
+		}
+		dir := strings.TrimPrefix(strings.TrimPrefix(pkg, br.GitRepoURL), "/")
+		// Standing for any Go file of the package.
+		for _, owner := range br.codeOwners.Owners(path.Join(dir, "*.go")) {
+			if !seen[owner] {
+				seen[owner] = true
+				owners = append(owners, owner)
+			}
+		}
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+// groupLabel returns the value of the label with key in group
+// e.g. "go.opencensus.io/trace" of "pkg" in "pkg:go.opencensus.io/trace goarch:amd64".
+func groupLabel(group, key string) string {
+	for _, label := range strings.Fields(group) {
+		if strings.HasPrefix(label, key+":") {
+			return strings.TrimPrefix(label, key+":")
+		}
+	}
+	return ""
+}
+
+// ownerEmails resolves owners to emails, through the GitHub API for
+// users and teams, whose members without a public email are left out.
+func (br *Request) ownerEmails(ctx context.Context, owners []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var emails []string
+	add := func(email string) {
+		if email != "" && !seen[normalizeEmail(email)] {
+			seen[normalizeEmail(email)] = true
+			emails = append(emails, email)
+		}
+	}
+	for _, owner := range owners {
+		if !strings.HasPrefix(owner, "@") {
+			add(owner)
+			continue
+		}
+		logins := []string{strings.TrimPrefix(owner, "@")}
+		if i := strings.Index(owner, "/"); i > 0 {
+			members, err := br.teamMembers(ctx, owner[1:i], owner[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("Listing the members of %s: %v", owner, err)
+			}
+			logins = members
+		}
+		for _, login := range logins {
+			var user struct {
+				Email string `json:"email"`
+			}
+			if err := br.githubGet(ctx, "/users/"+url.PathEscape(login), &user); err != nil {
+				return nil, fmt.Errorf("Retrieving @%s: %v", login, err)
+			}
+			add(user.Email)
+		}
+	}
+	sort.Strings(emails)
+	return emails, nil
+}
+
+// teamMembers returns the logins of the members of the GitHub team slug of org.
+func (br *Request) teamMembers(ctx context.Context, org, slug string) ([]string, error) {
+	const perPage = 100
+	var logins []string
+	for page := 1; ; page++ {
+		var members []struct {
+			Login string `json:"login"`
+		}
+		u := fmt.Sprintf("/orgs/%s/teams/%s/members?per_page=%d&page=%d", url.PathEscape(org), url.PathEscape(slug), perPage, page)
+		if err := br.githubGet(ctx, u, &members); err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			logins = append(logins, member.Login)
+		}
+		if len(members) < perPage {
+			return logins, nil
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPackageOwnersOfReportRows(t *testing.T) {
+	gtr := readTestEvents(t, "go-test-two-packages.json")
+	rows := resultRows(compareConfigs([]string{"before", "after"}, [][]byte{gtr.benchmarks, gtr.benchmarks}, defaultSplitBy))
+
+	co, err := ParseCodeOwners(strings.NewReader("* @census-instrumentation/go\n/a/ @alice # package a\n/b/*_test.go bob@example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := &Request{GitRepoURL: "example.com/tm", codeOwners: co}
+
+	var ofA []*Row
+	for _, row := range rows {
+		if groupLabel(row.Group, "pkg") == "example.com/tm/a" {
+			ofA = append(ofA, row)
+		}
+	}
+	if len(ofA) == 0 || len(ofA) == len(rows) {
+		t.Fatalf("got %d of %d rows of package a, want some", len(ofA), len(rows))
+	}
+	if got, want := br.packageOwners(ofA), []string{"@alice"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("owners of package a: got %v, want %v", got, want)
+	}
+	// "*.go" of b doesn't match "*_test.go", hence b is owned by the team.
+	if got, want := br.packageOwners(rows), []string{"@alice", "@census-instrumentation/go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("owners of packages a and b: got %v, want %v", got, want)
+	}
+}
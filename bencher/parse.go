@@ -0,0 +1,90 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// benchResult is a single benchmark result line.
+type benchResult struct {
+	// Name is the benchmark's name without the "Benchmark"
+	// prefix, as benchstat reports it e.g. "StartSpan-8".
+	Name       string
+	Iterations int
+	// Values maps units e.g. "ns/op" to the measured values.
+	Values map[string]float64
+	// Labels are the configuration lines in effect e.g. "pkg".
+	Labels map[string]string
+	// Line is the original result line and
+	// Index its index among the lines of the results.
+	Line  string
+	Index int
+}
+
+// parseResults parses results in the Go benchmark format, ignoring
+// lines that are neither configuration nor benchmark results.
+func parseResults(blob []byte) []*benchResult {
+	var results []*benchResult
+	labels := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(blob))
+	sc.Buffer(nil, 1<<20)
+	for i := 0; sc.Scan(); i++ {
+		line := sc.Text()
+		if j := strings.Index(line, ": "); j > 0 && tagKeyRe.MatchString(line[:j]) {
+			// Labels are copied on write as results share them.
+			copied := make(map[string]string, len(labels)+1)
+			for key, value := range labels {
+				copied[key] = value
+			}
+			copied[line[:j]] = strings.TrimSpace(line[j+2:])
+			labels = copied
+			continue
+		}
+		if res := parseResultLine(line); res != nil {
+			res.Labels, res.Index = labels, i
+			results = append(results, res)
+		}
+	}
+	return results
+}
+
+func parseResultLine(line string) *benchResult {
+	f := strings.Fields(line)
+	if len(f) < 4 || !strings.HasPrefix(f[0], "Benchmark") {
+		return nil
+	}
+	n, err := strconv.Atoi(f[1])
+	if err != nil || n == 0 {
+		return nil
+	}
+	res := &benchResult{
+		Name:       strings.TrimPrefix(f[0], "Benchmark"),
+		Iterations: n,
+		Values:     make(map[string]float64),
+		Line:       line,
+	}
+	for i := 2; i+2 <= len(f); i += 2 {
+		value, err := strconv.ParseFloat(f[i], 64)
+		if err != nil {
+			continue
+		}
+		res.Values[f[i+1]] = value
+	}
+	return res
+}
@@ -0,0 +1,376 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// policyFileName is the file at the root of the target repository with
+// its gating policy, used unless the request has one.
+const policyFileName = ".bencherpolicy"
+
+// The severities of a PolicyVerdict, from least to most severe.
+const (
+	SeverityPass = "pass"
+	SeverityWarn = "warn"
+	SeverityFail = "fail"
+)
+
+var severityRank = map[string]int{SeverityPass: 0, SeverityWarn: 1, SeverityFail: 2}
+
+// geomeanBenchmark is how benchstat names the geometric mean row.
+const geomeanBenchmark = "[Geo mean]"
+
+// Policy decides how severe the changes found by a comparison are. It is
+// written as rules, one per line or separated by ";", of the form
+//
+//	fail if any benchmark matching Export.* regresses >10% or geomean regresses >3%
+//	warn if any benchmark regresses >5% in alloc/op
+//
+// A rule's conditions are either:
+//   - "any benchmark [matching <regexp>] regresses ><n>% [in <metric>]", met
+//     by any significant regression of a benchmark, named as benchstat
+//     reports it e.g. "ExportSpan-8", of any metric unless one is given.
+//   - "[total] geomean regresses ><n>% [in <metric>]", met if the geometric
+//     mean of every benchmark's metric, "time/op" unless another is given,
+//     regressed, whether or not significantly.
+//   - "[suite] duration regresses ><n>%", met if the benchmarks took longer
+//     than the median of the previous runs by more than n%, see
+//     SuiteDuration. It is only evaluated as runs complete.
+//
+// Metrics are named as benchstat reports them e.g. "time/op", "alloc/op",
+// "allocs/op" or "speed". Blank lines and lines starting with "#" are
+// skipped. The verdict is the severity of the most severe rule that was
+// met, SeverityPass if none was.
+type Policy struct {
+	rules []*policyRule
+}
+
+type policyRule struct {
+	text     string
+	severity string
+	conds    []*policyCond
+}
+
+type policyCond struct {
+	geomean  bool
+	duration bool
+	// match if set, is what regressed benchmarks must match.
+	match     *regexp.Regexp
+	metric    string
+	threshold float64
+}
+
+// PolicyVerdict is the outcome of evaluating a Policy against a comparison.
+type PolicyVerdict struct {
+	Severity string `json:"severity"`
+	// Violations are the met conditions, prefixed by their rule's severity
+	// e.g. "fail: ExportSpan-8 time/op regressed +12.30%, more than 10%".
+	Violations []string `json:"violations,omitempty"`
+}
+
+// ParsePolicy parses the text of a Policy.
+func ParsePolicy(text string) (*Policy, error) {
+	p := new(Policy)
+	for _, line := range strings.Split(text, "\n") {
+		for _, rule := range strings.Split(line, ";") {
+			rule = strings.TrimSpace(rule)
+			if rule == "" || strings.HasPrefix(rule, "#") {
+				continue
+			}
+			pr, err := parsePolicyRule(rule)
+			if err != nil {
+				return nil, fmt.Errorf("Policy rule %q: %v", rule, err)
+			}
+			p.rules = append(p.rules, pr)
+		}
+	}
+	if len(p.rules) == 0 {
+		return nil, fmt.Errorf("expecting at least one policy rule")
+	}
+	return p, nil
+}
+
+type policyTokens []string
+
+func (pt *policyTokens) peek() string {
+	if len(*pt) == 0 {
+		return ""
+	}
+	return strings.ToLower((*pt)[0])
+}
+
+func (pt *policyTokens) next() string {
+	if len(*pt) == 0 {
+		return ""
+	}
+	tok := (*pt)[0]
+	*pt = (*pt)[1:]
+	return tok
+}
+
+// accept consumes the next tokens if they are, case insensitively, words.
+func (pt *policyTokens) accept(words ...string) bool {
+	if len(*pt) < len(words) {
+		return false
+	}
+	for i, word := range words {
+		if !strings.EqualFold((*pt)[i], word) {
+			return false
+		}
+	}
+	*pt = (*pt)[len(words):]
+	return true
+}
+
+func (pt *policyTokens) expect(words ...string) error {
+	if !pt.accept(words...) {
+		return fmt.Errorf("expecting %q at %q", strings.Join(words, " "), strings.Join(*pt, " "))
+	}
+	return nil
+}
+
+func parsePolicyRule(rule string) (*policyRule, error) {
+	pt := policyTokens(strings.Fields(rule))
+	pr := &policyRule{text: rule, severity: strings.ToLower(pt.next())}
+	if pr.severity != SeverityFail && pr.severity != SeverityWarn {
+		return nil, fmt.Errorf("expecting %q or %q, got %q", SeverityFail, SeverityWarn, pr.severity)
+	}
+	if err := pt.expect("if"); err != nil {
+		return nil, err
+	}
+	for {
+		cond, err := parsePolicyCond(&pt)
+		if err != nil {
+			return nil, err
+		}
+		pr.conds = append(pr.conds, cond)
+		if len(pt) == 0 {
+			return pr, nil
+		}
+		if err := pt.expect("or"); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func parsePolicyCond(pt *policyTokens) (*policyCond, error) {
+	cond := new(policyCond)
+	switch {
+	case pt.accept("any", "benchmark"):
+		if pt.accept("matching") {
+			pattern := strings.TrimPrefix(pt.next(), "Benchmark")
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+			}
+			cond.match = re
+		}
+	case pt.accept("total", "geomean"), pt.accept("geomean"):
+		cond.geomean, cond.metric = true, "time/op"
+	case pt.accept("suite", "duration"), pt.accept("duration"):
+		cond.duration = true
+	default:
+		return nil, fmt.Errorf(`expecting "any benchmark", "geomean" or "duration" at %q`, strings.Join(*pt, " "))
+	}
+	if err := pt.expect("regresses"); err != nil {
+		return nil, err
+	}
+	pt.accept("by")
+
+	// The threshold is written e.g. ">10%", "> 10%" or "more than 10%".
+	threshold := pt.next()
+	if threshold == ">" {
+		threshold = ">" + pt.next()
+	} else if strings.EqualFold(threshold, "more") && pt.accept("than") {
+		threshold = ">" + pt.next()
+	}
+	if !strings.HasPrefix(threshold, ">") || !strings.HasSuffix(threshold, "%") {
+		return nil, fmt.Errorf("expecting a threshold e.g. \">10%%\", got %q", threshold)
+	}
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimPrefix(threshold, ">"), "%"), 64)
+	if err != nil || pct < 0 {
+		return nil, fmt.Errorf("invalid threshold %q", threshold)
+	}
+	cond.threshold = pct
+
+	if pt.accept("in") {
+		if cond.duration {
+			return nil, fmt.Errorf("the suite duration has no metrics")
+		}
+		if cond.metric = pt.next(); cond.metric == "" {
+			return nil, fmt.Errorf("expecting a metric after \"in\"")
+		}
+	}
+	if tok := pt.peek(); tok != "" && tok != "or" {
+		return nil, fmt.Errorf("unexpected %q", strings.Join(*pt, " "))
+	}
+	return cond, nil
+}
+
+// readPolicyFile returns the target repository's policy,
+// or nil if it has no policy file.
+func readPolicyFile(dir string) (*Policy, error) {
+	blob, err := ioutil.ReadFile(filepath.Join(dir, policyFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(string(blob))
+}
+
+// Evaluate evaluates the policy against the significantly changed rows
+// of a comparison, and the compared results from which geometric means
+// are computed. Conditions on the suite duration aren't met.
+func (p *Policy) Evaluate(rows []*Row, before, after []byte) *PolicyVerdict {
+	return p.evaluate(rows, before, after, nil)
+}
+
+// evaluate evaluates the policy as Evaluate does, and its conditions
+// on the suite duration against sd if set.
+func (p *Policy) evaluate(rows []*Row, before, after []byte, sd *SuiteDuration) *PolicyVerdict {
+	var geomeans map[string]float64
+	verdict := &PolicyVerdict{Severity: SeverityPass}
+	for _, rule := range p.rules {
+		var violations []string
+		for _, cond := range rule.conds {
+			if cond.duration {
+				if sd != nil && sd.Median > 0 && sd.PctDelta > cond.threshold {
+					violations = append(violations, fmt.Sprintf("suite duration regressed %+.2f%% to %s, more than %g%% over the median %s of the last %d runs",
+						sd.PctDelta, roundSeconds(sd.Seconds), cond.threshold, roundSeconds(sd.Median), sd.Runs))
+				}
+				continue
+			}
+			if !cond.geomean {
+				for _, row := range rows {
+					if reason := cond.violatedBy(row); reason != "" {
+						violations = append(violations, reason)
+					}
+				}
+				continue
+			}
+			if geomeans == nil {
+				geomeans = geomeanDeltas(before, after)
+			}
+			pct, ok := geomeans[cond.metric]
+			if !ok {
+				continue
+			}
+			if regression(cond.metric, pct) > cond.threshold {
+				violations = append(violations, fmt.Sprintf("geomean %s regressed %+.2f%%, more than %g%%", cond.metric, pct, cond.threshold))
+			}
+		}
+		for _, violation := range violations {
+			verdict.Violations = append(verdict.Violations, rule.severity+": "+violation)
+		}
+		if len(violations) > 0 && severityRank[rule.severity] > severityRank[verdict.Severity] {
+			verdict.Severity = rule.severity
+		}
+	}
+	return verdict
+}
+
+// violatedBy returns why row violates the condition, or blank if it doesn't.
+func (cond *policyCond) violatedBy(row *Row) string {
+	if row.Change >= 0 || (cond.metric != "" && row.Metric != cond.metric) {
+		return ""
+	}
+	if cond.match != nil && !cond.match.MatchString(row.Benchmark) {
+		return ""
+	}
+	if math.Abs(row.PctDelta) <= cond.threshold {
+		return ""
+	}
+	return fmt.Sprintf("%s %s regressed %+.2f%%, more than %g%%", row.Benchmark, row.Metric, row.PctDelta, cond.threshold)
+}
+
+// regression returns by how many percent a metric that changed by pct
+// regressed, negative if it improved. Speeds are better when greater.
+func regression(metric string, pct float64) float64 {
+	if metric == "speed" || strings.HasSuffix(metric, "-speed") {
+		return -pct
+	}
+	return pct
+}
+
+// geomeanDeltas returns the relative change of the geometric mean of
+// every metric's benchmarks, in percent, keyed by metric.
+func geomeanDeltas(before, after []byte) map[string]float64 {
+	c := &benchstat.Collection{
+		Alpha:      0.05,
+		AddGeoMean: true,
+		DeltaTest:  benchstat.UTest,
+	}
+	c.AddConfig("before", before)
+	c.AddConfig("after", after)
+
+	deltas := make(map[string]float64)
+	for _, table := range c.Tables() {
+		for _, row := range table.Rows {
+			if row.Benchmark == geomeanBenchmark && row.Delta != "" {
+				deltas[table.Metric] = row.PctDelta
+			}
+		}
+	}
+	return deltas
+}
+
+// loadPolicy sets the request's policy, parsed from Policy if
+// set, or else from the target repository's policy file.
+func (br *Request) loadPolicy() (err error) {
+	if br.Policy != "" {
+		br.policy, err = ParsePolicy(br.Policy)
+		return err
+	}
+	if br.policy, err = readPolicyFile(br.projectDir()); err != nil {
+		return fmt.Errorf("Reading %s: %v", policyFileName, err)
+	}
+	return nil
+}
+
+// gate evaluates the request's policy, if any, against the comparison
+// that produced res, failing it if benchmarks that must not allocate did.
+func (br *Request) gate(res *Result) error {
+	if br.policy != nil && res.before != nil {
+		before, after, err := br.prepare(res.before, res.after)
+		if err != nil {
+			return err
+		}
+		res.Policy = br.policy.evaluate(res.Rows, before, after, res.SuiteDuration)
+	}
+	if len(br.zeroAllocs) == 0 {
+		return nil
+	}
+	if violations := zeroAllocViolations(br.zeroAllocs, dropIgnored(res.before, br.ignore), dropIgnored(res.after, br.ignore)); len(violations) > 0 {
+		if res.Policy == nil {
+			res.Policy = new(PolicyVerdict)
+		}
+		res.Policy.Severity = SeverityFail
+		res.Policy.Violations = append(res.Policy.Violations, violations...)
+	}
+	return nil
+}
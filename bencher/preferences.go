@@ -0,0 +1,282 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keighl/postmark"
+
+	"go.opencensus.io/trace"
+
+	"google.golang.org/api/googleapi"
+)
+
+// preferencesName is the object holding the repository's recipient preferences.
+const preferencesName = "recipient-preferences.json"
+
+// The deliveries of a recipient's notifications.
+const (
+	// DeliveryImmediate emails every report as it is sent, the default.
+	DeliveryImmediate = "immediate"
+	// DeliveryDigest adds the reports to the repository's digest instead.
+	DeliveryDigest = "digest"
+	// DeliveryNone unsubscribes the recipient.
+	DeliveryNone = "none"
+)
+
+// RecipientPreferences are how one of the alert emails of a repository
+// wants to be notified of its runs.
+type RecipientPreferences struct {
+	Email    string `json:"email"`
+	Delivery string `json:"delivery"`
+	// MinTier is the least severe tier of the runs notified, e.g.
+	// TierWarn to only hear of regressions, TierInfo if blank. Runs are
+	// of the tier their routes classify them as, without which any
+	// regression is TierWarn.
+	MinTier   string    `json:"min_tier,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (rp *RecipientPreferences) validate() error {
+	switch rp.Delivery {
+	case DeliveryImmediate, DeliveryDigest, DeliveryNone:
+	default:
+		return fmt.Errorf("unknown delivery %q, expecting %q, %q or %q", rp.Delivery, DeliveryImmediate, DeliveryDigest, DeliveryNone)
+	}
+	if _, ok := tierRanks[rp.MinTier]; !ok && rp.MinTier != "" {
+		return fmt.Errorf("unknown tier %q, expecting %q, %q or %q", rp.MinTier, TierInfo, TierWarn, TierCritical)
+	}
+	if !strings.Contains(rp.Email, "@") {
+		return fmt.Errorf("invalid email %q", rp.Email)
+	}
+	return nil
+}
+
+// wants reports whether the recipient is notified of runs of tier.
+func (rp *RecipientPreferences) wants(tier string) bool {
+	return rp.Delivery != DeliveryNone && tierRanks[tier] >= tierRanks[rp.MinTier]
+}
+
+// normalizeEmail returns the key of an email's preferences.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// RecipientPreferences returns the preferences of the repository's
+// recipients that set any, by email.
+func (br *Request) RecipientPreferences(ctx context.Context) ([]*RecipientPreferences, error) {
+	ctx, span := br.startSpan(ctx, "recipient-preferences")
+	defer span.End()
+
+	prefs, err := br.loadPreferences(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*RecipientPreferences, 0, len(prefs))
+	for _, rp := range prefs {
+		list = append(list, rp)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Email < list[j].Email })
+	return list, nil
+}
+
+// maxPreferencesRetries is the number of times the preferences are read
+// and changed afresh, should those of others change concurrently.
+const maxPreferencesRetries = 5
+
+// SetRecipientPreferences replaces the preferences of rp.Email.
+func (br *Request) SetRecipientPreferences(ctx context.Context, rp *RecipientPreferences) error {
+	ctx, span := br.startSpan(ctx, "set-recipient-preferences")
+	defer span.End()
+
+	if err := rp.validate(); err != nil {
+		return err
+	}
+	rp.Email, rp.UpdatedAt = normalizeEmail(rp.Email), br.now()
+	for attempt := 1; ; attempt++ {
+		generation, prefs, err := br.readPreferences(ctx)
+		if err != nil {
+			return err
+		}
+		prefs[rp.Email] = rp
+		blob, err := json.Marshal(prefs)
+		if err != nil {
+			return err
+		}
+		// Only the generation that was read is replaced, lest
+		// the concurrent changes of other recipients are lost.
+		def := br.definition(preferencesName, func() io.Reader { return bytes.NewReader(blob) })
+		def.generation = generation
+		_, err = uploadBenchmarksToGCS(ctx, def)
+		if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusPreconditionFailed && attempt <= maxPreferencesRetries {
+			trace.FromContext(ctx).Annotatef(nil, "Recipient preferences conflict, retrying (attempt %d)", attempt)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Uploading the recipient preferences: %v", err)
+		}
+		return nil
+	}
+}
+
+// loadPreferences returns the stored preferences by normalized email,
+// none if no recipient set any.
+func (br *Request) loadPreferences(ctx context.Context) (map[string]*RecipientPreferences, error) {
+	_, prefs, err := br.readPreferences(ctx)
+	return prefs, err
+}
+
+// readPreferences returns the generation of the stored preferences,
+// 0 if there are none yet, and the preferences by normalized email.
+func (br *Request) readPreferences(ctx context.Context) (int64, map[string]*RecipientPreferences, error) {
+	prefs := make(map[string]*RecipientPreferences)
+	if br.InfraClient == nil && br.StorageService == nil {
+		return 0, prefs, nil
+	}
+	for attempt := 1; ; attempt++ {
+		obj, err := br.statObject(ctx, preferencesName)
+		if err != nil || obj == nil {
+			return 0, prefs, nil
+		}
+		blob, err := br.downloadGeneration(ctx, preferencesName, obj.Generation)
+		if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusNotFound && attempt <= maxPreferencesRetries {
+			// The generation was replaced since, read the new one.
+			continue
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("Retrieving the recipient preferences: %v", err)
+		}
+		if err := json.Unmarshal(blob, &prefs); err != nil {
+			return 0, nil, fmt.Errorf("Parsing the recipient preferences: %v", err)
+		}
+		return obj.Generation, prefs, nil
+	}
+}
+
+// recipients splits the alert emails into those emailed of a run of
+// tier right away and those whose digest it is added to, leaving out
+// the unsubscribed and those only notified of more severe tiers.
+func (br *Request) recipients(ctx context.Context, tier string) (immediate, digested []string, err error) {
+	prefs, err := br.loadPreferences(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, email := range br.AlertEmails {
+		rp, ok := prefs[normalizeEmail(email)]
+		switch {
+		case !ok:
+			immediate = append(immediate, email)
+		case !rp.wants(tier):
+		case rp.Delivery == DeliveryDigest:
+			digested = append(digested, email)
+		default:
+			immediate = append(immediate, email)
+		}
+	}
+	return immediate, digested, nil
+}
+
+// resultTier returns the tier of the run of results, as classified by
+// its routes, or else TierWarn if anything regressed.
+func (br *Request) resultTier(results interface{}) string {
+	res, ok := results.(*Result)
+	switch {
+	case !ok || res == nil:
+		return TierInfo
+	case res.Tier != "":
+		return res.Tier
+	case br.routes != nil:
+		return br.routes.Classify(res.Rows)
+	}
+	for _, row := range res.Rows {
+		if row.Change < 0 {
+			return TierWarn
+		}
+	}
+	return TierInfo
+}
+
+// UnsubscribeToken returns the token signing with key the link
+// through which email manages its notifications of repo.
+func UnsubscribeToken(key []byte, repo, email string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(repo + "\n" + normalizeEmail(email)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyUnsubscribeToken reports whether token was signed with key for email and repo.
+func VerifyUnsubscribeToken(key []byte, repo, email, token string) bool {
+	return len(key) > 0 && hmac.Equal([]byte(token), []byte(UnsubscribeToken(key, repo, email)))
+}
+
+// PreferencesURL returns the signed link of the page of dashboardURL
+// through which email unsubscribes from, or tunes, the notifications of repo.
+func PreferencesURL(dashboardURL string, key []byte, repo, email string) string {
+	query := url.Values{
+		"repo":  {repo},
+		"email": {email},
+		"token": {UnsubscribeToken(key, repo, email)},
+	}
+	return strings.TrimSuffix(dashboardURL, "/") + "/preferences?" + query.Encode()
+}
+
+// deliverTo delivers email to every one of to. With an UnsubscribeKey
+// and a DashboardURL, each is emailed separately with their own signed
+// link to unsubscribe or change their preferences.
+func (br *Request) deliverTo(ctx context.Context, email postmark.Email, to []string) error {
+	if len(br.UnsubscribeKey) == 0 || br.DashboardURL == "" {
+		email.To = strings.Join(to, ",")
+		return br.deliver(ctx, email)
+	}
+	var firstErr error
+	for _, recipient := range to {
+		link := PreferencesURL(br.DashboardURL, br.UnsubscribeKey, br.GitRepoURL, recipient)
+		personal := email
+		personal.To = recipient
+		// One-click unsubscription, as mail clients offer per RFC 8058.
+		personal.Headers = append(append([]postmark.Header(nil), email.Headers...),
+			postmark.Header{Name: "List-Unsubscribe", Value: "<" + link + "&unsubscribe=1>"},
+			postmark.Header{Name: "List-Unsubscribe-Post", Value: "List-Unsubscribe=One-Click"})
+		if personal.TextBody != "" {
+			personal.TextBody += "\n--\nUnsubscribe or change how you are notified: " + link + "\n"
+		}
+		if personal.HtmlBody != "" {
+			footer := `<p style="color:#888;font-size:small"><a href="` + html.EscapeString(link) + `">Unsubscribe or change how you are notified</a></p>`
+			if i := strings.LastIndex(personal.HtmlBody, "</body>"); i >= 0 {
+				personal.HtmlBody = personal.HtmlBody[:i] + footer + personal.HtmlBody[i:]
+			} else {
+				personal.HtmlBody += footer
+			}
+		}
+		if err := br.deliver(ctx, personal); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,56 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSetRecipientPreferencesConcurrently(t *testing.T) {
+	es, _ := openTestStore(t)
+	ctx := context.Background()
+
+	const n = 4
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			br := &Request{GitRepoURL: "example.com/tm", GCSBucket: "bencher", StorageService: es.Service()}
+			rp := &RecipientPreferences{Email: fmt.Sprintf("dev%d@example.org", i), Delivery: DeliveryDigest}
+			errs <- br.SetRecipientPreferences(ctx, rp)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	br := &Request{GitRepoURL: "example.com/tm", GCSBucket: "bencher", StorageService: es.Service()}
+	prefs, err := br.RecipientPreferences(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prefs) != n {
+		t.Fatalf("got the preferences of %d recipients, want all %d", len(prefs), n)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// The channels whose notifications can be previewed.
+const (
+	PreviewEmail    = "email"
+	PreviewSlack    = "slack"
+	PreviewMarkdown = "markdown"
+)
+
+// Preview is the notification that would be sent on a channel for a run.
+type Preview struct {
+	Channel     string `json:"channel"`
+	ContentType string `json:"content_type"`
+	// Subject, From and ReplyTo are the email's headers, if previewing an email.
+	Subject string `json:"subject,omitempty"`
+	From    string `json:"from,omitempty"`
+	ReplyTo string `json:"reply_to,omitempty"`
+	Body    string `json:"body"`
+}
+
+// PreviewNotification renders the notification of the stored run with runID
+// on channel, without sending it, so that the email header templates and
+// the request's policy can be iterated on against real results. The run is
+// compared against the run before it, as it was against the baseline then.
+func (br *Request) PreviewNotification(ctx context.Context, runID, channel string) (*Preview, error) {
+	ctx, span := br.startSpan(ctx, "preview-notification")
+	defer span.End()
+
+	switch channel {
+	case PreviewEmail, PreviewSlack, PreviewMarkdown:
+	default:
+		return nil, fmt.Errorf("unknown channel %q, expecting %q, %q or %q", channel, PreviewEmail, PreviewSlack, PreviewMarkdown)
+	}
+	res, err := br.rerenderRun(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &Preview{Channel: channel}
+	switch channel {
+	case PreviewEmail:
+		defaultSubject := fmt.Sprintf("Benchmarks for %s", br.GitRepoURL)
+		preview.Subject, preview.From, preview.ReplyTo, err = br.emailHeaders(defaultSubject, newEmailHeaderData(br.GitRepoURL, res))
+		if err != nil {
+			return nil, err
+		}
+		body, err := br.emailBody(emailTmpl, res)
+		if err != nil {
+			return nil, fmt.Errorf("Rendering the HTML email: %v", err)
+		}
+		preview.ContentType, preview.Body = "text/html; charset=utf-8", body.String()
+
+	case PreviewMarkdown:
+		buf := new(bytes.Buffer)
+		if err := NewSummary(br.GitRepoURL, res, nil).WriteMarkdown(buf); err != nil {
+			return nil, err
+		}
+		preview.ContentType, preview.Body = "text/markdown; charset=utf-8", buf.String()
+
+	case PreviewSlack:
+		blob, err := json.MarshalIndent(map[string]string{"text": slackText(br.GitRepoURL, res)}, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		preview.ContentType, preview.Body = "application/json", string(blob)
+	}
+	return preview, nil
+}
+
+// rerenderRun rebuilds the result of the stored run with runID by
+// comparing it against the stored run before it, and gating it with
+// the request's policy if set.
+func (br *Request) rerenderRun(ctx context.Context, runID string) (*Result, error) {
+	var run, prev *Run
+	rf := &RunFilter{PageSize: math.MaxInt32}
+	_, err := br.WalkRuns(ctx, rf, func(r *Run) error {
+		// Runs are walked oldest first.
+		switch {
+		case run != nil:
+		case r.ID == runID:
+			run = r
+		case r.hasResults():
+			prev = r
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case run == nil:
+		return nil, fmt.Errorf("no run %q of %q", runID, br.GitRepoURL)
+	case !run.hasResults():
+		return nil, run.noResultsError()
+	case prev == nil:
+		return nil, fmt.Errorf("run %q is the first of %q, with nothing to compare it against", runID, br.GitRepoURL)
+	}
+
+	beforeBlob, err := br.downloadBlob(ctx, prev.ID)
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving results of run %q: %v", prev.ID, err)
+	}
+	afterBlob, err := br.downloadBlob(ctx, run.ID)
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving results of run %q: %v", run.ID, err)
+	}
+	changed, err := br.compare(ctx, beforeBlob, afterBlob, br.splitBy())
+	if err != nil {
+		return nil, err
+	}
+	textBuf := new(bytes.Buffer)
+	formatText(textBuf, changed)
+	html, err := br.formatHTML(changed)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{
+		Benchmarks:      textBuf.String(),
+		HTMLBenchmarks:  html,
+		Rows:            resultRows(changed),
+		Tags:            run.Tags,
+		RunAt:           run.StartTime.Format(time.RFC3339),
+		Packages:        run.Packages,
+		Warnings:        runtimeWarnings(beforeBlob, afterBlob),
+		EnvironmentDiff: diffEnvironments(prev.Environment, run.Environment),
+		before:          beforeBlob,
+		after:           afterBlob,
+		changed:         changed,
+	}
+	if br.Policy != "" {
+		if br.policy, err = ParsePolicy(br.Policy); err != nil {
+			return nil, err
+		}
+		if err := br.gate(res); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// slackText renders res as a Slack message in its mrkdwn format.
+func slackText(repo string, res *Result) string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "*Benchmarks for %s*", slackEscape(repo))
+	if res.Policy != nil {
+		fmt.Fprintf(buf, " (%s)", res.Policy.Severity)
+	}
+	buf.WriteString("\n")
+	if res.RunAt != "" {
+		fmt.Fprintf(buf, "Run at: %s\n", res.RunAt)
+	}
+	for _, warning := range res.Warnings {
+		fmt.Fprintf(buf, ":warning: %s\n", slackEscape(warning))
+	}
+	if len(res.Rows) == 0 {
+		buf.WriteString("No significant changes.\n")
+	} else {
+		fmt.Fprintf(buf, "```\n%s```\n", slackEscape(res.Benchmarks))
+	}
+	if res.ReportURL != "" {
+		fmt.Fprintf(buf, "<%s|Full report>\n", res.ReportURL)
+	}
+	return buf.String()
+}
+
+// slackEscape escapes the characters that Slack treats as control sequences.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
@@ -0,0 +1,193 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// minFlamePct is the share of total samples below which
+// frames are pruned from the rendered flamegraph, to keep
+// the HTML artifact small enough to open in a browser.
+const minFlamePct = 0.1
+
+// profileGoBenchmarks runs the benchmarks of every package in the repository
+// once more with CPU profiling enabled and returns the rendered flamegraph
+// HTML keyed by the package's import path. Packages without benchmarks
+// produce no profile and are skipped.
+func (br *Request) profileGoBenchmarks(ctx context.Context) (map[string][]byte, error) {
+	ctx, span := br.startSpan(ctx, "profile-go-benchmarks")
+	defer span.End()
+
+	output, err := br.goCmd(ctx, "list", "./...").Output()
+	if err != nil {
+		return nil, fmt.Errorf("Listing packages: %v", err)
+	}
+
+	tmpDir, err := br.tempDir("bencher-profiles")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	flamegraphs := make(map[string][]byte)
+	for _, pkg := range strings.Fields(string(output)) {
+		base := strings.Replace(pkg, "/", "_", -1)
+		profPath := filepath.Join(tmpDir, base+".prof")
+		cmd := br.goCmd(ctx, "test", "-run=^$", "-bench=.", "-count=1",
+			"-o", filepath.Join(tmpDir, base+".test"), "-cpuprofile", profPath, pkg)
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("Profiling %q: %v", pkg, err)
+		}
+
+		f, err := os.Open(profPath)
+		if err != nil {
+			// No test files, hence no profile.
+			continue
+		}
+		prof, err := profile.Parse(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Parsing profile for %q: %v", pkg, err)
+		}
+		if len(prof.Sample) == 0 {
+			continue
+		}
+
+		buf := new(bytes.Buffer)
+		if err := renderFlamegraph(buf, pkg, prof); err != nil {
+			return nil, fmt.Errorf("Rendering flamegraph for %q: %v", pkg, err)
+		}
+		flamegraphs[pkg] = buf.Bytes()
+	}
+	return flamegraphs, nil
+}
+
+type flameNode struct {
+	Name     string
+	Value    int64
+	Pct      float64
+	Width    float64
+	Children []*flameNode
+
+	index map[string]*flameNode
+}
+
+func (fn *flameNode) child(name string) *flameNode {
+	if fn.index == nil {
+		fn.index = make(map[string]*flameNode)
+	}
+	cn, ok := fn.index[name]
+	if !ok {
+		cn = &flameNode{Name: name}
+		fn.index[name] = cn
+		fn.Children = append(fn.Children, cn)
+	}
+	return cn
+}
+
+// finalize computes the widths relative to the parent node,
+// drops frames too small to see and orders children by weight.
+func (fn *flameNode) finalize(total int64) {
+	var kept []*flameNode
+	for _, cn := range fn.Children {
+		cn.Pct = 100 * float64(cn.Value) / float64(total)
+		if cn.Pct < minFlamePct {
+			continue
+		}
+		cn.Width = 100 * float64(cn.Value) / float64(fn.Value)
+		cn.finalize(total)
+		kept = append(kept, cn)
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Value > kept[j].Value })
+	fn.Children = kept
+}
+
+func renderFlamegraph(w io.Writer, pkg string, prof *profile.Profile) error {
+	if len(prof.SampleType) == 0 {
+		return fmt.Errorf("the profile has no sample types")
+	}
+	// Prefer the CPU time sample type, otherwise use the last one
+	// which by pprof's convention is the most meaningful.
+	valueIndex := len(prof.SampleType) - 1
+	for i, st := range prof.SampleType {
+		if st.Type == "cpu" {
+			valueIndex = i
+		}
+	}
+
+	root := &flameNode{Name: pkg}
+	for _, sample := range prof.Sample {
+		if len(sample.Value) <= valueIndex {
+			continue
+		}
+		value := sample.Value[valueIndex]
+		root.Value += value
+		node := root
+		// Locations and their inlined lines are ordered leaf first.
+		for i := len(sample.Location) - 1; i >= 0; i-- {
+			lines := sample.Location[i].Line
+			for j := len(lines) - 1; j >= 0; j-- {
+				name := "?"
+				if fn := lines[j].Function; fn != nil {
+					name = fn.Name
+				}
+				node = node.child(name)
+				node.Value += value
+			}
+		}
+	}
+	if root.Value == 0 {
+		return ErrNoBenchmarks
+	}
+	root.Pct, root.Width = 100, 100
+	root.finalize(root.Value)
+
+	return flamegraphTmpl.Execute(w, root)
+}
+
+var flamegraphTmpl = template.Must(template.New("flamegraph").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>CPU flamegraph: {{.Name}}</title>
+<style>
+body { font-family: monospace; font-size: 11px; }
+.node { display: inline-block; vertical-align: top; box-sizing: border-box; }
+.frame { background: #f4a261; border: 1px solid #fff; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; padding: 1px 2px; }
+.frame:hover { background: #e76f51; }
+.children { display: flex; }
+</style>
+</head>
+<body>
+<h3>CPU flamegraph: {{.Name}}</h3>
+<p>Frames narrower than 0.1% of samples are omitted. Hover a frame for details.</p>
+{{template "node" .}}
+</body>
+</html>
+{{define "node"}}<div class="node" style="width: {{printf "%.3f" .Width}}%">
+<div class="frame" title="{{.Name}} ({{printf "%.2f" .Pct}}%)">{{.Name}}</div>
+<div class="children">{{range .Children}}{{template "node" .}}{{end}}</div>
+</div>{{end}}`))
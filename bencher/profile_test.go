@@ -0,0 +1,44 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestRenderFlamegraphSkipsShortSamples(t *testing.T) {
+	fn := &profile.Function{Name: "example.com/tm.Sum"}
+	loc := &profile.Location{Line: []profile.Line{{Function: fn}}}
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples"}, {Type: "cpu"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{loc}, Value: []int64{1}},
+			{Location: []*profile.Location{loc}, Value: []int64{1, 10}},
+		},
+	}
+	if err := renderFlamegraph(ioutil.Discard, "example.com/tm", prof); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenderFlamegraphWithoutSampleTypes(t *testing.T) {
+	prof := &profile.Profile{Sample: []*profile.Sample{{Value: []int64{}}}}
+	if err := renderFlamegraph(ioutil.Discard, "example.com/tm", prof); err == nil {
+		t.Fatal("rendering a profile without sample types succeeded, want an error")
+	}
+}
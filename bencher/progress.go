@@ -0,0 +1,186 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often the progress line is redrawn at most.
+const progressInterval = 100 * time.Millisecond
+
+// Progress renders the progress of running benchmarks to a terminal as a
+// single line, redrawn in place: the packages done, the benchmark running
+// and the time elapsed. Its OnTestEvent is meant as Request.OnTestEvent.
+type Progress struct {
+	w io.Writer
+	// total if positive, is the number of packages expected.
+	total int
+
+	mu      sync.Mutex
+	start   time.Time
+	drawn   time.Time
+	done    map[string]bool
+	failed  int
+	current string
+}
+
+// NewProgress returns a Progress writing to w, expecting total packages,
+// e.g. as listed by "go list ./...", or an unknown number if zero.
+func NewProgress(w io.Writer, total int) *Progress {
+	return &Progress{w: w, total: total, start: time.Now(), done: make(map[string]bool)}
+}
+
+// OnTestEvent updates the progress with an event of "go test -json".
+func (p *Progress) OnTestEvent(ev *TestEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch ev.Action {
+	case "output":
+		// Benchmarks print their name when they start, and their results.
+		if fields := strings.Fields(ev.Output); len(fields) > 0 && strings.HasPrefix(fields[0], "Benchmark") {
+			p.current = strings.TrimPrefix(ev.Package+"."+fields[0], ".")
+		}
+	case "pass", "fail", "skip":
+		if ev.Test == "" && !p.done[ev.Package] {
+			p.done[ev.Package] = true
+			if ev.Action == "fail" {
+				p.failed++
+			}
+		}
+	}
+	if now := time.Now(); now.Sub(p.drawn) >= progressInterval {
+		p.drawn = now
+		p.draw()
+	}
+}
+
+// Done clears the progress line, after which the summary can be written.
+func (p *Progress) Done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fmt.Fprint(p.w, "\r\033[K")
+}
+
+func (p *Progress) draw() {
+	packages := fmt.Sprintf("%d", len(p.done))
+	if p.total > 0 {
+		packages += fmt.Sprintf("/%d", p.total)
+	}
+	line := fmt.Sprintf("%s packages", packages)
+	if p.failed > 0 {
+		line += fmt.Sprintf(" (%d failed)", p.failed)
+	}
+	line += fmt.Sprintf(", %s elapsed", time.Since(p.start).Round(time.Second))
+	if p.current != "" {
+		line += ", running " + p.current
+	}
+	fmt.Fprintf(p.w, "\r\033[K%s", line)
+}
+
+// The ANSI colors of the summary.
+const (
+	ansiRed    = "\033[31m"
+	ansiGreen  = "\033[32m"
+	ansiYellow = "\033[33m"
+	ansiBold   = "\033[1m"
+	ansiReset  = "\033[0m"
+)
+
+// WriteSummary writes the changed rows of res as an aligned table, with
+// regressions in red and improvements in green if color is set, followed
+// by the policy verdict, if any.
+func WriteSummary(w io.Writer, res *Result, color bool) {
+	paint := func(code, s string) string {
+		if !color || code == "" {
+			return s
+		}
+		return code + s + ansiReset
+	}
+
+	if len(res.Rows) == 0 {
+		fmt.Fprintln(w, "No significant changes.")
+	} else {
+		header := []string{"benchmark", "metric", "before", "after", "delta"}
+		cells := [][]string{header}
+		for _, row := range res.Rows {
+			name := row.Benchmark
+			if row.Group != "" {
+				name = row.Group + "/" + name
+			}
+			cells = append(cells, []string{name, row.Metric, row.Before, row.After, row.Delta})
+		}
+		widths := make([]int, len(header))
+		for _, line := range cells {
+			for i, cell := range line {
+				if n := len([]rune(cell)); n > widths[i] {
+					widths[i] = n
+				}
+			}
+		}
+		// Cells are padded before being painted, lest the escape codes misalign them.
+		for i, line := range cells {
+			code := ""
+			switch {
+			case i == 0:
+				code = ansiBold
+			case res.Rows[i-1].Change < 0:
+				code = ansiRed
+			case res.Rows[i-1].Change > 0:
+				code = ansiGreen
+			}
+			padded := make([]string, len(line))
+			for j, cell := range line {
+				padded[j] = cell + strings.Repeat(" ", widths[j]-len([]rune(cell)))
+			}
+			fmt.Fprintln(w, paint(code, strings.TrimRight(strings.Join(padded, "  "), " ")))
+		}
+	}
+
+	if res.Deltas != "" {
+		fmt.Fprintf(w, "\n%s", res.Deltas)
+	}
+	for _, warning := range res.Warnings {
+		fmt.Fprintf(w, "\n%s %s\n", paint(ansiYellow, "Warning:"), warning)
+	}
+	if len(res.EnvironmentDiff) > 0 {
+		fmt.Fprintf(w, "\n%s\n", paint(ansiYellow, "Environment changes:"))
+		for _, ec := range res.EnvironmentDiff {
+			fmt.Fprintf(w, "  %s: %s -> %s\n", ec.Field, ec.Before, ec.After)
+		}
+	}
+	if res.Policy != nil {
+		code := ansiGreen
+		switch res.Policy.Severity {
+		case SeverityWarn:
+			code = ansiYellow
+		case SeverityFail:
+			code = ansiRed
+		}
+		fmt.Fprintf(w, "\nPolicy verdict: %s\n", paint(code, res.Policy.Severity))
+		for _, violation := range res.Policy.Violations {
+			fmt.Fprintf(w, "  %s\n", violation)
+		}
+	}
+	if res.ReportURL != "" {
+		fmt.Fprintf(w, "\nFull report: %s\n", res.ReportURL)
+	}
+}
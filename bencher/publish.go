@@ -0,0 +1,365 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+)
+
+// Publisher publishes the report artifacts of a run somewhere besides the
+// benchmark store, e.g. as the assets of a GitHub release.
+type Publisher interface {
+	// Publish publishes the artifacts of pub and returns
+	// the URL at which they were published.
+	Publish(ctx context.Context, pub *Publication) (string, error)
+}
+
+// PublisherFunc adapts a function to a Publisher.
+type PublisherFunc func(ctx context.Context, pub *Publication) (string, error)
+
+func (pf PublisherFunc) Publish(ctx context.Context, pub *Publication) (string, error) {
+	return pf(ctx, pub)
+}
+
+// Publication describes the artifacts to publish.
+type Publication struct {
+	// Repo is the import path of the benchmarked project.
+	Repo string
+	// RunID is the ID of the run that the artifacts are of, if any.
+	RunID string
+	// Target is where to publish, in the publisher's terms e.g.
+	// "census-instrumentation/opencensus-go@v0.22.0" for a GitHub release.
+	Target string
+	// Artifacts are the files to publish.
+	Artifacts []*PublishedArtifact
+	// Token is the publisher's credential, from Request.PublisherTokens.
+	Token string
+
+	HTTPClient     *http.Client
+	StorageService *storage.Service
+}
+
+// PublishedArtifact is a file to publish e.g. "report.html", or
+// "go.opencensus.io/index.html" if publishers are to nest it.
+type PublishedArtifact struct {
+	Name        string
+	ContentType string
+	Body        []byte
+}
+
+// The built-in publishers.
+const (
+	// PublisherGitHubRelease uploads the artifacts as assets of the
+	// release with the tag of its "owner/repo@tag" target, which must
+	// exist, with a token that may write the repository's contents.
+	PublisherGitHubRelease = "github-release"
+	// PublisherArtifactory deploys the artifacts under the repository
+	// path URL of its target e.g.
+	// "https://example.jfrog.io/artifactory/benchmarks-local/opencensus-go",
+	// with an access token.
+	PublisherArtifactory = "artifactory"
+	// PublisherGCSSite uploads the artifacts, readable by anyone and with
+	// their content types, under the "bucket/prefix" of its target, e.g.
+	// to a website bucket serving as the origin of a public dashboard.
+	PublisherGCSSite = "gcs-site"
+)
+
+var publishersMu sync.RWMutex
+var publishers = map[string]Publisher{
+	PublisherGitHubRelease: PublisherFunc(publishToGitHubRelease),
+	PublisherArtifactory:   PublisherFunc(publishToArtifactory),
+	PublisherGCSSite:       PublisherFunc(publishToGCSSite),
+}
+
+// RegisterPublisher makes p selectable by name in Request.PublishTo,
+// replacing any publisher registered under that name.
+func RegisterPublisher(name string, p Publisher) {
+	publishersMu.Lock()
+	defer publishersMu.Unlock()
+
+	publishers[name] = p
+}
+
+// PublisherNames returns the names of the registered publishers.
+func PublisherNames() []string {
+	publishersMu.RLock()
+	defer publishersMu.RUnlock()
+
+	names := make([]string, 0, len(publishers))
+	for name := range publishers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parsePublishTarget splits a "<publisher>:<target>" of Request.PublishTo.
+func parsePublishTarget(value string) (Publisher, string, string, error) {
+	i := strings.Index(value, ":")
+	if i <= 0 || i == len(value)-1 {
+		return nil, "", "", fmt.Errorf("expecting \"<publisher>:<target>\", got %q", value)
+	}
+	name, target := value[:i], value[i+1:]
+
+	publishersMu.RLock()
+	defer publishersMu.RUnlock()
+
+	p, ok := publishers[name]
+	if !ok {
+		return nil, "", "", fmt.Errorf("unknown publisher %q", name)
+	}
+	return p, name, target, nil
+}
+
+// publishArtifacts publishes artifacts of the run with runID to every
+// target of Request.PublishTo. The result is already stored, hence a
+// target that fails is returned as a warning rather than an error.
+func (br *Request) publishArtifacts(ctx context.Context, runID string, artifacts []*PublishedArtifact) (published map[string]string, warnings []string) {
+	ctx, span := br.startSpan(ctx, "publish-artifacts")
+	defer span.End()
+
+	published = make(map[string]string)
+	for _, value := range br.PublishTo {
+		p, name, target, err := parsePublishTarget(value)
+		if err == nil {
+			pub := &Publication{
+				Repo:           br.GitRepoURL,
+				RunID:          runID,
+				Target:         target,
+				Artifacts:      artifacts,
+				Token:          br.PublisherTokens[name],
+				HTTPClient:     br.HTTPClient,
+				StorageService: br.StorageService,
+			}
+			published[value], err = p.Publish(ctx, pub)
+		}
+		if err != nil {
+			span.Annotatef(nil, "Publishing to %s: %v", value, err)
+			warnings = append(warnings, fmt.Sprintf("Publishing to %s: %v", value, err))
+			delete(published, value)
+		}
+	}
+	return published, warnings
+}
+
+// runArtifacts returns the artifacts of res to publish: its HTML
+// report, its results and its summary.
+func runArtifacts(repo string, res *Result) []*PublishedArtifact {
+	summary, _ := json.MarshalIndent(NewSummary(repo, res, nil), "", "  ")
+	artifacts := []*PublishedArtifact{
+		{Name: "results.txt", ContentType: "text/plain; charset=utf-8", Body: []byte(res.Benchmarks)},
+		{Name: "summary.json", ContentType: "application/json", Body: summary},
+	}
+	if res.HTMLBenchmarks != "" {
+		artifacts = append(artifacts, &PublishedArtifact{
+			Name: "report.html", ContentType: "text/html; charset=utf-8", Body: []byte(res.HTMLBenchmarks),
+		})
+	}
+	return artifacts
+}
+
+// PublishRun publishes the report of the stored run with runID to the
+// targets of Request.PublishTo, as a run does when it completes.
+func (br *Request) PublishRun(ctx context.Context, runID string) (map[string]string, []string, error) {
+	ctx, span := br.startSpan(ctx, "publish-run")
+	defer span.End()
+
+	res, err := br.rerenderRun(ctx, runID)
+	if err != nil {
+		return nil, nil, err
+	}
+	published, warnings := br.publishArtifacts(ctx, runID, runArtifacts(br.GitRepoURL, res))
+	return published, warnings, nil
+}
+
+// Publish publishes artifacts that aren't of any run, e.g. the pages of
+// a static site, to the "<publisher>:<target>" to, returning the URL at
+// which they were published.
+func (br *Request) Publish(ctx context.Context, to string, artifacts []*PublishedArtifact) (string, error) {
+	ctx, span := br.startSpan(ctx, "publish")
+	defer span.End()
+
+	p, name, target, err := parsePublishTarget(to)
+	if err != nil {
+		return "", err
+	}
+	pub := &Publication{
+		Repo:           br.GitRepoURL,
+		Target:         target,
+		Artifacts:      artifacts,
+		Token:          br.PublisherTokens[name],
+		HTTPClient:     br.HTTPClient,
+		StorageService: br.StorageService,
+	}
+	return p.Publish(ctx, pub)
+}
+
+// flatRunID makes runID e.g. "2018-05-03/2018-05-03T14:05:06Z"
+// usable as part of a file name.
+func flatRunID(runID string) string {
+	return strings.NewReplacer("/", "_", ":", "").Replace(runID)
+}
+
+// do sends req with the publication's client, decoding the JSON
+// response into v if set, and expecting a successful response.
+func (pub *Publication) do(ctx context.Context, req *http.Request, v interface{}) error {
+	client := pub.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(body))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// The GitHub API URLs, variables for GitHub Enterprise.
+var (
+	githubAPIURL     = "https://api.github.com"
+	githubUploadsURL = "https://uploads.github.com"
+)
+
+func publishToGitHubRelease(ctx context.Context, pub *Publication) (string, error) {
+	i := strings.LastIndex(pub.Target, "@")
+	if i <= 0 || strings.Count(pub.Target[:i], "/") != 1 {
+		return "", fmt.Errorf("expecting a target of \"owner/repo@tag\", got %q", pub.Target)
+	}
+	repo, tag := pub.Target[:i], pub.Target[i+1:]
+	if pub.Token == "" {
+		return "", fmt.Errorf("no GitHub token is configured")
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/repos/%s/releases/tags/%s", githubAPIURL, repo, url.PathEscape(tag)), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "token "+pub.Token)
+	var release struct {
+		ID      int64  `json:"id"`
+		HTMLURL string `json:"html_url"`
+	}
+	if err := pub.do(ctx, req, &release); err != nil {
+		return "", fmt.Errorf("Retrieving release %q: %v", tag, err)
+	}
+
+	// Assets share the release, hence are named after the run.
+	prefix := "benchmarks-"
+	if pub.RunID != "" {
+		prefix += flatRunID(pub.RunID) + "-"
+	}
+	for _, artifact := range pub.Artifacts {
+		u := fmt.Sprintf("%s/repos/%s/releases/%d/assets?name=%s", githubUploadsURL, repo, release.ID, url.QueryEscape(prefix+artifact.Name))
+		req, err := http.NewRequest("POST", u, bytes.NewReader(artifact.Body))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", artifact.ContentType)
+		req.Header.Set("Authorization", "token "+pub.Token)
+		if err := pub.do(ctx, req, nil); err != nil {
+			return "", fmt.Errorf("Uploading %s: %v", artifact.Name, err)
+		}
+	}
+	return release.HTMLURL, nil
+}
+
+func publishToArtifactory(ctx context.Context, pub *Publication) (string, error) {
+	base, err := url.Parse(pub.Target)
+	if err != nil || (base.Scheme != "https" && base.Scheme != "http") || base.Host == "" {
+		return "", fmt.Errorf("expecting a target of an Artifactory repository path URL, got %q", pub.Target)
+	}
+	if pub.Token == "" {
+		return "", fmt.Errorf("no Artifactory token is configured")
+	}
+	dir := strings.TrimSuffix(pub.Target, "/")
+	if pub.RunID != "" {
+		dir += "/" + flatRunID(pub.RunID)
+	}
+	for _, artifact := range pub.Artifacts {
+		// Names may be paths e.g. "go.opencensus.io/index.html".
+		segments := strings.Split(artifact.Name, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		req, err := http.NewRequest("PUT", dir+"/"+strings.Join(segments, "/"), bytes.NewReader(artifact.Body))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", artifact.ContentType)
+		req.Header.Set("Authorization", "Bearer "+pub.Token)
+		if err := pub.do(ctx, req, nil); err != nil {
+			return "", fmt.Errorf("Deploying %s: %v", artifact.Name, err)
+		}
+	}
+	return dir + "/", nil
+}
+
+// siteCacheControl lets the published pages be cached briefly, so that
+// the site reflects new runs soon after they are published.
+const siteCacheControl = "public, max-age=300"
+
+func publishToGCSSite(ctx context.Context, pub *Publication) (string, error) {
+	if pub.StorageService == nil {
+		return "", ErrNoStorageService
+	}
+	bucket, prefix := pub.Target, ""
+	if i := strings.Index(pub.Target, "/"); i >= 0 {
+		bucket, prefix = pub.Target[:i], strings.Trim(pub.Target[i+1:], "/")
+	}
+	if bucket == "" {
+		return "", fmt.Errorf("expecting a target of \"bucket/prefix\", got %q", pub.Target)
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	if pub.RunID != "" {
+		prefix += "runs/" + pub.RunID + "/"
+	}
+	for _, artifact := range pub.Artifacts {
+		obj := &storage.Object{
+			Name:         prefix + artifact.Name,
+			ContentType:  artifact.ContentType,
+			CacheControl: siteCacheControl,
+		}
+		_, err := pub.StorageService.Objects.Insert(bucket, obj).Media(bytes.NewReader(artifact.Body), googleapi.ContentType(artifact.ContentType)).
+			PredefinedAcl("publicRead").Context(ctx).Do()
+		if err != nil {
+			return "", fmt.Errorf("Uploading %s: %v", artifact.Name, err)
+		}
+	}
+	return "https://storage.googleapis.com/" + bucket + "/" + prefix, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// pullsDir holds the revisions benchmarked of every pull request.
+const pullsDir = "pulls/"
+
+// PullRequestHistory groups the runs of the pushes to a pull request,
+// showing how the changes against the baseline evolved across them.
+type PullRequestHistory struct {
+	Repo   string `json:"repo"`
+	Number int    `json:"number"`
+	// Revisions are the benchmarked pushes, oldest first.
+	Revisions []*PullRevision `json:"revisions"`
+	// Benchmarks are the metrics that significantly changed in any
+	// revision, with their delta in each, by Benchmark and Metric.
+	Benchmarks []*PullBenchmark `json:"benchmarks,omitempty"`
+}
+
+// PullRevision is a run of a push to a pull request.
+type PullRevision struct {
+	RunID     string    `json:"run_id"`
+	StartTime time.Time `json:"start_time"`
+	// Revision and Commit are those of the run, if known.
+	Revision  string `json:"revision,omitempty"`
+	Commit    string `json:"commit,omitempty"`
+	ReportURL string `json:"report_url,omitempty"`
+	// Rows are the metrics that significantly changed against the baseline.
+	Rows []*Row `json:"rows,omitempty"`
+}
+
+// PullBenchmark is how a metric of a benchmark changed across the
+// revisions of a pull request.
+type PullBenchmark struct {
+	Benchmark string `json:"benchmark"`
+	Metric    string `json:"metric"`
+	Group     string `json:"group,omitempty"`
+	// Deltas are its changes in each of the revisions, in order,
+	// "~" in those in which it didn't significantly change.
+	Deltas []string `json:"deltas"`
+	// Change is that of the latest revision: +1 for an
+	// improvement, -1 for a regression, else 0.
+	Change int `json:"change"`
+}
+
+func pullRequestName(number int) string {
+	return fmt.Sprintf("%s%d.json", pullsDir, number)
+}
+
+// recordPullRevision adds the run of res to the revisions of the
+// request's PullRequest, replacing that of a re-run of the same commit.
+func (br *Request) recordPullRevision(ctx context.Context, run *Run, res *Result) error {
+	ctx, span := br.startSpan(ctx, "record-pull-revision")
+	defer span.End()
+
+	prh := &PullRequestHistory{Repo: br.GitRepoURL, Number: br.PullRequest}
+	if blob, err := br.downloadBlob(ctx, pullRequestName(br.PullRequest)); err == nil {
+		_ = json.Unmarshal(blob, prh)
+	}
+	rev := &PullRevision{
+		RunID:     run.ID,
+		StartTime: run.StartTime,
+		Revision:  run.Revision,
+		Commit:    run.Commit,
+		ReportURL: res.ReportURL,
+		Rows:      res.Rows,
+	}
+	if n := len(prh.Revisions); n > 0 && rev.Commit != "" && prh.Revisions[n-1].Commit == rev.Commit {
+		prh.Revisions[n-1] = rev
+	} else {
+		prh.Revisions = append(prh.Revisions, rev)
+	}
+	prh.Benchmarks = nil
+	blob, err := json.Marshal(prh)
+	if err != nil {
+		return err
+	}
+	if _, err := br.uploadBlob(ctx, pullRequestName(br.PullRequest), blob); err != nil {
+		return fmt.Errorf("Uploading pull request #%d: %v", br.PullRequest, err)
+	}
+	return nil
+}
+
+// PullRequestHistory returns the runs of the pushes to the pull request
+// number of the repository, with how each metric changed across them.
+func (br *Request) PullRequestHistory(ctx context.Context, number int) (*PullRequestHistory, error) {
+	ctx, span := br.startSpan(ctx, "pull-request-history")
+	defer span.End()
+
+	if number <= 0 {
+		return nil, fmt.Errorf("invalid pull request number %d", number)
+	}
+	blob, err := br.downloadBlob(ctx, pullRequestName(number))
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving pull request #%d: %v", number, err)
+	}
+	prh := new(PullRequestHistory)
+	if err := json.Unmarshal(blob, prh); err != nil {
+		return nil, fmt.Errorf("Parsing pull request #%d: %v", number, err)
+	}
+	prh.Benchmarks = pullBenchmarks(prh.Revisions)
+	return prh, nil
+}
+
+// pullBenchmarks tabulates the deltas of the rows of revs by metric.
+func pullBenchmarks(revs []*PullRevision) []*PullBenchmark {
+	byKey := make(map[string]*PullBenchmark)
+	var benchmarks []*PullBenchmark
+	for i, rev := range revs {
+		for _, row := range rev.Rows {
+			key := row.Benchmark + "\x00" + row.Metric + "\x00" + row.Group
+			pb, ok := byKey[key]
+			if !ok {
+				pb = &PullBenchmark{Benchmark: row.Benchmark, Metric: row.Metric, Group: row.Group}
+				for range revs {
+					pb.Deltas = append(pb.Deltas, "~")
+				}
+				byKey[key] = pb
+				benchmarks = append(benchmarks, pb)
+			}
+			pb.Deltas[i] = row.Delta
+			if i == len(revs)-1 {
+				pb.Change = row.Change
+			}
+		}
+	}
+	sort.Slice(benchmarks, func(i, j int) bool {
+		bi, bj := benchmarks[i], benchmarks[j]
+		if bi.Benchmark != bj.Benchmark {
+			return bi.Benchmark < bj.Benchmark
+		}
+		if bi.Metric != bj.Metric {
+			return bi.Metric < bj.Metric
+		}
+		return bi.Group < bj.Group
+	})
+	return benchmarks
+}
@@ -0,0 +1,244 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keighl/postmark"
+	"go.opencensus.io/trace"
+)
+
+// ErrQuotaExceeded is returned by Benchmark once the runs of the month
+// used up the machine time of the repository's quota.
+var ErrQuotaExceeded = errors.New("the monthly machine time quota is used up")
+
+// quotaWarningRatio is the share of a quota past which the repository's
+// alert emails are warned of it.
+const quotaWarningRatio = 0.8
+
+// Quota is a soft limit on the machine time that the runs of the
+// repositories matching Pattern may take in a calendar month, in the
+// request's time zone. It is soft as runs are only refused once it is
+// used up, hence the last run of the month may overrun it.
+type Quota struct {
+	// Pattern matches repositories in the syntax of path.Match e.g.
+	// "go.opencensus.io", or "github.com/orijtech/*" for a tenant's.
+	Pattern        string  `json:"pattern"`
+	MachineMinutes float64 `json:"machine_minutes"`
+}
+
+// ParseQuotas parses comma separated quotas of the form
+// "<pattern>=<machine minutes>" e.g. "go.opencensus.io=600,github.com/orijtech/*=1200".
+func ParseQuotas(s string) ([]*Quota, error) {
+	var quotas []*Quota
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid quota %q, expecting <pattern>=<machine minutes>", pair)
+		}
+		q := &Quota{Pattern: pair[:i]}
+		if _, err := path.Match(q.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern of quota %q: %v", pair, err)
+		}
+		minutes, err := strconv.ParseFloat(pair[i+1:], 64)
+		if err != nil || minutes <= 0 {
+			return nil, fmt.Errorf("invalid machine minutes of quota %q, expecting a positive number", pair)
+		}
+		q.MachineMinutes = minutes
+		quotas = append(quotas, q)
+	}
+	return quotas, nil
+}
+
+// QuotaUsage is the machine time used by the runs under a quota in a month.
+type QuotaUsage struct {
+	Pattern string `json:"pattern"`
+	Month   string `json:"month"`
+	// Repos are the repositories under the quota.
+	Repos          []string `json:"repos"`
+	Runs           int      `json:"runs"`
+	MachineMinutes float64  `json:"machine_minutes"`
+	Limit          float64  `json:"limit"`
+}
+
+// Quota returns the first of the request's quotas matching its repository, if any.
+func (br *Request) Quota() *Quota {
+	for _, q := range br.Quotas {
+		if ok, _ := path.Match(q.Pattern, br.GitRepoURL); ok {
+			return q
+		}
+	}
+	return nil
+}
+
+// usageDir holds a marker per run, whatever its outcome, named after
+// the time it started in UTC, whose metadata records its machine time.
+// The usage of a month is summed from their listing, rather than from
+// the metadata of every run, which runs without changes don't store.
+const usageDir = "usage/"
+
+// runUsage is the machine time and estimated cost of a run, on its usage marker.
+type runUsage struct {
+	MachineMinutes float64  `json:"machine_minutes"`
+	Cost           *RunCost `json:"cost,omitempty"`
+}
+
+// recordUsage uploads the usage marker of the run with runID, which
+// started at start, took minutes and cost cost if estimated. Failing to
+// is only traced since the run itself succeeded.
+func (br *Request) recordUsage(ctx context.Context, runID string, start time.Time, minutes float64, cost *RunCost) {
+	ctx, span := br.startSpan(ctx, "record-usage")
+	defer span.End()
+
+	usage, err := json.Marshal(&runUsage{MachineMinutes: minutes, Cost: cost})
+	if err != nil {
+		span.Annotatef(nil, "Recording the usage: %v", err)
+		return
+	}
+	def := br.definition(usageDir+start.UTC().Format(time.RFC3339)+"-"+runID, func() io.Reader { return strings.NewReader("") })
+	def.Metadata[MetadataUsage] = string(usage)
+	if _, err := uploadBenchmarksToGCS(ctx, def); err != nil {
+		span.Annotatef(nil, "Recording the usage: %v", err)
+	}
+}
+
+// QuotaUsage sums the machine time of the runs, deleted or not, that
+// started in the month of t, in t's location, of every repository
+// matching the quota's pattern, from their usage markers.
+func (br *Request) QuotaUsage(ctx context.Context, q *Quota, t time.Time) (*QuotaUsage, error) {
+	ctx, span := br.startSpan(ctx, "quota-usage")
+	defer span.End()
+
+	if br.StorageService == nil {
+		return nil, ErrNoStorageService
+	}
+	repos := []string{q.Pattern}
+	if strings.ContainsAny(q.Pattern, `*?[\`) {
+		infos, err := br.ListRepos(ctx)
+		if err != nil {
+			return nil, err
+		}
+		repos = repos[:0]
+		for _, info := range infos {
+			if ok, _ := path.Match(q.Pattern, info.Repo); ok {
+				repos = append(repos, info.Repo)
+			}
+		}
+	}
+
+	from := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	to := from.AddDate(0, 1, 0)
+	qu := &QuotaUsage{Pattern: q.Pattern, Month: from.Format("2006-01"), Repos: repos, Limit: q.MachineMinutes}
+	for _, repo := range repos {
+		rbr := &Request{
+			GitRepoURL:     repo,
+			GCSBucket:      br.GCSBucket,
+			InfraClient:    br.InfraClient,
+			StorageService: br.StorageService,
+			EncryptionKey:  br.EncryptionKey,
+		}
+		err := rbr.walkUsage(ctx, from, to, func(usage *runUsage) {
+			qu.Runs++
+			qu.MachineMinutes += usage.MachineMinutes
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Listing the usage of %s: %v", repo, err)
+		}
+	}
+	return qu, nil
+}
+
+// walkUsage calls fn with the usage of every run of the repository that
+// started from from until to, listing their markers without retrieving them.
+func (br *Request) walkUsage(ctx context.Context, from, to time.Time, fn func(*runUsage)) error {
+	prefix := br.inBenchmarksDir(usageDir)
+	pageToken := ""
+	for {
+		call := br.StorageService.Objects.List(br.GCSBucket).Prefix(prefix).
+			StartOffset(prefix+from.UTC().Format(time.RFC3339)).
+			EndOffset(prefix+to.UTC().Format(time.RFC3339)).
+			Fields("items(name,metadata)", "nextPageToken").Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		objs, err := call.Do()
+		if err != nil {
+			return err
+		}
+		for _, obj := range objs.Items {
+			usage := new(runUsage)
+			if err := json.Unmarshal([]byte(obj.Metadata[MetadataUsage]), usage); err != nil {
+				return fmt.Errorf("Parsing the usage of %q: %v", obj.Name, err)
+			}
+			fn(usage)
+		}
+		if pageToken = objs.NextPageToken; pageToken == "" {
+			return nil
+		}
+	}
+}
+
+// checkQuota returns the usage of the repository's quota, if any, as of
+// now, or ErrQuotaExceeded if it is used up.
+func (br *Request) checkQuota(ctx context.Context, now time.Time) (*QuotaUsage, error) {
+	q := br.Quota()
+	if q == nil {
+		return nil, nil
+	}
+	qu, err := br.QuotaUsage(ctx, q, now)
+	if err != nil {
+		return nil, fmt.Errorf("Checking the quota of %s: %v", br.GitRepoURL, err)
+	}
+	if qu.MachineMinutes >= qu.Limit {
+		return qu, ErrQuotaExceeded
+	}
+	return qu, nil
+}
+
+// warnOfQuota emails the alert emails if the run, which took minutes,
+// is the one that took the usage of the quota past quotaWarningRatio.
+// Failing to is only traced since the run itself succeeded.
+func (br *Request) warnOfQuota(ctx context.Context, qu *QuotaUsage, minutes float64) {
+	span := trace.FromContext(ctx)
+
+	threshold := quotaWarningRatio * qu.Limit
+	used := qu.MachineMinutes + minutes
+	if qu.MachineMinutes >= threshold || used < threshold || len(br.AlertEmails) == 0 {
+		return
+	}
+	email := postmark.Email{
+		From:    br.AppEmail,
+		To:      strings.Join(br.AlertEmails, ","),
+		Subject: fmt.Sprintf("Benchmarks of %s used %.0f%% of the monthly machine time", br.GitRepoURL, 100*used/qu.Limit),
+		TextBody: fmt.Sprintf("The runs of %s in %s took %.1f of the %.0f machine minutes of the quota of %q.\n\n"+
+			"Runs will be refused once the quota is used up, until next month.\n",
+			strings.Join(qu.Repos, ", "), qu.Month, used, qu.Limit, qu.Pattern),
+	}
+	if err := br.deliver(ctx, email); err != nil {
+		span.Annotatef(nil, "Warning of the quota of %q: %v", qu.Pattern, err)
+	}
+}
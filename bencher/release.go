@@ -0,0 +1,236 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// The formats in which a ReleaseReport is rendered.
+const (
+	ReportMarkdown = "markdown"
+	ReportHTML     = "html"
+)
+
+// signaturePrefix begins the last line of a signed report, which is a
+// comment in both Markdown and HTML.
+const signaturePrefix = "<!-- bencher-signature ed25519 "
+
+// ErrNoSignature is returned when verifying a report that isn't signed.
+var ErrNoSignature = errors.New("the report isn't signed")
+
+// ReleaseReport is the outcome of benchmarking a release of the suite's
+// modules against their previous release, to be attached to release notes.
+type ReleaseReport struct {
+	Release string         `json:"release"`
+	Repos   []*ReleaseRepo `json:"repos"`
+	Created time.Time      `json:"created"`
+	// Severity is the most severe policy verdict of the repositories,
+	// SeverityFail if any couldn't be benchmarked.
+	Severity string `json:"severity"`
+}
+
+// ReleaseRepo is the outcome of benchmarking the release of one module.
+type ReleaseRepo struct {
+	Repo string `json:"repo"`
+	// Previous is the release that it was compared against.
+	Previous string  `json:"previous,omitempty"`
+	Result   *Result `json:"result,omitempty"`
+	// Error if set, is why the module has no result
+	// e.g. "no changes detected!" or a failed build.
+	Error string `json:"error,omitempty"`
+}
+
+// ReleaseReport benchmarks version release of every module of the suite
+// against previous, or if blank, against the module's release preceding
+// it, through CompareVersions, carrying on past those that fail. The
+// request's GitRepoURL is restored once done.
+func (br *Request) ReleaseReport(ctx context.Context, release, previous string) (*ReleaseReport, error) {
+	ctx, span := br.startSpan(ctx, "release-report")
+	defer span.End()
+
+	if len(br.Suite) == 0 {
+		return nil, fmt.Errorf("expecting at least one module in the suite")
+	}
+	if release == "" {
+		return nil, fmt.Errorf("expecting a non-blank release")
+	}
+	defer func(repo string) {
+		br.GitRepoURL, br.VCS, br.Revision = repo, "", ""
+	}(br.GitRepoURL)
+
+	rr := &ReleaseReport{Release: release, Created: br.now().UTC(), Severity: SeverityPass}
+	for _, repo := range br.Suite {
+		br.GitRepoURL, br.ignore, br.policy = repo, nil, nil
+		br.transfers.reset()
+		rep := &ReleaseRepo{Repo: repo, Previous: previous}
+		rr.Repos = append(rr.Repos, rep)
+
+		var err error
+		if rep.Previous == "" {
+			rep.Previous, err = br.previousVersion(ctx, release)
+		}
+		if err == nil {
+			rep.Result, err = br.CompareVersions(ctx, rep.Previous, release)
+		}
+		switch {
+		case err == ErrNoChanges:
+			rep.Error = "no changes detected!"
+		case err != nil:
+			rep.Error = err.Error()
+			rr.Severity = SeverityFail
+			span.Annotatef(nil, "Benchmarking %s@%s: %v", repo, release, err)
+		case rep.Result.Policy != nil && severityRank[rep.Result.Policy.Severity] > severityRank[rr.Severity]:
+			rr.Severity = rep.Result.Policy.Severity
+		}
+	}
+	return rr, nil
+}
+
+// previousVersion returns the latest release of the module GitRepoURL
+// published before version, skipping pre-releases.
+func (br *Request) previousVersion(ctx context.Context, version string) (string, error) {
+	tmp, err := ioutil.TempDir("", "bencher-versions-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	cmd := br.checkoutCmd(ctx, "go", "list", "-m", "-versions", br.GitRepoURL)
+	cmd.Dir = tmp
+	cmd.Env = append(cmd.Env, "GO111MODULE=on", "GOFLAGS=-mod=mod")
+	out, err := runCheckoutCmd(cmd)
+	if err != nil {
+		return "", err
+	}
+	// The versions follow the module path in semantic version order.
+	versions := strings.Fields(string(out))
+	for i := len(versions) - 1; i > 0; i-- {
+		if versions[i] != version {
+			continue
+		}
+		for _, prev := range reverse(versions[1:i]) {
+			if !strings.Contains(prev, "-") {
+				return prev, nil
+			}
+		}
+		return "", fmt.Errorf("no release of %s precedes %s", br.GitRepoURL, version)
+	}
+	return "", fmt.Errorf("%s@%s isn't published", br.GitRepoURL, version)
+}
+
+func reverse(s []string) []string {
+	r := make([]string, len(s))
+	for i, v := range s {
+		r[len(s)-1-i] = v
+	}
+	return r
+}
+
+// Render renders the report as ReportMarkdown or ReportHTML, signed with
+// key unless it is nil. The signature is an ed25519 signature of all
+// that precedes the last line, which carries it as a comment, and is
+// checked with VerifyReport.
+func (rr *ReleaseReport) Render(format string, key ed25519.PrivateKey) ([]byte, error) {
+	var tmpl *template.Template
+	switch format {
+	case "", ReportMarkdown:
+		tmpl = releaseMarkdownTmpl
+	case ReportHTML:
+		tmpl = releaseHTMLTmpl
+	default:
+		return nil, fmt.Errorf("unknown report format %q", format)
+	}
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, rr); err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return buf.Bytes(), nil
+	}
+	sig := ed25519.Sign(key, buf.Bytes())
+	fmt.Fprintf(buf, "%s%s -->\n", signaturePrefix, base64.StdEncoding.EncodeToString(sig))
+	return buf.Bytes(), nil
+}
+
+// VerifyReport checks the signature of a report rendered by
+// ReleaseReport.Render against the public key pub. Leading newlines,
+// such as the heartbeats of a response, are skipped.
+func VerifyReport(pub ed25519.PublicKey, doc []byte) error {
+	doc = bytes.TrimLeft(doc, "\n")
+	i := bytes.LastIndex(doc, []byte(signaturePrefix))
+	if i < 0 {
+		return ErrNoSignature
+	}
+	trailer := strings.TrimSpace(string(doc[i+len(signaturePrefix):]))
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(trailer, " -->"))
+	if err != nil {
+		return fmt.Errorf("Decoding the signature: %v", err)
+	}
+	if !ed25519.Verify(pub, doc[:i], sig) {
+		return errors.New("the report's signature doesn't match")
+	}
+	return nil
+}
+
+var releaseMarkdownTmpl = template.Must(template.New("release-markdown").Parse(`# Benchmarks of release {{.Release}}
+
+Verdict: **{{.Severity}}**, generated {{.Created.Format "2006-01-02T15:04:05Z07:00"}}.
+{{range .Repos}}
+## {{.Repo}}{{if .Previous}} ({{.Previous}} → {{$.Release}}){{end}}
+{{if .Error}}
+{{.Error}}
+{{else}}{{with .Result}}{{with .Policy}}
+Policy verdict: **{{.Severity}}**
+{{range .Violations}}
+- {{.}}{{end}}
+{{end}}{{range .Warnings}}
+> **Warning:** {{.}}
+{{end}}
+` + "```" + `
+{{.Benchmarks}}` + "```" + `
+{{end}}{{end}}{{end}}`))
+
+var releaseHTMLTmpl = template.Must(template.New("release-html").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Benchmarks of release {{html .Release}}</title></head>
+<body>
+<h1>Benchmarks of release {{html .Release}}</h1>
+<p>Verdict: <b>{{html .Severity}}</b>, generated {{.Created.Format "2006-01-02T15:04:05Z07:00"}}.</p>
+{{range .Repos}}
+<h2>{{html .Repo}}{{if .Previous}} ({{html .Previous}} → {{html $.Release}}){{end}}</h2>
+{{if .Error}}
+<p>{{html .Error}}</p>
+{{else}}{{with .Result}}{{with .Policy}}
+<p>Policy verdict: <b>{{html .Severity}}</b></p>
+{{if .Violations}}<ul>{{range .Violations}}<li>{{html .}}</li>{{end}}</ul>{{end}}
+{{end}}{{range .Warnings}}
+<p><b>Warning:</b> {{html .}}</p>
+{{end}}
+{{.HTMLBenchmarks}}
+{{end}}{{end}}{{end}}
+</body>
+</html>
+`))
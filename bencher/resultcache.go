@@ -0,0 +1,147 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"runtime"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// resultCacheDir holds the results of runs under the
+// key of their commit and settings, see resultCacheKey.
+const resultCacheDir = "result-cache/"
+
+// cachedResult is the outcome of a run, returned by later runs of the
+// same commit with the same settings instead of re-running, e.g. for
+// webhook retries and repeated pushes of the same commit.
+type cachedResult struct {
+	Key       string    `json:"key"`
+	CreatedAt time.Time `json:"created_at"`
+	// NoChanges is set if the run detected no changes.
+	NoChanges bool    `json:"no_changes,omitempty"`
+	Result    *Result `json:"result,omitempty"`
+}
+
+// resultCacheKey returns the key of the run's results, hashing the
+// repository, the commit of its checked out sources, the Go version and
+// every setting of the run, or "" if its results can't be cached as the
+// sources aren't those of an immutable revision e.g. they were modified.
+func (br *Request) resultCacheKey(ctx context.Context) string {
+	span := trace.FromContext(ctx)
+
+	commit := br.commit
+	if commit == "" {
+		span.Annotatef(nil, "The results of %s can't be cached", br.GitRepoURL)
+		return ""
+	}
+	goVersion, err := runCheckoutCmd(br.checkoutCmd(ctx, "go", "version"))
+	if err != nil {
+		return ""
+	}
+
+	blob, _ := json.Marshal(map[string]interface{}{
+		"repo":          br.GitRepoURL,
+		"commit":        commit,
+		"go_version":    string(bytes.TrimSpace(goVersion)),
+		"goos":          runtime.GOOS,
+		"goarch":        runtime.GOARCH,
+		"tags":          br.Tags,
+		"gogc":          br.GOGC,
+		"godebug":       br.GODEBUG,
+		"seed":          br.Seed,
+		"profile":       br.Profile,
+		"harness":       br.Harness,
+		"snapshot":      br.Snapshot,
+		"time_budget":   br.TimeBudget,
+		"comparer":      br.Comparer,
+		"outliers":      br.Outliers,
+		"units_of_work": br.UnitsOfWork,
+		"policy":        br.Policy,
+		"baselines":     br.Baselines,
+		"baseline_run":  br.BaselineRunID,
+		"pull_request":  br.PullRequest,
+		"review":        br.ReviewComments,
+		"zero_allocs":   br.ZeroAllocs,
+	})
+	sum := sha256.Sum256(blob)
+	return hex.EncodeToString(sum[:])
+}
+
+// sourceCommit returns the commit of the checked out sources, or their
+// module version, or "" if they aren't those of an immutable revision
+// e.g. they were modified.
+func (br *Request) sourceCommit(ctx context.Context) string {
+	if br.VCS == VCSModule {
+		// Unlike queries such as "latest" or a branch, versions are immutable.
+		if strings.HasPrefix(br.Revision, "v") && strings.Count(br.Revision, ".") >= 2 {
+			return br.Revision
+		}
+		return ""
+	}
+	git := func(args ...string) string {
+		cmd := br.checkoutCmd(ctx, "git", args...)
+		cmd.Dir = br.projectDir()
+		out, err := runCheckoutCmd(cmd)
+		if err != nil {
+			return ""
+		}
+		return string(bytes.TrimSpace(out))
+	}
+	if status := git("status", "--porcelain", "--untracked-files=no"); status != "" {
+		return ""
+	}
+	return git("rev-parse", "HEAD")
+}
+
+// lookUpResult returns the cached outcome of the run with key, or nil.
+func (br *Request) lookUpResult(ctx context.Context, key string) *cachedResult {
+	ctx, span := br.startSpan(ctx, "look-up-result")
+	defer span.End()
+
+	blob, err := br.downloadBlob(ctx, resultCacheDir+key+".json")
+	if err != nil {
+		return nil
+	}
+	cr := new(cachedResult)
+	if err := json.Unmarshal(blob, cr); err != nil || (cr.Result == nil && !cr.NoChanges) {
+		span.Annotatef(nil, "Invalid cached result %s: %v", key, err)
+		return nil
+	}
+	return cr
+}
+
+// cacheResult caches the outcome of the run with key, either res or, if
+// nil, no changes. Failing to is only traced since the run itself succeeded.
+func (br *Request) cacheResult(ctx context.Context, key string, res *Result) {
+	ctx, span := br.startSpan(ctx, "cache-result")
+	defer span.End()
+
+	cr := &cachedResult{Key: key, CreatedAt: br.now().UTC(), NoChanges: res == nil, Result: res}
+	blob, err := json.Marshal(cr)
+	if err == nil {
+		_, err = br.uploadBlob(ctx, resultCacheDir+key+".json", blob)
+	}
+	if err != nil {
+		span.Annotatef(nil, "Caching the result: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PullRequestFile is a file changed by a pull request, as listed by GitHub.
+type PullRequestFile struct {
+	Filename string `json:"filename"`
+	Status   string `json:"status"`
+	// Patch is the file's unified diff, absent from binary or large files.
+	Patch string `json:"patch"`
+}
+
+// ReviewComment is an inline comment of a pull request review.
+type ReviewComment struct {
+	Path string `json:"path"`
+	Line int    `json:"line"`
+	Side string `json:"side"`
+	Body string `json:"body"`
+}
+
+var (
+	hunkHeaderRe    = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+	benchmarkFuncRe = regexp.MustCompile(`^func (Benchmark\w*)\(`)
+	fullCommitRe    = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// diffLines returns the lines of the new version of a file that its
+// unified diff patch shows, on which review comments can be made.
+func diffLines(patch string) map[int]bool {
+	lines := make(map[int]bool)
+	line := 0
+	for _, l := range strings.Split(patch, "\n") {
+		if m := hunkHeaderRe.FindStringSubmatch(l); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			continue
+		}
+		if line == 0 || strings.HasPrefix(l, "-") || strings.HasPrefix(l, `\`) {
+			continue
+		}
+		lines[line] = true
+		line++
+	}
+	return lines
+}
+
+// benchmarkFuncs returns the lines of the benchmark functions declared
+// in the file at path, by their name without the "Benchmark" prefix.
+func benchmarkFuncs(path string) (map[string]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	funcs := make(map[string]int)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		if m := benchmarkFuncRe.FindStringSubmatch(sc.Text()); m != nil {
+			funcs[strings.TrimPrefix(m[1], "Benchmark")] = n
+		}
+	}
+	return funcs, sc.Err()
+}
+
+// pullRequestFiles lists the files changed by the pull request number of repo.
+func (br *Request) pullRequestFiles(ctx context.Context, repo string, number int) ([]*PullRequestFile, error) {
+	const perPage = 100
+	var files []*PullRequestFile
+	for page := 1; ; page++ {
+		var listed []*PullRequestFile
+		u := fmt.Sprintf("/repos/%s/pulls/%d/files?per_page=%d&page=%d", repo, number, perPage, page)
+		if err := br.githubGet(ctx, u, &listed); err != nil {
+			return nil, err
+		}
+		files = append(files, listed...)
+		if len(listed) < perPage {
+			return files, nil
+		}
+	}
+}
+
+// reviewComments returns a comment, at the declaration of its benchmark
+// function, on the regressions of rows whose benchmark function is
+// declared in the changed files on a line that the diff shows. The
+// regressions of benchmarks declared elsewhere in the changed files are
+// returned as lines for the review's body.
+func (br *Request) reviewComments(files []*PullRequestFile, rows []*Row, reportURL string) ([]*ReviewComment, []string, error) {
+	type location struct {
+		file  string
+		line  int
+		shown bool
+	}
+	// The benchmarks of the changed test files by package and name.
+	locations := make(map[string]location)
+	for _, file := range files {
+		if file.Status == "removed" || !strings.HasSuffix(file.Filename, "_test.go") {
+			continue
+		}
+		funcs, err := benchmarkFuncs(filepath.Join(br.projectDir(), filepath.FromSlash(file.Filename)))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Reading %s: %v", file.Filename, err)
+		}
+		shown := diffLines(file.Patch)
+		pkg := br.GitRepoURL
+		if dir := path.Dir(file.Filename); dir != "." {
+			pkg += "/" + dir
+		}
+		for name, line := range funcs {
+			locations[pkg+"."+name] = location{file.Filename, line, shown[line]}
+		}
+	}
+
+	byLocation := make(map[location][]string)
+	var unshown []string
+	for _, row := range rows {
+		if row.Change >= 0 {
+			continue
+		}
+		name := gomaxprocsSuffixRe.ReplaceAllString(row.Benchmark, "")
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i]
+		}
+		loc, ok := locations[groupLabel(row.Group, "pkg")+"."+name]
+		if !ok {
+			continue
+		}
+		line := fmt.Sprintf("* `%s` %s regressed %s: %s → %s", row.Benchmark, row.Metric, row.Delta, row.Before, row.After)
+		if !loc.shown {
+			// Inline comments can only be on lines of the diff.
+			unshown = append(unshown, line+fmt.Sprintf(" (%s:%d)", loc.file, loc.line))
+			continue
+		}
+		byLocation[loc] = append(byLocation[loc], line)
+	}
+
+	var comments []*ReviewComment
+	for loc, lines := range byLocation {
+		body := "Against the baseline, this pull request's benchmarks show:\n\n" + strings.Join(lines, "\n")
+		if reportURL != "" {
+			body += fmt.Sprintf("\n\nSee the [full report](%s).", reportURL)
+		}
+		comments = append(comments, &ReviewComment{Path: loc.file, Line: loc.line, Side: "RIGHT", Body: body})
+	}
+	sort.Slice(comments, func(i, j int) bool {
+		if comments[i].Path != comments[j].Path {
+			return comments[i].Path < comments[j].Path
+		}
+		return comments[i].Line < comments[j].Line
+	})
+	return comments, unshown, nil
+}
+
+// commentOnPullRequest posts the regressions of res whose benchmark
+// functions are in files changed by the request's PullRequest, as inline
+// comments of a review at those functions, returning the review's URL,
+// blank if no regression is in a changed file. Regressions of functions
+// outside the diff's hunks are listed in the review's body.
+func (br *Request) commentOnPullRequest(ctx context.Context, res *Result) (string, error) {
+	ctx, span := br.startSpan(ctx, "comment-on-pull-request")
+	defer span.End()
+
+	repo, err := br.githubRepo()
+	if err != nil {
+		return "", err
+	}
+	files, err := br.pullRequestFiles(ctx, repo, br.PullRequest)
+	if err != nil {
+		return "", fmt.Errorf("Listing the files of pull request #%d: %v", br.PullRequest, err)
+	}
+	comments, unshown, err := br.reviewComments(files, res.Rows, res.ReportURL)
+	if err != nil || len(comments)+len(unshown) == 0 {
+		return "", err
+	}
+
+	body := "Benchmarks in files changed by this pull request regressed against the baseline."
+	if len(comments) > 0 {
+		body = fmt.Sprintf("Benchmarks in %d functions changed by this pull request regressed against the baseline.", len(comments))
+	}
+	if len(unshown) > 0 {
+		body += "\n\nOutside of the diff:\n\n" + strings.Join(unshown, "\n")
+		if res.ReportURL != "" {
+			body += fmt.Sprintf("\n\nSee the [full report](%s).", res.ReportURL)
+		}
+	}
+	review := map[string]interface{}{
+		"event": "COMMENT",
+		"body":  body,
+	}
+	if len(comments) > 0 {
+		review["comments"] = comments
+	}
+	// Comments are anchored to the benchmarked commit if known, else to the latest.
+	if fullCommitRe.MatchString(br.commit) {
+		review["commit_id"] = br.commit
+	}
+	var posted struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := br.githubPost(ctx, fmt.Sprintf("/repos/%s/pulls/%d/reviews", repo, br.PullRequest), review, &posted); err != nil {
+		return "", fmt.Errorf("Posting the review of pull request #%d: %v", br.PullRequest, err)
+	}
+	span.Annotatef(nil, "Posted %d review comments and %d regressions in the review's body", len(comments), len(unshown))
+	return posted.HTMLURL, nil
+}
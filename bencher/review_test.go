@@ -0,0 +1,71 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReviewCommentsOfReportRows(t *testing.T) {
+	gtr := readTestEvents(t, "go-test-two-packages.json")
+	rows := resultRows(compareConfigs([]string{"before", "after"}, [][]byte{gtr.benchmarks, gtr.benchmarks}, defaultSplitBy))
+	for _, row := range rows {
+		row.Change = -1
+	}
+
+	dir, err := ioutil.TempDir("", "bencher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := "package p\n\nimport \"testing\"\n\nfunc BenchmarkSum(b *testing.B) {}\n\nfunc BenchmarkAlloc(b *testing.B) {}\n"
+	for _, pkg := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(dir, pkg), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, pkg, "bench_test.go"), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []*PullRequestFile{
+		// The diff of a shows BenchmarkSum, that of b neither function.
+		{Filename: "a/bench_test.go", Status: "modified", Patch: "@@ -4,2 +4,2 @@\n \n-func BenchmarkSum(b *testing.B) { b.Skip() }\n+func BenchmarkSum(b *testing.B) {}"},
+		{Filename: "b/bench_test.go", Status: "modified", Patch: "@@ -1,2 +1,2 @@\n-package q\n+package p\n "},
+	}
+	br := &Request{GitRepoURL: "example.com/tm", workDir: dir}
+
+	comments, unshown, err := br.reviewComments(files, rows, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 1 || comments[0].Path != "a/bench_test.go" || comments[0].Line != 5 {
+		t.Fatalf("got comments %+v, want one at a/bench_test.go:5", comments)
+	}
+	if !strings.Contains(comments[0].Body, "`Sum") || strings.Contains(comments[0].Body, "`Alloc") {
+		t.Errorf("comment on BenchmarkSum of a:\n%s", comments[0].Body)
+	}
+	if len(unshown) == 0 {
+		t.Fatal("got no regressions outside of the diff, want those of a's BenchmarkAlloc and of b")
+	}
+	for _, line := range unshown {
+		if !strings.Contains(line, "(a/bench_test.go:7)") && !strings.Contains(line, "(b/bench_test.go:") {
+			t.Errorf("regression outside of the diff at the wrong place: %s", line)
+		}
+	}
+}
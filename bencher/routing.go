@@ -0,0 +1,426 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/keighl/postmark"
+)
+
+// routesFileName is the file of the target repository
+// routing its notifications by severity tier.
+const routesFileName = ".bencherroutes"
+
+// The severity tiers of notifications, by increasing severity.
+const (
+	TierInfo     = "info"
+	TierWarn     = "warn"
+	TierCritical = "critical"
+)
+
+// The channels to which a tier's notifications are routed.
+const (
+	// ChannelEmail emails the full report to the alert emails.
+	ChannelEmail = "email"
+	// ChannelDigest adds a line to the repository's digest,
+	// which SendDigest emails and clears e.g. daily.
+	ChannelDigest = "digest"
+	// ChannelSlack posts to Request.SlackWebhookURL.
+	ChannelSlack = "slack"
+	// ChannelPagerDuty triggers an incident with Request.PagerDutyRoutingKey.
+	ChannelPagerDuty = "pagerduty"
+)
+
+var tierRanks = map[string]int{TierInfo: 0, TierWarn: 1, TierCritical: 2}
+
+// Routes route the notifications of a repository's runs by severity tier,
+// in place of emailing every report.
+type Routes struct {
+	// Tiers are the routed tiers, by increasing severity.
+	Tiers []*Tier
+}
+
+// Tier is a severity tier and the channels its notifications go to.
+type Tier struct {
+	Name string
+	// Threshold is the regression in percent that a changed metric must
+	// exceed for a run to be of the tier. It is 0 for TierInfo, which
+	// is every run that no other tier applies to.
+	Threshold float64
+	Channels  []string
+}
+
+// ParseRoutes parses routes, one tier per line, of the form
+// "<tier> [>N%]: <channel>, ...". For example
+//
+//	info: digest
+//	warn >5%: slack
+//	critical >20%: pagerduty, email
+//
+// sends runs with a regression beyond 20% to PagerDuty and by email,
+// those with one beyond 5% to Slack, and adds the others to the digest.
+// A warn or critical tier without a threshold applies to any regression.
+// Blank lines and lines starting with "#" are ignored.
+func ParseRoutes(text string) (*Routes, error) {
+	routes := new(Routes)
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tier, err := parseTier(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		if routes.tier(tier.Name) != nil {
+			return nil, fmt.Errorf("line %d: tier %q is routed twice", i+1, tier.Name)
+		}
+		routes.Tiers = append(routes.Tiers, tier)
+	}
+	if len(routes.Tiers) == 0 {
+		return nil, fmt.Errorf("expecting at least one tier")
+	}
+	sort.SliceStable(routes.Tiers, func(i, j int) bool {
+		return tierRanks[routes.Tiers[i].Name] < tierRanks[routes.Tiers[j].Name]
+	})
+	return routes, nil
+}
+
+func parseTier(line string) (*Tier, error) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("expecting \"<tier> [>N%%]: <channel>, ...\", got %q", line)
+	}
+	fields := strings.Fields(line[:i])
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("expecting a tier and an optional threshold before %q", line[i:])
+	}
+	tier := &Tier{Name: fields[0]}
+	if _, ok := tierRanks[tier.Name]; !ok {
+		return nil, fmt.Errorf("unknown tier %q, expecting %q, %q or %q", tier.Name, TierInfo, TierWarn, TierCritical)
+	}
+	if len(fields) == 2 {
+		if tier.Name == TierInfo {
+			return nil, fmt.Errorf("the %q tier takes no threshold", TierInfo)
+		}
+		threshold := fields[1]
+		if !strings.HasPrefix(threshold, ">") || !strings.HasSuffix(threshold, "%") {
+			return nil, fmt.Errorf("expecting a threshold e.g. \">10%%\", got %q", threshold)
+		}
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimPrefix(threshold, ">"), "%"), 64)
+		if err != nil || pct < 0 {
+			return nil, fmt.Errorf("invalid threshold %q", threshold)
+		}
+		tier.Threshold = pct
+	}
+	for _, channel := range strings.Split(line[i+1:], ",") {
+		switch channel = strings.TrimSpace(channel); channel {
+		case ChannelEmail, ChannelDigest, ChannelSlack, ChannelPagerDuty:
+			tier.Channels = append(tier.Channels, channel)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown channel %q", channel)
+		}
+	}
+	if len(tier.Channels) == 0 {
+		return nil, fmt.Errorf("expecting the channels of tier %q", tier.Name)
+	}
+	return tier, nil
+}
+
+// readRoutesFile returns the target repository's routes,
+// or nil if it has no routes file.
+func readRoutesFile(dir string) (*Routes, error) {
+	blob, err := ioutil.ReadFile(filepath.Join(dir, routesFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseRoutes(string(blob))
+}
+
+// loadRoutes sets the request's routes, parsed from Routes if
+// set, or else from the target repository's routes file.
+func (br *Request) loadRoutes() (err error) {
+	if br.Routes != "" {
+		br.routes, err = ParseRoutes(br.Routes)
+		return err
+	}
+	if br.routes, err = readRoutesFile(br.projectDir()); err != nil {
+		return fmt.Errorf("Reading %s: %v", routesFileName, err)
+	}
+	return nil
+}
+
+func (rt *Routes) tier(name string) *Tier {
+	for _, tier := range rt.Tiers {
+		if tier.Name == name {
+			return tier
+		}
+	}
+	return nil
+}
+
+// Classify returns the most severe tier whose threshold a regression
+// among the significantly changed rows exceeds, else TierInfo.
+func (rt *Routes) Classify(rows []*Row) string {
+	name := TierInfo
+	for _, tier := range rt.Tiers {
+		if tier.Name == TierInfo {
+			continue
+		}
+		for _, row := range rows {
+			if row.Change < 0 && math.Abs(row.PctDelta) > tier.Threshold {
+				name = tier.Name
+				break
+			}
+		}
+	}
+	return name
+}
+
+// route notifies of res on the channels of its tier, or not at all if
+// that tier isn't routed. Every channel is tried, the first error returned.
+func (br *Request) route(ctx context.Context, subject string, tmpl *template.Template, res *Result, headerData *EmailHeaderData) error {
+	ctx, span := br.startSpan(ctx, "route-notification")
+	defer span.End()
+
+	res.Tier = br.routes.Classify(res.Rows)
+	headerData.Tier = res.Tier
+	tier := br.routes.tier(res.Tier)
+	if tier == nil {
+		span.Annotatef(nil, "The %q tier isn't routed", res.Tier)
+		return nil
+	}
+
+	var firstErr error
+	for _, channel := range tier.Channels {
+		var err error
+		switch channel {
+		case ChannelEmail:
+			err = br.sendEmail(ctx, subject, tmpl, res, headerData)
+		case ChannelDigest:
+			var to, digested []string
+			if to, digested, err = br.recipients(ctx, res.Tier); err == nil {
+				err = br.addToDigest(ctx, res, append(to, digested...))
+			}
+		case ChannelSlack:
+			err = br.postToSlack(ctx, res)
+		case ChannelPagerDuty:
+			err = br.triggerPagerDuty(ctx, res)
+		}
+		if err != nil {
+			span.Annotatef(nil, "Notifying on %s: %v", channel, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Notifying on %s: %v", channel, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// postJSON posts v as JSON to url, expecting a successful response.
+func (br *Request) postJSON(ctx context.Context, url string, v interface{}) error {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := br.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+func (br *Request) postToSlack(ctx context.Context, res *Result) error {
+	if br.SlackWebhookURL == "" {
+		return fmt.Errorf("no Slack webhook URL is configured")
+	}
+	return br.postJSON(ctx, br.SlackWebhookURL, map[string]string{"text": slackText(br.GitRepoURL, res)})
+}
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// triggerPagerDuty triggers an incident through PagerDuty's Events API,
+// deduplicated by the set of changes so that repeated runs with the same
+// regressions don't page again while it is open.
+func (br *Request) triggerPagerDuty(ctx context.Context, res *Result) error {
+	if br.PagerDutyRoutingKey == "" {
+		return fmt.Errorf("no PagerDuty routing key is configured")
+	}
+	data := newEmailHeaderData(br.GitRepoURL, res)
+	severity := map[string]string{TierInfo: "info", TierWarn: "warning", TierCritical: "critical"}[res.Tier]
+	event := map[string]interface{}{
+		"routing_key":  br.PagerDutyRoutingKey,
+		"event_action": "trigger",
+		"dedup_key":    br.GitRepoURL + "/" + fingerprint(res.Rows),
+		"payload": map[string]interface{}{
+			"summary":  fmt.Sprintf("Benchmarks for %s: %d regressions", br.GitRepoURL, data.Regressions),
+			"source":   br.GitRepoURL,
+			"severity": severity,
+			"custom_details": map[string]interface{}{
+				"tags":       res.Tags,
+				"run_at":     res.RunAt,
+				"benchmarks": res.Benchmarks,
+			},
+		},
+	}
+	if res.ReportURL != "" {
+		event["links"] = []map[string]string{{"href": res.ReportURL, "text": "Full report"}}
+	}
+	return br.postJSON(ctx, pagerDutyEventsURL, event)
+}
+
+const digestName = "notification-digest.json"
+
+// digest is what the runs routed to ChannelDigest
+// added since the digest was last sent.
+type digest struct {
+	To      []string       `json:"to"`
+	Entries []*DigestEntry `json:"entries"`
+}
+
+// DigestEntry is a run listed in a digest.
+type DigestEntry struct {
+	RunAt        string            `json:"run_at"`
+	Tier         string            `json:"tier"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	Regressions  int               `json:"regressions"`
+	Improvements int               `json:"improvements"`
+	ReportURL    string            `json:"report_url,omitempty"`
+}
+
+// addToDigest adds res to the digest of the repository, sent to recipients.
+func (br *Request) addToDigest(ctx context.Context, res *Result, recipients []string) error {
+	d := new(digest)
+	if blob, err := br.downloadBlob(ctx, digestName); err == nil {
+		_ = json.Unmarshal(blob, d)
+	}
+	for _, email := range recipients {
+		addGroup(&d.To, email)
+	}
+	data := newEmailHeaderData(br.GitRepoURL, res)
+	d.Entries = append(d.Entries, &DigestEntry{
+		RunAt:        res.RunAt,
+		Tier:         res.Tier,
+		Tags:         res.Tags,
+		Regressions:  data.Regressions,
+		Improvements: data.Improvements,
+		ReportURL:    res.ReportURL,
+	})
+	blob, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if _, err := br.uploadBlob(ctx, digestName, blob); err != nil {
+		return fmt.Errorf("Uploading the digest: %v", err)
+	}
+	return nil
+}
+
+// SendDigest emails the runs added to the repository's digest since it
+// was last sent, to their alert emails and the request's, then clears it.
+// It is meant to be invoked periodically e.g. daily, and returns the
+// entries that were sent, none if the digest was empty.
+func (br *Request) SendDigest(ctx context.Context) ([]*DigestEntry, error) {
+	ctx, span := br.startSpan(ctx, "send-digest")
+	defer span.End()
+
+	d := new(digest)
+	if blob, err := br.downloadBlob(ctx, digestName); err == nil {
+		if err := json.Unmarshal(blob, d); err != nil {
+			return nil, fmt.Errorf("Parsing the digest: %v", err)
+		}
+	}
+	if len(d.Entries) == 0 {
+		return nil, nil
+	}
+	for _, email := range br.AlertEmails {
+		addGroup(&d.To, email)
+	}
+	prefs, err := br.loadPreferences(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var to []string
+	for _, email := range d.To {
+		if rp, ok := prefs[normalizeEmail(email)]; !ok || rp.Delivery != DeliveryNone {
+			to = append(to, email)
+		}
+	}
+	if len(to) == 0 {
+		return nil, fmt.Errorf("no recipients for the digest of %d runs", len(d.Entries))
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%d runs of %s since the last digest:\n\n", len(d.Entries), br.GitRepoURL)
+	for _, entry := range d.Entries {
+		fmt.Fprintf(buf, "%s [%s] %d regressions, %d improvements", entry.RunAt, entry.Tier, entry.Regressions, entry.Improvements)
+		if ref := firstNonEmpty(entry.Tags["ref"], entry.Tags["branch"]); ref != "" {
+			fmt.Fprintf(buf, " on %s", ref)
+		}
+		buf.WriteString("\n")
+		if entry.ReportURL != "" {
+			fmt.Fprintf(buf, "  %s\n", entry.ReportURL)
+		}
+	}
+	email := postmark.Email{
+		From:     br.AppEmail,
+		Subject:  fmt.Sprintf("Benchmarks digest for %s", br.GitRepoURL),
+		TextBody: buf.String(),
+	}
+	if err := br.deliverTo(ctx, email, to); err != nil {
+		return nil, err
+	}
+
+	blob, err := json.Marshal(&digest{})
+	if err != nil {
+		return d.Entries, err
+	}
+	if _, err := br.uploadBlob(ctx, digestName, blob); err != nil {
+		return d.Entries, fmt.Errorf("Clearing the digest: %v", err)
+	}
+	return d.Entries, nil
+}
@@ -0,0 +1,380 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Run describes a single benchmarking run. It is stored
+// as JSON alongside the run's results so that runs can
+// later be listed and filtered without parsing results.
+type Run struct {
+	ID        string            `json:"id"`
+	Repo      string            `json:"repo"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	StartTime time.Time         `json:"start_time"`
+
+	// Status is RunStatusOK, blank for runs stored before statuses
+	// were, or RunStatusNoBenchmarks.
+	Status string `json:"status,omitempty"`
+
+	// GOOS and GOARCH are the platform on which the benchmarks ran.
+	GOOS   string `json:"goos,omitempty"`
+	GOARCH string `json:"goarch,omitempty"`
+
+	Packages []*PackageSummary `json:"packages,omitempty"`
+
+	Cost *RunCost `json:"cost,omitempty"`
+	// MachineMinutes is how long the run took, priced or not.
+	MachineMinutes float64 `json:"machine_minutes,omitempty"`
+	// SuiteSeconds is how long its benchmarks took, see SuiteDuration.
+	SuiteSeconds float64 `json:"suite_seconds,omitempty"`
+
+	// GOGC, GODEBUG and Seed are the runtime settings of the run, if set.
+	GOGC    string `json:"gogc,omitempty"`
+	GODEBUG string `json:"godebug,omitempty"`
+	Seed    string `json:"seed,omitempty"`
+
+	// VCS and Revision are how the benchmarked sources were checked out, if set.
+	VCS      string `json:"vcs,omitempty"`
+	Revision string `json:"revision,omitempty"`
+	// Commit is the commit or module version of the benchmarked sources,
+	// if they were those of an immutable revision.
+	Commit string `json:"commit,omitempty"`
+	// Harness is the name of the harness that ran the benchmarks, if recorded.
+	Harness string `json:"harness,omitempty"`
+
+	// Environment fingerprints the machine, toolchain and settings of
+	// the run, for runs stored since they were recorded.
+	Environment *Environment `json:"environment,omitempty"`
+
+	// Snapshot is the archived workspace of the run, if it was archived.
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+
+	// BaselineRunID is the run it was compared against, if
+	// Request.BaselineRunID chose one rather than "latest".
+	BaselineRunID string `json:"baseline_run_id,omitempty"`
+	// PullRequest is the number of the pull request whose push
+	// the run benchmarked, if Request.PullRequest was set.
+	PullRequest int `json:"pull_request,omitempty"`
+	// Partial is set if the results lack those of packages that failed.
+	Partial bool `json:"partial,omitempty"`
+	// Submitted is set if the run was submitted with a submission token.
+	Submitted bool `json:"submitted,omitempty"`
+
+	// Imported is the file from which the run was imported, if it
+	// was a historical run imported with ImportRuns.
+	Imported string `json:"imported,omitempty"`
+
+	// Deleted is set if the run was soft-deleted.
+	Deleted *Deletion `json:"deleted,omitempty"`
+
+	// Compacted if set, is the week e.g. "2018-W41" into whose summary
+	// the run's results were rolled, after which only its metadata is kept.
+	Compacted string `json:"compacted,omitempty"`
+}
+
+// The statuses of runs.
+const (
+	// RunStatusOK is the status of the runs whose results were stored.
+	RunStatusOK = "ok"
+	// RunStatusNoBenchmarks is the status of the runs that found no
+	// benchmarks, e.g. of a repository that removed them all, which
+	// only have their metadata stored.
+	RunStatusNoBenchmarks = "no-benchmarks"
+)
+
+// hasResults reports whether the run's results are stored,
+// unless it found none or they were compacted.
+func (run *Run) hasResults() bool {
+	return run.Status != RunStatusNoBenchmarks && run.Compacted == ""
+}
+
+// replacedBaseline reports whether the run's results replaced the
+// baseline when it ran, as Request.replacesBaseline decides, hence
+// may be its baseline again e.g. once the run after it is deleted.
+func (run *Run) replacedBaseline() bool {
+	return run.hasResults() && !run.Partial && run.BaselineRunID == "" && run.PullRequest == 0 && !run.Submitted
+}
+
+// noResultsError explains why the run, which has no results, can't be used.
+func (run *Run) noResultsError() error {
+	if run.Status == RunStatusNoBenchmarks {
+		return fmt.Errorf("run %q found no benchmarks and has no results", run.ID)
+	}
+	return fmt.Errorf("run %q was compacted into %s and has no results left", run.ID, run.Compacted)
+}
+
+const runMetaSuffix = "-meta.json"
+
+// tagKeyRe matches the keys allowed in benchfmt configuration
+// lines, which is how tags are embedded into stored results.
+var tagKeyRe = regexp.MustCompile(`^[a-z][^\sA-Z:]*$`)
+
+func validateTags(tags map[string]string) error {
+	for key, value := range tags {
+		if !tagKeyRe.MatchString(key) {
+			return fmt.Errorf("invalid tag key %q: must begin with a lowercase letter and contain no spaces, colons or uppercase letters", key)
+		}
+		if key == platformTag {
+			return fmt.Errorf("invalid tag key %q: reserved for the baselines of platforms", key)
+		}
+		if bytes.ContainsAny([]byte(value), "\r\n") {
+			return fmt.Errorf("invalid value for tag %q: must not contain newlines", key)
+		}
+	}
+	return nil
+}
+
+// tagsHeader renders tags as benchfmt configuration lines, so that
+// benchstat attaches them as labels to every benchmark that follows.
+func tagsHeader(tags map[string]string) []byte {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buf := new(bytes.Buffer)
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%s: %s\n", key, tags[key])
+	}
+	return buf.Bytes()
+}
+
+func (br *Request) uploadRunMeta(ctx context.Context, run *Run) (string, error) {
+	ctx, span := br.startSpan(ctx, "upload-run-meta")
+	defer span.End()
+
+	blob, err := json.Marshal(run)
+	if err != nil {
+		return "", err
+	}
+	return br.uploadBlob(ctx, run.ID+runMetaSuffix, blob)
+}
+
+// Deletion records that a run was soft-deleted, e.g. because it ran
+// alongside a backup job, excluding it from listings, histories and
+// baselines until it is restored.
+type Deletion struct {
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// DeleteRun soft-deletes the run with runID. If its results are the
+// baseline, the most recent run that wasn't deleted becomes the baseline.
+func (br *Request) DeleteRun(ctx context.Context, runID, reason string) error {
+	ctx, span := br.startSpan(ctx, "delete-run")
+	defer span.End()
+
+	return br.setDeletion(ctx, runID, &Deletion{At: br.now(), Reason: reason})
+}
+
+// RestoreRun restores the soft-deleted run with runID, making its
+// results the baseline again if it is the most recent run.
+func (br *Request) RestoreRun(ctx context.Context, runID string) error {
+	ctx, span := br.startSpan(ctx, "restore-run")
+	defer span.End()
+
+	return br.setDeletion(ctx, runID, nil)
+}
+
+// PromoteRun makes the results of the stored run with runID the baseline,
+// "latest", that of its platform and "latest@<key>=<value>" for each of
+// its tags, e.g. to
+// compare against a known good run after an accepted regression.
+func (br *Request) PromoteRun(ctx context.Context, runID string) error {
+	ctx, span := br.startSpan(ctx, "promote-run")
+	defer span.End()
+
+	blob, err := br.downloadBlob(ctx, runID+runMetaSuffix)
+	if err != nil {
+		return fmt.Errorf("Retrieving metadata of run %q: %v", runID, err)
+	}
+	run := new(Run)
+	if err := json.Unmarshal(blob, run); err != nil {
+		return fmt.Errorf("Parsing metadata of run %q: %v", runID, err)
+	}
+	switch {
+	case run.Deleted != nil:
+		return fmt.Errorf("run %q was deleted, restore it first", runID)
+	case !run.hasResults():
+		return run.noResultsError()
+	}
+
+	for _, path := range run.baselines() {
+		if _, err := br.promoteAs(ctx, run.ID, run.ID, path, anyGeneration); err != nil {
+			return fmt.Errorf("Promoting run %q to %q: %v", runID, path, err)
+		}
+	}
+	return nil
+}
+
+// baselineRunResults returns the results of the run Request.BaselineRunID.
+func (br *Request) baselineRunResults(ctx context.Context) ([]byte, error) {
+	runID := br.BaselineRunID
+	if strings.Contains(runID, "..") || strings.Contains(runID, "/") {
+		return nil, fmt.Errorf("invalid baseline run %q", runID)
+	}
+	blob, err := br.downloadBlob(ctx, runID+runMetaSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving metadata of baseline run %q: %v", runID, err)
+	}
+	run := new(Run)
+	if err := json.Unmarshal(blob, run); err != nil {
+		return nil, fmt.Errorf("Parsing metadata of baseline run %q: %v", runID, err)
+	}
+	switch {
+	case run.Deleted != nil:
+		return nil, fmt.Errorf("baseline run %q was deleted, restore it first", runID)
+	case !run.hasResults():
+		return nil, run.noResultsError()
+	}
+	results, err := br.downloadBlob(ctx, runID)
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving results of baseline run %q: %v", runID, err)
+	}
+	return results, nil
+}
+
+func (br *Request) setDeletion(ctx context.Context, runID string, deletion *Deletion) error {
+	if br.StorageService == nil {
+		return ErrNoStorageService
+	}
+	blob, err := br.downloadBlob(ctx, runID+runMetaSuffix)
+	if err != nil {
+		return fmt.Errorf("Retrieving metadata of run %q: %v", runID, err)
+	}
+	run := new(Run)
+	if err := json.Unmarshal(blob, run); err != nil {
+		return fmt.Errorf("Parsing metadata of run %q: %v", runID, err)
+	}
+	run.Deleted = deletion
+	if _, err := br.uploadRunMeta(ctx, run); err != nil {
+		return fmt.Errorf("Uploading metadata of run %q: %v", runID, err)
+	}
+	return br.reconcileBaselines(ctx, run)
+}
+
+// reconcileBaselines updates the baselines of the run, which was just
+// deleted or restored, from the run IDs they record: a baseline holding
+// the deleted run's results then holds those of the most recent run
+// before it, and one holding those of the run that the restored run
+// was deleted in favor of holds the restored run's again. Any other
+// baseline, e.g. one that was edited or promoted to since, is left alone,
+// as are those of which every run was deleted.
+func (br *Request) reconcileBaselines(ctx context.Context, run *Run) error {
+	ctx, span := br.startSpan(ctx, "reconcile-baselines")
+	defer span.End()
+
+	if run.Deleted == nil && !run.replacedBaseline() {
+		return nil
+	}
+	latest, err := br.latestRuns(ctx, run.Tags, run.ID)
+	if err != nil {
+		return err
+	}
+	for _, path := range run.baselines() {
+		held, generation, err := br.baselineHolder(ctx, path)
+		if err != nil {
+			return err
+		}
+		prev := latest[path]
+		switch {
+		case run.Deleted != nil:
+			if generation == 0 || held != run.ID || prev == nil {
+				continue
+			}
+			if _, err := br.promoteAs(ctx, prev.ID, prev.ID, path, generation); err != nil {
+				return fmt.Errorf("Restoring baseline %q from run %q: %v", path, prev.ID, err)
+			}
+		case prev != nil && !run.StartTime.After(prev.StartTime):
+			// A more recent run replaced the baseline since.
+		case generation == 0 || (prev != nil && held == prev.ID):
+			// Generation 0 guards against another run having created it meanwhile.
+			if _, err := br.promoteAs(ctx, run.ID, run.ID, path, generation); err != nil {
+				return fmt.Errorf("Restoring baseline %q from run %q: %v", path, run.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// baselines returns the names of the baselines that the results of the
+// run replace: "latest", that of its platform and "latest@<key>=<value>"
+// for each of its tags.
+func (run *Run) baselines() []string {
+	paths := []string{"latest"}
+	if run.GOOS != "" {
+		paths = append(paths, platformBaseline(run.GOOS, run.GOARCH))
+	}
+	for key, value := range run.Tags {
+		paths = append(paths, latestForTag(key, value))
+	}
+	return paths
+}
+
+// latestRuns returns the most recent run, but for the one with excludedID,
+// that wasn't deleted and replaced the baseline when it ran, of "latest",
+// of every platform's baseline and of "latest@<key>=<value>" for each of tags.
+func (br *Request) latestRuns(ctx context.Context, tags map[string]string, excludedID string) (map[string]*Run, error) {
+	latest := make(map[string]*Run)
+	rf := &RunFilter{PageSize: math.MaxInt32}
+	_, err := br.WalkRuns(ctx, rf, func(run *Run) error {
+		// Runs are walked oldest first. Compacted runs and those without
+		// benchmarks have no results to promote, while partial runs and
+		// those of pull requests or against a chosen run never replaced it.
+		if !run.replacedBaseline() || run.ID == excludedID {
+			return nil
+		}
+		latest["latest"] = run
+		if run.GOOS != "" {
+			latest[platformBaseline(run.GOOS, run.GOARCH)] = run
+		}
+		for key, value := range tags {
+			if run.Tags[key] == value {
+				latest[latestForTag(key, value)] = run
+			}
+		}
+		return nil
+	})
+	return latest, err
+}
+
+// baselineHolder returns the ID of the run whose results the named
+// baseline holds, as recorded in its metadata, blank if none e.g. once
+// edited, and its generation, 0 if it doesn't exist.
+func (br *Request) baselineHolder(ctx context.Context, name string) (string, int64, error) {
+	obj, err := br.StorageService.Objects.Get(br.GCSBucket, br.inBenchmarksDir(name)).Context(ctx).Do()
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusNotFound {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("Retrieving baseline %q: %v", name, err)
+	}
+	return obj.Metadata[MetadataRunID], obj.Generation, nil
+}
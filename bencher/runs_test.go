@@ -0,0 +1,80 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDeleteAndRestoreTheBaselinesRun(t *testing.T) {
+	es, _ := openTestStore(t)
+	ctx := context.Background()
+	br := &Request{GitRepoURL: "example.com/tm", GCSBucket: "bencher", StorageService: es.Service()}
+	runs := storeTestRuns(t, br, 2)
+	if err := br.PromoteRun(ctx, runs[1].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := br.DeleteRun(ctx, runs[1].ID, "backup"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"latest", br.baselineName()} {
+		if got := heldRun(t, br, name); got != runs[0].ID {
+			t.Errorf("once the run it held is deleted, %s holds run %q, want %q", name, got, runs[0].ID)
+		}
+	}
+	if err := br.RestoreRun(ctx, runs[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"latest", br.baselineName()} {
+		if got := heldRun(t, br, name); got != runs[1].ID {
+			t.Errorf("once the run it held is restored, %s holds run %q, want %q", name, got, runs[1].ID)
+		}
+	}
+}
+
+func TestDeleteRunKeepsEditedBaselines(t *testing.T) {
+	es, _ := openTestStore(t)
+	ctx := context.Background()
+	br := &Request{GitRepoURL: "example.com/tm", GCSBucket: "bencher", StorageService: es.Service()}
+	runs := storeTestRuns(t, br, 2)
+	if err := br.PromoteRun(ctx, runs[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	edited := []byte("BenchmarkSum \t 1000\t 42 ns/op\n")
+	if _, err := br.ReplaceBaseline(ctx, "", edited); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, run := range runs {
+		if err := br.DeleteRun(ctx, run.ID, "backup"); err != nil {
+			t.Fatal(err)
+		}
+		if err := br.RestoreRun(ctx, run.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blob, err := br.downloadBlob(ctx, br.baselineName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(blob) != string(edited) {
+		t.Fatalf("deleting and restoring runs changed the edited baseline to %q", blob)
+	}
+	if got := heldRun(t, br, "latest"); got != runs[1].ID {
+		t.Fatalf("latest holds run %q, want %q", got, runs[1].ID)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"go.opencensus.io/trace"
+)
+
+// ParseSampler parses a trace sampler: "always", "never" or
+// the probability of sampling a trace, e.g. "0.01".
+func ParseSampler(s string) (trace.Sampler, error) {
+	switch s {
+	case "always":
+		return trace.AlwaysSample(), nil
+	case "never":
+		return trace.NeverSample(), nil
+	}
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil || p < 0 || p > 1 {
+		return nil, fmt.Errorf("invalid sampler %q, expecting \"always\", \"never\" or a probability in [0, 1]", s)
+	}
+	return trace.ProbabilitySampler(p), nil
+}
+
+// startSpan starts the span of the request's operation op, named and
+// attributed by its SpanConvention, which begins a trace sampled by
+// TraceSampler if ctx carries no span yet. Spans within a trace
+// otherwise follow its sampling decision.
+func (br *Request) startSpan(ctx context.Context, op string) (context.Context, *trace.Span) {
+	ctx = context.WithValue(ctx, spanRequestKey{}, br)
+	conv := br.SpanConvention
+	if conv == nil {
+		conv = DefaultSpanConvention
+	}
+	service := br.ServiceName
+	if service == "" {
+		service = DefaultServiceName
+	}
+	var span *trace.Span
+	if br.TraceSampler != nil && trace.FromContext(ctx) == nil {
+		ctx, span = trace.StartSpan(ctx, conv.SpanName(service, op), trace.WithSampler(br.TraceSampler))
+	} else {
+		ctx, span = trace.StartSpan(ctx, conv.SpanName(service, op))
+	}
+	if span.IsRecordingEvents() {
+		span.AddAttributes(conv.SpanAttributes(service, br)...)
+	}
+	return ctx, span
+}
+
+type spanRequestKey struct{}
+
+// startSpan starts the span of op as a request's startSpan does, that
+// of the request whose span ctx descends from, for functions without one.
+func startSpan(ctx context.Context, op string) (context.Context, *trace.Span) {
+	br, _ := ctx.Value(spanRequestKey{}).(*Request)
+	if br == nil {
+		br = new(Request)
+	}
+	return br.startSpan(ctx, op)
+}
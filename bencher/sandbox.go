@@ -0,0 +1,89 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// jail is the private directory tree of an unprivileged user in which
+// the benchmarked code runs, away from the server's home and files.
+type jail struct {
+	dir  string
+	user *sandboxUser
+}
+
+// enterJail creates a jail for the user named RunAs, if set, in which
+// the go commands of the request then run until the returned function
+// removes it.
+func (br *Request) enterJail() (func(), error) {
+	if br.RunAs == "" {
+		return func() {}, nil
+	}
+	su, err := lookupSandboxUser(br.RunAs)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "bencher-jail")
+	if err != nil {
+		return nil, err
+	}
+	j := &jail{dir: dir, user: su}
+	for _, sub := range []string{"", "home", "gopath", "cache", "tmp"} {
+		path := filepath.Join(dir, sub)
+		if err := os.MkdirAll(path, 0700); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		if err := su.chown(path); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+	br.jail = j
+	return func() {
+		br.jail = nil
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// confine makes cmd run as the jail's user with the jail's directories.
+// Modules are downloaded into the jail's GOPATH, while the server's is
+// kept last for the benchmarked sources, which must be readable by the user.
+func (j *jail) confine(cmd *exec.Cmd) {
+	cmd.Env = append(cmd.Env,
+		"HOME="+filepath.Join(j.dir, "home"),
+		"GOPATH="+filepath.Join(j.dir, "gopath")+string(filepath.ListSeparator)+build.Default.GOPATH,
+		"GOCACHE="+filepath.Join(j.dir, "cache"),
+		"TMPDIR="+filepath.Join(j.dir, "tmp"),
+	)
+	j.user.apply(cmd)
+}
+
+// tempDir creates a temporary directory writable by the go commands.
+func (br *Request) tempDir(prefix string) (string, error) {
+	if br.jail == nil {
+		return ioutil.TempDir("", prefix)
+	}
+	dir, err := ioutil.TempDir(filepath.Join(br.jail.dir, "tmp"), prefix)
+	if err != nil {
+		return "", err
+	}
+	return dir, br.jail.user.chown(dir)
+}
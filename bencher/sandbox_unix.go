@@ -0,0 +1,67 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package bencher
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+type sandboxUser struct {
+	uid, gid uint32
+}
+
+func lookupSandboxUser(name string) (*sandboxUser, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid %q of user %q: %v", u.Uid, name, err)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid %q of user %q: %v", u.Gid, name, err)
+	}
+	if uid == 0 {
+		return nil, fmt.Errorf("refusing to run benchmarks as %q, a superuser", name)
+	}
+	return &sandboxUser{uid: uint32(uid), gid: uint32(gid)}, nil
+}
+
+func (su *sandboxUser) chown(path string) error {
+	return os.Chown(path, int(su.uid), int(su.gid))
+}
+
+// apply makes cmd run as the user, without the server's
+// supplementary groups, which requires the server to be root.
+func (su *sandboxUser) apply(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    su.uid,
+		Gid:    su.gid,
+		Groups: []uint32{},
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package bencher
+
+import (
+	"errors"
+	"os/exec"
+)
+
+type sandboxUser struct{}
+
+func lookupSandboxUser(name string) (*sandboxUser, error) {
+	return nil, errors.New("running benchmarks as another user is not supported on Windows")
+}
+
+func (su *sandboxUser) chown(path string) error { return nil }
+
+func (su *sandboxUser) apply(cmd *exec.Cmd) {}
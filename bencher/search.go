@@ -0,0 +1,153 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const latestSuffix = "/benchmarks/latest"
+
+// SearchHit is a benchmark found in a repository's latest results.
+type SearchHit struct {
+	Repo string `json:"repo"`
+	// Benchmark is named as benchstat reports it e.g. "StartSpan-8".
+	Benchmark string    `json:"benchmark"`
+	GOARCH    string    `json:"goarch,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Means maps units e.g. "ns/op" to the mean of the latest samples.
+	Means map[string]float64 `json:"means"`
+}
+
+// RepoInfo is a repository with stored results.
+type RepoInfo struct {
+	Repo string `json:"repo"`
+	// UpdatedAt is when its baseline was last replaced.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ListRepos returns the repositories with a baseline in the bucket, in
+// lexical order. The request's GitRepoURL is ignored.
+func (br *Request) ListRepos(ctx context.Context) ([]*RepoInfo, error) {
+	ctx, span := br.startSpan(ctx, "list-repos")
+	defer span.End()
+
+	if br.StorageService == nil {
+		return nil, ErrNoStorageService
+	}
+	var repos []*RepoInfo
+	pageToken := ""
+	for {
+		call := br.StorageService.Objects.List(br.GCSBucket).
+			Fields("items(name,updated)", "nextPageToken").Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		objs, err := call.Do()
+		if err != nil {
+			return nil, fmt.Errorf("Listing baselines: %v", err)
+		}
+		for _, obj := range objs.Items {
+			if !strings.HasSuffix(obj.Name, latestSuffix) {
+				continue
+			}
+			ri := &RepoInfo{Repo: strings.TrimSuffix(obj.Name, latestSuffix)}
+			ri.UpdatedAt, _ = time.Parse(time.RFC3339, obj.Updated)
+			repos = append(repos, ri)
+		}
+		if pageToken = objs.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].Repo < repos[j].Repo
+	})
+	return repos, nil
+}
+
+// SearchBenchmark finds the benchmark, named with or without its
+// "Benchmark" prefix and GOMAXPROCS suffix e.g. "BenchmarkStartSpan", in
+// the latest results of every repository in the bucket, to answer
+// questions such as what span creation costs across all services.
+// The request's GitRepoURL is ignored.
+func (br *Request) SearchBenchmark(ctx context.Context, name string) ([]*SearchHit, error) {
+	ctx, span := br.startSpan(ctx, "search-benchmark")
+	defer span.End()
+
+	if br.StorageService == nil {
+		return nil, ErrNoStorageService
+	}
+	name = strings.TrimPrefix(name, "Benchmark")
+	if name == "" {
+		return nil, fmt.Errorf("expecting a non-blank benchmark name")
+	}
+
+	// 1. Find every repository's baseline.
+	repos, err := br.ListRepos(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Average the benchmark's samples in each of them, by architecture.
+	var hits []*SearchHit
+	for _, repo := range repos {
+		rbr := &Request{
+			GitRepoURL:     repo.Repo,
+			GCSBucket:      br.GCSBucket,
+			InfraClient:    br.InfraClient,
+			StorageService: br.StorageService,
+			EncryptionKey:  br.EncryptionKey,
+		}
+		blob, err := rbr.downloadBlob(ctx, "latest")
+		if err != nil {
+			return nil, fmt.Errorf("Retrieving the latest results of %s: %v", repo.Repo, err)
+		}
+
+		byKey := make(map[string]*SearchHit)
+		counts := make(map[string]map[string]int)
+		var keys []string
+		for _, res := range parseResults(blob) {
+			if res.Name != name && gomaxprocsSuffixRe.ReplaceAllString(res.Name, "") != name {
+				continue
+			}
+			arch := res.Labels["goarch"]
+			key := res.Name + "\x00" + arch
+			hit, ok := byKey[key]
+			if !ok {
+				hit = &SearchHit{Repo: repo.Repo, Benchmark: res.Name, GOARCH: arch, UpdatedAt: repo.UpdatedAt, Means: make(map[string]float64)}
+				byKey[key] = hit
+				counts[key] = make(map[string]int)
+				keys = append(keys, key)
+			}
+			for unit, value := range res.Values {
+				hit.Means[unit] += value
+				counts[key][unit]++
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			hit := byKey[key]
+			for unit := range hit.Means {
+				hit.Means[unit] /= float64(counts[key][unit])
+			}
+			hits = append(hits, hit)
+		}
+	}
+	return hits, nil
+}
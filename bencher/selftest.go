@@ -0,0 +1,198 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/keighl/postmark"
+)
+
+// CanaryRepo is the repository benchmarked by SelfTest. Its sources
+// aren't checked out but written by the VCSCanary VCS.
+const CanaryRepo = "bencher.canary/selftest"
+
+// VCSCanary writes the sources of CanaryRepo into a temporary directory.
+const VCSCanary = "canary"
+
+// canarySources are the files of CanaryRepo, whose benchmarks
+// are quick and stable enough not to change between runs.
+var canarySources = map[string]string{
+	"go.mod": "module " + CanaryRepo + "\n\ngo 1.11\n",
+	"canary.go": `// Package selftest is benchmarked by the bencher's self-test.
+package selftest
+
+// Sum returns the sum of values.
+func Sum(values []int) int {
+	sum := 0
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+`,
+	"canary_test.go": `package selftest
+
+import "testing"
+
+func BenchmarkCanarySum(b *testing.B) {
+	values := make([]int, 1024)
+	for i := range values {
+		values[i] = i
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Sum(values)
+	}
+}
+
+var sink []byte
+
+func BenchmarkCanaryAlloc(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sink = make([]byte, 64)
+	}
+}
+`,
+}
+
+func canaryCheckout(ctx context.Context, co *Checkout) (string, func(), error) {
+	if co.Repo != CanaryRepo {
+		return "", nil, fmt.Errorf("the %q VCS only checks out %q", VCSCanary, CanaryRepo)
+	}
+	tmp, err := ioutil.TempDir("", "bencher-canary-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tmp) }
+	// The user of a jail must be able to read the sources.
+	if err := os.Chmod(tmp, 0755); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	for name, src := range canarySources {
+		if err := ioutil.WriteFile(filepath.Join(tmp, name), []byte(src), 0644); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+	return tmp, cleanup, nil
+}
+
+// SelfTestReport is the outcome of a SelfTest, step by step.
+type SelfTestReport struct {
+	StartTime time.Time       `json:"start_time"`
+	Passed    bool            `json:"passed"`
+	Steps     []*SelfTestStep `json:"steps"`
+}
+
+// SelfTestStep is a step of the pipeline exercised by a SelfTest.
+type SelfTestStep struct {
+	Name string `json:"name"`
+	// Elapsed is the step's duration in seconds.
+	Elapsed float64 `json:"elapsed"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// SelfTest runs the whole pipeline end to end on CanaryRepo, in place of
+// the request's repository: it benchmarks the canary, stores and compares
+// its results, reads them back, and notifies the alert emails e.g. a test
+// channel, stopping at the first broken step. If it fails, operators, if
+// any, are alerted, since the pipeline otherwise breaks unnoticed until
+// users stop receiving reports.
+func (br *Request) SelfTest(ctx context.Context, operators []string) (*SelfTestReport, error) {
+	ctx, span := br.startSpan(ctx, "self-test")
+	defer span.End()
+
+	br.GitRepoURL, br.VCS, br.Revision = CanaryRepo, VCSCanary, ""
+	report := &SelfTestReport{StartTime: time.Now(), Passed: true}
+	step := func(name string, fn func() error) {
+		if !report.Passed {
+			return
+		}
+		start := time.Now()
+		err := fn()
+		st := &SelfTestStep{Name: name, Elapsed: time.Since(start).Seconds()}
+		if err != nil {
+			st.Error, report.Passed = err.Error(), false
+			span.Annotatef(nil, "Self-test step %q failed: %v", name, err)
+		}
+		report.Steps = append(report.Steps, st)
+	}
+
+	step("run", func() error {
+		_, err := br.Benchmark(ctx)
+		if err == ErrNoChanges {
+			return nil
+		}
+		return err
+	})
+	var stored []byte
+	step("store", func() error {
+		var err error
+		if stored, err = br.downloadBlob(ctx, "latest"); err != nil {
+			return err
+		}
+		if !bytes.Contains(stored, []byte("BenchmarkCanarySum")) {
+			return fmt.Errorf("the stored results lack the canary's benchmarks")
+		}
+		return nil
+	})
+	step("compare", func() error {
+		changed, err := br.compare(ctx, stored, stored, br.splitBy())
+		if err != nil {
+			return err
+		}
+		if len(changed) > 0 {
+			return fmt.Errorf("comparing the stored results against themselves found %d changed tables", len(changed))
+		}
+		return nil
+	})
+	if len(br.AlertEmails) > 0 {
+		step("notify", func() error { return br.SendTestNotification(ctx) })
+	}
+
+	if report.Passed || len(operators) == 0 {
+		return report, nil
+	}
+	body := new(bytes.Buffer)
+	fmt.Fprintf(body, "The bencher's self-test, started at %s, failed:\n\n", report.StartTime.Format(time.RFC1123))
+	for _, st := range report.Steps {
+		status := "ok"
+		if st.Error != "" {
+			status = "FAILED: " + st.Error
+		}
+		fmt.Fprintf(body, "%-8s %6.1fs  %s\n", st.Name, st.Elapsed, status)
+	}
+	fmt.Fprintf(body, "\nRuns and notifications of other repositories are likely failing too.\n")
+	email := postmark.Email{
+		From:     br.AppEmail,
+		To:       strings.Join(operators, ","),
+		Subject:  "Bencher self-test failed",
+		TextBody: body.String(),
+	}
+	if err := br.deliver(ctx, email); err != nil {
+		return report, fmt.Errorf("Alerting operators of the failed self-test: %v", err)
+	}
+	return report, nil
+}
@@ -0,0 +1,226 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keighl/postmark"
+	"google.golang.org/api/storage/v1"
+)
+
+// Service embeds the benchmarking pipeline in another Go program. Its
+// options inject the store, mailer, runner, comparer and clock of the
+// requests it creates, e.g. fakes in tests, in place of the defaults and
+// of the registries that the names in a Request select from.
+type Service struct {
+	storageService *storage.Service
+	bucket         string
+	project        string
+
+	mailer   Mailer
+	runner   Harness
+	comparer Comparer
+	clock    Clock
+	ids      IDGenerator
+
+	errorReporter ErrorReporter
+}
+
+// ServiceOption configures a Service.
+type ServiceOption func(*Service)
+
+// NewService returns a Service configured by opts.
+func NewService(opts ...ServiceOption) *Service {
+	s := new(Service)
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithStore stores results in bucket, of project, through ss e.g. a client
+// of a fake GCS server created with option.WithEndpoint.
+func WithStore(ss *storage.Service, bucket, project string) ServiceOption {
+	return func(s *Service) {
+		s.storageService, s.bucket, s.project = ss, bucket, project
+	}
+}
+
+// WithMailer sends notifications with m instead of Postmark.
+func WithMailer(m Mailer) ServiceOption {
+	return func(s *Service) { s.mailer = m }
+}
+
+// WithRunner runs the benchmarks with h whatever the requested harness,
+// or the target repository's harness file, is.
+func WithRunner(h Harness) ServiceOption {
+	return func(s *Service) { s.runner = h }
+}
+
+// WithComparer compares results with c whatever Request.Comparer is.
+func WithComparer(c Comparer) ServiceOption {
+	return func(s *Service) { s.comparer = c }
+}
+
+// WithClock tells the time with c, e.g. a fixed time in tests, for the
+// start times and storage keys of runs, and the timestamps of reports,
+// notifications and the state stored alongside results.
+func WithClock(c Clock) ServiceOption {
+	return func(s *Service) { s.clock = c }
+}
+
+// WithIDGenerator names runs and dead letters with g, e.g.
+// sequentially in tests, instead of by the time.
+func WithIDGenerator(g IDGenerator) ServiceOption {
+	return func(s *Service) { s.ids = g }
+}
+
+// WithErrorReporter reports the runs that fail to er.
+func WithErrorReporter(er ErrorReporter) ServiceOption {
+	return func(s *Service) { s.errorReporter = er }
+}
+
+// NewRequest returns a request for repo bound to the service, for the
+// caller to configure further e.g. with its AlertEmails and Tags.
+func (s *Service) NewRequest(repo string) *Request {
+	br := &Request{GitRepoURL: repo}
+	s.bind(br)
+	return br
+}
+
+// BenchmarkAndEmail runs the whole pipeline for br, as
+// Request.BenchmarkAndEmail does, bound to the service.
+func (s *Service) BenchmarkAndEmail(ctx context.Context, br *Request) (interface{}, error) {
+	s.bind(br)
+	return br.BenchmarkAndEmail(ctx)
+}
+
+// Benchmark benchmarks br without notifying, as Request.Benchmark
+// does, bound to the service.
+func (s *Service) Benchmark(ctx context.Context, br *Request) (interface{}, error) {
+	s.bind(br)
+	return br.Benchmark(ctx)
+}
+
+// bind injects the service's dependencies into br,
+// leaving the fields that the service doesn't set.
+func (s *Service) bind(br *Request) {
+	if s.storageService != nil {
+		br.StorageService, br.GCSBucket, br.GCSProject = s.storageService, s.bucket, s.project
+	}
+	br.mailer, br.runner, br.customComparer = s.mailer, s.runner, s.comparer
+	br.clock, br.idGenerator = s.clock, s.ids
+	if s.errorReporter != nil {
+		br.ErrorReporter = s.errorReporter
+	}
+}
+
+// Mailer sends notification emails.
+type Mailer interface {
+	SendEmail(ctx context.Context, email postmark.Email) error
+}
+
+// MailerFunc adapts a function to a Mailer.
+type MailerFunc func(ctx context.Context, email postmark.Email) error
+
+func (mf MailerFunc) SendEmail(ctx context.Context, email postmark.Email) error {
+	return mf(ctx, email)
+}
+
+// Clock tells the time.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function to a Clock e.g. ClockFunc(time.Now).
+type ClockFunc func() time.Time
+
+func (cf ClockFunc) Now() time.Time {
+	return cf()
+}
+
+// IDGenerator names what is stored by ID.
+type IDGenerator interface {
+	// RunID returns the ID of a run started at t, the prefix of its
+	// stored objects, which must sort as the start times of runs do.
+	RunID(t time.Time) string
+	// NewID returns a unique ID e.g. of a dead letter.
+	NewID() string
+}
+
+// timeIDs is the default IDGenerator, naming runs by their start
+// time e.g. "2018-05-03/2018-05-03T14:05:06Z" and other objects
+// by the nanoseconds since the epoch.
+type timeIDs struct{}
+
+func (timeIDs) RunID(t time.Time) string {
+	return datedPrefix(t)
+}
+
+func (timeIDs) NewID() string {
+	return fmt.Sprintf("%d", time.Now().UnixNano())
+}
+
+// SequentialIDs is an IDGenerator for tests, whose IDs are the start
+// time of runs as by default, and a counter for other objects e.g.
+// "000001", so that the storage keys of a test are the same every time.
+type SequentialIDs struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (si *SequentialIDs) RunID(t time.Time) string {
+	return datedPrefix(t)
+}
+
+func (si *SequentialIDs) NewID() string {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	si.n++
+	return fmt.Sprintf("%06d", si.n)
+}
+
+// sendMail sends email with the request's mailer, by default Postmark.
+func (br *Request) sendMail(ctx context.Context, email postmark.Email) error {
+	if err := br.Faults.delayEmail(ctx); err != nil {
+		return err
+	}
+	if br.mailer != nil {
+		return br.mailer.SendEmail(ctx, email)
+	}
+	_, err := br.postmarkClient().SendEmail(email)
+	return err
+}
+
+// ids returns the request's IDGenerator, by default naming by the time.
+func (br *Request) ids() IDGenerator {
+	if br.idGenerator != nil {
+		return br.idGenerator
+	}
+	return timeIDs{}
+}
+
+// now returns the time with the request's clock, by default the system's.
+func (br *Request) now() time.Time {
+	if br.clock != nil {
+		return br.clock.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,140 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// ShadowComparison is how a shadow comparer, run alongside the comparer
+// of a comparison, would have judged it differently. It is recorded
+// and traced but never alerted about, so that a new comparer can be
+// evaluated on real runs before it replaces the current one.
+type ShadowComparison struct {
+	Comparer string
+	// Added are the metrics e.g. "ExportSpan-8 time/op" that only the shadow
+	// comparer deemed changed, and Missed those that only the comparer did.
+	Added  []string `json:",omitempty"`
+	Missed []string `json:",omitempty"`
+	// Severity is the policy's verdict on the shadow comparer's changes,
+	// if there is a policy.
+	Severity string `json:",omitempty"`
+	// Disagrees is set if the changes or the verdicts differ.
+	Disagrees bool
+	// Error if set, is why the shadow comparer failed.
+	Error string `json:",omitempty"`
+}
+
+var (
+	keyComparer = tag.MustNewKey("comparer")
+	keyOutcome  = tag.MustNewKey("outcome")
+
+	mShadowComparisons = stats.Int64("bencher/shadow_comparisons", "The comparisons made by shadow comparers", stats.UnitDimensionless)
+)
+
+// ShadowComparisonsView counts the comparisons of shadow comparers by
+// comparer and outcome: "agree", "disagree" or "error".
+var ShadowComparisonsView = &view.View{
+	Name:        "bencher/shadow_comparisons",
+	Description: "The comparisons made by shadow comparers, by comparer and outcome",
+	Measure:     mShadowComparisons,
+	TagKeys:     []tag.Key{keyComparer, keyOutcome},
+	Aggregation: view.Count(),
+}
+
+// shadowCompare compares the results of res anew with br.ShadowComparer,
+// recording in res.Shadow how its changes and verdict differ.
+func (br *Request) shadowCompare(ctx context.Context, res *Result) {
+	if br.ShadowComparer == "" || res.before == nil {
+		return
+	}
+	ctx, span := br.startSpan(ctx, "shadow-compare")
+	defer span.End()
+
+	sc := &ShadowComparison{Comparer: br.ShadowComparer}
+	res.Shadow = sc
+	outcome := "agree"
+	defer func() {
+		_ = stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(keyComparer, sc.Comparer), tag.Upsert(keyOutcome, outcome)}, mShadowComparisons.M(1))
+	}()
+
+	rows, err := br.shadowRows(ctx, res)
+	if err != nil {
+		outcome, sc.Error = "error", err.Error()
+		span.Annotatef(nil, "Shadow comparer %q: %v", sc.Comparer, err)
+		return
+	}
+
+	changed := make(map[string]bool)
+	for _, row := range res.Rows {
+		changed[rowName(row)] = true
+	}
+	shadowed := make(map[string]bool)
+	for _, row := range rows {
+		name := rowName(row)
+		if shadowed[name] = true; !changed[name] {
+			sc.Added = append(sc.Added, name)
+		}
+	}
+	for _, row := range res.Rows {
+		if name := rowName(row); !shadowed[name] {
+			sc.Missed = append(sc.Missed, name)
+		}
+	}
+	if br.policy != nil && res.Policy != nil {
+		before, after, err := br.prepare(res.before, res.after)
+		if err == nil {
+			sc.Severity = br.policy.Evaluate(rows, before, after).Severity
+		}
+	}
+
+	sc.Disagrees = len(sc.Added) > 0 || len(sc.Missed) > 0 || (res.Policy != nil && sc.Severity != res.Policy.Severity)
+	if sc.Disagrees {
+		outcome = "disagree"
+		span.Annotatef(nil, "Shadow comparer %q disagrees: %d added, %d missed, verdict %q", sc.Comparer, len(sc.Added), len(sc.Missed), sc.Severity)
+	}
+}
+
+func (br *Request) shadowRows(ctx context.Context, res *Result) ([]*Row, error) {
+	comparersMu.RLock()
+	c, ok := comparers[br.ShadowComparer]
+	comparersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown comparer %q", br.ShadowComparer)
+	}
+	before, after, err := br.prepare(res.before, res.after)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := c.Compare(ctx, before, after, br.splitBy())
+	if err != nil {
+		return nil, err
+	}
+	return resultRows(tables), nil
+}
+
+// rowName names the metric of row e.g. "ExportSpan-8 time/op".
+func rowName(row *Row) string {
+	name := row.Benchmark
+	if row.Group != "" {
+		name = row.Group + "/" + name
+	}
+	return name + " " + row.Metric
+}
@@ -0,0 +1,115 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Simulation reports how a gating policy would have judged stored runs.
+type Simulation struct {
+	Repo string `json:"repo"`
+	// Runs is the number of runs judged, each against the run before it.
+	Runs   int `json:"runs"`
+	Passed int `json:"passed"`
+	Warned int `json:"warned"`
+	Failed int `json:"failed"`
+	// Flagged are the runs that would have warned or failed, oldest first.
+	Flagged []*SimulatedRun `json:"flagged,omitempty"`
+}
+
+// SimulatedRun is the verdict a policy would have had on a run.
+type SimulatedRun struct {
+	RunID     string    `json:"run_id"`
+	StartTime time.Time `json:"start_time"`
+	// BaselineID is the run it was compared against.
+	BaselineID string         `json:"baseline_id"`
+	Verdict    *PolicyVerdict `json:"verdict"`
+}
+
+// SimulatePolicy evaluates policy against at most the window most recent
+// runs carrying all of tags, each compared against the run before it as
+// it was against the baseline then, so that thresholds can be tuned
+// before the policy is enforced. Runs without results are skipped.
+func (br *Request) SimulatePolicy(ctx context.Context, policy *Policy, tags map[string]string, window int) (*Simulation, error) {
+	ctx, span := br.startSpan(ctx, "simulate-policy")
+	defer span.End()
+
+	if window <= 0 {
+		window = defaultPageSize
+	}
+	// The run before the window is the baseline of the window's first.
+	var runs []*Run
+	rf := &RunFilter{PageSize: math.MaxInt32, Tags: tags}
+	_, err := br.WalkRuns(ctx, rf, func(run *Run) error {
+		if !run.hasResults() {
+			return nil
+		}
+		if runs = append(runs, run); len(runs) > window+1 {
+			runs = runs[1:]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) < 2 {
+		return nil, fmt.Errorf("expecting at least two stored runs of %q to simulate with, got %d", br.GitRepoURL, len(runs))
+	}
+
+	sim := &Simulation{Repo: br.GitRepoURL}
+	before, err := br.downloadBlob(ctx, runs[0].ID)
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving results of run %q: %v", runs[0].ID, err)
+	}
+	for i, run := range runs[1:] {
+		after, err := br.downloadBlob(ctx, run.ID)
+		if err != nil {
+			return nil, fmt.Errorf("Retrieving results of run %q: %v", run.ID, err)
+		}
+		changed, err := br.compare(ctx, before, after, br.splitBy())
+		if err != nil {
+			return nil, err
+		}
+		preparedBefore, preparedAfter, err := br.prepare(before, after)
+		if err != nil {
+			return nil, err
+		}
+		verdict := policy.Evaluate(resultRows(changed), preparedBefore, preparedAfter)
+
+		sim.Runs++
+		switch verdict.Severity {
+		case SeverityPass:
+			sim.Passed++
+		case SeverityWarn:
+			sim.Warned++
+		case SeverityFail:
+			sim.Failed++
+		}
+		if verdict.Severity != SeverityPass {
+			sim.Flagged = append(sim.Flagged, &SimulatedRun{
+				RunID:      run.ID,
+				StartTime:  run.StartTime,
+				BaselineID: runs[i].ID,
+				Verdict:    verdict,
+			})
+		}
+		before = after
+	}
+	return sim, nil
+}
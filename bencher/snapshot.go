@@ -0,0 +1,291 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// snapshotArtifact is the name of the artifact archiving a run's workspace.
+const snapshotArtifact = "snapshot.tar.gz"
+
+// Snapshot records the archived workspace of a run, from which
+// RerunSnapshot re-executes it.
+type Snapshot struct {
+	// Artifact is the name of the archive, see OpenArtifact.
+	Artifact string `json:"artifact"`
+	// GoVersion is the output of "go version" on the machine that ran it.
+	GoVersion string `json:"go_version"`
+	// SHA256 is the hex encoded SHA-256 of the archive.
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// snapshotWorkspace archives the checked out sources, including go.sum
+// but without any .git directory, into a temporary file as a gzipped tar.
+// The caller must remove the file.
+func (br *Request) snapshotWorkspace(ctx context.Context) (string, *Snapshot, error) {
+	ctx, span := br.startSpan(ctx, "snapshot-workspace")
+	defer span.End()
+
+	goVersion, err := runCheckoutCmd(br.checkoutCmd(ctx, "go", "version"))
+	if err != nil {
+		return "", nil, err
+	}
+	f, err := ioutil.TempFile("", "bencher-snapshot-")
+	if err != nil {
+		return "", nil, err
+	}
+	fail := func(err error) (string, *Snapshot, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return "", nil, fmt.Errorf("Archiving the workspace: %v", err)
+	}
+
+	sum := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(f, sum))
+	tw := tar.NewWriter(gz)
+	dir := br.projectDir()
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, in)
+		return err
+	})
+	if err != nil {
+		return fail(err)
+	}
+	if err := tw.Close(); err != nil {
+		return fail(err)
+	}
+	if err := gz.Close(); err != nil {
+		return fail(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	if err := f.Close(); err != nil {
+		return fail(err)
+	}
+	return f.Name(), &Snapshot{
+		Artifact:  ArtifactName(snapshotArtifact),
+		GoVersion: string(bytes.TrimSpace(goVersion)),
+		SHA256:    hex.EncodeToString(sum.Sum(nil)),
+		Size:      info.Size(),
+	}, nil
+}
+
+// uploadSnapshot uploads the archived workspace at path as
+// the snapshot artifact of the run with runID.
+func (br *Request) uploadSnapshot(ctx context.Context, runID, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := br.UploadArtifact(ctx, runID, snapshotArtifact, f); err != nil {
+		return fmt.Errorf("Uploading the workspace snapshot: %v", err)
+	}
+	return nil
+}
+
+// RerunSnapshot re-executes the stored run with runID from its archived
+// workspace, with its tags, runtime settings and harness, and compares
+// the results against the run's own, e.g. to settle a disputed result.
+// The results of the rerun aren't stored. Results from a different Go
+// toolchain than the run's are warned of, as they aren't reproductions.
+func (br *Request) RerunSnapshot(ctx context.Context, runID string) (*Result, error) {
+	ctx, span := br.startSpan(ctx, "rerun-snapshot")
+	defer span.End()
+
+	blob, err := br.downloadBlob(ctx, runID+runMetaSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving metadata of run %q: %v", runID, err)
+	}
+	run := new(Run)
+	if err := json.Unmarshal(blob, run); err != nil {
+		return nil, fmt.Errorf("Parsing metadata of run %q: %v", runID, err)
+	}
+	switch {
+	case run.Snapshot == nil:
+		return nil, fmt.Errorf("run %q has no workspace snapshot", runID)
+	case !run.hasResults():
+		return nil, run.noResultsError()
+	}
+	beforeBlob, err := br.downloadBlob(ctx, runID)
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving results of run %q: %v", runID, err)
+	}
+	archive, err := br.downloadBlob(ctx, runID+"-"+run.Snapshot.Artifact)
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving the workspace snapshot of run %q: %v", runID, err)
+	}
+	if sum := sha256.Sum256(archive); hex.EncodeToString(sum[:]) != run.Snapshot.SHA256 {
+		return nil, fmt.Errorf("the workspace snapshot of run %q doesn't match its SHA-256", runID)
+	}
+
+	br.Tags, br.GOGC, br.GODEBUG, br.Seed, br.Harness = run.Tags, run.GOGC, run.GODEBUG, run.Seed, run.Harness
+	var warnings []string
+	goVersion, err := runCheckoutCmd(br.checkoutCmd(ctx, "go", "version"))
+	if err != nil {
+		return nil, err
+	}
+	if v := string(bytes.TrimSpace(goVersion)); v != run.Snapshot.GoVersion {
+		warnings = append(warnings, fmt.Sprintf("Rerun with %q rather than the run's %q", v, run.Snapshot.GoVersion))
+	}
+
+	tmp, err := ioutil.TempDir("", "bencher-snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	// The user of a jail must be able to read the sources.
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return nil, err
+	}
+	if err := extractSnapshot(archive, tmp); err != nil {
+		return nil, fmt.Errorf("Extracting the workspace snapshot of run %q: %v", runID, err)
+	}
+	br.workDir = tmp
+	defer func() { br.workDir = "" }()
+
+	leaveJail, err := br.enterJail()
+	if err != nil {
+		return nil, fmt.Errorf("Creating the jail of %q: %v", br.RunAs, err)
+	}
+	defer leaveJail()
+
+	stopFixtures, err := br.startFixtures(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if stopFixtures != nil {
+		defer stopFixtures()
+	}
+	gtr, err := br.runBenchmarks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Rerunning run %q: %v", runID, err)
+	}
+	gtr.events.Close()
+	if br.ignore, err = readIgnoreFile(br.projectDir()); err != nil {
+		return nil, fmt.Errorf("Reading %s: %v", ignoreFileName, err)
+	}
+	if err := br.loadPolicy(); err != nil {
+		return nil, err
+	}
+	afterBlob := gtr.benchmarks
+	if settings := br.runtimeSettings(); len(settings) > 0 {
+		afterBlob = append(tagsHeader(settings), afterBlob...)
+	}
+	if len(br.Tags) > 0 {
+		afterBlob = append(tagsHeader(br.Tags), afterBlob...)
+	}
+
+	res, err := br.compareTagged(ctx, "run", runID, "rerun", beforeBlob, afterBlob)
+	if err != nil {
+		return nil, err
+	}
+	res.Warnings = append(warnings, res.Warnings...)
+	res.EnvironmentDiff = diffEnvironments(run.Environment, br.environment(ctx))
+	if err := br.gate(res); err != nil {
+		return nil, fmt.Errorf("Evaluating the policy: %v", err)
+	}
+	return res, nil
+}
+
+// extractSnapshot extracts the gzipped tar archive into dir, with
+// files and directories readable by anyone e.g. the user of a jail.
+func extractSnapshot(archive []byte, dir string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(hdr.Name)
+		if filepath.IsAbs(name) || strings.HasPrefix(filepath.Clean(name), "..") {
+			return fmt.Errorf("invalid path %q", hdr.Name)
+		}
+		target := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644|os.FileMode(hdr.Mode)&0111)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
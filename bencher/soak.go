@@ -0,0 +1,280 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/keighl/postmark"
+)
+
+// soaksDir holds the time series of soak runs, by benchmark.
+const soaksDir = "soaks/"
+
+const (
+	defaultSoakInterval       = 10 * time.Second
+	defaultSoakMaxDegradation = 10
+	// minSoakSamples are needed to compare the first and last quarters.
+	minSoakSamples = 4
+)
+
+// SoakSpec describes a soak run of a single benchmark.
+type SoakSpec struct {
+	// Package is the package of the benchmark e.g. "./trace".
+	Package string `json:"package"`
+	// Benchmark is the benchmark's name without its "Benchmark"
+	// prefix e.g. "StartSpan" or "Export/batched".
+	Benchmark string `json:"benchmark"`
+	// Duration is how long the benchmark is run for in total.
+	Duration time.Duration `json:"duration"`
+	// Interval is how long every sample is measured for, 10s if 0.
+	Interval time.Duration `json:"interval"`
+	// MaxDegradation is by how many percent a metric may worsen
+	// from the first to the last quarter of the samples, 10 if 0.
+	MaxDegradation float64 `json:"max_degradation"`
+	// OnSample if set, is called with every sample as it is measured.
+	OnSample func(*SoakSample) `json:"-"`
+}
+
+// SoakSample is a measurement of a soak run's benchmark over an interval.
+type SoakSample struct {
+	// Elapsed is the time since the soak run started.
+	Elapsed    time.Duration `json:"elapsed"`
+	Iterations int           `json:"iterations"`
+	NsPerOp    float64       `json:"ns_per_op"`
+	// OpsPerSec is the throughput, the inverse of NsPerOp.
+	OpsPerSec   float64 `json:"ops_per_sec"`
+	BytesPerOp  float64 `json:"bytes_per_op"`
+	AllocsPerOp float64 `json:"allocs_per_op"`
+}
+
+// SoakReport is the time series of a soak run and the degradations
+// found in it, which one-shot benchmarks can't catch, e.g. leaks or
+// heap fragmentation slowing a benchmark down as it keeps running.
+type SoakReport struct {
+	ID        string        `json:"id"`
+	Repo      string        `json:"repo"`
+	Package   string        `json:"package"`
+	Benchmark string        `json:"benchmark"`
+	StartTime time.Time     `json:"start_time"`
+	Duration  time.Duration `json:"duration"`
+	Samples   []*SoakSample `json:"samples"`
+	// Trends are the relative changes in percent of the means of every
+	// metric e.g. "time/op" from the first to the last quarter of the
+	// samples, positive if it worsened, and none for metrics that grew from 0.
+	Trends map[string]float64 `json:"trends"`
+	// Degradations describe the metrics that worsened by more than the
+	// spec's MaxDegradation.
+	Degradations []string `json:"degradations,omitempty"`
+	// URL is where the report is stored.
+	URL string `json:"url,omitempty"`
+	// Alerted is set if the AlertEmails were emailed the degradations.
+	Alerted bool `json:"alerted"`
+}
+
+// soakMetrics are the metrics of a soak run's samples, all of
+// which worsen as they grow.
+var soakMetrics = []struct {
+	name  string
+	value func(*SoakSample) float64
+}{
+	{"time/op", func(s *SoakSample) float64 { return s.NsPerOp }},
+	{"alloc/op", func(s *SoakSample) float64 { return s.BytesPerOp }},
+	{"allocs/op", func(s *SoakSample) float64 { return s.AllocsPerOp }},
+}
+
+// Soak runs the spec's benchmark of the repository continuously in a
+// single process for the spec's duration, sampling it every interval,
+// then stores the time series under the repository's "soaks/" and flags
+// the metrics that degraded over time, alerting the AlertEmails if any.
+func (br *Request) Soak(ctx context.Context, spec *SoakSpec) (*SoakReport, error) {
+	ctx, span := br.startSpan(ctx, "soak")
+	defer span.End()
+
+	interval := spec.Interval
+	if interval <= 0 {
+		interval = defaultSoakInterval
+	}
+	count := int(spec.Duration / interval)
+	switch {
+	case spec.Benchmark == "":
+		return nil, errors.New("expecting a benchmark to soak")
+	case count < minSoakSamples:
+		return nil, fmt.Errorf("expecting the duration to be at least %d intervals of %s, got %s", minSoakSamples, interval, spec.Duration)
+	}
+	if err := br.validateRuntimeSettings(); err != nil {
+		return nil, err
+	}
+
+	removeCheckout, err := br.checkout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer removeCheckout()
+	leaveJail, err := br.enterJail()
+	if err != nil {
+		return nil, fmt.Errorf("Creating the jail of %q: %v", br.RunAs, err)
+	}
+	defer leaveJail()
+	stopFixtures, err := br.startFixtures(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if stopFixtures != nil {
+		defer stopFixtures()
+	}
+
+	start := br.now()
+	report := &SoakReport{
+		ID:        br.ids().RunID(start),
+		Repo:      br.GitRepoURL,
+		Package:   firstNonEmpty(spec.Package, "."),
+		Benchmark: spec.Benchmark,
+		StartTime: start,
+	}
+	if report.Samples, err = br.soakSamples(ctx, spec, report.Package, interval, count); err != nil {
+		return nil, err
+	}
+	report.Duration = br.now().Sub(start)
+	if len(report.Samples) < minSoakSamples {
+		return nil, fmt.Errorf("%s of %s reported %d samples, expecting at least %d", spec.Benchmark, report.Package, len(report.Samples), minSoakSamples)
+	}
+	maxDegradation := spec.MaxDegradation
+	if maxDegradation <= 0 {
+		maxDegradation = defaultSoakMaxDegradation
+	}
+	report.Trends, report.Degradations = soakTrends(report.Samples, maxDegradation)
+
+	blob, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	name := soaksDir + strings.Replace(spec.Benchmark, "/", "_", -1) + "/" + report.ID + ".json"
+	if report.URL, err = br.uploadBlob(ctx, name, blob); err != nil {
+		return nil, fmt.Errorf("Uploading the soak report: %v", err)
+	}
+	if len(report.Degradations) == 0 || len(br.AlertEmails) == 0 {
+		return report, nil
+	}
+	email := postmark.Email{
+		From:    br.AppEmail,
+		To:      strings.Join(br.AlertEmails, ","),
+		Subject: fmt.Sprintf("%s of %s degraded over a soak run", spec.Benchmark, br.GitRepoURL),
+		TextBody: fmt.Sprintf("Running %s of %s continuously for %s, in %d samples:\n\n  %s\n\nThe samples are at %s\n",
+			spec.Benchmark, report.Package, report.Duration.Round(time.Second), len(report.Samples),
+			strings.Join(report.Degradations, "\n  "), report.URL),
+	}
+	if err := br.deliver(ctx, email); err != nil {
+		return report, err
+	}
+	report.Alerted = true
+	return report, nil
+}
+
+// soakSamples runs the benchmark count times for interval each, in the
+// same process so that what it leaks accumulates, sampling every result
+// as it is printed.
+func (br *Request) soakSamples(ctx context.Context, spec *SoakSpec, pkg string, interval time.Duration, count int) ([]*SoakSample, error) {
+	// Every level of a sub-benchmark's name is matched on its own.
+	levels := strings.Split(spec.Benchmark, "/")
+	for i, level := range levels {
+		levels[i] = "^" + regexp.QuoteMeta(level) + "$"
+	}
+	levels[0] = "^Benchmark" + strings.TrimPrefix(levels[0], "^")
+	cmd := br.goCmd(ctx, "test", "-run=^$", "-bench="+strings.Join(levels, "/"),
+		fmt.Sprintf("-benchtime=%s", interval), fmt.Sprintf("-count=%d", count),
+		"-benchmem", "-timeout=0", pkg)
+	stderr := &cappedBuffer{max: 64 << 10}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var samples []*SoakSample
+	sc := bufio.NewScanner(stdout)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		res := parseResultLine(sc.Text())
+		if res == nil {
+			continue
+		}
+		sample := &SoakSample{
+			Elapsed:     time.Since(start),
+			Iterations:  res.Iterations,
+			NsPerOp:     res.Values["ns/op"],
+			BytesPerOp:  res.Values["B/op"],
+			AllocsPerOp: res.Values["allocs/op"],
+		}
+		if sample.NsPerOp > 0 {
+			sample.OpsPerSec = 1e9 / sample.NsPerOp
+		}
+		samples = append(samples, sample)
+		if spec.OnSample != nil {
+			spec.OnSample(sample)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("Soaking %s: %v: %s", spec.Benchmark, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return samples, nil
+}
+
+// soakTrends returns the relative change of every metric's mean from the
+// first to the last quarter of samples, and describes those that
+// worsened by more than maxDegradation percent.
+func soakTrends(samples []*SoakSample, maxDegradation float64) (map[string]float64, []string) {
+	quarter := len(samples) / 4
+	first, last := samples[:quarter], samples[len(samples)-quarter:]
+	mean := func(samples []*SoakSample, value func(*SoakSample) float64) float64 {
+		var sum float64
+		for _, s := range samples {
+			sum += value(s)
+		}
+		return sum / float64(len(samples))
+	}
+
+	trends := make(map[string]float64)
+	var degradations []string
+	for _, metric := range soakMetrics {
+		before, after := mean(first, metric.value), mean(last, metric.value)
+		switch {
+		case before == 0 && after == 0:
+			trends[metric.name] = 0
+		case before == 0:
+			// An infinite trend can't be stored, hence there is none.
+			degradations = append(degradations, fmt.Sprintf("%s grew from 0 in the first quarter to %.4g in the last", metric.name, after))
+		default:
+			pct := 100 * (after - before) / before
+			trends[metric.name] = pct
+			if pct > maxDegradation {
+				degradations = append(degradations, fmt.Sprintf("%s grew %.2f%% from %.4g in the first quarter to %.4g in the last, more than %g%%", metric.name, pct, before, after, maxDegradation))
+			}
+		}
+	}
+	return trends, degradations
+}
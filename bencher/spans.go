@@ -0,0 +1,101 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"fmt"
+
+	"go.opencensus.io/trace"
+)
+
+// DefaultServiceName is the service the spans of a Request are of,
+// unless its ServiceName is set.
+const DefaultServiceName = "bencher"
+
+// The attributes of spans set by DefaultSpanConvention.
+const (
+	SpanAttrService   = "service.name"
+	SpanAttrComponent = "component"
+	SpanAttrRepo      = "bencher.repo"
+	SpanAttrRunID     = "bencher.run_id"
+	SpanAttrRevision  = "bencher.revision"
+)
+
+// SpanConvention names the spans of a Request's operations, and
+// chooses the attributes set on every one of them, e.g. to match
+// those of the other services traced by the same backend.
+type SpanConvention interface {
+	// SpanName returns the name of the span of the operation op
+	// e.g. "benchmark-and-email" of the service e.g. "bencher".
+	SpanName(service, op string) string
+	// SpanAttributes returns the attributes of the spans of br.
+	SpanAttributes(service string, br *Request) []trace.Attribute
+}
+
+// The built-in span conventions.
+var (
+	// DefaultSpanConvention names spans "<service>.<op>" e.g.
+	// "bencher.benchmark-and-email", and sets the service, the component,
+	// and the repository, run and revision, if known, on every span.
+	DefaultSpanConvention SpanConvention = defaultSpanConvention{}
+	// LegacySpanConvention names spans "/<op>" without any attributes,
+	// as they were before span conventions, for existing dashboards.
+	LegacySpanConvention SpanConvention = legacySpanConvention{}
+)
+
+// ParseSpanConvention returns the built-in span convention
+// named "default" or "legacy", the default one if blank.
+func ParseSpanConvention(name string) (SpanConvention, error) {
+	switch name {
+	case "", "default":
+		return DefaultSpanConvention, nil
+	case "legacy":
+		return LegacySpanConvention, nil
+	}
+	return nil, fmt.Errorf("unknown span convention %q, expecting \"default\" or \"legacy\"", name)
+}
+
+type defaultSpanConvention struct{}
+
+func (defaultSpanConvention) SpanName(service, op string) string {
+	return service + "." + op
+}
+
+func (defaultSpanConvention) SpanAttributes(service string, br *Request) []trace.Attribute {
+	attrs := []trace.Attribute{
+		trace.StringAttribute(SpanAttrService, service),
+		trace.StringAttribute(SpanAttrComponent, "bencher"),
+	}
+	if br.GitRepoURL != "" {
+		attrs = append(attrs, trace.StringAttribute(SpanAttrRepo, br.GitRepoURL))
+	}
+	if br.runID != "" {
+		attrs = append(attrs, trace.StringAttribute(SpanAttrRunID, br.runID))
+	}
+	if br.Revision != "" {
+		attrs = append(attrs, trace.StringAttribute(SpanAttrRevision, br.Revision))
+	}
+	return attrs
+}
+
+type legacySpanConvention struct{}
+
+func (legacySpanConvention) SpanName(service, op string) string {
+	return "/" + op
+}
+
+func (legacySpanConvention) SpanAttributes(service string, br *Request) []trace.Attribute {
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spoolMemoryLimit is how much a spool holds in memory
+// before spilling to a temporary file.
+const spoolMemoryLimit = 4 << 20
+
+// spool buffers what is written to it in memory, up to spoolMemoryLimit,
+// and beyond that in a temporary file, so that the output of a verbose run
+// doesn't have to fit in the server's memory.
+type spool struct {
+	mem  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && s.mem.Len()+len(p) > spoolMemoryLimit {
+		f, err := ioutil.TempFile("", "bencher-spool-")
+		if err != nil {
+			return 0, err
+		}
+		if _, err := f.Write(s.mem.Bytes()); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, err
+		}
+		s.file = f
+		s.mem = bytes.Buffer{}
+	}
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.mem.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// Reader returns a reader of everything written so far, from the start.
+func (s *spool) Reader() io.Reader {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, 0, s.size)
+	}
+	return bytes.NewReader(s.mem.Bytes())
+}
+
+// Close removes the temporary file, if any.
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// cappedBuffer keeps the first max bytes written to it, and
+// discards the rest, e.g. to report the start of a long stderr.
+type cappedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (cb *cappedBuffer) Write(p []byte) (int, error) {
+	if room := cb.max - cb.Len(); room < len(p) {
+		cb.truncated = true
+		if room > 0 {
+			cb.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return cb.Buffer.Write(p)
+}
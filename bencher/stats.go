@@ -0,0 +1,85 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// tQuantiles975 are the 97.5th percentiles of Student's t-distribution
+// by degrees of freedom, with which 95% confidence intervals are computed.
+var tQuantiles975 = []float64{
+	1: 12.706, 2: 4.303, 3: 3.182, 4: 2.776, 5: 2.571,
+	6: 2.447, 7: 2.365, 8: 2.306, 9: 2.262, 10: 2.228,
+	11: 2.201, 12: 2.179, 13: 2.160, 14: 2.145, 15: 2.131,
+	16: 2.120, 17: 2.110, 18: 2.101, 19: 2.093, 20: 2.086,
+	21: 2.080, 22: 2.074, 23: 2.069, 24: 2.064, 25: 2.060,
+	26: 2.056, 27: 2.052, 28: 2.048, 29: 2.045, 30: 2.042,
+}
+
+// confidenceInterval returns the half-width of the 95% confidence
+// interval of the mean of values, relative to the mean, in percent.
+func confidenceInterval(values []float64) (float64, bool) {
+	n := len(values)
+	if n < 2 {
+		return 0, false
+	}
+	m := mean(values)
+	ss := 0.0
+	for _, v := range values {
+		ss += (v - m) * (v - m)
+	}
+	return relativeCI(n, m, math.Sqrt(ss/float64(n-1)))
+}
+
+// relativeCI is the confidenceInterval of n samples
+// of the given mean and sample standard deviation.
+func relativeCI(n int, m, sd float64) (float64, bool) {
+	if n < 2 || m == 0 {
+		return 0, false
+	}
+	t := 1.96
+	if df := n - 1; df < len(tQuantiles975) {
+		t = tQuantiles975[df]
+	}
+	return 100 * t * sd / math.Sqrt(float64(n)) / math.Abs(m), true
+}
+
+// annotateCIs appends the confidence intervals of the means of
+// every row to its note, e.g. "95% CI ±1.2% → ±0.8%".
+func annotateCIs(tables []*benchstat.Table) {
+	for _, table := range tables {
+		for _, row := range table.Rows {
+			var cis []string
+			for _, m := range row.Metrics {
+				ci, ok := confidenceInterval(m.RValues)
+				if !ok {
+					cis = append(cis, "?")
+					continue
+				}
+				cis = append(cis, fmt.Sprintf("±%.1f%%", ci))
+			}
+			note := "95% CI " + strings.Join(cis, " → ")
+			if row.Note != "" {
+				note = row.Note + " " + note
+			}
+			row.Note = note
+		}
+	}
+}
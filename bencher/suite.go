@@ -0,0 +1,111 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// SuiteResult is the combined report of benchmarking a suite of repositories.
+type SuiteResult struct {
+	Repos []*RepoResult
+}
+
+// RepoResult is the outcome of benchmarking one repository of a suite.
+type RepoResult struct {
+	Repo   string
+	Result *Result `json:",omitempty"`
+	// Error if set, is why the repository has no result
+	// e.g. "no changes detected!" or a failed build.
+	Error string `json:",omitempty"`
+}
+
+// BenchmarkSuite benchmarks every repository of the suite in turn, with the
+// request's settings, carrying on past those that fail. The request's
+// GitRepoURL is restored once done.
+func (br *Request) BenchmarkSuite(ctx context.Context) (*SuiteResult, error) {
+	ctx, span := br.startSpan(ctx, "benchmark-suite")
+	defer span.End()
+
+	if len(br.Suite) == 0 {
+		return nil, fmt.Errorf("expecting at least one repository in the suite")
+	}
+	defer func(repo string) {
+		br.GitRepoURL = repo
+	}(br.GitRepoURL)
+
+	sr := new(SuiteResult)
+	for _, repo := range br.Suite {
+		// Every repository is a run of its own, costed on its own.
+		br.GitRepoURL, br.ignore = repo, nil
+		br.transfers.reset()
+		rr := &RepoResult{Repo: repo}
+		results, err := br.Benchmark(ctx)
+		if err != nil {
+			rr.Error = err.Error()
+			span.Annotatef(nil, "Benchmarking %s: %v", repo, err)
+		}
+		rr.Result, _ = results.(*Result)
+		sr.Repos = append(sr.Repos, rr)
+	}
+	return sr, nil
+}
+
+// BenchmarkSuiteAndEmail benchmarks the suite and emails the
+// combined report, grouped by repository, to the alert emails.
+func (br *Request) BenchmarkSuiteAndEmail(ctx context.Context) (*SuiteResult, error) {
+	ctx, span := br.startSpan(ctx, "benchmark-suite-and-email")
+	defer span.End()
+
+	if err := br.ValidateTemplates(); err != nil {
+		return nil, err
+	}
+	sr, err := br.BenchmarkSuite(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	repos := strings.Join(br.Suite, ", ")
+	headerData := &EmailHeaderData{Repo: repos, Tags: br.Tags}
+	for _, rr := range sr.Repos {
+		if rr.Result == nil {
+			continue
+		}
+		data := newEmailHeaderData(rr.Repo, rr.Result)
+		headerData.Regressions += data.Regressions
+		headerData.Improvements += data.Improvements
+	}
+	subject := fmt.Sprintf("Benchmarks for %d repositories: %s", len(br.Suite), repos)
+	return sr, br.sendEmail(ctx, subject, suiteEmailTmpl, sr, headerData)
+}
+
+var suiteEmailTmpl = template.Must(template.New("suite-email").Parse(`
+{{range .Repos}}
+<h2>{{html .Repo}}</h2>
+{{if .Error}}
+<p>{{html .Error}}</p>
+{{else}}{{with .Result}}
+{{range .Warnings}}
+<b>Warning:</b> {{html .}}
+<br />
+{{end}}
+{{.HTMLBenchmarks}}
+{{if .ReportURL}}<p>See the <a href="{{html .ReportURL}}">full report</a>.</p>{{end}}
+{{end}}{{end}}
+{{end}}
+`))
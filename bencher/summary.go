@@ -0,0 +1,164 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Summary describes the outcome of a comparison for CI pipelines to
+// consume, e.g. as the summary.json artifact of "bencher run", without
+// parsing what was printed.
+type Summary struct {
+	Repo  string            `json:"repo"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	RunAt string            `json:"run_at,omitempty"`
+	// Status is that of the run e.g. "no-benchmarks", if it ran.
+	Status string `json:"status,omitempty"`
+
+	Regressions  []*Row `json:"regressions"`
+	Improvements []*Row `json:"improvements"`
+
+	// Links are the URLs of the stored results and of the full report.
+	Links map[string]string `json:"links,omitempty"`
+
+	Policy   *PolicyVerdict `json:"policy,omitempty"`
+	Warnings []string       `json:"warnings,omitempty"`
+	// EnvironmentChanges are how the environments of the compared runs differ.
+	EnvironmentChanges []*EnvironmentChange `json:"environment_changes,omitempty"`
+
+	// FailedPackages and SkippedBenchmarks are missing from the comparison.
+	FailedPackages    []string `json:"failed_packages,omitempty"`
+	SkippedBenchmarks []string `json:"skipped_benchmarks,omitempty"`
+
+	// Error is why the benchmarks or the comparison failed, if they did.
+	Error string `json:"error,omitempty"`
+}
+
+// NewSummary summarizes the result res of benchmarking or comparing
+// repo, or err if that failed. ErrNoChanges is summarized as no changes,
+// and ErrNoBenchmarks as the status RunStatusNoBenchmarks.
+func NewSummary(repo string, res *Result, err error) *Summary {
+	s := &Summary{Repo: repo, Regressions: []*Row{}, Improvements: []*Row{}}
+	if err == ErrNoBenchmarks {
+		s.Status = RunStatusNoBenchmarks
+		if res != nil {
+			s.Tags, s.RunAt = res.Tags, res.RunAt
+		}
+		return s
+	}
+	if err != nil {
+		if err != ErrNoChanges {
+			s.Error = err.Error()
+		}
+		return s
+	}
+	if res == nil {
+		return s
+	}
+	s.Tags, s.RunAt, s.Status = res.Tags, res.RunAt, res.Status
+	for _, row := range res.Rows {
+		switch {
+		case row.Change < 0:
+			s.Regressions = append(s.Regressions, row)
+		case row.Change > 0:
+			s.Improvements = append(s.Improvements, row)
+		}
+	}
+	if len(res.URLs) > 0 || res.ReportURL != "" {
+		s.Links = make(map[string]string)
+		for name, url := range res.URLs {
+			s.Links[name] = url
+		}
+		if res.ReportURL != "" {
+			s.Links["report"] = res.ReportURL
+		}
+	}
+	s.Policy, s.Warnings = res.Policy, res.Warnings
+	s.EnvironmentChanges = res.EnvironmentDiff
+	s.FailedPackages, s.SkippedBenchmarks = res.FailedPackages, res.SkippedBenchmarks
+	return s
+}
+
+// WriteMarkdown writes the summary as GitHub flavored Markdown, e.g.
+// for the step summary of a GitHub Actions job.
+func (s *Summary) WriteMarkdown(w io.Writer) error {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "### Benchmarks of %s\n\n", s.Repo)
+	if s.Error != "" {
+		fmt.Fprintf(&buf, "**Failed:** %s\n", markdownCell(s.Error))
+		_, err := io.WriteString(w, buf.String())
+		return err
+	}
+	if s.Status == RunStatusNoBenchmarks {
+		buf.WriteString("No benchmarks found.\n")
+		_, err := io.WriteString(w, buf.String())
+		return err
+	}
+	if s.Policy != nil {
+		fmt.Fprintf(&buf, "**Policy verdict: %s**\n\n", s.Policy.Severity)
+		for _, violation := range s.Policy.Violations {
+			fmt.Fprintf(&buf, "- %s\n", markdownCell(violation))
+		}
+		if len(s.Policy.Violations) > 0 {
+			buf.WriteString("\n")
+		}
+	}
+	if len(s.Regressions) == 0 && len(s.Improvements) == 0 {
+		buf.WriteString("No significant changes.\n\n")
+	}
+	writeRows := func(title string, rows []*Row) {
+		if len(rows) == 0 {
+			return
+		}
+		fmt.Fprintf(&buf, "#### %s\n\n", title)
+		buf.WriteString("| Benchmark | Metric | Before | After | Delta |\n|---|---|---:|---:|---:|\n")
+		for _, row := range rows {
+			name := row.Benchmark
+			if row.Group != "" {
+				name = row.Group + "/" + name
+			}
+			fmt.Fprintf(&buf, "| %s | %s | %s | %s | %s |\n", markdownCell(name), markdownCell(row.Metric), markdownCell(row.Before), markdownCell(row.After), markdownCell(row.Delta))
+		}
+		buf.WriteString("\n")
+	}
+	writeRows(fmt.Sprintf("Regressions (%d)", len(s.Regressions)), s.Regressions)
+	writeRows(fmt.Sprintf("Improvements (%d)", len(s.Improvements)), s.Improvements)
+
+	for _, warning := range s.Warnings {
+		fmt.Fprintf(&buf, "> %s\n\n", markdownCell(warning))
+	}
+	for _, ec := range s.EnvironmentChanges {
+		fmt.Fprintf(&buf, "> %s changed: `%s` → `%s`\n\n", markdownCell(ec.Field), markdownCell(ec.Before), markdownCell(ec.After))
+	}
+	if len(s.Links) > 0 {
+		names := make([]string, 0, len(s.Links))
+		for name := range s.Links {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&buf, "- [%s](%s)\n", markdownCell(name), s.Links[name])
+		}
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// markdownCell escapes text to fit on a line, or in a table cell.
+var markdownCell = strings.NewReplacer("|", `\|`, "\r", " ", "\n", " ").Replace
@@ -0,0 +1,271 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// TestEvent is a single event of the stream emitted by
+// "go test -json", as documented by cmd/test2json.
+type TestEvent struct {
+	Time    time.Time
+	Action  string
+	Package string  `json:",omitempty"`
+	Test    string  `json:",omitempty"`
+	Elapsed float64 `json:",omitempty"`
+	Output  string  `json:",omitempty"`
+}
+
+// PackageSummary describes how the benchmarks of a single package ran.
+type PackageSummary struct {
+	Package string `json:"package"`
+	// Status is the package's final action: "pass", "fail" or "skip".
+	Status string `json:"status"`
+	// Elapsed is the package's wall clock duration in seconds.
+	Elapsed float64 `json:"elapsed"`
+	// Benchmarks is the number of benchmark result lines produced.
+	Benchmarks int      `json:"benchmarks"`
+	Skipped    []string `json:"skipped,omitempty"`
+	Failed     []string `json:"failed,omitempty"`
+	// BenchTime is the -benchtime of the package's
+	// benchmarks, if not go test's default of 1s.
+	BenchTime string `json:"benchtime,omitempty"`
+}
+
+// maxPendingLine bounds an output line being reassembled, beyond which
+// it is dropped since it can't be a benchmark result anyway.
+const maxPendingLine = 64 << 10
+
+// goTestRun is the parsed output of "go test -json".
+type goTestRun struct {
+	// benchmarks are the benchmark result lines in benchfmt.
+	benchmarks []byte
+	// events is the raw newline delimited JSON event stream,
+	// spooled to disk if large. It must be closed once uploaded.
+	events   *spool
+	packages []*PackageSummary
+}
+
+func (gtr *goTestRun) failedPackages() []string {
+	var failed []string
+	for _, ps := range gtr.packages {
+		if ps.Status == "fail" {
+			failed = append(failed, ps.Package)
+		}
+	}
+	return failed
+}
+
+// skippedBenchmarks returns the skipped benchmarks,
+// qualified by their package e.g. "go.opencensus.io/trace.BenchmarkExport".
+func (gtr *goTestRun) skippedBenchmarks() []string {
+	var skipped []string
+	for _, ps := range gtr.packages {
+		for _, name := range ps.Skipped {
+			skipped = append(skipped, ps.Package+"."+name)
+		}
+	}
+	return skipped
+}
+
+// accountingWarnings warns that the failed packages and the
+// skipped benchmarks are missing from a comparison.
+func accountingWarnings(failed, skipped []string) []string {
+	var warnings []string
+	switch len(failed) {
+	case 0:
+	case 1:
+		warnings = append(warnings, fmt.Sprintf("1 package failed to run, its benchmarks aren't compared: %s", failed[0]))
+	default:
+		warnings = append(warnings, fmt.Sprintf("%d packages failed to run, their benchmarks aren't compared: %s", len(failed), strings.Join(failed, ", ")))
+	}
+	switch len(skipped) {
+	case 0:
+	case 1:
+		warnings = append(warnings, fmt.Sprintf("1 benchmark was skipped: %s", skipped[0]))
+	default:
+		warnings = append(warnings, fmt.Sprintf("%d benchmarks were skipped: %s", len(skipped), strings.Join(skipped, ", ")))
+	}
+	return warnings
+}
+
+// parseTestEvents consumes the "go test -json" stream from r, invoking
+// onEvent, if non-nil, for every event as soon as it has been decoded.
+// Every package's run is traced by a child span of ctx's, from its first
+// event to its last, so that a slow package stands out. The stream is
+// scanned as it arrives, only the benchmark results being kept in memory.
+func parseTestEvents(ctx context.Context, r io.Reader, onEvent func(*TestEvent)) (*goTestRun, error) {
+	events := new(spool)
+	dec := json.NewDecoder(io.TeeReader(r, events))
+
+	summaries := make(map[string]*PackageSummary)
+	// Benchmark names and results can arrive in separate
+	// output events, so output is reassembled into lines.
+	pending := make(map[string]string)
+	benchmarks := new(bytes.Buffer)
+	nBenchmarks := 0
+	// The configuration lines e.g. "pkg: go.opencensus.io/trace" that each
+	// package prints ahead of its results label them, hence are written
+	// before them, again whenever the results of packages interleave.
+	configs := make(map[string][]string)
+	lastPackage := ""
+
+	spans := make(map[string]*trace.Span)
+	// Packages still running when the stream ends, e.g. as
+	// go test was killed, have their spans ended regardless.
+	defer func() {
+		for _, span := range spans {
+			span.End()
+		}
+	}()
+
+	for {
+		ev := new(TestEvent)
+		if err := dec.Decode(ev); err == io.EOF {
+			break
+		} else if err != nil {
+			events.Close()
+			return nil, err
+		}
+		if onEvent != nil {
+			onEvent(ev)
+		}
+		if ev.Package == "" {
+			continue
+		}
+		ps, ok := summaries[ev.Package]
+		if !ok {
+			ps = &PackageSummary{Package: ev.Package}
+			summaries[ev.Package] = ps
+			_, spans[ev.Package] = startSpan(ctx, "go-test-package")
+			spans[ev.Package].AddAttributes(trace.StringAttribute("package", ev.Package))
+		}
+		span := spans[ev.Package]
+
+		switch ev.Action {
+		case "output":
+			buffered := pending[ev.Package] + ev.Output
+			lines := strings.Split(buffered, "\n")
+			if pending[ev.Package] = lines[len(lines)-1]; len(pending[ev.Package]) > maxPendingLine {
+				pending[ev.Package] = ""
+			}
+			for _, line := range lines[:len(lines)-1] {
+				// Filter out anything that doesn't begin with a benchmark
+				line = strings.TrimSpace(line)
+				if isBenchmarkConfig(line) {
+					configs[ev.Package] = append(configs[ev.Package], line)
+					continue
+				}
+				if isBenchmarkResult(line) {
+					if nBenchmarks > 0 {
+						benchmarks.WriteByte('\n')
+					}
+					if ev.Package != lastPackage {
+						for _, config := range configs[ev.Package] {
+							benchmarks.WriteString(config + "\n")
+						}
+						lastPackage = ev.Package
+					}
+					benchmarks.WriteString(line)
+					nBenchmarks++
+					ps.Benchmarks++
+					if span != nil {
+						span.Annotate(nil, line)
+					}
+				}
+			}
+
+		case "skip", "fail", "pass":
+			if ev.Test == "" {
+				ps.Status = ev.Action
+				ps.Elapsed = ev.Elapsed
+				if span != nil {
+					span.AddAttributes(
+						trace.StringAttribute("status", ps.Status),
+						trace.Int64Attribute("benchmarks", int64(ps.Benchmarks)),
+					)
+					if ps.Status == "fail" {
+						span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: "benchmarks failed"})
+					}
+					span.End()
+					delete(spans, ev.Package)
+				}
+			} else if ev.Action == "skip" {
+				ps.Skipped = append(ps.Skipped, ev.Test)
+				if span != nil {
+					span.Annotatef(nil, "Skipped %s", ev.Test)
+				}
+			} else if ev.Action == "fail" {
+				ps.Failed = append(ps.Failed, ev.Test)
+				if span != nil {
+					span.Annotatef(nil, "Failed %s", ev.Test)
+				}
+			}
+		}
+	}
+
+	gtr := &goTestRun{
+		benchmarks: benchmarks.Bytes(),
+		events:     events,
+	}
+	for _, ps := range summaries {
+		gtr.packages = append(gtr.packages, ps)
+	}
+	sort.Slice(gtr.packages, func(i, j int) bool {
+		return gtr.packages[i].Package < gtr.packages[j].Package
+	})
+	if nBenchmarks == 0 {
+		return gtr, ErrNoBenchmarks
+	}
+	return gtr, nil
+}
+
+// benchmarkConfigKeys are the keys of the configuration lines
+// that go test prints ahead of a package's benchmark results.
+var benchmarkConfigKeys = []string{"goos", "goarch", "pkg", "cpu"}
+
+// isBenchmarkConfig reports whether line is a configuration line
+// e.g. "goarch: amd64" printed by go test ahead of benchmark results.
+func isBenchmarkConfig(line string) bool {
+	for _, key := range benchmarkConfigKeys {
+		if strings.HasPrefix(line, key+": ") {
+			return true
+		}
+	}
+	return false
+}
+
+// isBenchmarkResult reports whether line is a benchmark result
+// e.g. "BenchmarkStartSpan-8   1000000   1234 ns/op", as opposed
+// to a lone benchmark name printed ahead of a failure or skip.
+func isBenchmarkResult(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+		return false
+	}
+	_, err := strconv.ParseUint(fields[1], 10, 64)
+	return err == nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+// readTestEvents parses the go test -json output in testdata/name.
+func readTestEvents(t *testing.T, name string) *goTestRun {
+	t.Helper()
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gtr, err := parseTestEvents(context.Background(), f, nil)
+	if err != nil {
+		t.Fatalf("parseTestEvents: %v", err)
+	}
+	return gtr
+}
+
+func TestParseTestEventsLabelsResults(t *testing.T) {
+	gtr := readTestEvents(t, "go-test-two-packages.json")
+
+	results := parseResults(gtr.benchmarks)
+	if len(results) != 8 {
+		t.Fatalf("got %d results, want 8:\n%s", len(results), gtr.benchmarks)
+	}
+	byPackage := make(map[string]int)
+	for _, res := range results {
+		if res.Labels["goos"] != "linux" || res.Labels["goarch"] != "amd64" {
+			t.Errorf("%s: got goos %q and goarch %q, want linux and amd64", res.Line, res.Labels["goos"], res.Labels["goarch"])
+		}
+		byPackage[res.Labels["pkg"]]++
+	}
+	for _, pkg := range []string{"example.com/tm/a", "example.com/tm/b"} {
+		if byPackage[pkg] != 4 {
+			t.Errorf("got %d results of %s, want 4", byPackage[pkg], pkg)
+		}
+	}
+}
+
+func TestParseTestEventsKeepsPackagesApart(t *testing.T) {
+	gtr := readTestEvents(t, "go-test-two-packages.json")
+
+	tables := compareConfigs([]string{"before", "after"}, [][]byte{gtr.benchmarks, gtr.benchmarks}, defaultSplitBy)
+	groups := make(map[string]bool)
+	for _, table := range tables {
+		for _, row := range table.Rows {
+			groups[groupLabel(row.Group, "pkg")+" "+row.Benchmark] = true
+		}
+	}
+	for _, want := range []string{"example.com/tm/a Sum", "example.com/tm/b Sum", "example.com/tm/a Alloc", "example.com/tm/b Alloc"} {
+		if !groups[want] {
+			t.Errorf("missing the row of %q among %v", want, groups)
+		}
+	}
+}
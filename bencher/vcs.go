@@ -0,0 +1,297 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// VCS makes the sources of a Go project available to benchmark.
+type VCS interface {
+	// Checkout returns the directory holding the sources described by co,
+	// and a function removing them once benchmarked, or nil if they are kept.
+	Checkout(ctx context.Context, co *Checkout) (dir string, cleanup func(), err error)
+}
+
+// VCSFunc adapts a function to a VCS.
+type VCSFunc func(ctx context.Context, co *Checkout) (string, func(), error)
+
+func (vf VCSFunc) Checkout(ctx context.Context, co *Checkout) (string, func(), error) {
+	return vf(ctx, co)
+}
+
+// Checkout describes the sources to check out.
+type Checkout struct {
+	// Repo is the import path of the project e.g. "go.opencensus.io".
+	Repo string
+	// Revision is what to check out e.g. a commit, branch or tag,
+	// or a module version e.g. "v0.22.0". Blank is the default one.
+	Revision string
+	// SourceURL if set, is where the sources are fetched from, for import
+	// paths that aren't their repository's URL e.g. vanity import paths.
+	SourceURL string
+	// Dir is the project's directory in GOPATH.
+	Dir string
+	// Command returns a command running name with args with the
+	// environment given to the go commands that benchmark.
+	Command func(ctx context.Context, name string, args ...string) *exec.Cmd
+}
+
+// The built-in VCSes.
+const (
+	// VCSGOPATH benchmarks the sources already in GOPATH as they are.
+	VCSGOPATH = "gopath"
+	// VCSGit clones the repository into GOPATH, or fetches it if it
+	// was cloned before, and checks out the revision.
+	VCSGit = "git"
+	// VCSModule downloads a published version of the module through
+	// GOPROXY into a temporary directory, without any repository.
+	VCSModule = "module"
+)
+
+// DefaultVCS is the name of the VCS used when none is requested.
+const DefaultVCS = VCSGOPATH
+
+var vcsesMu sync.RWMutex
+var vcses = map[string]VCS{
+	VCSGOPATH: VCSFunc(func(ctx context.Context, co *Checkout) (string, func(), error) {
+		if co.Revision != "" {
+			return "", nil, fmt.Errorf("the %q VCS can't check out revision %q", VCSGOPATH, co.Revision)
+		}
+		return co.Dir, nil, nil
+	}),
+	VCSGit:    VCSFunc(gitCheckout),
+	VCSModule: VCSFunc(moduleCheckout),
+	VCSCanary: VCSFunc(canaryCheckout),
+}
+
+// RegisterVCS makes v selectable by name in Request.VCS, e.g. for
+// Mercurial or Subversion, replacing any VCS registered under that name.
+func RegisterVCS(name string, v VCS) {
+	vcsesMu.Lock()
+	defer vcsesMu.Unlock()
+
+	vcses[name] = v
+}
+
+// VCSNames returns the names of the registered VCSes.
+func VCSNames() []string {
+	vcsesMu.RLock()
+	defer vcsesMu.RUnlock()
+
+	names := make([]string, 0, len(vcses))
+	for name := range vcses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (br *Request) vcs() (VCS, error) {
+	name := br.VCS
+	if name == "" {
+		name = DefaultVCS
+	}
+	vcsesMu.RLock()
+	defer vcsesMu.RUnlock()
+
+	v, ok := vcses[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown vcs %q", name)
+	}
+	return v, nil
+}
+
+// checkout checks out the sources to benchmark, after which projectDir
+// is their directory. The returned function removes them if need be.
+func (br *Request) checkout(ctx context.Context) (func(), error) {
+	ctx, span := br.startSpan(ctx, "checkout")
+	defer span.End()
+
+	v, err := br.vcs()
+	if err != nil {
+		return nil, err
+	}
+	co := &Checkout{
+		Repo:      br.GitRepoURL,
+		Revision:  br.Revision,
+		SourceURL: br.SourceURL,
+		Dir:       br.gopathDir(),
+		Command:   br.checkoutCmd,
+	}
+	dir, cleanup, err := v.Checkout(ctx, co)
+	if err != nil {
+		return nil, fmt.Errorf("Checking out %s: %v", br.GitRepoURL, err)
+	}
+	br.workDir = dir
+	br.commit = br.sourceCommit(ctx)
+	return func() {
+		br.workDir, br.commit = "", ""
+		if cleanup != nil {
+			cleanup()
+		}
+	}, nil
+}
+
+// checkoutCmd returns a command running name with args, unlike goCmd
+// outside of any jail, with the environment of the go commands.
+func (br *Request) checkoutCmd(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(childEnv(), br.Env...)
+	return cmd
+}
+
+// runCheckoutCmd runs cmd, returning its stdout, or its stderr as the error.
+func runCheckoutCmd(cmd *exec.Cmd) ([]byte, error) {
+	stdout, stderr := new(bytes.Buffer), &cappedBuffer{max: 64 << 10}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", strings.Join(cmd.Args, " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func gitCheckout(ctx context.Context, co *Checkout) (string, func(), error) {
+	url := co.SourceURL
+	if url == "" {
+		url = "https://" + co.Repo
+	}
+	// Git would take such a revision for an option.
+	if strings.HasPrefix(co.Revision, "-") {
+		return "", nil, fmt.Errorf("invalid revision %q", co.Revision)
+	}
+	if _, err := os.Stat(filepath.Join(co.Dir, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(co.Dir), 0755); err != nil {
+			return "", nil, err
+		}
+		if _, err := runCheckoutCmd(co.Command(ctx, "git", "clone", "--quiet", url, co.Dir)); err != nil {
+			return "", nil, err
+		}
+	}
+
+	git := func(args ...string) ([]byte, error) {
+		cmd := co.Command(ctx, "git", args...)
+		cmd.Dir = co.Dir
+		return runCheckoutCmd(cmd)
+	}
+	// The checkout may have been cloned from another source URL.
+	if _, err := git("remote", "set-url", "origin", url); err != nil {
+		return "", nil, err
+	}
+	if _, err := git("fetch", "--quiet", "--tags", "--force", "origin"); err != nil {
+		return "", nil, err
+	}
+	rev := co.Revision
+	if rev == "" {
+		rev = "origin/HEAD"
+	} else if _, err := git("rev-parse", "--verify", "--quiet", "origin/"+rev); err == nil {
+		// Branches are checked out as last fetched, not as last checked out.
+		rev = "origin/" + rev
+	}
+	// "--" ends the revisions, lest rev be taken for a path.
+	if _, err := git("checkout", "--quiet", "--force", "--detach", rev, "--"); err != nil {
+		return "", nil, err
+	}
+	return co.Dir, nil, nil
+}
+
+func moduleCheckout(ctx context.Context, co *Checkout) (string, func(), error) {
+	version := co.Revision
+	if version == "" {
+		version = "latest"
+	}
+	tmp, err := ioutil.TempDir("", "bencher-module-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tmp) }
+	// The user of a jail must be able to read the sources.
+	if err := os.Chmod(tmp, 0755); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	// Outside of any module, the download only depends on GOPROXY.
+	cmd := co.Command(ctx, "go", "mod", "download", "-json", co.Repo+"@"+version)
+	cmd.Dir = tmp
+	cmd.Env = append(cmd.Env, "GO111MODULE=on", "GOFLAGS=-mod=mod")
+	out, err := runCheckoutCmd(cmd)
+	var mod struct {
+		Version string
+		Dir     string
+		Error   string
+	}
+	if jerr := json.Unmarshal(out, &mod); jerr == nil && mod.Error != "" {
+		err = fmt.Errorf("%s", mod.Error)
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	// The module cache is read-only, while go test may have to update go.sum.
+	dir := filepath.Join(tmp, "src")
+	if err := copyTree(mod.Dir, dir); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("Copying %s@%s: %v", co.Repo, mod.Version, err)
+	}
+	return dir, cleanup, nil
+}
+
+// copyTree copies the directory src to dst, with files and
+// directories readable by anyone e.g. the user of a jail.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644|info.Mode()&0111)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
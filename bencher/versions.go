@@ -0,0 +1,104 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+)
+
+// versionTag is the tag by which CompareVersions labels the results of
+// each version.
+const versionTag = "version"
+
+// CompareVersions downloads the published versions before and after of
+// the module GitRepoURL through GOPROXY, e.g. "v0.22.0" and "v0.23.0" of
+// "go.opencensus.io", benchmarks each in a temporary directory and
+// compares them, e.g. to validate a release candidate without any
+// repository checkout. The results aren't stored. The ignore and policy
+// files are those of after, unless the request has a Policy.
+func (br *Request) CompareVersions(ctx context.Context, before, after string) (*Result, error) {
+	ctx, span := br.startSpan(ctx, "compare-versions")
+	defer span.End()
+
+	if before == "" || after == "" || before == after {
+		return nil, fmt.Errorf("expecting two different versions of %q, got %q and %q", br.GitRepoURL, before, after)
+	}
+	if err := br.validateRuntimeSettings(); err != nil {
+		return nil, err
+	}
+	if br.Policy != "" {
+		if _, err := ParsePolicy(br.Policy); err != nil {
+			return nil, err
+		}
+	}
+
+	br.VCS = VCSModule
+	beforeBlob, err := br.benchmarkVersion(ctx, before, false)
+	if err != nil {
+		return nil, err
+	}
+	afterBlob, err := br.benchmarkVersion(ctx, after, true)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := br.compareTagged(ctx, versionTag, before, after, beforeBlob, afterBlob)
+	if err != nil {
+		return nil, err
+	}
+	if err := br.gate(res); err != nil {
+		return nil, fmt.Errorf("Evaluating the policy: %v", err)
+	}
+	return res, nil
+}
+
+// benchmarkVersion returns the results of benchmarking the given version
+// of the module, tagged with it, and if last, loads its ignore and policy
+// files before they are removed along with it.
+func (br *Request) benchmarkVersion(ctx context.Context, version string, last bool) ([]byte, error) {
+	br.Revision = version
+	removeCheckout, err := br.checkout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer removeCheckout()
+
+	leaveJail, err := br.enterJail()
+	if err != nil {
+		return nil, fmt.Errorf("Creating the jail of %q: %v", br.RunAs, err)
+	}
+	defer leaveJail()
+
+	gtr, err := br.runGoBenchmarks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Benchmarking %s@%s: %v", br.GitRepoURL, version, err)
+	}
+	gtr.events.Close()
+	if last {
+		if br.ignore, err = readIgnoreFile(br.projectDir()); err != nil {
+			return nil, fmt.Errorf("Reading %s: %v", ignoreFileName, err)
+		}
+		if err := br.loadPolicy(); err != nil {
+			return nil, err
+		}
+	}
+
+	blob := gtr.benchmarks
+	if settings := br.runtimeSettings(); len(settings) > 0 {
+		blob = append(tagsHeader(settings), blob...)
+	}
+	return append(tagsHeader(map[string]string{versionTag: version}), blob...), nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bencher
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// zeroAllocFileName is the file at the root of the target repository
+// listing the benchmarks that must not allocate, in the syntax of its
+// ignore file, e.g. the hot paths of recording a span or a measurement.
+const zeroAllocFileName = ".bencherzeroalloc"
+
+// loadZeroAllocs sets the patterns of the benchmarks that must not
+// allocate, from ZeroAllocs if set, or else from the target repository's
+// zero allocation file.
+func (br *Request) loadZeroAllocs() (err error) {
+	if len(br.ZeroAllocs) > 0 {
+		for _, pattern := range br.ZeroAllocs {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid zero allocation pattern %q: %v", pattern, err)
+			}
+		}
+		br.zeroAllocs = br.ZeroAllocs
+		return nil
+	}
+	if br.zeroAllocs, err = readPatternFile(br.projectDir(), zeroAllocFileName); err != nil {
+		return fmt.Errorf("Reading %s: %v", zeroAllocFileName, err)
+	}
+	return nil
+}
+
+// zeroAllocViolations returns a violation for every benchmark matching
+// patterns that reported allocations in any sample of after, regardless
+// of timing significance, with its allocations before if it had any.
+// Benchmarks without allocs/op e.g. of other harnesses are skipped.
+func zeroAllocViolations(patterns []string, before, after []byte) []string {
+	if len(patterns) == 0 {
+		return nil
+	}
+	beforeAllocs, afterAllocs := maxAllocs(patterns, before), maxAllocs(patterns, after)
+	var names []string
+	for name, allocs := range afterAllocs {
+		if allocs > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	violations := make([]string, 0, len(names))
+	for _, name := range names {
+		violation := fmt.Sprintf("%s: %s allocates %g allocs/op, expecting 0", SeverityFail, name, afterAllocs[name])
+		if allocs, ok := beforeAllocs[name]; ok {
+			violation += fmt.Sprintf(" (%g before)", allocs)
+		}
+		violations = append(violations, violation)
+	}
+	return violations
+}
+
+// maxAllocs returns the most allocs/op of any sample of the benchmarks
+// of blob matching patterns, by name and package if labeled with one.
+func maxAllocs(patterns []string, blob []byte) map[string]float64 {
+	allocs := make(map[string]float64)
+	for _, res := range parseResults(blob) {
+		value, ok := res.Values["allocs/op"]
+		if !ok || !ignored(res.Name, patterns) {
+			continue
+		}
+		name := res.Name
+		if pkg := res.Labels["pkg"]; pkg != "" {
+			name = strings.TrimSuffix(pkg, "/") + "." + name
+		}
+		if prev, seen := allocs[name]; !seen || value > prev {
+			allocs[name] = value
+		}
+	}
+	return allocs
+}